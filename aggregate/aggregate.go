@@ -0,0 +1,87 @@
+package aggregate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/cpustejovsky/event-store/events"
+	"github.com/cpustejovsky/event-store/store"
+)
+
+// DefaultMaxRetries is how many times Execute retries a command after a concurrent write when MaxRetries is not set
+const DefaultMaxRetries int = 3
+
+// Handler validates a command against the current state of a stream and returns the events it causes
+// state is the stream projected by the event store, or nil for a stream without events
+// The store assigns the Id and Versions of the returned envelopes
+type Handler func(ctx context.Context, state *events.Envelope) ([]events.Envelope, error)
+
+// RejectedError is returned by a Handler when a command is not valid for the current state of its stream
+type RejectedError struct {
+	ID     string
+	Reason string
+}
+
+func (e *RejectedError) Error() string {
+	return fmt.Sprintf("command rejected for ID %s: %s", e.ID, e.Reason)
+}
+
+// Reject returns a RejectedError for the stream with id
+func Reject(id string, format string, args ...any) error {
+	return &RejectedError{ID: id, Reason: fmt.Sprintf(format, args...)}
+}
+
+// Repository runs commands against the aggregates of an EventStore
+type Repository struct {
+	Store store.EventStore
+	// MaxRetries is how many times a command is retried after losing a race with another writer; zero uses DefaultMaxRetries
+	MaxRetries int
+}
+
+func NewRepository(es store.EventStore) *Repository {
+	return &Repository{Store: es}
+}
+
+// Load returns the projected state of the stream with id and the version to expect when appending to it
+// A stream without events has a nil state and the version store.NoStream
+func (r *Repository) Load(ctx context.Context, id string) (*events.Envelope, int, error) {
+	state, err := r.Store.Project(ctx, id)
+	checkErr := &store.NoEventFoundError{}
+	if errors.As(err, &checkErr) || (err == nil && state == nil) {
+		return nil, store.NoStream, nil
+	}
+	if err != nil {
+		return nil, store.NoStream, err
+	}
+	//The projection carries the Version following the latest event
+	return state, state.Version - 1, nil
+}
+
+// Execute loads the stream with id, runs handle against its state and appends the resulting events only if the stream has not changed since
+// When another writer appends first, the stream is reloaded and handle runs again, up to MaxRetries times
+// after which the store.WrongExpectedVersionError is returned; errors from handle are returned as is
+func (r *Repository) Execute(ctx context.Context, id string, handle Handler) error {
+	retries := r.MaxRetries
+	if retries <= 0 {
+		retries = DefaultMaxRetries
+	}
+	for attempt := 0; ; attempt++ {
+		state, version, err := r.Load(ctx, id)
+		if err != nil {
+			return err
+		}
+		envelopes, err := handle(ctx, state)
+		if err != nil {
+			return err
+		}
+		if len(envelopes) == 0 {
+			return nil
+		}
+		err = r.Store.AppendExpected(ctx, id, version, envelopes...)
+		versionErr := &store.WrongExpectedVersionError{}
+		if errors.As(err, &versionErr) && attempt < retries {
+			continue
+		}
+		return err
+	}
+}
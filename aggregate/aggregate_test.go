@@ -0,0 +1,96 @@
+package aggregate_test
+
+import (
+	"context"
+	"errors"
+	"github.com/cpustejovsky/event-store/aggregate"
+	"github.com/cpustejovsky/event-store/events"
+	"github.com/cpustejovsky/event-store/protos/hitpoints"
+	"github.com/cpustejovsky/event-store/store"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+	"testing"
+)
+
+var ctx = context.Background()
+
+func hitPointsEnvelope(t *testing.T, change int32) events.Envelope {
+	bin, err := proto.Marshal(&hitpoints.PlayerCharacterHitPoints{CharacterName: "cpustejovsky", CharacterHitPoints: change})
+	require.Nil(t, err)
+	return events.Envelope{EventName: events.HitPointsName, Event: bin}
+}
+
+func TestRepository_Execute(t *testing.T) {
+	es := store.InMemory()
+	repo := aggregate.NewRepository(es)
+	id := uuid.NewString()
+	var states []*events.Envelope
+	for _, change := range []int32{8, -2} {
+		err := repo.Execute(ctx, id, func(_ context.Context, state *events.Envelope) ([]events.Envelope, error) {
+			states = append(states, state)
+			return []events.Envelope{hitPointsEnvelope(t, change)}, nil
+		})
+		require.Nil(t, err)
+	}
+	require.Equal(t, 2, len(states))
+	assert.Nil(t, states[0])
+	require.NotNil(t, states[1])
+	assert.Equal(t, 1, states[1].Version)
+
+	version, err := es.QueryLatestVersion(ctx, id)
+	require.Nil(t, err)
+	assert.Equal(t, 1, version)
+}
+
+func TestRepository_ExecuteRejected(t *testing.T) {
+	es := store.InMemory()
+	repo := aggregate.NewRepository(es)
+	id := uuid.NewString()
+	err := repo.Execute(ctx, id, func(context.Context, *events.Envelope) ([]events.Envelope, error) {
+		return nil, aggregate.Reject(id, "not allowed")
+	})
+	checkErr := &aggregate.RejectedError{}
+	require.True(t, errors.As(err, &checkErr))
+	assert.Equal(t, "not allowed", checkErr.Reason)
+	_, err = es.QueryAll(ctx, id)
+	noEventErr := &store.NoEventFoundError{}
+	assert.True(t, errors.As(err, &noEventErr))
+}
+
+func TestRepository_ExecuteRetriesConflicts(t *testing.T) {
+	es := store.InMemory()
+	repo := aggregate.NewRepository(es)
+	id := uuid.NewString()
+	calls := 0
+	err := repo.Execute(ctx, id, func(_ context.Context, state *events.Envelope) ([]events.Envelope, error) {
+		calls++
+		if calls == 1 {
+			//Another writer appends between loading the state and appending
+			require.Nil(t, es.AppendExpected(ctx, id, store.NoStream, hitPointsEnvelope(t, 8)))
+			return []events.Envelope{hitPointsEnvelope(t, 10)}, nil
+		}
+		require.NotNil(t, state)
+		return []events.Envelope{hitPointsEnvelope(t, -2)}, nil
+	})
+	require.Nil(t, err)
+	assert.Equal(t, 2, calls)
+	projected, err := es.Project(ctx, id)
+	require.Nil(t, err)
+	var hp hitpoints.PlayerCharacterHitPoints
+	require.Nil(t, proto.Unmarshal(projected.Event, &hp))
+	assert.Equal(t, int32(6), hp.GetCharacterHitPoints())
+
+	//A stream that keeps changing fails once the retries are used up
+	repo.MaxRetries = 2
+	calls = 0
+	err = repo.Execute(ctx, id, func(context.Context, *events.Envelope) ([]events.Envelope, error) {
+		calls++
+		require.Nil(t, es.AppendExpected(ctx, id, store.AnyVersion, hitPointsEnvelope(t, 1)))
+		return []events.Envelope{hitPointsEnvelope(t, 1)}, nil
+	})
+	versionErr := &store.WrongExpectedVersionError{}
+	assert.True(t, errors.As(err, &versionErr))
+	assert.Equal(t, 3, calls)
+}
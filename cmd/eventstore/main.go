@@ -0,0 +1,125 @@
+// Command eventstore runs administrative tasks against a DynamoDB event store table
+//
+//	eventstore -table event-store ensure-table -stream NEW_IMAGE
+//	eventstore -table event-store invalidate-snapshots -event-name hitpoints
+//	eventstore -table event-store delete-stream -id 6f1c... -mode hard
+//	eventstore -table event-store backfill-stream-headers
+//	eventstore -table event-store backfill-positions
+//
+// The AWS region and credentials are loaded from the default AWS configuration
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/cpustejovsky/event-store/store"
+	"log"
+	"os"
+)
+
+func main() {
+	table := flag.String("table", os.Getenv("EVENT_STORE_TABLE"), "name of the event store table; defaults to $EVENT_STORE_TABLE")
+	flag.Usage = usage
+	flag.Parse()
+	if *table == "" || flag.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+	ctx := context.Background()
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		log.Fatal(err)
+	}
+	es := store.DynamoDB(dynamodb.NewFromConfig(cfg), *table)
+	if err := run(ctx, es, flag.Arg(0), flag.Args()[1:]); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), "usage: eventstore [-table name] command [flags]\n\ncommands:\n")
+	fmt.Fprintf(flag.CommandLine.Output(), "  ensure-table [-stream view-type] [-ttl attribute] [-migrate]\tcreate the table or check its schema\n")
+	fmt.Fprintf(flag.CommandLine.Output(), "  invalidate-snapshots -event-name name\tdelete every snapshot of streams with the event name\n")
+	fmt.Fprintf(flag.CommandLine.Output(), "  delete-stream -id id [-mode soft|hard]\tclose a stream with a tombstone, removing its events with -mode hard\n")
+	fmt.Fprintf(flag.CommandLine.Output(), "  backfill-stream-headers\twrite the stream headers ListStreams reads for streams appended to before they existed\n")
+	fmt.Fprintf(flag.CommandLine.Output(), "  backfill-positions\tgive events appended before global positions existed the Position ReadAll reads\n\nflags:\n")
+	flag.PrintDefaults()
+}
+
+// run executes the command with its arguments
+func run(ctx context.Context, es *store.DynamoDBEventStore, command string, args []string) error {
+	switch command {
+	case "ensure-table":
+		fs := flag.NewFlagSet(command, flag.ExitOnError)
+		stream := fs.String("stream", "", "view type of the table's DynamoDB stream, such as NEW_IMAGE; empty requires no stream")
+		ttl := fs.String("ttl", "", "time to live attribute; empty requires no time to live")
+		migrate := fs.Bool("migrate", false, "add missing indexes and enable a missing stream or time to live")
+		if err := fs.Parse(args); err != nil {
+			return err
+		}
+		opts := store.TableOptions{Table: es.Table, TTLAttribute: *ttl, StreamViewType: types.StreamViewType(*stream), Migrate: *migrate}
+		if err := store.EnsureTable(ctx, es.DB, opts); err != nil {
+			return err
+		}
+		fmt.Printf("table %s matches the event store schema\n", es.Table)
+		return nil
+	case "invalidate-snapshots":
+		fs := flag.NewFlagSet(command, flag.ExitOnError)
+		eventName := fs.String("event-name", "", "EventName whose snapshots are deleted")
+		if err := fs.Parse(args); err != nil {
+			return err
+		}
+		if *eventName == "" {
+			return fmt.Errorf("%s: -event-name is required", command)
+		}
+		invalidated, err := es.InvalidateSnapshots(ctx, *eventName)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("invalidated %d snapshots of %s\n", invalidated, *eventName)
+		return nil
+	case "delete-stream":
+		fs := flag.NewFlagSet(command, flag.ExitOnError)
+		id := fs.String("id", "", "id of the stream to delete")
+		mode := fs.String("mode", string(store.SoftDelete), "soft keeps the events; hard removes them and the snapshots")
+		if err := fs.Parse(args); err != nil {
+			return err
+		}
+		if *id == "" {
+			return fmt.Errorf("%s: -id is required", command)
+		}
+		if err := es.DeleteStream(ctx, *id, store.DeleteMode(*mode)); err != nil {
+			return err
+		}
+		fmt.Printf("deleted stream %s (%s delete)\n", *id, *mode)
+		return nil
+	case "backfill-stream-headers":
+		fs := flag.NewFlagSet(command, flag.ExitOnError)
+		if err := fs.Parse(args); err != nil {
+			return err
+		}
+		written, err := es.BackfillStreamHeaders(ctx)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("wrote %d stream headers\n", written)
+		return nil
+	case "backfill-positions":
+		fs := flag.NewFlagSet(command, flag.ExitOnError)
+		if err := fs.Parse(args); err != nil {
+			return err
+		}
+		updated, err := es.BackfillPositions(ctx)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("updated the position of %d events\n", updated)
+		return nil
+	default:
+		return fmt.Errorf("unknown command %q", command)
+	}
+}
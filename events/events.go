@@ -4,12 +4,21 @@ import (
 	"fmt"
 	hitpointspb "github.com/cpustejovsky/event-store/protos/hitpoints"
 	levelspb "github.com/cpustejovsky/event-store/protos/levels"
+	"google.golang.org/protobuf/proto"
+	"time"
 )
 
 type Aggregator interface {
 	Aggregate([][]byte) ([]byte, error)
 }
 
+// VersionedAggregator is implemented by aggregators that version their aggregation logic
+// Snapshots built by another version of the aggregator are not used; aggregators without a version are version 0
+type VersionedAggregator interface {
+	Aggregator
+	AggregatorVersion() int
+}
+
 type AggregatorNotFoundError struct {
 	Name string
 }
@@ -18,11 +27,20 @@ func (e *AggregatorNotFoundError) Error() string {
 	return fmt.Sprintf("aggregator not found for name %s", e.Name)
 }
 
-var HitPointsName string = string(hitpointspb.File_protos_hitpoints_hitpoints_proto.FullName().Name())
-var LevelsName string = string(levelspb.File_protos_levels_levels_proto.FullName().Name())
+// HitPointsName and LevelsName are the EventNames hit point and level events are stored with, the name of their protobuf package
+// DefaultRegistry registers them as aliases of the full names of the messages
+var HitPointsName string = string(hitpointspb.File_protos_hitpoints_hitpoints_proto.Package().Name())
+var LevelsName string = string(levelspb.File_protos_levels_levels_proto.Package().Name())
+
+// EventName returns the EventName of envelopes holding m, the full name of its protobuf message such as hitpoints.PlayerCharacterHitPoints
+// Unlike the package name, it tells apart the messages of a package
+func EventName(m proto.Message) string {
+	return string(m.ProtoReflect().Descriptor().FullName())
+}
 
 type AggregatorMap map[string]Aggregator
 
+// Deprecated: NewEventMap shares Aggregators between aggregations; use DefaultRegistry
 func NewEventMap() AggregatorMap {
 	return AggregatorMap{
 		HitPointsName: &HitPoints{},
@@ -30,49 +48,47 @@ func NewEventMap() AggregatorMap {
 	}
 }
 
-// Envelope contains necessary information to store event in the event store
-type Envelope struct {
-	Id        string
-	Version   int
-	Event     []byte
-	EventName string
+// Metadata describes when an event was recorded, who caused it and which request it belongs to
+// RecordedAt is set by the event store when the event is appended
+type Metadata struct {
+	RecordedAt    time.Time
+	User          string
+	CorrelationId string
+	CausationId   string
+	Headers       map[string]string
 }
 
-// Snapshot contains aggregated event information along with last version
-type Snapshot struct {
+// Envelope contains necessary information to store event in the event store
+// Position is the event's place in the global order of all streams and is assigned by the event store
+// SchemaVersion is the version of the Event payload's schema; event stores upcast old versions when reading
+type Envelope struct {
 	Id            string
 	Version       int
-	LatestVersion int
+	Position      int
 	Event         []byte
 	EventName     string
+	SchemaVersion int
+	Metadata
+}
+
+// Snapshot contains aggregated event information along with last version
+// AggregatorVersion is the version of the aggregator that built it and is set by the event store
+type Snapshot struct {
+	Id                string
+	Version           int
+	LatestVersion     int
+	AggregatorVersion int
+	Event             []byte
+	EventName         string
+	Metadata
 }
 
+// AggregateEnvelopes reconstitutes the ordered envelopes of a stream with the aggregators of DefaultRegistry
 func AggregateEnvelopes(envelopes []Envelope) (*Envelope, error) {
-	var e Envelope
-	//Loop through envelopes to get events to append into a slice that is reconstituted based on EventName
-	var events [][]byte
-	for i, envelope := range envelopes {
-		if i == len(envelopes)-1 {
-			e.Id = envelope.Id
-			e.Version = envelope.Version + 1
-			e.EventName = envelope.EventName
-		}
-		events = append(events, envelope.Event)
-	}
-	agg, err := reconstituteEvents(events, e.EventName)
-	if err != nil {
-		return nil, err
-	}
-	e.Event = agg
-	return &e, nil
+	return defaultRegistry.AggregateEnvelopes(envelopes)
 }
 
-func reconstituteEvents(es [][]byte, name string) ([]byte, error) {
-	//map Name to wrapper of protobuf type that has a reconstitute method
-	m := NewEventMap()
-	agg, ok := m[name]
-	if !ok {
-		return nil, &AggregatorNotFoundError{Name: name}
-	}
-	return agg.Aggregate(es)
+// AggregateSnapshot folds the envelopes recorded since a snapshot onto the snapshot's aggregate with the aggregators of DefaultRegistry
+func AggregateSnapshot(snapshot *Snapshot, envelopes []Envelope) (*Envelope, error) {
+	return defaultRegistry.AggregateSnapshot(snapshot, envelopes)
 }
@@ -1,3 +1,49 @@
-package events_test
+package events
 
-//TODO: Add tests here
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+// countAggregator aggregates events into the number of events it has seen
+type countAggregator struct {
+	count int
+}
+
+func (c *countAggregator) Aggregate(events [][]byte) ([]byte, error) {
+	c.count += len(events)
+	return []byte{byte(c.count)}, nil
+}
+
+func TestRegistry_AggregateEnvelopes(t *testing.T) {
+	r := NewRegistry()
+	r.Register("count", func() Aggregator { return &countAggregator{} })
+	envelopes := []Envelope{
+		{Id: "id", Version: 0, EventName: "count"},
+		{Id: "id", Version: 1, EventName: "count", Metadata: Metadata{User: "user"}},
+	}
+	//A new Aggregator is built for every aggregation so state does not leak between them
+	for i := 0; i < 2; i++ {
+		e, err := r.AggregateEnvelopes(envelopes)
+		require.Nil(t, err)
+		assert.Equal(t, "id", e.Id)
+		assert.Equal(t, 2, e.Version)
+		assert.Equal(t, []byte{2}, e.Event)
+		assert.Equal(t, "user", e.User)
+	}
+}
+
+func TestRegistry_AggregatorNotFound(t *testing.T) {
+	r := NewRegistry()
+	_, err := r.AggregateEnvelopes([]Envelope{{Id: "id", EventName: HitPointsName}})
+	checkErr := &AggregatorNotFoundError{}
+	require.True(t, errors.As(err, &checkErr))
+	assert.Equal(t, HitPointsName, checkErr.Name)
+
+	_, err = DefaultRegistry().Aggregator(HitPointsName)
+	assert.Nil(t, err)
+	_, err = DefaultRegistry().Aggregator(LevelsName)
+	assert.Nil(t, err)
+}
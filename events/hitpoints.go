@@ -6,10 +6,18 @@ import (
 	"google.golang.org/protobuf/proto"
 )
 
+// HitPointsVersion is the AggregatorVersion of HitPoints; bump it whenever Aggregate folds events differently
+// Version 0 matches the snapshots written before HitPoints was versioned
+const HitPointsVersion = 0
+
 type HitPoints struct {
 	hitpoints.PlayerCharacterHitPoints
 }
 
+func (h *HitPoints) AggregatorVersion() int {
+	return HitPointsVersion
+}
+
 func (h *HitPoints) Aggregate(events [][]byte) ([]byte, error) {
 	h.Note = "Aggregated Notes: "
 	var hp hitpoints.PlayerCharacterHitPoints
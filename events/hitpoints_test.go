@@ -13,7 +13,7 @@ import (
 func TestHitPoints_Aggregate(t *testing.T) {
 	name := "cpustejovsky"
 	id := uuid.NewString()
-	hitPointEvents := []hitpoints.PlayerCharacterHitPoints{{
+	hitPointEvents := []*hitpoints.PlayerCharacterHitPoints{{
 		Id:                 id,
 		CharacterName:      name,
 		CharacterHitPoints: 8,
@@ -33,7 +33,7 @@ func TestHitPoints_Aggregate(t *testing.T) {
 	want := &hitpoints.PlayerCharacterHitPoints{}
 	want.Note = "Aggregated Notes: "
 	for _, e := range hitPointEvents {
-		bin, err := proto.Marshal(&e)
+		bin, err := proto.Marshal(e)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -6,17 +6,25 @@ import (
 	"google.golang.org/protobuf/proto"
 )
 
+// LevelsVersion is the AggregatorVersion of Levels; bump it whenever Aggregate folds events differently
+// Version 0 matches the snapshots written before Levels was versioned
+const LevelsVersion = 0
+
 type Levels struct {
 	pb.Level
 }
 
+func (l *Levels) AggregatorVersion() int {
+	return LevelsVersion
+}
+
 func (l *Levels) Aggregate(events [][]byte) ([]byte, error) {
-	var lvl pb.Level
-	var levelEvents []pb.Level
+	var levelEvents []*pb.Level
 	m := make(map[pb.LevelType]struct{})
 	//Unmarshal events; add LevelType to map
 	for _, event := range events {
-		err := proto.Unmarshal(event, &lvl)
+		lvl := &pb.Level{}
+		err := proto.Unmarshal(event, lvl)
 		if err != nil {
 			return nil, err
 		}
@@ -50,7 +58,7 @@ func (l *Levels) Aggregate(events [][]byte) ([]byte, error) {
 	return bin, nil
 }
 
-func (l *Levels) aggregateXP(events []pb.Level) {
+func (l *Levels) aggregateXP(events []*pb.Level) {
 	for _, e := range events {
 		expSum := l.GetExperience() + e.GetExperience()
 		l.Experience = &expSum
@@ -58,7 +66,7 @@ func (l *Levels) aggregateXP(events []pb.Level) {
 	l.Levels = nil
 }
 
-func (l *Levels) aggregateMilestone(events []pb.Level) {
+func (l *Levels) aggregateMilestone(events []*pb.Level) {
 	for _, e := range events {
 		lvlSum := l.GetLevels() + e.GetLevels()
 		l.Levels = &lvlSum
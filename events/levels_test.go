@@ -14,7 +14,7 @@ func TestLevels_Aggregate(t *testing.T) {
 	id := uuid.NewString()
 	t.Run("Aggregate Levels events with milestone system", func(t *testing.T) {
 		var l int32 = 1
-		levelEvents := []pb.Level{
+		levelEvents := []*pb.Level{
 			{
 				Id:            id,
 				CharacterName: name,
@@ -40,7 +40,7 @@ func TestLevels_Aggregate(t *testing.T) {
 		var bins [][]byte
 		want := &pb.Level{}
 		for _, e := range levelEvents {
-			bin, err := proto.Marshal(&e)
+			bin, err := proto.Marshal(e)
 			if err != nil {
 				t.Fatal(err)
 			}
@@ -61,7 +61,7 @@ func TestLevels_Aggregate(t *testing.T) {
 		var exp1 int32 = 50
 		var exp2 int32 = 25
 		var exp3 int32 = 75
-		levelEvents := []pb.Level{
+		levelEvents := []*pb.Level{
 			{
 				Id:            id,
 				CharacterName: name,
@@ -87,7 +87,7 @@ func TestLevels_Aggregate(t *testing.T) {
 		var bins [][]byte
 		want := &pb.Level{}
 		for _, e := range levelEvents {
-			bin, err := proto.Marshal(&e)
+			bin, err := proto.Marshal(e)
 			if err != nil {
 				t.Fatal(err)
 			}
@@ -110,7 +110,7 @@ func TestLevels_Aggregate(t *testing.T) {
 		var l int32 = 1
 		var exp1 int32 = 50
 		var exp2 int32 = 75
-		levelEvents := []pb.Level{
+		levelEvents := []*pb.Level{
 			{
 				Id:            id,
 				CharacterName: name,
@@ -136,7 +136,7 @@ func TestLevels_Aggregate(t *testing.T) {
 		var bins [][]byte
 		want := &pb.Level{}
 		for _, e := range levelEvents {
-			bin, err := proto.Marshal(&e)
+			bin, err := proto.Marshal(e)
 			if err != nil {
 				t.Fatal(err)
 			}
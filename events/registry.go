@@ -0,0 +1,149 @@
+package events
+
+import (
+	hitpointspb "github.com/cpustejovsky/event-store/protos/hitpoints"
+	levelspb "github.com/cpustejovsky/event-store/protos/levels"
+	"sync"
+)
+
+// Registry maps the EventName of envelopes to the Aggregator that reconstitutes them and to the Upcasters of their old schema versions
+// Aggregators keep state while aggregating, so the registry holds a constructor and builds a new Aggregator for every aggregation
+// Names are the full names of protobuf messages, as returned by EventName; an alias maps another stored name to one of them
+type Registry struct {
+	mu          sync.RWMutex
+	aggregators map[string]func() Aggregator
+	upcasters   map[schema]Upcaster
+	aliases     map[string]string
+}
+
+// NewRegistry returns an empty Registry
+func NewRegistry() *Registry {
+	return &Registry{
+		aggregators: make(map[string]func() Aggregator),
+		upcasters:   make(map[schema]Upcaster),
+		aliases:     make(map[string]string),
+	}
+}
+
+// DefaultRegistry returns a Registry with the aggregators of the events defined in this repository
+// They are registered under the full names of their messages, with HitPointsName and LevelsName, which stored events carry, as aliases
+// Applications can register their own event types on top of it
+func DefaultRegistry() *Registry {
+	r := NewRegistry()
+	hitPoints := EventName(&hitpointspb.PlayerCharacterHitPoints{})
+	levels := EventName(&levelspb.Level{})
+	r.Register(hitPoints, func() Aggregator { return &HitPoints{} })
+	r.Register(levels, func() Aggregator { return &Levels{} })
+	r.Alias(HitPointsName, hitPoints)
+	r.Alias(LevelsName, levels)
+	return r
+}
+
+// defaultRegistry is used by AggregateEnvelopes
+var defaultRegistry = DefaultRegistry()
+
+// Register sets the constructor of the Aggregator for name, replacing any previous one
+// name is the EventName of the envelopes, the full name of their protobuf message as returned by EventName
+func (r *Registry) Register(name string, newAggregator func() Aggregator) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.aggregators[r.resolve(name)] = newAggregator
+}
+
+// Alias makes envelopes stored with the EventName alias use the Aggregator and Upcasters registered for name
+// It keeps events stored under another name, such as HitPointsName, readable after their aggregator is registered under its message's full name
+func (r *Registry) Alias(alias, name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.aliases[alias] = name
+}
+
+// resolve returns the name an alias stands for, or name itself; callers must hold the lock
+func (r *Registry) resolve(name string) string {
+	if aliased, ok := r.aliases[name]; ok {
+		return aliased
+	}
+	return name
+}
+
+// Aggregator returns a new Aggregator for name, or for the name it is an alias of, or an AggregatorNotFoundError
+func (r *Registry) Aggregator(name string) (Aggregator, error) {
+	r.mu.RLock()
+	newAggregator, ok := r.aggregators[r.resolve(name)]
+	r.mu.RUnlock()
+	if !ok {
+		return nil, &AggregatorNotFoundError{Name: name}
+	}
+	return newAggregator(), nil
+}
+
+// AggregatorVersion returns the version of the Aggregator for name, which is 0 unless it is a VersionedAggregator
+func (r *Registry) AggregatorVersion(name string) (int, error) {
+	agg, err := r.Aggregator(name)
+	if err != nil {
+		return 0, err
+	}
+	if versioned, ok := agg.(VersionedAggregator); ok {
+		return versioned.AggregatorVersion(), nil
+	}
+	return 0, nil
+}
+
+// AggregateEnvelopes reconstitutes the ordered envelopes of a stream with the Aggregator registered for their EventName
+func (r *Registry) AggregateEnvelopes(envelopes []Envelope) (*Envelope, error) {
+	var e Envelope
+	//Loop through envelopes to get events to append into a slice that is reconstituted based on EventName
+	var events [][]byte
+	for i, envelope := range envelopes {
+		if i == len(envelopes)-1 {
+			e.Id = envelope.Id
+			e.Version = envelope.Version + 1
+			e.EventName = envelope.EventName
+			e.Metadata = envelope.Metadata
+		}
+		events = append(events, envelope.Event)
+	}
+	agg, err := r.Aggregator(e.EventName)
+	if err != nil {
+		return nil, err
+	}
+	e.Event, err = agg.Aggregate(events)
+	if err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+// AggregateSnapshot folds the ordered envelopes recorded since a snapshot onto the snapshot's aggregate
+// A StateAggregator receives the snapshot as its state; any other Aggregator receives it as the event preceding LatestVersion
+// The result carries the next Version of the stream
+func (r *Registry) AggregateSnapshot(snapshot *Snapshot, envelopes []Envelope) (*Envelope, error) {
+	snapshotEnvelope := Envelope{
+		Id:        snapshot.Id,
+		Version:   snapshot.LatestVersion - 1,
+		Event:     snapshot.Event,
+		EventName: snapshot.EventName,
+		Metadata:  snapshot.Metadata,
+	}
+	agg, err := r.Aggregator(snapshot.EventName)
+	if err != nil {
+		return nil, err
+	}
+	stateAgg, ok := agg.(StateAggregator)
+	if !ok {
+		return r.AggregateEnvelopes(append([]Envelope{snapshotEnvelope}, envelopes...))
+	}
+	e := snapshotEnvelope
+	var events [][]byte
+	for _, envelope := range envelopes {
+		e = envelope
+		events = append(events, envelope.Event)
+	}
+	e.Version++
+	e.Position = 0
+	e.Event, err = stateAgg.AggregateFrom(snapshot.Event, events)
+	if err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
@@ -0,0 +1,66 @@
+package events
+
+import (
+	"google.golang.org/protobuf/proto"
+)
+
+// StateAggregator is implemented by aggregators whose aggregate state is a different message than their events
+// AggregateFrom folds events onto an encoded state, such as a snapshot, instead of treating the state as the first event
+type StateAggregator interface {
+	Aggregator
+	AggregateFrom(state []byte, events [][]byte) ([]byte, error)
+}
+
+// TypedAggregator decodes events of type E, folds them into a state of type S with Apply and encodes the result
+// E and S are pointers to generated protobuf messages, for example *hitpoints.PlayerCharacterHitPoints
+type TypedAggregator[E, S proto.Message] struct {
+	// Apply returns the state after event; it receives an empty state for the first event of a stream
+	Apply func(state S, event E) S
+	// Version is the AggregatorVersion; change it whenever Apply folds events differently
+	Version int
+}
+
+// NewTypedAggregator returns a TypedAggregator folding events with apply
+func NewTypedAggregator[E, S proto.Message](apply func(state S, event E) S) *TypedAggregator[E, S] {
+	return &TypedAggregator[E, S]{Apply: apply}
+}
+
+// RegisterTyped registers apply as the Aggregator for the EventName of E, so the name always matches the events it decodes
+// version is the AggregatorVersion; bump it whenever apply folds events differently
+func RegisterTyped[E, S proto.Message](r *Registry, version int, apply func(state S, event E) S) {
+	r.Register(EventName(newMessage[E]()), func() Aggregator {
+		return &TypedAggregator[E, S]{Apply: apply, Version: version}
+	})
+}
+
+func (a *TypedAggregator[E, S]) AggregatorVersion() int {
+	return a.Version
+}
+
+// Aggregate folds the encoded events into an empty state
+func (a *TypedAggregator[E, S]) Aggregate(events [][]byte) ([]byte, error) {
+	return a.AggregateFrom(nil, events)
+}
+
+// AggregateFrom folds the encoded events into the encoded state; a nil state is the empty state
+func (a *TypedAggregator[E, S]) AggregateFrom(state []byte, events [][]byte) ([]byte, error) {
+	s := newMessage[S]()
+	if err := proto.Unmarshal(state, s); err != nil {
+		return nil, err
+	}
+	for _, event := range events {
+		e := newMessage[E]()
+		if err := proto.Unmarshal(event, e); err != nil {
+			return nil, err
+		}
+		s = a.Apply(s, e)
+	}
+	return proto.Marshal(s)
+}
+
+// newMessage returns a new empty message of type M
+// Generated messages support ProtoReflect on a nil pointer, which gives access to the message type
+func newMessage[M proto.Message]() M {
+	var zero M
+	return zero.ProtoReflect().New().Interface().(M)
+}
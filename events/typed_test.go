@@ -0,0 +1,131 @@
+package events
+
+import (
+	"github.com/cpustejovsky/event-store/protos/hitpoints"
+	pb "github.com/cpustejovsky/event-store/protos/levels"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+	"testing"
+)
+
+func applyHitPoints(state, event *hitpoints.PlayerCharacterHitPoints) *hitpoints.PlayerCharacterHitPoints {
+	state.Id = event.GetId()
+	state.CharacterName = event.GetCharacterName()
+	state.CharacterHitPoints += event.GetCharacterHitPoints()
+	return state
+}
+
+// countHitPointChanges keeps the number of hit point changes in the Levels field of a Level
+func countHitPointChanges(state *pb.Level, event *hitpoints.PlayerCharacterHitPoints) *pb.Level {
+	count := state.GetLevels() + 1
+	state.Id = event.GetId()
+	state.Levels = &count
+	return state
+}
+
+func hitPointEvents(t *testing.T, changes ...int32) [][]byte {
+	var bins [][]byte
+	for _, change := range changes {
+		bin, err := proto.Marshal(&hitpoints.PlayerCharacterHitPoints{Id: "id", CharacterName: "cpustejovsky", CharacterHitPoints: change})
+		require.Nil(t, err)
+		bins = append(bins, bin)
+	}
+	return bins
+}
+
+func TestTypedAggregator_Aggregate(t *testing.T) {
+	agg := NewTypedAggregator(applyHitPoints)
+	bin, err := agg.Aggregate(hitPointEvents(t, 8, -2, -3))
+	require.Nil(t, err)
+	got := &hitpoints.PlayerCharacterHitPoints{}
+	require.Nil(t, proto.Unmarshal(bin, got))
+	assert.Equal(t, "id", got.GetId())
+	assert.Equal(t, "cpustejovsky", got.GetCharacterName())
+	assert.Equal(t, int32(3), got.GetCharacterHitPoints())
+
+	_, err = agg.Aggregate([][]byte{{0xff}})
+	assert.NotNil(t, err)
+}
+
+func TestRegistry_AggregateSnapshot(t *testing.T) {
+	r := NewRegistry()
+	RegisterTyped(r, 3, countHitPointChanges)
+	//The aggregator is registered for the full name of the event message, not of the state
+	assert.Equal(t, "hitpoints.PlayerCharacterHitPoints", EventName(&hitpoints.PlayerCharacterHitPoints{}))
+	_, err := r.Aggregator(EventName(&pb.Level{}))
+	assert.NotNil(t, err)
+	//Events stored with the package name are read through an alias
+	_, err = r.Aggregator(HitPointsName)
+	assert.NotNil(t, err)
+	r.Alias(HitPointsName, EventName(&hitpoints.PlayerCharacterHitPoints{}))
+	version, err := r.AggregatorVersion(HitPointsName)
+	require.Nil(t, err)
+	assert.Equal(t, 3, version)
+	bins := hitPointEvents(t, 8, -2, -3)
+	var envelopes []Envelope
+	for i, bin := range bins {
+		envelopes = append(envelopes, Envelope{Id: "id", Version: i, EventName: HitPointsName, Event: bin})
+	}
+	aggregated, err := r.AggregateEnvelopes(envelopes[:2])
+	require.Nil(t, err)
+
+	//The snapshot state is a Level, so it must not be decoded as an event
+	snapshot := &Snapshot{Id: "id", LatestVersion: 2, EventName: HitPointsName, Event: aggregated.Event}
+	got, err := r.AggregateSnapshot(snapshot, envelopes[2:])
+	require.Nil(t, err)
+	assert.Equal(t, 3, got.Version)
+	level := &pb.Level{}
+	require.Nil(t, proto.Unmarshal(got.Event, level))
+	assert.Equal(t, int32(3), level.GetLevels())
+
+	//Without events after the snapshot the snapshot is the projection
+	got, err = r.AggregateSnapshot(snapshot, nil)
+	require.Nil(t, err)
+	assert.Equal(t, 2, got.Version)
+	assert.Equal(t, "id", got.Id)
+	require.Nil(t, proto.Unmarshal(got.Event, level))
+	assert.Equal(t, int32(2), level.GetLevels())
+}
+
+func TestRegisterTyped_MessagesOfOnePackage(t *testing.T) {
+	r := NewRegistry()
+	RegisterTyped(r, 1, func(state, event *wrapperspb.StringValue) *wrapperspb.StringValue {
+		state.Value += event.GetValue()
+		return state
+	})
+	RegisterTyped(r, 2, func(state, event *wrapperspb.Int32Value) *wrapperspb.Int32Value {
+		state.Value += event.GetValue()
+		return state
+	})
+	//Both messages are in the google.protobuf package, so a name derived from the package would register the second over the first
+	stringName, intName := EventName(&wrapperspb.StringValue{}), EventName(&wrapperspb.Int32Value{})
+	assert.Equal(t, "google.protobuf.StringValue", stringName)
+	assert.Equal(t, "google.protobuf.Int32Value", intName)
+	for name, version := range map[string]int{stringName: 1, intName: 2} {
+		got, err := r.AggregatorVersion(name)
+		require.Nil(t, err)
+		assert.Equal(t, version, got)
+	}
+
+	var strings, ints []Envelope
+	for i, s := range []string{"a", "b"} {
+		bin, err := proto.Marshal(wrapperspb.String(s))
+		require.Nil(t, err)
+		strings = append(strings, Envelope{Id: "id", Version: i, EventName: stringName, Event: bin})
+		bin, err = proto.Marshal(wrapperspb.Int32(int32(i + 1)))
+		require.Nil(t, err)
+		ints = append(ints, Envelope{Id: "id", Version: i, EventName: intName, Event: bin})
+	}
+	aggregated, err := r.AggregateEnvelopes(strings)
+	require.Nil(t, err)
+	stringState := &wrapperspb.StringValue{}
+	require.Nil(t, proto.Unmarshal(aggregated.Event, stringState))
+	assert.Equal(t, "ab", stringState.GetValue())
+	aggregated, err = r.AggregateEnvelopes(ints)
+	require.Nil(t, err)
+	intState := &wrapperspb.Int32Value{}
+	require.Nil(t, proto.Unmarshal(aggregated.Event, intState))
+	assert.Equal(t, int32(3), intState.GetValue())
+}
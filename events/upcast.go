@@ -0,0 +1,84 @@
+package events
+
+import (
+	"fmt"
+)
+
+// Upcaster transforms an event from an old schema into a newer one
+// It may rewrite the Event payload, rename the EventName and set the SchemaVersion
+// If it leaves both EventName and SchemaVersion unchanged, the SchemaVersion is incremented
+type Upcaster interface {
+	Upcast(Envelope) (Envelope, error)
+}
+
+// UpcasterFunc adapts a function to an Upcaster
+type UpcasterFunc func(Envelope) (Envelope, error)
+
+func (f UpcasterFunc) Upcast(e Envelope) (Envelope, error) {
+	return f(e)
+}
+
+// UpcastCycleError is returned when the Upcasters of an event lead back to a schema it already had
+type UpcastCycleError struct {
+	EventName     string
+	SchemaVersion int
+}
+
+func (e *UpcastCycleError) Error() string {
+	return fmt.Sprintf("upcasting cycle at event name %s schema version %d", e.EventName, e.SchemaVersion)
+}
+
+// schema identifies the shape of an event payload
+type schema struct {
+	eventName string
+	version   int
+}
+
+// RegisterUpcaster sets the Upcaster for events with eventName, or a name it is an alias of, at schemaVersion, replacing any previous one
+func (r *Registry) RegisterUpcaster(eventName string, schemaVersion int, u Upcaster) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.upcasters[schema{eventName: r.resolve(eventName), version: schemaVersion}] = u
+}
+
+// Upcast applies the chain of Upcasters registered for the envelope's EventName and SchemaVersion until none is left
+// An envelope already in its current schema is returned unchanged
+func (r *Registry) Upcast(e Envelope) (Envelope, error) {
+	seen := make(map[schema]struct{})
+	for {
+		r.mu.RLock()
+		from := schema{eventName: r.resolve(e.EventName), version: e.SchemaVersion}
+		u, ok := r.upcasters[from]
+		r.mu.RUnlock()
+		if !ok {
+			return e, nil
+		}
+		if _, ok := seen[from]; ok {
+			return e, &UpcastCycleError{EventName: e.EventName, SchemaVersion: e.SchemaVersion}
+		}
+		seen[from] = struct{}{}
+		upcast, err := u.Upcast(e)
+		if err != nil {
+			return e, err
+		}
+		r.mu.RLock()
+		renamed := r.resolve(upcast.EventName) != from.eventName
+		r.mu.RUnlock()
+		if !renamed && upcast.SchemaVersion == from.version {
+			upcast.SchemaVersion++
+		}
+		e = upcast
+	}
+}
+
+// UpcastEnvelopes upcasts every envelope in place
+func (r *Registry) UpcastEnvelopes(envelopes []Envelope) error {
+	for i := range envelopes {
+		e, err := r.Upcast(envelopes[i])
+		if err != nil {
+			return err
+		}
+		envelopes[i] = e
+	}
+	return nil
+}
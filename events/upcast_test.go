@@ -0,0 +1,65 @@
+package events
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestRegistry_Upcast(t *testing.T) {
+	r := NewRegistry()
+	//Version 0 of "hp" stored the change twice; version 1 is renamed to HitPointsName
+	r.RegisterUpcaster("hp", 0, UpcasterFunc(func(e Envelope) (Envelope, error) {
+		e.Event = e.Event[:1]
+		return e, nil
+	}))
+	r.RegisterUpcaster("hp", 1, UpcasterFunc(func(e Envelope) (Envelope, error) {
+		e.EventName = HitPointsName
+		e.SchemaVersion = 2
+		return e, nil
+	}))
+
+	got, err := r.Upcast(Envelope{Id: "id", EventName: "hp", Event: []byte{7, 7}})
+	require.Nil(t, err)
+	assert.Equal(t, Envelope{Id: "id", EventName: HitPointsName, SchemaVersion: 2, Event: []byte{7}}, got)
+
+	current := Envelope{Id: "id", EventName: HitPointsName, SchemaVersion: 2, Event: []byte{7}}
+	got, err = r.Upcast(current)
+	require.Nil(t, err)
+	assert.Equal(t, current, got)
+
+	envelopes := []Envelope{{EventName: "hp", Event: []byte{1, 1}}, {EventName: "hp", SchemaVersion: 1, Event: []byte{2}}}
+	require.Nil(t, r.UpcastEnvelopes(envelopes))
+	assert.Equal(t, []byte{1}, envelopes[0].Event)
+	assert.Equal(t, HitPointsName, envelopes[1].EventName)
+
+	//An alias uses the upcasters of the name it stands for
+	r.Alias("hit-points", "hp")
+	got, err = r.Upcast(Envelope{Id: "id", EventName: "hit-points", Event: []byte{7, 7}})
+	require.Nil(t, err)
+	assert.Equal(t, Envelope{Id: "id", EventName: HitPointsName, SchemaVersion: 2, Event: []byte{7}}, got)
+}
+
+func TestRegistry_UpcastErrors(t *testing.T) {
+	r := NewRegistry()
+	r.RegisterUpcaster("a", 0, UpcasterFunc(func(e Envelope) (Envelope, error) {
+		e.EventName = "b"
+		return e, nil
+	}))
+	r.RegisterUpcaster("b", 0, UpcasterFunc(func(e Envelope) (Envelope, error) {
+		e.EventName = "a"
+		return e, nil
+	}))
+	_, err := r.Upcast(Envelope{EventName: "a"})
+	checkErr := &UpcastCycleError{}
+	require.True(t, errors.As(err, &checkErr))
+	assert.Equal(t, "a", checkErr.EventName)
+
+	failed := errors.New("failed")
+	r.RegisterUpcaster("c", 0, UpcasterFunc(func(e Envelope) (Envelope, error) {
+		return e, failed
+	}))
+	_, err = r.Upcast(Envelope{EventName: "c"})
+	assert.Equal(t, failed, err)
+}
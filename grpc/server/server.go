@@ -3,40 +3,126 @@ package server
 import (
 	"context"
 	"errors"
+	"github.com/cpustejovsky/event-store/aggregate"
 	"github.com/cpustejovsky/event-store/events"
 	pb "github.com/cpustejovsky/event-store/protos/hitpoints"
 	"github.com/cpustejovsky/event-store/store"
 	"github.com/golang/protobuf/ptypes/empty"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/proto"
+	"strings"
+)
+
+// Incoming gRPC metadata keys recorded in the events.Metadata of appended events
+const (
+	CorrelationIdKey string = "x-correlation-id"
+	CausationIdKey   string = "x-causation-id"
+	UserKey          string = "x-user"
+	// HeaderPrefix marks metadata keys copied into events.Metadata Headers with the prefix removed
+	HeaderPrefix string = "x-event-"
 )
 
 type Server struct {
-	Store store.EventStore
+	Store      store.EventStore
+	Repository *aggregate.Repository
 	pb.UnimplementedHitPointsRecorderServer
 }
 
 func New(es store.EventStore) *Server {
 	return &Server{
-		Store: es,
+		Store:      es,
+		Repository: aggregate.NewRepository(es),
 	}
 }
 
+// RecordHitPoints validates a hit point change against the character's current hit points and records it
+// Malformed requests fail with InvalidArgument, changes the character's state does not allow with FailedPrecondition
+// and changes that keep losing races with concurrent writers with Aborted
 func (s *Server) RecordHitPoints(ctx context.Context, hp *pb.PlayerCharacterHitPoints) (*empty.Empty, error) {
+	if hp.GetId() == "" || hp.GetCharacterName() == "" {
+		return nil, status.Error(codes.InvalidArgument, "Id and CharacterName are required")
+	}
+	if hp.GetCharacterHitPoints() == 0 {
+		return nil, status.Error(codes.InvalidArgument, "CharacterHitPoints must change the hit points")
+	}
 	bin, err := proto.Marshal(hp)
 	if err != nil {
 		return nil, err
 	}
-	id := hp.GetId()
-	v, err := s.Store.QueryLatestVersion(ctx, id)
-	if err != nil && !errors.Is(err, &store.NoEventFoundError{}) {
+	m := metadataFromContext(ctx)
+	err = s.Repository.Execute(ctx, hp.GetId(), func(ctx context.Context, state *events.Envelope) ([]events.Envelope, error) {
+		if err := validateHitPoints(hp, state); err != nil {
+			return nil, err
+		}
+		return []events.Envelope{{
+			Event:     bin,
+			EventName: string(pb.File_protos_hitpoints_hitpoints_proto.FullName()),
+			Metadata:  m,
+		}}, nil
+	})
+	rejectedErr := &aggregate.RejectedError{}
+	if errors.As(err, &rejectedErr) {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	//Concurrent writes kept moving the stream; Aborted signals the client that the call can be retried
+	versionErr := &store.WrongExpectedVersionError{}
+	if errors.As(err, &versionErr) {
+		return nil, status.Error(codes.Aborted, err.Error())
+	}
+	if err != nil {
 		return nil, err
 	}
-	envelope := events.Envelope{
-		Id:        id,
-		Version:   v + 1,
-		Event:     bin,
-		EventName: string(pb.File_protos_hitpoints_hitpoints_proto.FullName()),
+	return &empty.Empty{}, nil
+}
+
+// validateHitPoints checks a hit point change against the character's aggregated hit points, which are nil for a new character
+func validateHitPoints(hp *pb.PlayerCharacterHitPoints, state *events.Envelope) error {
+	id := hp.GetId()
+	if state == nil {
+		if hp.GetCharacterHitPoints() < 0 {
+			return aggregate.Reject(id, "a new character must start with positive hit points")
+		}
+		return nil
+	}
+	var current pb.PlayerCharacterHitPoints
+	if err := proto.Unmarshal(state.Event, &current); err != nil {
+		return err
+	}
+	if current.GetCharacterName() != hp.GetCharacterName() {
+		return aggregate.Reject(id, "character is named %s, not %s", current.GetCharacterName(), hp.GetCharacterName())
+	}
+	if total := current.GetCharacterHitPoints() + hp.GetCharacterHitPoints(); total < 0 {
+		return aggregate.Reject(id, "hit points cannot drop below zero, %d would leave %d", hp.GetCharacterHitPoints(), total)
+	}
+	return nil
+}
+
+// metadataFromContext builds event Metadata from the incoming gRPC metadata of a request
+func metadataFromContext(ctx context.Context) events.Metadata {
+	var m events.Metadata
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return m
+	}
+	first := func(key string) string {
+		if values := md.Get(key); len(values) > 0 {
+			return values[0]
+		}
+		return ""
+	}
+	m.CorrelationId = first(CorrelationIdKey)
+	m.CausationId = first(CausationIdKey)
+	m.User = first(UserKey)
+	for key, values := range md {
+		if !strings.HasPrefix(key, HeaderPrefix) || len(values) == 0 {
+			continue
+		}
+		if m.Headers == nil {
+			m.Headers = make(map[string]string)
+		}
+		m.Headers[strings.TrimPrefix(key, HeaderPrefix)] = values[0]
 	}
-	err = s.Store.Append(ctx, &envelope)
-	return &empty.Empty{}, err
+	return m
 }
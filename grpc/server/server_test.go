@@ -5,12 +5,18 @@ import (
 	"github.com/cpustejovsky/event-store/events"
 	"github.com/cpustejovsky/event-store/grpc/server"
 	pb "github.com/cpustejovsky/event-store/protos/hitpoints"
+	"github.com/cpustejovsky/event-store/store"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 	"google.golang.org/grpc/test/bufconn"
 	"log"
 	"net"
 	"testing"
+	"time"
 )
 
 var EventStoreTable = "event-store"
@@ -18,6 +24,7 @@ var id = "ab9261dc-685c-4cec-b6f0-f6fb886cdf7cs"
 
 type StubEventStore struct {
 	Appended             bool
+	Projected            bool
 	QueriedLatestVersion bool
 }
 
@@ -25,10 +32,25 @@ func (s *StubEventStore) Append(context.Context, *events.Envelope) error {
 	s.Appended = true
 	return nil
 }
+func (s *StubEventStore) AppendBatch(context.Context, []events.Envelope) error {
+	s.Appended = true
+	return nil
+}
+func (s *StubEventStore) AppendExpected(context.Context, string, int, ...events.Envelope) error {
+	s.Appended = true
+	return nil
+}
 func (s *StubEventStore) Snapshot(context.Context, *events.Snapshot) error {
 	return nil
 }
 func (s *StubEventStore) Project(context.Context, string) (*events.Envelope, error) {
+	s.Projected = true
+	return nil, &store.NoEventFoundError{}
+}
+func (s *StubEventStore) ProjectAt(context.Context, string, int) (*events.Envelope, error) {
+	return nil, nil
+}
+func (s *StubEventStore) ProjectAsOf(context.Context, string, time.Time) (*events.Envelope, error) {
 	return nil, nil
 }
 func (s *StubEventStore) QueryLatestVersion(context.Context, string) (int, error) {
@@ -39,6 +61,21 @@ func (s *StubEventStore) QueryLatestVersion(context.Context, string) (int, error
 func (s *StubEventStore) QueryAll(context.Context, string) ([]events.Envelope, error) {
 	return nil, nil
 }
+func (s *StubEventStore) Read(context.Context, string, store.ReadOptions) ([]events.Envelope, error) {
+	return nil, nil
+}
+func (s *StubEventStore) ReadAll(context.Context, int, int) ([]events.Envelope, error) {
+	return nil, nil
+}
+func (s *StubEventStore) QueryByEventName(context.Context, string, store.EventNameOptions) ([]events.Envelope, error) {
+	return nil, nil
+}
+func (s *StubEventStore) ListStreams(context.Context, store.ListOptions) ([]store.StreamInfo, string, error) {
+	return nil, "", nil
+}
+func (s *StubEventStore) DeleteStream(context.Context, string, store.DeleteMode) error {
+	return nil
+}
 
 const bufSize = 1024 * 1024
 
@@ -78,5 +115,80 @@ func TestNewServer(t *testing.T) {
 	_, err = c.RecordHitPoints(ctx, &pchp)
 	assert.Nil(t, err)
 	assert.True(t, es.Appended)
-	assert.True(t, es.QueriedLatestVersion)
+	assert.True(t, es.Projected)
+}
+
+func TestServer_RecordHitPoints(t *testing.T) {
+	ctx := context.Background()
+	es := store.InMemory()
+	svr := server.New(es)
+	for _, change := range []int32{8, -2} {
+		_, err := svr.RecordHitPoints(ctx, &pb.PlayerCharacterHitPoints{
+			Id:                 id,
+			CharacterName:      "cpustejovsky",
+			CharacterHitPoints: change,
+		})
+		require.Nil(t, err)
+	}
+	queried, err := es.QueryAll(ctx, id)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(queried))
+	for i, e := range queried {
+		assert.Equal(t, id, e.Id)
+		assert.Equal(t, i, e.Version)
+		assert.Equal(t, events.HitPointsName, e.EventName)
+	}
+}
+
+func TestServer_RecordHitPoints_Metadata(t *testing.T) {
+	es := store.InMemory()
+	svr := server.New(es)
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(
+		server.CorrelationIdKey, "correlation",
+		server.CausationIdKey, "causation",
+		server.UserKey, "dungeon-master",
+		server.HeaderPrefix+"session", "12",
+		"x-unrelated", "ignored",
+	))
+	before := time.Now()
+	_, err := svr.RecordHitPoints(ctx, &pb.PlayerCharacterHitPoints{
+		Id:                 id,
+		CharacterName:      "cpustejovsky",
+		CharacterHitPoints: 8,
+	})
+	require.Nil(t, err)
+	queried, err := es.QueryAll(ctx, id)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(queried))
+	m := queried[0].Metadata
+	assert.Equal(t, "correlation", m.CorrelationId)
+	assert.Equal(t, "causation", m.CausationId)
+	assert.Equal(t, "dungeon-master", m.User)
+	assert.Equal(t, map[string]string{"session": "12"}, m.Headers)
+	assert.False(t, m.RecordedAt.Before(before))
+}
+
+func TestServer_RecordHitPoints_Validation(t *testing.T) {
+	ctx := context.Background()
+	es := store.InMemory()
+	svr := server.New(es)
+	record := func(name string, change int32) error {
+		_, err := svr.RecordHitPoints(ctx, &pb.PlayerCharacterHitPoints{
+			Id:                 id,
+			CharacterName:      name,
+			CharacterHitPoints: change,
+		})
+		return err
+	}
+	assert.Equal(t, codes.InvalidArgument, status.Code(record("", 8)))
+	assert.Equal(t, codes.InvalidArgument, status.Code(record("cpustejovsky", 0)))
+	assert.Equal(t, codes.FailedPrecondition, status.Code(record("cpustejovsky", -2)))
+	require.Nil(t, record("cpustejovsky", 8))
+	assert.Equal(t, codes.FailedPrecondition, status.Code(record("someone else", -2)))
+	assert.Equal(t, codes.FailedPrecondition, status.Code(record("cpustejovsky", -9)))
+	require.Nil(t, record("cpustejovsky", -8))
+
+	queried, err := es.QueryAll(ctx, id)
+	require.Nil(t, err)
+	assert.Equal(t, 2, len(queried))
 }
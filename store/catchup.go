@@ -0,0 +1,202 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"github.com/cpustejovsky/event-store/events"
+	"time"
+)
+
+// catchUpPageSize is how many historical events a CatchUpSubscription reads at a time
+const catchUpPageSize = 100
+
+// DefaultRetryInterval is how long a CatchUpSubscription waits to read again when RetryInterval is not set
+const DefaultRetryInterval = 100 * time.Millisecond
+
+// DefaultGapTimeout is how long a CatchUpSubscription waits for a missing global position when GapTimeout is not set
+const DefaultGapTimeout = 10 * time.Second
+
+// SubscribableEventStore is an EventStore that also delivers live events
+type SubscribableEventStore interface {
+	EventStore
+	Subscriber
+}
+
+// Handler processes an event delivered by a CatchUpSubscription
+type Handler func(context.Context, events.Envelope) error
+
+// SubscriptionClosedError is returned by CatchUpSubscription.Run when the live subscription closes before its context is done
+type SubscriptionClosedError struct {
+	Name string
+}
+
+func (e *SubscriptionClosedError) Error() string {
+	return "live subscription closed for " + e.Name
+}
+
+// CatchUpSubscription replays the events after its checkpoint and then switches to live delivery
+// When the Filter selects a stream by Id the checkpoint is the event's Version,
+// otherwise every stream is read through ReadAll and the checkpoint is the event's global Position
+type CatchUpSubscription struct {
+	Name        string
+	Store       SubscribableEventStore
+	Checkpoints CheckpointStore
+	Filter      SubscriptionFilter
+	// RetryInterval is how long Run waits before reading again when an event announced by the live subscription is not readable yet
+	RetryInterval time.Duration
+	// GapTimeout is how long after the event following it was recorded a position missing from ReadAll is waited for;
+	// after that it is taken to be the position of an event removed by a HardDelete and skipped
+	// It must exceed the time PositionIndex takes to show an event plus the time an append takes to commit
+	GapTimeout time.Duration
+}
+
+func CatchUp(name string, es SubscribableEventStore, checkpoints CheckpointStore, filter SubscriptionFilter) *CatchUpSubscription {
+	return &CatchUpSubscription{
+		Name:        name,
+		Store:       es,
+		Checkpoints: checkpoints,
+		Filter:      filter,
+	}
+}
+
+// Run delivers every event after the saved checkpoint to handle in order, saving the checkpoint after each one
+// Delivery is at least once: an event handled before its checkpoint was saved is delivered again by the next Run,
+// so handle should be idempotent, for example by skipping events whose Position or Version it has already applied
+// It subscribes before reading history so events appended during the replay are not missed
+// Live events only tell Run how far to read; the events themselves are read from the store in order,
+// so a subscription delivering them out of order cannot move the checkpoint past an event that was not handled
+// Run returns when ctx is done, handle fails or the live subscription closes
+func (c *CatchUpSubscription) Run(ctx context.Context, handle Handler) error {
+	position, err := c.Checkpoints.Load(ctx, c.Name)
+	if err != nil {
+		return err
+	}
+	subCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	live, err := c.Store.Subscribe(subCtx, c.Filter)
+	if err != nil {
+		return err
+	}
+
+	//from is the first position not yet read, whether or not the events before it matched the filter
+	from, err := c.catchUp(ctx, handle, position+1, NoStream)
+	if err != nil {
+		return err
+	}
+	for {
+		select {
+		case e, ok := <-live:
+			if !ok {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				return &SubscriptionClosedError{Name: c.Name}
+			}
+			if c.position(&e) < from {
+				continue
+			}
+			if from, err = c.catchUp(ctx, handle, from, c.position(&e)); err != nil {
+				return err
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// catchUp delivers the matching events from position from on and returns the first position it has not read
+// It reads until the store has no more events, then keeps reading until the event at through, if there is one, has been read
+// ReadAll may read an eventually consistent index, so a page missing a global position is only delivered up to the gap,
+// which is read again until the event shows up or GapTimeout has passed since the event after it was recorded;
+// positions of hard deleted events hold erased markers, or are left out by DynamoDBEventStore and skipped once GapTimeout has passed
+func (c *CatchUpSubscription) catchUp(ctx context.Context, handle Handler, from int, through int) (int, error) {
+	for {
+		envelopes, err := c.read(ctx, from)
+		checkErr := &NoEventFoundError{}
+		if err != nil && !errors.As(err, &checkErr) {
+			return from, err
+		}
+		read := len(envelopes)
+		gap := false
+		if c.Filter.Id == "" {
+			envelopes, gap = contiguous(envelopes, from, c.gapTimeout())
+		}
+		for _, e := range envelopes {
+			if erased(&e) || !c.Filter.Match(&e) {
+				continue
+			}
+			if err := handle(ctx, e); err != nil {
+				return from, err
+			}
+			if err := c.Checkpoints.Save(ctx, c.Name, c.position(&e)); err != nil {
+				return from, err
+			}
+		}
+		if len(envelopes) > 0 {
+			from = c.position(&envelopes[len(envelopes)-1]) + 1
+		}
+		if !gap && read == catchUpPageSize {
+			continue
+		}
+		if !gap && from > through {
+			return from, nil
+		}
+		//The store does not return an event before the last one read, or the one the live subscription announced, yet
+		if err := c.wait(ctx); err != nil {
+			return from, err
+		}
+	}
+}
+
+// contiguous returns the envelopes of a ReadAll page starting at position from up to the first missing position that may still show up
+// A missing position is taken to be gone for good once the event after it was recorded timeout ago, as the event at it committed first
+// gap reports that a position was missing, so the envelopes after it were dropped
+func contiguous(envelopes []events.Envelope, from int, timeout time.Duration) (_ []events.Envelope, gap bool) {
+	next := from
+	for i := range envelopes {
+		if envelopes[i].Position != next && time.Since(envelopes[i].RecordedAt) < timeout {
+			return envelopes[:i], true
+		}
+		next = envelopes[i].Position + 1
+	}
+	return envelopes, false
+}
+
+func (c *CatchUpSubscription) gapTimeout() time.Duration {
+	if c.GapTimeout <= 0 {
+		return DefaultGapTimeout
+	}
+	return c.GapTimeout
+}
+
+// wait sleeps for the RetryInterval or until ctx is done
+func (c *CatchUpSubscription) wait(ctx context.Context) error {
+	interval := c.RetryInterval
+	if interval <= 0 {
+		interval = DefaultRetryInterval
+	}
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// read returns the next page of history starting at position from
+func (c *CatchUpSubscription) read(ctx context.Context, from int) ([]events.Envelope, error) {
+	if c.Filter.Id == "" {
+		return c.Store.ReadAll(ctx, from, catchUpPageSize)
+	}
+	return c.Store.Read(ctx, c.Filter.Id, ReadOptions{FromVersion: from, Limit: catchUpPageSize})
+}
+
+// position returns the checkpoint position of an event
+func (c *CatchUpSubscription) position(e *events.Envelope) int {
+	if c.Filter.Id == "" {
+		return e.Position
+	}
+	return e.Version
+}
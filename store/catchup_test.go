@@ -0,0 +1,362 @@
+package store_test
+
+import (
+	"context"
+	"errors"
+	"github.com/cpustejovsky/event-store/events"
+	"github.com/cpustejovsky/event-store/store"
+	"github.com/cpustejovsky/event-store/store/dynamotest"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recorder is a Handler that records the versions it handled and signals when it has seen a version
+type recorder struct {
+	mu       sync.Mutex
+	versions []int
+	seen     chan int
+}
+
+func newRecorder() *recorder {
+	return &recorder{seen: make(chan int, 1000)}
+}
+
+func (r *recorder) handle(_ context.Context, e events.Envelope) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.versions = append(r.versions, e.Version)
+	r.seen <- e.Version
+	return nil
+}
+
+func (r *recorder) waitFor(t *testing.T, version int) {
+	t.Helper()
+	for {
+		select {
+		case v := <-r.seen:
+			if v == version {
+				return
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("version %d was not handled", version)
+		}
+	}
+}
+
+func appendVersions(t *testing.T, es store.EventStore, id string, from, to int) {
+	t.Helper()
+	for v := from; v <= to; v++ {
+		require.Nil(t, es.Append(ctx, &events.Envelope{Id: id, Version: v, EventName: events.HitPointsName}))
+	}
+}
+
+func versions(from, to int) []int {
+	var vs []int
+	for v := from; v <= to; v++ {
+		vs = append(vs, v)
+	}
+	return vs
+}
+
+func TestCatchUpSubscription(t *testing.T) {
+	es := store.InMemory()
+	checkpoints := store.InMemoryCheckpoints()
+	id := uuid.NewString()
+	appendVersions(t, es, id, 0, 149)
+
+	run := func(r *recorder) (cancel func() error) {
+		runCtx, stop := context.WithCancel(ctx)
+		done := make(chan error, 1)
+		go func() {
+			done <- store.CatchUp("hit-points", es, checkpoints, store.SubscriptionFilter{Id: id}).Run(runCtx, r.handle)
+		}()
+		return func() error {
+			stop()
+			return <-done
+		}
+	}
+
+	t.Run("Replays history then delivers live events without gaps or duplicates", func(t *testing.T) {
+		r := newRecorder()
+		cancel := run(r)
+		//Appending while the history is replayed exercises the switch to live delivery
+		appendVersions(t, es, id, 150, 199)
+		r.waitFor(t, 199)
+		err := cancel()
+		assert.True(t, errors.Is(err, context.Canceled))
+		assert.Equal(t, versions(0, 199), r.versions)
+		position, err := checkpoints.Load(ctx, "hit-points")
+		require.Nil(t, err)
+		assert.Equal(t, 199, position)
+	})
+
+	t.Run("Resumes from the saved checkpoint", func(t *testing.T) {
+		appendVersions(t, es, id, 200, 209)
+		r := newRecorder()
+		cancel := run(r)
+		r.waitFor(t, 209)
+		appendVersions(t, es, id, 210, 212)
+		r.waitFor(t, 212)
+		require.True(t, errors.Is(cancel(), context.Canceled))
+		assert.Equal(t, versions(200, 212), r.versions)
+	})
+
+	t.Run("Stops without saving the checkpoint when the handler fails", func(t *testing.T) {
+		appendVersions(t, es, id, 213, 213)
+		failure := errors.New("projection failed")
+		err := store.CatchUp("hit-points", es, checkpoints, store.SubscriptionFilter{Id: id}).Run(ctx, func(context.Context, events.Envelope) error {
+			return failure
+		})
+		assert.True(t, errors.Is(err, failure))
+		position, err := checkpoints.Load(ctx, "hit-points")
+		require.Nil(t, err)
+		assert.Equal(t, 212, position)
+	})
+
+}
+
+func TestCatchUpSubscription_AllStreams(t *testing.T) {
+	es := store.InMemory()
+	checkpoints := store.InMemoryCheckpoints()
+	prefix := uuid.NewString()
+	appendVersions(t, es, prefix+"-a", 0, 79)
+	appendVersions(t, es, uuid.NewString(), 0, 9)
+	appendVersions(t, es, prefix+"-b", 0, 79)
+
+	var positions []int
+	seen := make(chan struct{}, 1000)
+	handle := func(_ context.Context, e events.Envelope) error {
+		positions = append(positions, e.Position)
+		seen <- struct{}{}
+		return nil
+	}
+	runCtx, stop := context.WithCancel(ctx)
+	done := make(chan error, 1)
+	go func() {
+		done <- store.CatchUp("party", es, checkpoints, store.SubscriptionFilter{IdPrefix: prefix}).Run(runCtx, handle)
+	}()
+	appendVersions(t, es, prefix+"-a", 80, 89)
+	for i := 0; i < 170; i++ {
+		select {
+		case <-seen:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("handled %d of 170 events", i)
+		}
+	}
+	stop()
+	require.True(t, errors.Is(<-done, context.Canceled))
+
+	var want []int
+	all, err := es.ReadAll(ctx, 0, 0)
+	require.Nil(t, err)
+	for _, e := range all {
+		if strings.HasPrefix(e.Id, prefix) {
+			want = append(want, e.Position)
+		}
+	}
+	assert.Equal(t, want, positions)
+	position, err := checkpoints.Load(ctx, "party")
+	require.Nil(t, err)
+	assert.Equal(t, want[len(want)-1], position)
+}
+
+// swappingStore delivers every pair of live events in reverse order, like a DynamoDB stream draining one shard after another
+type swappingStore struct {
+	*store.InMemoryEventStore
+}
+
+func (s swappingStore) Subscribe(ctx context.Context, filter store.SubscriptionFilter) (<-chan events.Envelope, error) {
+	live, err := s.InMemoryEventStore.Subscribe(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	swapped := make(chan events.Envelope)
+	go func() {
+		defer close(swapped)
+		for first := range live {
+			second, ok := <-live
+			if !ok {
+				return
+			}
+			for _, e := range []events.Envelope{second, first} {
+				select {
+				case swapped <- e:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return swapped, nil
+}
+
+func TestCatchUpSubscription_OutOfOrderLiveEvents(t *testing.T) {
+	es := swappingStore{store.InMemory()}
+	checkpoints := store.InMemoryCheckpoints()
+	var positions []int
+	seen := make(chan struct{}, 100)
+	runCtx, stop := context.WithCancel(ctx)
+	done := make(chan error, 1)
+	go func() {
+		done <- store.CatchUp("swapped", es, checkpoints, store.SubscriptionFilter{}).Run(runCtx, func(_ context.Context, e events.Envelope) error {
+			positions = append(positions, e.Position)
+			seen <- struct{}{}
+			return nil
+		})
+	}()
+	//Wait for the replay of the empty history so the events below arrive live
+	time.Sleep(50 * time.Millisecond)
+	appendVersions(t, es, uuid.NewString(), 0, 5)
+	for i := 0; i < 6; i++ {
+		select {
+		case <-seen:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("handled %d of 6 events", i)
+		}
+	}
+	stop()
+	require.True(t, errors.Is(<-done, context.Canceled))
+	assert.Equal(t, versions(0, 5), positions)
+	position, err := checkpoints.Load(ctx, "swapped")
+	require.Nil(t, err)
+	assert.Equal(t, 5, position)
+}
+
+func TestCatchUpSubscription_HardDeletedEvents(t *testing.T) {
+	es := store.InMemory()
+	deleted := uuid.NewString()
+	kept := uuid.NewString()
+	appendVersions(t, es, deleted, 0, 2)
+	appendVersions(t, es, kept, 0, 1)
+	require.Nil(t, es.DeleteStream(ctx, deleted, store.HardDelete))
+
+	var handled []events.Envelope
+	runCtx, stop := context.WithCancel(ctx)
+	done := make(chan error, 1)
+	go func() {
+		done <- store.CatchUp("erased", es, store.InMemoryCheckpoints(), store.SubscriptionFilter{}).Run(runCtx, func(_ context.Context, e events.Envelope) error {
+			handled = append(handled, e)
+			if len(handled) == 3 {
+				stop()
+			}
+			return nil
+		})
+	}()
+	select {
+	case err := <-done:
+		require.True(t, errors.Is(err, context.Canceled), "expected context.Canceled, got %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the erased positions were waited for")
+	}
+	//The erased markers are skipped; the kept events and the tombstone are handled
+	require.Equal(t, 3, len(handled))
+	assert.Equal(t, []int{3, 4, 5}, []int{handled[0].Position, handled[1].Position, handled[2].Position})
+	assert.Equal(t, store.TombstoneEventName, handled[2].EventName)
+}
+
+func TestCatchUpSubscription_HardDeletedGaps(t *testing.T) {
+	es := &announcingStore{DynamoDBEventStore: store.DynamoDB(dynamoClient(t), EventStoreTable)}
+	deleted := uuid.NewString()
+	kept := uuid.NewString()
+	appendVersions(t, es, deleted, 0, 2)
+	appendVersions(t, es, kept, 0, 1)
+	require.Nil(t, es.DeleteStream(ctx, deleted, store.HardDelete))
+
+	run := func(gapTimeout time.Duration, wait time.Duration) []events.Envelope {
+		var handled []events.Envelope
+		runCtx, stop := context.WithTimeout(ctx, wait)
+		defer stop()
+		sub := store.CatchUp("gaps", es, store.InMemoryCheckpoints(), store.SubscriptionFilter{})
+		sub.RetryInterval = 5 * time.Millisecond
+		sub.GapTimeout = gapTimeout
+		err := sub.Run(runCtx, func(_ context.Context, e events.Envelope) error {
+			handled = append(handled, e)
+			if len(handled) == 3 {
+				stop()
+			}
+			return nil
+		})
+		require.True(t, errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded), "unexpected error %v", err)
+		return handled
+	}
+	//The deleted items leave a gap that could be an event PositionIndex does not show yet, so it is waited for
+	assert.Empty(t, run(store.DefaultGapTimeout, 100*time.Millisecond))
+	//Once the events after it are older than GapTimeout the gap is skipped
+	handled := run(20*time.Millisecond, 5*time.Second)
+	require.Equal(t, 3, len(handled))
+	assert.Equal(t, []int{3, 4, 5}, []int{handled[0].Position, handled[1].Position, handled[2].Position})
+	assert.Equal(t, store.TombstoneEventName, handled[2].EventName)
+}
+
+// announcingStore tells its subscribers about every event it appends as soon as the write succeeds,
+// like a DynamoDB stream delivering a record before PositionIndex shows the event
+type announcingStore struct {
+	*store.DynamoDBEventStore
+	mu   sync.Mutex
+	subs []chan events.Envelope
+}
+
+func (s *announcingStore) Subscribe(_ context.Context, _ store.SubscriptionFilter) (<-chan events.Envelope, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ch := make(chan events.Envelope, 1000)
+	s.subs = append(s.subs, ch)
+	return ch, nil
+}
+
+func (s *announcingStore) Append(ctx context.Context, e *events.Envelope) error {
+	if err := s.DynamoDBEventStore.Append(ctx, e); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, ch := range s.subs {
+		ch <- *e
+	}
+	return nil
+}
+
+func TestCatchUpSubscription_EventuallyConsistentIndex(t *testing.T) {
+	srv := dynamotest.NewServer()
+	t.Cleanup(srv.Close)
+	srv.IndexDelay = 40 * time.Millisecond
+	client := srv.Client()
+	require.Nil(t, store.CreateTable(ctx, client, EventStoreTable))
+	es := &announcingStore{DynamoDBEventStore: store.DynamoDB(client, EventStoreTable)}
+	checkpoints := store.InMemoryCheckpoints()
+
+	//Writes close together show up in PositionIndex out of order, both in the history and while live
+	appendVersions(t, es, uuid.NewString(), 0, 19)
+	var positions []int
+	seen := make(chan struct{}, 100)
+	runCtx, stop := context.WithCancel(ctx)
+	done := make(chan error, 1)
+	sub := store.CatchUp("index", es, checkpoints, store.SubscriptionFilter{})
+	sub.RetryInterval = 5 * time.Millisecond
+	go func() {
+		done <- sub.Run(runCtx, func(_ context.Context, e events.Envelope) error {
+			positions = append(positions, e.Position)
+			seen <- struct{}{}
+			return nil
+		})
+	}()
+	appendVersions(t, es, uuid.NewString(), 0, 19)
+	for i := 0; i < 40; i++ {
+		select {
+		case <-seen:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("handled %d of 40 events", i)
+		}
+	}
+	stop()
+	require.True(t, errors.Is(<-done, context.Canceled))
+	assert.Equal(t, versions(0, 39), positions)
+	position, err := checkpoints.Load(ctx, "index")
+	require.Nil(t, err)
+	assert.Equal(t, 39, position)
+}
@@ -0,0 +1,158 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// CheckpointValue is appended to a subscription name to form the Id of its checkpoint item in DynamoDB
+const CheckpointValue string = "CHECKPOINT"
+
+// NoCheckpoint is the position loaded for a subscription that has not saved a checkpoint yet
+const NoCheckpoint int = -1
+
+// CheckpointStore persists the position of the last event a named subscription has processed
+type CheckpointStore interface {
+	Load(ctx context.Context, name string) (int, error)
+	Save(ctx context.Context, name string, position int) error
+}
+
+// InMemoryCheckpointStore keeps checkpoints in memory; they do not survive a restart of the process
+type InMemoryCheckpointStore struct {
+	mu          sync.Mutex
+	checkpoints map[string]int
+}
+
+func InMemoryCheckpoints() *InMemoryCheckpointStore {
+	return &InMemoryCheckpointStore{checkpoints: make(map[string]int)}
+}
+
+func (m *InMemoryCheckpointStore) Load(ctx context.Context, name string) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return NoCheckpoint, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	position, ok := m.checkpoints[name]
+	if !ok {
+		return NoCheckpoint, nil
+	}
+	return position, nil
+}
+
+func (m *InMemoryCheckpointStore) Save(ctx context.Context, name string, position int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.checkpoints[name] = position
+	return nil
+}
+
+// FileCheckpointStore keeps one file per subscription in Dir
+type FileCheckpointStore struct {
+	Dir string
+}
+
+func FileCheckpoints(dir string) *FileCheckpointStore {
+	return &FileCheckpointStore{Dir: dir}
+}
+
+func (f *FileCheckpointStore) Load(ctx context.Context, name string) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return NoCheckpoint, err
+	}
+	bin, err := os.ReadFile(f.path(name))
+	if errors.Is(err, os.ErrNotExist) {
+		return NoCheckpoint, nil
+	}
+	if err != nil {
+		return NoCheckpoint, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(bin)))
+}
+
+// Save writes the checkpoint to a temporary file and renames it so a crash never leaves a partial checkpoint
+func (f *FileCheckpointStore) Save(ctx context.Context, name string, position int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(f.Dir, 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(f.Dir, ".checkpoint-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.WriteString(strconv.Itoa(position)); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), f.path(name))
+}
+
+func (f *FileCheckpointStore) path(name string) string {
+	return filepath.Join(f.Dir, url.PathEscape(name)+".checkpoint")
+}
+
+// DynamoDBCheckpointStore keeps checkpoints as items of a table with the event store's key schema
+// The event store table itself can be used; checkpoint items are stored under the name with CheckpointValue appended
+type DynamoDBCheckpointStore struct {
+	DB    *dynamodb.Client
+	Table string
+}
+
+func DynamoDBCheckpoints(db *dynamodb.Client, table string) *DynamoDBCheckpointStore {
+	return &DynamoDBCheckpointStore{DB: db, Table: table}
+}
+
+func (d *DynamoDBCheckpointStore) Load(ctx context.Context, name string) (int, error) {
+	out, err := d.DB.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(d.Table),
+		Key:            d.key(name),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return NoCheckpoint, err
+	}
+	position, ok := out.Item["Position"].(*types.AttributeValueMemberN)
+	if !ok {
+		return NoCheckpoint, nil
+	}
+	return strconv.Atoi(position.Value)
+}
+
+func (d *DynamoDBCheckpointStore) Save(ctx context.Context, name string, position int) error {
+	item := d.key(name)
+	item["Position"] = &types.AttributeValueMemberN{Value: strconv.Itoa(position)}
+	_, err := d.DB.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(d.Table),
+		Item:      item,
+	})
+	return err
+}
+
+func (d *DynamoDBCheckpointStore) key(name string) AttributeValueMap {
+	return AttributeValueMap{
+		"Id":      &types.AttributeValueMemberS{Value: name + CheckpointValue},
+		"Version": &types.AttributeValueMemberN{Value: "0"},
+	}
+}
@@ -0,0 +1,46 @@
+package store_test
+
+import (
+	"github.com/cpustejovsky/event-store/store"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func testCheckpointStore(t *testing.T, checkpoints store.CheckpointStore) {
+	name := "projection/" + uuid.NewString()
+	position, err := checkpoints.Load(ctx, name)
+	require.Nil(t, err)
+	assert.Equal(t, store.NoCheckpoint, position)
+
+	for _, want := range []int{0, 7, 42} {
+		require.Nil(t, checkpoints.Save(ctx, name, want))
+		position, err = checkpoints.Load(ctx, name)
+		require.Nil(t, err)
+		assert.Equal(t, want, position)
+	}
+
+	position, err = checkpoints.Load(ctx, uuid.NewString())
+	require.Nil(t, err)
+	assert.Equal(t, store.NoCheckpoint, position)
+}
+
+func TestInMemoryCheckpointStore(t *testing.T) {
+	testCheckpointStore(t, store.InMemoryCheckpoints())
+}
+
+func TestFileCheckpointStore(t *testing.T) {
+	dir := t.TempDir()
+	testCheckpointStore(t, store.FileCheckpoints(dir))
+
+	//Checkpoints survive a new FileCheckpointStore for the same directory
+	require.Nil(t, store.FileCheckpoints(dir).Save(ctx, "restart", 3))
+	position, err := store.FileCheckpoints(dir).Load(ctx, "restart")
+	require.Nil(t, err)
+	assert.Equal(t, 3, position)
+}
+
+func TestDynamoDBCheckpointStore(t *testing.T) {
+	testCheckpointStore(t, store.DynamoDBCheckpoints(dynamoClient(t), EventStoreTable))
+}
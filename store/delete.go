@@ -0,0 +1,236 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/cpustejovsky/event-store/events"
+	"strconv"
+)
+
+// TombstoneEventName is the EventName of the event DeleteStream appends to close a stream
+// The tombstone's Event holds the DeleteMode it was deleted with, so the choice is kept for audit
+const TombstoneEventName string = "$tombstone"
+
+// ErasedEventName is the EventName of the marker ReadAll returns at the global position of an event removed by a HardDelete
+// A marker carries nothing but its Position, so a reader of the log can tell a removed event from one that is not visible yet
+// DynamoDBEventStore deletes the items of removed events instead, so its ReadAll leaves their positions out
+const ErasedEventName string = "$erased"
+
+// DeleteMode selects how DeleteStream deletes a stream
+type DeleteMode string
+
+const (
+	// SoftDelete keeps the events of the stream and closes it with a tombstone
+	SoftDelete DeleteMode = "soft"
+	// HardDelete closes the stream with a tombstone and removes its events and snapshots; only the tombstone is kept
+	HardDelete DeleteMode = "hard"
+)
+
+// StreamDeletedError is returned by appends to and reads of a stream closed by DeleteStream
+type StreamDeletedError struct {
+	ID string
+	// Version is the Version of the tombstone
+	Version int
+	Mode    DeleteMode
+}
+
+func (e *StreamDeletedError) Error() string {
+	return fmt.Sprintf("stream %s was deleted (%s delete) at version %d", e.ID, e.Mode, e.Version)
+}
+
+// UnknownDeleteModeError is returned by DeleteStream for a mode other than SoftDelete and HardDelete
+type UnknownDeleteModeError struct {
+	Mode DeleteMode
+}
+
+func (e *UnknownDeleteModeError) Error() string {
+	return fmt.Sprintf("unknown delete mode %q", string(e.Mode))
+}
+
+func (mode DeleteMode) validate() error {
+	if mode != SoftDelete && mode != HardDelete {
+		return &UnknownDeleteModeError{Mode: mode}
+	}
+	return nil
+}
+
+// tombstone returns the tombstone closing the stream with id after latest
+func tombstone(id string, latest int, mode DeleteMode) []events.Envelope {
+	batch := []events.Envelope{{Id: id, Version: latest + 1, EventName: TombstoneEventName, Event: []byte(mode)}}
+	stamp(batch)
+	return batch
+}
+
+// tombstoneError returns a StreamDeletedError if e is a tombstone and nil otherwise
+func tombstoneError(e *events.Envelope) error {
+	if e.EventName != TombstoneEventName {
+		return nil
+	}
+	return &StreamDeletedError{ID: e.Id, Version: e.Version, Mode: DeleteMode(e.Event)}
+}
+
+// purged reports whether err is the StreamDeletedError of a stream already hard deleted, which a repeated HardDelete leaves as it is
+func purged(err error, mode DeleteMode) (*StreamDeletedError, bool) {
+	deleted := &StreamDeletedError{}
+	if errors.As(err, &deleted) && deleted.Mode == HardDelete && mode == HardDelete {
+		return deleted, true
+	}
+	return nil, false
+}
+
+// DeleteStream closes the stream with id by appending a tombstone after its latest version
+// Appends to the stream and reads of it fail with a StreamDeletedError afterwards; ReadAll, QueryByEventName and subscriptions deliver the tombstone
+// HardDelete then removes the stream's events and snapshots in batches; repeating it finishes a removal that was interrupted
+// Deleting a stream that was already deleted otherwise returns its StreamDeletedError, and deleting an empty stream a NoEventFoundError
+func (d *DynamoDBEventStore) DeleteStream(ctx context.Context, id string, mode DeleteMode) error {
+	if err := mode.validate(); err != nil {
+		return err
+	}
+	if err := checkId(id); err != nil {
+		return err
+	}
+	for {
+		latest, err := d.QueryLatestVersion(ctx, id)
+		if deleted, ok := purged(err, mode); ok {
+			return d.removeStream(ctx, id, deleted.Version)
+		}
+		if err != nil {
+			return err
+		}
+		err = d.appendBatch(ctx, tombstone(id, latest, mode))
+		checkErr := &EventAlreadyExistsError{}
+		if errors.As(err, &checkErr) {
+			//An event was appended after the latest version was read, so the tombstone goes after it
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if mode == HardDelete {
+			return d.removeStream(ctx, id, latest+1)
+		}
+		return nil
+	}
+}
+
+// removeStream deletes the events of the stream with id before the tombstone at version and every snapshot of the stream
+// The items are deleted rather than replaced, so ReadAll leaves out their positions and CatchUpSubscription skips them once GapTimeout has passed
+func (d *DynamoDBEventStore) removeStream(ctx context.Context, id string, version int) error {
+	var keys []AttributeValueMap
+	for _, params := range []*dynamodb.QueryInput{{
+		TableName:              aws.String(d.Table),
+		KeyConditionExpression: aws.String("#id = :id AND #version < :tombstone"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":id":        &types.AttributeValueMemberS{Value: id},
+			":tombstone": &types.AttributeValueMemberN{Value: strconv.Itoa(version)},
+		},
+	}, {
+		TableName:              aws.String(d.Table),
+		KeyConditionExpression: aws.String("#id = :id"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":id": &types.AttributeValueMemberS{Value: id + SnapshotValue},
+		},
+	}} {
+		params.ProjectionExpression = aws.String("#id, #version")
+		params.ExpressionAttributeNames = map[string]string{"#id": "Id", "#version": "Version"}
+		items, err := d.query(ctx, params)
+		checkErr := &NoEventFoundError{}
+		if err != nil && !errors.As(err, &checkErr) {
+			return err
+		}
+		for _, item := range items {
+			keys = append(keys, AttributeValueMap{"Id": item["Id"], "Version": item["Version"]})
+		}
+	}
+	_, err := d.deleteItems(ctx, keys)
+	return err
+}
+
+// checkDeleted returns a StreamDeletedError if the stream with id was deleted
+// It reads the latest item of the stream, which is the tombstone of a deleted stream
+func (d *DynamoDBEventStore) checkDeleted(ctx context.Context, id string) error {
+	_, err := d.QueryLatestVersion(ctx, id)
+	checkErr := &NoEventFoundError{}
+	if errors.As(err, &checkErr) {
+		return nil
+	}
+	return err
+}
+
+// DeleteStream closes the stream with id by appending a tombstone after its latest version
+// Appends to the stream and reads of it fail with a StreamDeletedError afterwards; ReadAll, QueryByEventName and subscriptions deliver the tombstone
+// HardDelete also removes the stream's events and snapshots; ReadAll returns an erased marker at the position of every removed event
+// Deleting a stream that was hard deleted again with HardDelete does nothing; deleting it otherwise returns its StreamDeletedError,
+// and deleting an empty stream a NoEventFoundError
+func (m *InMemoryEventStore) DeleteStream(ctx context.Context, id string, mode DeleteMode) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := mode.validate(); err != nil {
+		return err
+	}
+	if err := checkId(id); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	err := m.deleted(id)
+	if _, ok := purged(err, mode); ok {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	stream := m.streams[id]
+	if len(stream) == 0 {
+		return &NoEventFoundError{}
+	}
+	snapshots := m.snapshots[id]
+	//Committing a HardDelete tombstone removes the events and snapshots of the stream from memory
+	if err := m.commit(ctx, tombstone(id, stream[len(stream)-1].Version, mode)); err != nil {
+		return err
+	}
+	if mode == HardDelete {
+		return m.deleteSnapshots(id, snapshots)
+	}
+	return nil
+}
+
+// deleted returns a StreamDeletedError if the stream with id was deleted; callers must hold the lock
+func (m *InMemoryEventStore) deleted(id string) error {
+	stream := m.streams[id]
+	if len(stream) == 0 {
+		return nil
+	}
+	return tombstoneError(&stream[len(stream)-1])
+}
+
+// erase replaces the events of the stream with id before version by placeholders in the global log and forgets its snapshots
+// Callers must hold the lock
+func (m *InMemoryEventStore) erase(id string, version int) {
+	stream := m.streams[id]
+	var kept []events.Envelope
+	for _, e := range stream {
+		if e.Version >= version {
+			kept = append(kept, e)
+			continue
+		}
+		m.log[e.Position] = events.Envelope{Position: e.Position}
+	}
+	m.streams[id] = kept
+	delete(m.snapshots, id)
+}
+
+// erased reports whether e is the placeholder a hard deleted event leaves in the global log, or the erased marker ReadAll returns for it
+func erased(e *events.Envelope) bool {
+	return e.Id == ""
+}
+
+// erasedMarker returns the envelope ReadAll returns at the position of an event removed by a HardDelete
+func erasedMarker(position int) events.Envelope {
+	return events.Envelope{Position: position, EventName: ErasedEventName}
+}
@@ -0,0 +1,619 @@
+package dynamotest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// condition evaluates a condition, key condition or filter expression against an item
+type condition func(item) bool
+
+// operand evaluates an operand of an expression against an item; ok is false for a missing attribute
+type operand func(item) (v attribute, ok bool)
+
+// update applies the actions of an update expression to an item in place
+type update func(item) error
+
+// token is a lexical token of an expression
+type token struct {
+	kind byte
+	text string
+}
+
+// Token kinds; operators and punctuation use their first character
+const (
+	tokenEOF   byte = 0
+	tokenName  byte = 'a'
+	tokenValue byte = ':'
+)
+
+// expression parses one expression with the ExpressionAttributeNames and ExpressionAttributeValues of its request
+type expression struct {
+	tokens []token
+	pos    int
+	names  map[string]string
+	values map[string]attribute
+}
+
+// validationError is an expression or request the fake rejects as DynamoDB would with a ValidationException
+type validationError struct {
+	message string
+}
+
+func (e *validationError) Error() string {
+	return e.message
+}
+
+func invalid(format string, args ...any) error {
+	return &validationError{message: fmt.Sprintf(format, args...)}
+}
+
+func newExpression(input string, names map[string]string, values map[string]attribute) (*expression, error) {
+	tokens, err := lex(input)
+	if err != nil {
+		return nil, err
+	}
+	return &expression{tokens: tokens, names: names, values: values}, nil
+}
+
+// lex splits an expression into tokens
+func lex(input string) ([]token, error) {
+	var tokens []token
+	for i := 0; i < len(input); {
+		c := input[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '(' || c == ')' || c == ',' || c == '=' || c == '+' || c == '-':
+			tokens = append(tokens, token{kind: c, text: string(c)})
+			i++
+		case c == '<' || c == '>':
+			op := string(c)
+			if i+1 < len(input) && (input[i+1] == '=' || (c == '<' && input[i+1] == '>')) {
+				op += string(input[i+1])
+			}
+			tokens = append(tokens, token{kind: c, text: op})
+			i += len(op)
+		case c == ':' || c == '#' || isNameChar(c):
+			j := i + 1
+			for j < len(input) && isNameChar(input[j]) {
+				j++
+			}
+			kind := tokenName
+			if c == ':' {
+				kind = tokenValue
+			}
+			tokens = append(tokens, token{kind: kind, text: input[i:j]})
+			i = j
+		default:
+			return nil, invalid("Invalid expression: unexpected character %q", c)
+		}
+	}
+	return append(tokens, token{kind: tokenEOF}), nil
+}
+
+func isNameChar(c byte) bool {
+	return c == '_' || c == '.' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
+
+func (e *expression) peek() token {
+	return e.tokens[e.pos]
+}
+
+func (e *expression) next() token {
+	t := e.tokens[e.pos]
+	if t.kind != tokenEOF {
+		e.pos++
+	}
+	return t
+}
+
+// keyword consumes the next token if it is the keyword word, which is matched case-insensitively
+func (e *expression) keyword(word string) bool {
+	t := e.peek()
+	if t.kind == tokenName && strings.EqualFold(t.text, word) {
+		e.pos++
+		return true
+	}
+	return false
+}
+
+func (e *expression) expect(kind byte) error {
+	if t := e.next(); t.kind != kind {
+		return invalid("Invalid expression: expected %q, found %q", kind, t.text)
+	}
+	return nil
+}
+
+func (e *expression) end() error {
+	if t := e.peek(); t.kind != tokenEOF {
+		return invalid("Invalid expression: unexpected token %q", t.text)
+	}
+	return nil
+}
+
+// parseCondition parses a complete condition expression
+func parseCondition(input string, names map[string]string, values map[string]attribute) (condition, error) {
+	e, err := newExpression(input, names, values)
+	if err != nil {
+		return nil, err
+	}
+	c, err := e.or()
+	if err != nil {
+		return nil, err
+	}
+	return c, e.end()
+}
+
+func (e *expression) or() (condition, error) {
+	left, err := e.and()
+	if err != nil {
+		return nil, err
+	}
+	for e.keyword("OR") {
+		right, err := e.and()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(it item) bool { return l(it) || right(it) }
+	}
+	return left, nil
+}
+
+func (e *expression) and() (condition, error) {
+	left, err := e.not()
+	if err != nil {
+		return nil, err
+	}
+	for e.keyword("AND") {
+		right, err := e.not()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(it item) bool { return l(it) && right(it) }
+	}
+	return left, nil
+}
+
+func (e *expression) not() (condition, error) {
+	if e.keyword("NOT") {
+		c, err := e.not()
+		if err != nil {
+			return nil, err
+		}
+		return func(it item) bool { return !c(it) }, nil
+	}
+	return e.primary()
+}
+
+func (e *expression) primary() (condition, error) {
+	if e.peek().kind == '(' {
+		e.next()
+		c, err := e.or()
+		if err != nil {
+			return nil, err
+		}
+		return c, e.expect(')')
+	}
+	if t := e.peek(); t.kind == tokenName && e.tokens[e.pos+1].kind == '(' {
+		return e.function()
+	}
+	left, err := e.operand()
+	if err != nil {
+		return nil, err
+	}
+	if e.keyword("BETWEEN") {
+		low, err := e.operand()
+		if err != nil {
+			return nil, err
+		}
+		if !e.keyword("AND") {
+			return nil, invalid("Invalid expression: BETWEEN without AND")
+		}
+		high, err := e.operand()
+		if err != nil {
+			return nil, err
+		}
+		return func(it item) bool {
+			v, okV := left(it)
+			l, okL := low(it)
+			h, okH := high(it)
+			if !okV || !okL || !okH {
+				return false
+			}
+			c1, ok1 := compare(v, l)
+			c2, ok2 := compare(v, h)
+			return ok1 && ok2 && c1 >= 0 && c2 <= 0
+		}, nil
+	}
+	if e.keyword("IN") {
+		if err := e.expect('('); err != nil {
+			return nil, err
+		}
+		var list []operand
+		for {
+			o, err := e.operand()
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, o)
+			if e.peek().kind != ',' {
+				break
+			}
+			e.next()
+		}
+		if err := e.expect(')'); err != nil {
+			return nil, err
+		}
+		return func(it item) bool {
+			v, ok := left(it)
+			if !ok {
+				return false
+			}
+			for _, o := range list {
+				if w, ok := o(it); ok && equal(v, w) {
+					return true
+				}
+			}
+			return false
+		}, nil
+	}
+	op := e.next()
+	right, err := e.operand()
+	if err != nil {
+		return nil, err
+	}
+	return comparison(op.text, left, right)
+}
+
+// comparison returns the condition comparing two operands with the comparator op
+func comparison(op string, left, right operand) (condition, error) {
+	var accept func(int) bool
+	switch op {
+	case "=":
+		return func(it item) bool {
+			l, okL := left(it)
+			r, okR := right(it)
+			return okL && okR && equal(l, r)
+		}, nil
+	case "<>":
+		return func(it item) bool {
+			l, okL := left(it)
+			r, okR := right(it)
+			return okL && okR && !equal(l, r)
+		}, nil
+	case "<":
+		accept = func(c int) bool { return c < 0 }
+	case "<=":
+		accept = func(c int) bool { return c <= 0 }
+	case ">":
+		accept = func(c int) bool { return c > 0 }
+	case ">=":
+		accept = func(c int) bool { return c >= 0 }
+	default:
+		return nil, invalid("Invalid expression: unexpected token %q", op)
+	}
+	return func(it item) bool {
+		l, okL := left(it)
+		r, okR := right(it)
+		if !okL || !okR {
+			return false
+		}
+		c, ok := compare(l, r)
+		return ok && accept(c)
+	}, nil
+}
+
+// function parses a condition function such as attribute_exists(path)
+func (e *expression) function() (condition, error) {
+	name := strings.ToLower(e.next().text)
+	e.next()
+	var args []operand
+	var paths []string
+	for e.peek().kind != ')' {
+		if len(args) > 0 {
+			if err := e.expect(','); err != nil {
+				return nil, err
+			}
+		}
+		path := ""
+		if e.peek().kind == tokenName {
+			var err error
+			if path, err = e.name(e.peek().text); err != nil {
+				return nil, err
+			}
+		}
+		o, err := e.operand()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, o)
+		paths = append(paths, path)
+	}
+	e.next()
+	switch {
+	case (name == "attribute_exists" || name == "attribute_not_exists") && len(args) == 1 && paths[0] != "":
+		exists := name == "attribute_exists"
+		return func(it item) bool {
+			_, ok := args[0](it)
+			return ok == exists
+		}, nil
+	case name == "begins_with" && len(args) == 2:
+		return func(it item) bool {
+			v, okV := args[0](it)
+			p, okP := args[1](it)
+			if !okV || !okP || v.kind() != p.kind() || (v.kind() != "S" && v.kind() != "B") {
+				return false
+			}
+			s, _ := v.scalar()
+			prefix, _ := p.scalar()
+			return strings.HasPrefix(s, prefix)
+		}, nil
+	case name == "contains" && len(args) == 2:
+		return func(it item) bool {
+			v, okV := args[0](it)
+			w, okW := args[1](it)
+			return okV && okW && contains(v, w)
+		}, nil
+	}
+	return nil, invalid("Invalid expression: unsupported function %s with %d arguments", name, len(args))
+}
+
+// contains reports whether the string v contains the string w, or the set or list v has the element w
+func contains(v, w attribute) bool {
+	switch v.kind() {
+	case "S":
+		s, _ := v.scalar()
+		sub, ok := w.scalar()
+		return ok && w.kind() == "S" && strings.Contains(s, sub)
+	case "L":
+		var list []attribute
+		if json.Unmarshal(v["L"], &list) != nil {
+			return false
+		}
+		for _, element := range list {
+			if equal(element, w) {
+				return true
+			}
+		}
+	case "SS", "NS", "BS":
+		var set []json.RawMessage
+		if json.Unmarshal(v[v.kind()], &set) != nil {
+			return false
+		}
+		for _, element := range set {
+			if equal(attribute{v.kind()[:1]: element}, w) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// name resolves an attribute name or #placeholder
+func (e *expression) name(text string) (string, error) {
+	if strings.HasPrefix(text, "#") {
+		name, ok := e.names[text]
+		if !ok {
+			return "", invalid("Value provided in ExpressionAttributeNames unused in expressions or undefined: %s", text)
+		}
+		return name, nil
+	}
+	if strings.Contains(text, ".") {
+		return "", invalid("Invalid expression: nested attribute paths are not supported: %s", text)
+	}
+	return text, nil
+}
+
+// operand parses an attribute name or :value
+func (e *expression) operand() (operand, error) {
+	t := e.next()
+	switch t.kind {
+	case tokenValue:
+		v, ok := e.values[t.text]
+		if !ok {
+			return nil, invalid("An expression attribute value used in expression is not defined; attribute value: %s", t.text)
+		}
+		return func(item) (attribute, bool) { return v, true }, nil
+	case tokenName:
+		name, err := e.name(t.text)
+		if err != nil {
+			return nil, err
+		}
+		return func(it item) (attribute, bool) {
+			v, ok := it[name]
+			return v, ok
+		}, nil
+	}
+	return nil, invalid("Invalid expression: expected an operand, found %q", t.text)
+}
+
+// parseUpdate parses an update expression made of SET and REMOVE clauses
+// SET supports plain values, addition and subtraction of numbers and if_not_exists
+func parseUpdate(input string, names map[string]string, values map[string]attribute) (update, error) {
+	e, err := newExpression(input, names, values)
+	if err != nil {
+		return nil, err
+	}
+	var actions []update
+	for e.peek().kind != tokenEOF {
+		switch {
+		case e.keyword("SET"):
+			for {
+				action, err := e.set()
+				if err != nil {
+					return nil, err
+				}
+				actions = append(actions, action)
+				if e.peek().kind != ',' {
+					break
+				}
+				e.next()
+			}
+		case e.keyword("REMOVE"):
+			for {
+				t := e.next()
+				name, err := e.name(t.text)
+				if err != nil {
+					return nil, err
+				}
+				actions = append(actions, func(it item) error {
+					delete(it, name)
+					return nil
+				})
+				if e.peek().kind != ',' {
+					break
+				}
+				e.next()
+			}
+		default:
+			return nil, invalid("Invalid UpdateExpression: unsupported clause %q", e.peek().text)
+		}
+	}
+	return func(it item) error {
+		//Every value is computed from the item as it was before the update
+		before := it.copy()
+		for _, action := range actions {
+			if err := action(before); err != nil {
+				return err
+			}
+		}
+		for k := range it {
+			delete(it, k)
+		}
+		for k, v := range before {
+			it[k] = v
+		}
+		return nil
+	}, nil
+}
+
+// set parses a path = value action of a SET clause
+func (e *expression) set() (update, error) {
+	t := e.next()
+	if t.kind != tokenName {
+		return nil, invalid("Invalid UpdateExpression: expected an attribute, found %q", t.text)
+	}
+	name, err := e.name(t.text)
+	if err != nil {
+		return nil, err
+	}
+	if err := e.expect('='); err != nil {
+		return nil, err
+	}
+	value, err := e.setValue()
+	if err != nil {
+		return nil, err
+	}
+	if op := e.peek().kind; op == '+' || op == '-' {
+		e.next()
+		right, err := e.setValue()
+		if err != nil {
+			return nil, err
+		}
+		left := value
+		value = func(it item) (attribute, bool) {
+			l, okL := left(it)
+			r, okR := right(it)
+			if !okL || !okR {
+				return nil, false
+			}
+			return arithmetic(l, r, op)
+		}
+	}
+	return func(it item) error {
+		v, ok := value(it)
+		if !ok {
+			return invalid("The provided expression refers to an attribute that does not exist in the item")
+		}
+		it[name] = v
+		return nil
+	}, nil
+}
+
+// setValue parses an operand of a SET action, which may be if_not_exists(path, value)
+func (e *expression) setValue() (operand, error) {
+	if t := e.peek(); t.kind == tokenName && strings.EqualFold(t.text, "if_not_exists") {
+		e.next()
+		if err := e.expect('('); err != nil {
+			return nil, err
+		}
+		path, err := e.operand()
+		if err != nil {
+			return nil, err
+		}
+		if err := e.expect(','); err != nil {
+			return nil, err
+		}
+		fallback, err := e.operand()
+		if err != nil {
+			return nil, err
+		}
+		if err := e.expect(')'); err != nil {
+			return nil, err
+		}
+		return func(it item) (attribute, bool) {
+			if v, ok := path(it); ok {
+				return v, true
+			}
+			return fallback(it)
+		}, nil
+	}
+	return e.operand()
+}
+
+// arithmetic adds or subtracts two numbers
+func arithmetic(l, r attribute, op byte) (attribute, bool) {
+	x, okX := l.scalar()
+	y, okY := r.scalar()
+	if l.kind() != "N" || r.kind() != "N" || !okX || !okY {
+		return nil, false
+	}
+	m, okM := new(big.Float).SetPrec(128).SetString(x)
+	n, okN := new(big.Float).SetPrec(128).SetString(y)
+	if !okM || !okN {
+		return nil, false
+	}
+	if op == '+' {
+		m.Add(m, n)
+	} else {
+		m.Sub(m, n)
+	}
+	return number(m.Text('f', -1)), true
+}
+
+// number returns an N attribute
+func number(n string) attribute {
+	var b bytes.Buffer
+	json.NewEncoder(&b).Encode(n)
+	return attribute{"N": bytes.TrimSpace(b.Bytes())}
+}
+
+// parseProjection parses a projection expression into the names of the attributes it selects
+func parseProjection(input string, names map[string]string) ([]string, error) {
+	e, err := newExpression(input, names, nil)
+	if err != nil {
+		return nil, err
+	}
+	var projection []string
+	for {
+		t := e.next()
+		if t.kind != tokenName {
+			return nil, invalid("Invalid ProjectionExpression: expected an attribute, found %q", t.text)
+		}
+		name, err := e.name(t.text)
+		if err != nil {
+			return nil, err
+		}
+		projection = append(projection, name)
+		if e.peek().kind != ',' {
+			return projection, e.end()
+		}
+		e.next()
+	}
+}
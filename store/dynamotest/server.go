@@ -0,0 +1,938 @@
+// Package dynamotest provides an in-process fake of the subset of DynamoDB the event store uses, so DynamoDBEventStore can be tested without AWS
+// It speaks the DynamoDB JSON protocol over HTTP and supports table management, PutItem, GetItem, UpdateItem, DeleteItem, Query, Scan,
+// BatchWriteItem and TransactWriteItems with condition, key condition, filter, update and projection expressions
+// Every table and index is always ACTIVE and reads of a table are strongly consistent;
+// reads of a global secondary index are too, unless Server.IndexDelay makes writes show up in indexes late
+package dynamotest
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Region is the region of the clients returned by Client
+const Region = "us-east-1"
+
+// maxTransactionItems is the largest number of actions TransactWriteItems accepts
+const maxTransactionItems = 100
+
+// maxBatchWriteItems is the largest number of requests BatchWriteItem accepts
+const maxBatchWriteItems = 25
+
+// Server is a fake DynamoDB endpoint listening on a local port
+type Server struct {
+	// URL is the endpoint of the server, such as http://127.0.0.1:49152
+	URL string
+	// PageSize caps how many items a Query or Scan evaluates per page, standing in for DynamoDB's 1 MB page limit; zero evaluates every item
+	PageSize int
+	// IndexDelay makes every write visible to a Query or Scan of an index only after a random delay between half of IndexDelay and IndexDelay,
+	// so writes close together can show up in an index out of order, as in DynamoDB's eventually consistent global secondary indexes
+	// Zero makes every write visible at once
+	IndexDelay time.Duration
+	srv        *httptest.Server
+	mu         sync.Mutex
+	tables     map[string]*table
+}
+
+// NewServer starts a fake DynamoDB server with no tables
+// Call Close when done with it
+func NewServer() *Server {
+	s := &Server{tables: make(map[string]*table)}
+	s.srv = httptest.NewServer(s)
+	s.URL = s.srv.URL
+	return s
+}
+
+// Close shuts the server down
+func (s *Server) Close() {
+	s.srv.Close()
+}
+
+// Client returns a DynamoDB client that sends every request to the server with static credentials
+// Its endpoint resolver is given the signing region, as otherwise it writes it on every call, which races between concurrent requests
+func (s *Server) Client() *dynamodb.Client {
+	return dynamodb.New(dynamodb.Options{
+		Region:           Region,
+		Credentials:      credentials.NewStaticCredentialsProvider("fake", "fake", ""),
+		EndpointResolver: dynamodb.EndpointResolverFromURL(s.URL, func(e *aws.Endpoint) { e.SigningRegion = Region }),
+		HTTPClient:       s.srv.Client(),
+		RetryMaxAttempts: 1,
+	})
+}
+
+// keySchemaElement, attributeDefinition, projection, indexDefinition and streamSpecification mirror the API shapes of the same names
+type keySchemaElement struct {
+	AttributeName string
+	KeyType       string
+}
+
+type attributeDefinition struct {
+	AttributeName string
+	AttributeType string
+}
+
+type projection struct {
+	ProjectionType   string
+	NonKeyAttributes []string `json:",omitempty"`
+}
+
+type indexDefinition struct {
+	IndexName  string
+	KeySchema  []keySchemaElement
+	Projection projection
+}
+
+type streamSpecification struct {
+	StreamEnabled  bool
+	StreamViewType string `json:",omitempty"`
+}
+
+// request holds the fields of every supported operation's input
+type request struct {
+	TableName                 string
+	IndexName                 string
+	Key                       item
+	Item                      item
+	ConditionExpression       string
+	KeyConditionExpression    string
+	FilterExpression          string
+	UpdateExpression          string
+	ProjectionExpression      string
+	ExpressionAttributeNames  map[string]string
+	ExpressionAttributeValues map[string]attribute
+	ExclusiveStartKey         item
+	Limit                     int
+	ScanIndexForward          *bool
+	Select                    string
+	ReturnValues              string
+
+	ReturnValuesOnConditionCheckFailure string
+
+	KeySchema                   []keySchemaElement
+	AttributeDefinitions        []attributeDefinition
+	GlobalSecondaryIndexes      []indexDefinition
+	GlobalSecondaryIndexUpdates []struct {
+		Create *indexDefinition
+		Delete *struct{ IndexName string }
+	}
+	StreamSpecification     *streamSpecification
+	TimeToLiveSpecification *struct {
+		Enabled       bool
+		AttributeName string
+	}
+
+	TransactItems []struct {
+		ConditionCheck *request
+		Put            *request
+		Delete         *request
+		Update         *request
+	}
+	RequestItems map[string][]struct {
+		PutRequest    *struct{ Item item }
+		DeleteRequest *struct{ Key item }
+	}
+}
+
+// apiError is an error response of the DynamoDB API
+type apiError struct {
+	code    string
+	message string
+	// reasons are the cancellation reasons of a TransactionCanceledException
+	reasons []reason
+}
+
+// reason is the cancellation reason of one item of a canceled transaction
+type reason struct {
+	Code string
+	// Item is the item that failed its condition when the write asked for it with ReturnValuesOnConditionCheckFailure
+	Item item `json:",omitempty"`
+}
+
+func (e *apiError) Error() string {
+	return e.code + ": " + e.message
+}
+
+func notFound(format string, args ...any) error {
+	return &apiError{code: "ResourceNotFoundException", message: fmt.Sprintf(format, args...)}
+}
+
+var errConditionFailed = &apiError{code: "ConditionalCheckFailedException", message: "The conditional request failed"}
+
+// ServeHTTP dispatches a DynamoDB API call on its X-Amz-Target header
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	target := r.Header.Get("X-Amz-Target")
+	operation, ok := s.operations()[strings.TrimPrefix(target, "DynamoDB_20120810.")]
+	if !ok {
+		writeError(w, &apiError{code: "UnknownOperationException", message: "unsupported operation " + target})
+		return
+	}
+	var req request
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, &apiError{code: "SerializationException", message: err.Error()})
+		return
+	}
+	s.mu.Lock()
+	out, err := operation(&req)
+	s.mu.Unlock()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+	json.NewEncoder(w).Encode(out)
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	apiErr, ok := err.(*apiError)
+	if !ok {
+		code := "InternalServerError"
+		if _, ok := err.(*validationError); ok {
+			code = "ValidationException"
+		}
+		apiErr = &apiError{code: code, message: err.Error()}
+	}
+	body := map[string]any{
+		"__type":  "com.amazonaws.dynamodb.v20120810#" + apiErr.code,
+		"message": apiErr.message,
+	}
+	if apiErr.reasons != nil {
+		body["Message"] = apiErr.message
+		body["CancellationReasons"] = apiErr.reasons
+	}
+	status := http.StatusBadRequest
+	if apiErr.code == "InternalServerError" {
+		status = http.StatusInternalServerError
+	}
+	w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func (s *Server) operations() map[string]func(*request) (any, error) {
+	return map[string]func(*request) (any, error){
+		"CreateTable":        s.createTable,
+		"DescribeTable":      s.describeTable,
+		"UpdateTable":        s.updateTable,
+		"DeleteTable":        s.deleteTable,
+		"DescribeTimeToLive": s.describeTimeToLive,
+		"UpdateTimeToLive":   s.updateTimeToLive,
+		"PutItem":            s.putItem,
+		"GetItem":            s.getItem,
+		"UpdateItem":         s.updateItem,
+		"DeleteItem":         s.deleteItem,
+		"Query":              s.query,
+		"Scan":               s.scan,
+		"BatchWriteItem":     s.batchWriteItem,
+		"TransactWriteItems": s.transactWriteItems,
+	}
+}
+
+// table is a table and its items, keyed by keyString of their primary key
+type table struct {
+	name       string
+	keySchema  []keySchemaElement
+	attributes []attributeDefinition
+	indexes    []indexDefinition
+	stream     *streamSpecification
+	ttl        string
+	created    time.Time
+	items      map[string]item
+	// indexed holds when the last write of an item becomes visible to index reads, for writes made with an IndexDelay
+	indexed map[string]time.Time
+}
+
+// keyNames returns the hash and range key attributes of a key schema; the range key is empty if there is none
+func keyNames(schema []keySchemaElement) (hash, rng string) {
+	for _, k := range schema {
+		if k.KeyType == "HASH" {
+			hash = k.AttributeName
+		} else {
+			rng = k.AttributeName
+		}
+	}
+	return hash, rng
+}
+
+func (t *table) hash() string {
+	hash, _ := keyNames(t.keySchema)
+	return hash
+}
+
+func (t *table) rng() string {
+	_, rng := keyNames(t.keySchema)
+	return rng
+}
+
+func (t *table) index(name string) (indexDefinition, error) {
+	for _, index := range t.indexes {
+		if index.IndexName == name {
+			return index, nil
+		}
+	}
+	return indexDefinition{}, invalid("The table does not have the specified index: %s", name)
+}
+
+// attributeType returns the declared type of a key attribute
+func (t *table) attributeType(name string) string {
+	for _, a := range t.attributes {
+		if a.AttributeName == name {
+			return a.AttributeType
+		}
+	}
+	return ""
+}
+
+// validateItem checks that it has the table's key attributes and that its index keys have their declared types
+func (t *table) validateItem(it item) error {
+	for _, name := range []string{t.hash(), t.rng()} {
+		if name == "" {
+			continue
+		}
+		if _, ok := it[name]; !ok {
+			return invalid("One or more parameter values were invalid: Missing the key %s in the item", name)
+		}
+	}
+	for _, index := range t.indexes {
+		for _, k := range index.KeySchema {
+			if v, ok := it[k.AttributeName]; ok && v.kind() != t.attributeType(k.AttributeName) {
+				return invalid("One or more parameter values were invalid: Type mismatch for Index Key %s Expected: %s Actual: %s IndexName: %s",
+					k.AttributeName, t.attributeType(k.AttributeName), v.kind(), index.IndexName)
+			}
+		}
+	}
+	for _, name := range []string{t.hash(), t.rng()} {
+		if v, ok := it[name]; ok && v.kind() != t.attributeType(name) {
+			return invalid("One or more parameter values were invalid: Type mismatch for key %s expected: %s actual: %s", name, t.attributeType(name), v.kind())
+		}
+	}
+	return nil
+}
+
+// validateKey checks that key holds exactly the table's key attributes and returns its keyString
+func (t *table) validateKey(key item) (string, error) {
+	hash, rng := t.hash(), t.rng()
+	want := 1
+	if rng != "" {
+		want = 2
+	}
+	if len(key) != want || !key.has(hash, rng) {
+		return "", invalid("The provided key element does not match the schema")
+	}
+	if err := t.validateItem(key); err != nil {
+		return "", invalid("The provided key element does not match the schema")
+	}
+	return keyString(key, hash, rng), nil
+}
+
+func (t *table) description() map[string]any {
+	desc := map[string]any{
+		"TableName":            t.name,
+		"TableArn":             t.arn(),
+		"TableStatus":          "ACTIVE",
+		"KeySchema":            t.keySchema,
+		"AttributeDefinitions": t.attributes,
+		"CreationDateTime":     float64(t.created.UnixNano()) / 1e9,
+		"ItemCount":            len(t.items),
+		"BillingModeSummary":   map[string]string{"BillingMode": "PAY_PER_REQUEST"},
+	}
+	if len(t.indexes) > 0 {
+		indexes := make([]map[string]any, 0, len(t.indexes))
+		for _, index := range t.indexes {
+			indexes = append(indexes, map[string]any{
+				"IndexName":   index.IndexName,
+				"IndexArn":    t.arn() + "/index/" + index.IndexName,
+				"KeySchema":   index.KeySchema,
+				"Projection":  index.Projection,
+				"IndexStatus": "ACTIVE",
+			})
+		}
+		desc["GlobalSecondaryIndexes"] = indexes
+	}
+	if t.stream != nil && t.stream.StreamEnabled {
+		desc["StreamSpecification"] = t.stream
+		desc["LatestStreamArn"] = t.arn() + "/stream/" + t.created.UTC().Format("2006-01-02T15:04:05.000")
+	}
+	return desc
+}
+
+func (t *table) arn() string {
+	return "arn:aws:dynamodb:" + Region + ":000000000000:table/" + t.name
+}
+
+func (s *Server) table(name string) (*table, error) {
+	t, ok := s.tables[name]
+	if !ok {
+		return nil, notFound("Requested resource not found: Table: %s not found", name)
+	}
+	return t, nil
+}
+
+func (s *Server) createTable(req *request) (any, error) {
+	if _, ok := s.tables[req.TableName]; ok {
+		return nil, &apiError{code: "ResourceInUseException", message: "Table already exists: " + req.TableName}
+	}
+	t := &table{
+		name:       req.TableName,
+		keySchema:  req.KeySchema,
+		attributes: req.AttributeDefinitions,
+		stream:     req.StreamSpecification,
+		created:    time.Now(),
+		items:      make(map[string]item),
+		indexed:    make(map[string]time.Time),
+	}
+	if t.hash() == "" || t.attributeType(t.hash()) == "" || (t.rng() != "" && t.attributeType(t.rng()) == "") {
+		return nil, invalid("One or more parameter values were invalid: the key schema must be defined in AttributeDefinitions")
+	}
+	for _, index := range req.GlobalSecondaryIndexes {
+		if err := t.addIndex(index); err != nil {
+			return nil, err
+		}
+	}
+	s.tables[t.name] = t
+	return map[string]any{"TableDescription": t.description()}, nil
+}
+
+func (t *table) addIndex(index indexDefinition) error {
+	if _, err := t.index(index.IndexName); err == nil {
+		return invalid("One or more parameter values were invalid: Duplicate index name: %s", index.IndexName)
+	}
+	for _, k := range index.KeySchema {
+		if t.attributeType(k.AttributeName) == "" {
+			return invalid("One or more parameter values were invalid: Some index key attributes are not defined in AttributeDefinitions: %s", k.AttributeName)
+		}
+	}
+	t.indexes = append(t.indexes, index)
+	return nil
+}
+
+func (s *Server) describeTable(req *request) (any, error) {
+	t, err := s.table(req.TableName)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]any{"Table": t.description()}, nil
+}
+
+func (s *Server) updateTable(req *request) (any, error) {
+	t, err := s.table(req.TableName)
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range req.AttributeDefinitions {
+		if t.attributeType(a.AttributeName) == "" {
+			t.attributes = append(t.attributes, a)
+		}
+	}
+	for _, update := range req.GlobalSecondaryIndexUpdates {
+		switch {
+		case update.Create != nil:
+			if err := t.addIndex(*update.Create); err != nil {
+				return nil, err
+			}
+		case update.Delete != nil:
+			if _, err := t.index(update.Delete.IndexName); err != nil {
+				return nil, notFound("Requested resource not found: Index: %s not found", update.Delete.IndexName)
+			}
+			for i, index := range t.indexes {
+				if index.IndexName == update.Delete.IndexName {
+					t.indexes = append(t.indexes[:i], t.indexes[i+1:]...)
+					break
+				}
+			}
+		}
+	}
+	if req.StreamSpecification != nil {
+		t.stream = req.StreamSpecification
+	}
+	return map[string]any{"TableDescription": t.description()}, nil
+}
+
+func (s *Server) deleteTable(req *request) (any, error) {
+	t, err := s.table(req.TableName)
+	if err != nil {
+		return nil, err
+	}
+	delete(s.tables, t.name)
+	return map[string]any{"TableDescription": t.description()}, nil
+}
+
+func (s *Server) describeTimeToLive(req *request) (any, error) {
+	t, err := s.table(req.TableName)
+	if err != nil {
+		return nil, err
+	}
+	ttl := map[string]string{"TimeToLiveStatus": "DISABLED"}
+	if t.ttl != "" {
+		ttl = map[string]string{"TimeToLiveStatus": "ENABLED", "AttributeName": t.ttl}
+	}
+	return map[string]any{"TimeToLiveDescription": ttl}, nil
+}
+
+func (s *Server) updateTimeToLive(req *request) (any, error) {
+	t, err := s.table(req.TableName)
+	if err != nil {
+		return nil, err
+	}
+	spec := req.TimeToLiveSpecification
+	if spec == nil || spec.AttributeName == "" {
+		return nil, invalid("TimeToLiveSpecification with an AttributeName is required")
+	}
+	switch {
+	case spec.Enabled && t.ttl != "":
+		return nil, invalid("TimeToLive is already enabled")
+	case !spec.Enabled && t.ttl == "":
+		return nil, invalid("TimeToLive is already disabled")
+	case spec.Enabled:
+		t.ttl = spec.AttributeName
+	default:
+		t.ttl = ""
+	}
+	return map[string]any{"TimeToLiveSpecification": spec}, nil
+}
+
+// write is a validated put, update or delete of one item
+type write struct {
+	t   *table
+	key string
+	// apply returns the item after the write, or nil if it deletes the item
+	apply func(before item) (item, error)
+	cond  condition
+	// returnOld reports whether a failed condition returns the item as it was
+	returnOld bool
+	// indexedAt is when the write becomes visible to index reads; zero if it is visible at once
+	indexedAt time.Time
+}
+
+// check evaluates the write's condition against the item it writes
+func (w *write) check() bool {
+	if w.cond == nil {
+		return true
+	}
+	before := w.t.items[w.key]
+	if before == nil {
+		before = item{}
+	}
+	return w.cond(before)
+}
+
+// commit applies the write and returns the item as it was before
+func (w *write) commit() (item, error) {
+	before := w.t.items[w.key]
+	after, err := w.apply(before)
+	if err != nil {
+		return nil, err
+	}
+	if after == nil {
+		delete(w.t.items, w.key)
+		delete(w.t.indexed, w.key)
+	} else {
+		w.t.items[w.key] = after
+		if !w.indexedAt.IsZero() {
+			w.t.indexed[w.key] = w.indexedAt
+		}
+	}
+	return before, nil
+}
+
+// indexedAt returns when a write made now becomes visible to index reads, or the zero time if it is visible at once
+func (s *Server) indexedAt() time.Time {
+	if s.IndexDelay <= 0 {
+		return time.Time{}
+	}
+	half := s.IndexDelay / 2
+	return time.Now().Add(half + time.Duration(rand.Int63n(int64(s.IndexDelay-half)+1)))
+}
+
+// prepare validates a put, update, delete or condition check and parses its expressions
+func (s *Server) prepare(req *request, kind string) (*write, error) {
+	t, err := s.table(req.TableName)
+	if err != nil {
+		return nil, err
+	}
+	w := &write{t: t, returnOld: req.ReturnValuesOnConditionCheckFailure == "ALL_OLD", indexedAt: s.indexedAt()}
+	if req.ConditionExpression != "" {
+		if w.cond, err = parseCondition(req.ConditionExpression, req.ExpressionAttributeNames, req.ExpressionAttributeValues); err != nil {
+			return nil, err
+		}
+	}
+	switch kind {
+	case "Put":
+		if err := t.validateItem(req.Item); err != nil {
+			return nil, err
+		}
+		w.key = keyString(req.Item, t.hash(), t.rng())
+		put := req.Item.copy()
+		w.apply = func(item) (item, error) { return put, nil }
+		return w, nil
+	case "Update":
+		if w.key, err = t.validateKey(req.Key); err != nil {
+			return nil, err
+		}
+		var set update
+		if req.UpdateExpression != "" {
+			if set, err = parseUpdate(req.UpdateExpression, req.ExpressionAttributeNames, req.ExpressionAttributeValues); err != nil {
+				return nil, err
+			}
+		}
+		w.apply = func(before item) (item, error) {
+			after := req.Key.copy()
+			if before != nil {
+				after = before.copy()
+			}
+			if set != nil {
+				if err := set(after); err != nil {
+					return nil, err
+				}
+			}
+			for name, v := range req.Key {
+				if !equal(after[name], v) {
+					return nil, invalid("One or more parameter values were invalid: Cannot update attribute %s. This attribute is part of the key", name)
+				}
+			}
+			return after, t.validateItem(after)
+		}
+		return w, nil
+	case "Delete":
+		if w.key, err = t.validateKey(req.Key); err != nil {
+			return nil, err
+		}
+		w.apply = func(item) (item, error) { return nil, nil }
+		return w, nil
+	case "ConditionCheck":
+		if w.key, err = t.validateKey(req.Key); err != nil {
+			return nil, err
+		}
+		if w.cond == nil {
+			return nil, invalid("ConditionCheck requires a ConditionExpression")
+		}
+		//A condition check leaves the item as it is
+		w.indexedAt = time.Time{}
+		w.apply = func(before item) (item, error) { return before, nil }
+		return w, nil
+	}
+	return nil, invalid("unsupported write %s", kind)
+}
+
+// single performs one conditional write and returns the attributes selected by ReturnValues
+func (s *Server) single(req *request, kind string) (any, error) {
+	w, err := s.prepare(req, kind)
+	if err != nil {
+		return nil, err
+	}
+	if !w.check() {
+		return nil, errConditionFailed
+	}
+	before, err := w.commit()
+	if err != nil {
+		return nil, err
+	}
+	out := map[string]any{}
+	switch req.ReturnValues {
+	case "ALL_OLD":
+		if before != nil {
+			out["Attributes"] = before
+		}
+	case "ALL_NEW":
+		if after := w.t.items[w.key]; after != nil {
+			out["Attributes"] = after
+		}
+	}
+	return out, nil
+}
+
+func (s *Server) putItem(req *request) (any, error) {
+	return s.single(req, "Put")
+}
+
+func (s *Server) updateItem(req *request) (any, error) {
+	return s.single(req, "Update")
+}
+
+func (s *Server) deleteItem(req *request) (any, error) {
+	return s.single(req, "Delete")
+}
+
+func (s *Server) getItem(req *request) (any, error) {
+	t, err := s.table(req.TableName)
+	if err != nil {
+		return nil, err
+	}
+	key, err := t.validateKey(req.Key)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	if req.ProjectionExpression != "" {
+		if names, err = parseProjection(req.ProjectionExpression, req.ExpressionAttributeNames); err != nil {
+			return nil, err
+		}
+	}
+	it, ok := t.items[key]
+	if !ok {
+		return map[string]any{}, nil
+	}
+	return map[string]any{"Item": project(it, names)}, nil
+}
+
+// project returns the attributes of it named by names, or every attribute if names is empty
+func project(it item, names []string) item {
+	if len(names) == 0 {
+		return it
+	}
+	return it.key(names...)
+}
+
+func (s *Server) transactWriteItems(req *request) (any, error) {
+	if len(req.TransactItems) == 0 || len(req.TransactItems) > maxTransactionItems {
+		return nil, invalid("1 validation error detected: Value at 'transactItems' failed to satisfy constraint: Member must have length less than or equal to %d", maxTransactionItems)
+	}
+	writes := make([]*write, 0, len(req.TransactItems))
+	seen := make(map[string]bool)
+	for _, action := range req.TransactItems {
+		var w *write
+		var err error
+		switch {
+		case action.Put != nil:
+			w, err = s.prepare(action.Put, "Put")
+		case action.Update != nil:
+			w, err = s.prepare(action.Update, "Update")
+		case action.Delete != nil:
+			w, err = s.prepare(action.Delete, "Delete")
+		case action.ConditionCheck != nil:
+			w, err = s.prepare(action.ConditionCheck, "ConditionCheck")
+		default:
+			err = invalid("TransactItems can only contain one of ConditionCheck, Put, Update or Delete")
+		}
+		if err != nil {
+			return nil, err
+		}
+		if seen[w.t.name+w.key] {
+			return nil, invalid("Transaction request cannot include multiple operations on one item")
+		}
+		seen[w.t.name+w.key] = true
+		writes = append(writes, w)
+	}
+	reasons := make([]reason, len(writes))
+	codes := make([]string, len(writes))
+	failed := false
+	for i, w := range writes {
+		reasons[i].Code = "None"
+		if !w.check() {
+			reasons[i].Code = "ConditionalCheckFailed"
+			if w.returnOld {
+				reasons[i].Item = w.t.items[w.key]
+			}
+			failed = true
+		}
+		codes[i] = reasons[i].Code
+	}
+	if failed {
+		return nil, &apiError{
+			code:    "TransactionCanceledException",
+			message: "Transaction cancelled, please refer cancellation reasons for specific reasons [" + strings.Join(codes, ", ") + "]",
+			reasons: reasons,
+		}
+	}
+	//Compute every write before applying any so a validation error leaves the tables untouched
+	afters := make([]item, len(writes))
+	for i, w := range writes {
+		after, err := w.apply(w.t.items[w.key])
+		if err != nil {
+			return nil, err
+		}
+		afters[i] = after
+	}
+	for i, w := range writes {
+		after := afters[i]
+		w.apply = func(item) (item, error) { return after, nil }
+		if _, err := w.commit(); err != nil {
+			return nil, err
+		}
+	}
+	return map[string]any{}, nil
+}
+
+func (s *Server) batchWriteItem(req *request) (any, error) {
+	var writes []*write
+	for name, requests := range req.RequestItems {
+		for _, r := range requests {
+			var w *write
+			var err error
+			switch {
+			case r.PutRequest != nil:
+				w, err = s.prepare(&request{TableName: name, Item: r.PutRequest.Item}, "Put")
+			case r.DeleteRequest != nil:
+				w, err = s.prepare(&request{TableName: name, Key: r.DeleteRequest.Key}, "Delete")
+			default:
+				err = invalid("A WriteRequest must contain a PutRequest or a DeleteRequest")
+			}
+			if err != nil {
+				return nil, err
+			}
+			writes = append(writes, w)
+		}
+	}
+	if len(writes) == 0 || len(writes) > maxBatchWriteItems {
+		return nil, invalid("1 validation error detected: Value at 'requestItems' failed to satisfy constraint: Member must have length less than or equal to %d", maxBatchWriteItems)
+	}
+	for _, w := range writes {
+		if _, err := w.commit(); err != nil {
+			return nil, err
+		}
+	}
+	return map[string]any{"UnprocessedItems": map[string]any{}}, nil
+}
+
+// read is a parsed Query or Scan
+type read struct {
+	t *table
+	// index reports whether the read is of an index, which may not show the latest writes yet
+	index bool
+	// hash and rng are the key attributes of the table or index read
+	hash, rng string
+	// order sorts the items read, ending with the table's key so the order is total
+	order      []string
+	filter     condition
+	projection []string
+	// keys are the attributes of LastEvaluatedKey
+	keys []string
+	// include selects the attributes an index projects; nil for the table or an index projecting every attribute
+	include []string
+}
+
+func (s *Server) newRead(req *request) (*read, error) {
+	t, err := s.table(req.TableName)
+	if err != nil {
+		return nil, err
+	}
+	r := &read{t: t, hash: t.hash(), rng: t.rng()}
+	if req.IndexName != "" {
+		index, err := t.index(req.IndexName)
+		if err != nil {
+			return nil, err
+		}
+		r.index = true
+		r.hash, r.rng = keyNames(index.KeySchema)
+		switch index.Projection.ProjectionType {
+		case "KEYS_ONLY":
+			r.include = []string{t.hash(), t.rng(), r.hash, r.rng}
+		case "INCLUDE":
+			r.include = append([]string{t.hash(), t.rng(), r.hash, r.rng}, index.Projection.NonKeyAttributes...)
+		}
+	}
+	r.order = []string{r.hash, r.rng, t.hash(), t.rng()}
+	r.keys = []string{t.hash(), t.rng(), r.hash, r.rng}
+	if req.FilterExpression != "" {
+		if r.filter, err = parseCondition(req.FilterExpression, req.ExpressionAttributeNames, req.ExpressionAttributeValues); err != nil {
+			return nil, err
+		}
+	}
+	if req.ProjectionExpression != "" {
+		if r.projection, err = parseProjection(req.ProjectionExpression, req.ExpressionAttributeNames); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// items returns the items of the table or index, which only holds the items with its key attributes, in order
+// An index leaves out the items whose last write is not visible to it yet
+func (r *read) items() []item {
+	var items []item
+	now := time.Now()
+	for key, it := range r.t.items {
+		if r.index && now.Before(r.t.indexed[key]) {
+			continue
+		}
+		if it.has(r.hash, r.rng) {
+			items = append(items, it)
+		}
+	}
+	sortItems(items, r.order...)
+	return items
+}
+
+// page evaluates the items following ExclusiveStartKey up to Limit and returns the output of a Query or Scan
+func (s *Server) page(r *read, req *request, items []item, forward bool) (any, error) {
+	direction := 1
+	if !forward {
+		direction = -1
+		for i, j := 0, len(items)-1; i < j; i, j = i+1, j-1 {
+			items[i], items[j] = items[j], items[i]
+		}
+	}
+	if req.ExclusiveStartKey != nil {
+		if !req.ExclusiveStartKey.has(r.keys...) {
+			return nil, invalid("The provided starting key is invalid: The provided key element does not match the schema")
+		}
+		start := sort.Search(len(items), func(i int) bool {
+			return direction*compareItems(items[i], req.ExclusiveStartKey, r.order...) > 0
+		})
+		items = items[start:]
+	}
+	limit := req.Limit
+	if s.PageSize > 0 && (limit == 0 || s.PageSize < limit) {
+		limit = s.PageSize
+	}
+	out := map[string]any{}
+	if limit > 0 && len(items) >= limit {
+		//DynamoDB returns a LastEvaluatedKey whenever it stops at the limit, even if no items are left
+		out["LastEvaluatedKey"] = items[limit-1].key(r.keys...)
+		items = items[:limit]
+	}
+	results := make([]item, 0, len(items))
+	for _, it := range items {
+		if r.filter != nil && !r.filter(it) {
+			continue
+		}
+		if r.include != nil {
+			it = it.key(r.include...)
+		}
+		results = append(results, project(it, r.projection))
+	}
+	out["Count"] = len(results)
+	out["ScannedCount"] = len(items)
+	if req.Select != "COUNT" {
+		out["Items"] = results
+	}
+	return out, nil
+}
+
+func (s *Server) query(req *request) (any, error) {
+	r, err := s.newRead(req)
+	if err != nil {
+		return nil, err
+	}
+	if req.KeyConditionExpression == "" {
+		return nil, invalid("Either the KeyConditions or KeyConditionExpression parameter must be specified in the request")
+	}
+	keyCondition, err := parseCondition(req.KeyConditionExpression, req.ExpressionAttributeNames, req.ExpressionAttributeValues)
+	if err != nil {
+		return nil, err
+	}
+	var items []item
+	for _, it := range r.items() {
+		if keyCondition(it) {
+			items = append(items, it)
+		}
+	}
+	return s.page(r, req, items, req.ScanIndexForward == nil || *req.ScanIndexForward)
+}
+
+func (s *Server) scan(req *request) (any, error) {
+	r, err := s.newRead(req)
+	if err != nil {
+		return nil, err
+	}
+	return s.page(r, req, r.items(), true)
+}
@@ -0,0 +1,244 @@
+package dynamotest_test
+
+import (
+	"context"
+	"errors"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/cpustejovsky/event-store/store/dynamotest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"strconv"
+	"testing"
+	"time"
+)
+
+var ctx = context.Background()
+
+// newTable starts a server with a table keyed by Id and Version and an index keyed by Log and Position
+func newTable(t *testing.T) (*dynamotest.Server, *dynamodb.Client) {
+	srv := dynamotest.NewServer()
+	t.Cleanup(srv.Close)
+	client := srv.Client()
+	_, err := client.CreateTable(ctx, &dynamodb.CreateTableInput{
+		TableName:   aws.String("events"),
+		BillingMode: types.BillingModePayPerRequest,
+		AttributeDefinitions: []types.AttributeDefinition{
+			{AttributeName: aws.String("Id"), AttributeType: types.ScalarAttributeTypeS},
+			{AttributeName: aws.String("Version"), AttributeType: types.ScalarAttributeTypeN},
+			{AttributeName: aws.String("Log"), AttributeType: types.ScalarAttributeTypeS},
+			{AttributeName: aws.String("Position"), AttributeType: types.ScalarAttributeTypeN},
+		},
+		KeySchema: []types.KeySchemaElement{
+			{AttributeName: aws.String("Id"), KeyType: types.KeyTypeHash},
+			{AttributeName: aws.String("Version"), KeyType: types.KeyTypeRange},
+		},
+		GlobalSecondaryIndexes: []types.GlobalSecondaryIndex{{
+			IndexName: aws.String("PositionIndex"),
+			KeySchema: []types.KeySchemaElement{
+				{AttributeName: aws.String("Log"), KeyType: types.KeyTypeHash},
+				{AttributeName: aws.String("Position"), KeyType: types.KeyTypeRange},
+			},
+			Projection: &types.Projection{ProjectionType: types.ProjectionTypeAll},
+		}},
+	})
+	require.Nil(t, err)
+	return srv, client
+}
+
+func event(id string, version, position int) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"Id":       &types.AttributeValueMemberS{Value: id},
+		"Version":  &types.AttributeValueMemberN{Value: strconv.Itoa(version)},
+		"Log":      &types.AttributeValueMemberS{Value: "ALL"},
+		"Position": &types.AttributeValueMemberN{Value: strconv.Itoa(position)},
+		"Event":    &types.AttributeValueMemberB{Value: []byte{byte(version)}},
+	}
+}
+
+func versions(t *testing.T, items []map[string]types.AttributeValue) []string {
+	t.Helper()
+	var versions []string
+	for _, item := range items {
+		v, ok := item["Version"].(*types.AttributeValueMemberN)
+		require.True(t, ok)
+		versions = append(versions, v.Value)
+	}
+	return versions
+}
+
+func TestPutItem_Condition(t *testing.T) {
+	_, client := newTable(t)
+	put := &dynamodb.PutItemInput{
+		TableName:           aws.String("events"),
+		Item:                event("a", 0, 0),
+		ConditionExpression: aws.String("attribute_not_exists(Version)"),
+	}
+	_, err := client.PutItem(ctx, put)
+	require.Nil(t, err)
+	_, err = client.PutItem(ctx, put)
+	checkErr := &types.ConditionalCheckFailedException{}
+	assert.True(t, errors.As(err, &checkErr), "expected ConditionalCheckFailedException, got %v", err)
+
+	out, err := client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:                aws.String("events"),
+		Key:                      map[string]types.AttributeValue{"Id": event("a", 0, 0)["Id"], "Version": event("a", 0, 0)["Version"]},
+		ProjectionExpression:     aws.String("#event"),
+		ExpressionAttributeNames: map[string]string{"#event": "Event"},
+	})
+	require.Nil(t, err)
+	assert.Equal(t, map[string]types.AttributeValue{"Event": &types.AttributeValueMemberB{Value: []byte{0}}}, out.Item)
+
+	_, err = client.PutItem(ctx, &dynamodb.PutItemInput{TableName: aws.String("events"), Item: map[string]types.AttributeValue{"Id": event("a", 0, 0)["Id"]}})
+	assert.NotNil(t, err)
+}
+
+func TestQuery_Pagination(t *testing.T) {
+	srv, client := newTable(t)
+	srv.PageSize = 2
+	for version := 0; version < 5; version++ {
+		_, err := client.PutItem(ctx, &dynamodb.PutItemInput{TableName: aws.String("events"), Item: event("a", version, 10-version)})
+		require.Nil(t, err)
+	}
+	_, err := client.PutItem(ctx, &dynamodb.PutItemInput{TableName: aws.String("events"), Item: event("b", 0, 20)})
+	require.Nil(t, err)
+
+	query := func(input *dynamodb.QueryInput) []string {
+		var items []map[string]types.AttributeValue
+		pages := 0
+		p := dynamodb.NewQueryPaginator(client, input)
+		for p.HasMorePages() {
+			out, err := p.NextPage(ctx)
+			require.Nil(t, err)
+			items = append(items, out.Items...)
+			pages++
+		}
+		assert.Greater(t, pages, 1)
+		return versions(t, items)
+	}
+	assert.Equal(t, []string{"1", "2", "3", "4"}, query(&dynamodb.QueryInput{
+		TableName:              aws.String("events"),
+		KeyConditionExpression: aws.String("Id = :id AND Version >= :from"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":id":   &types.AttributeValueMemberS{Value: "a"},
+			":from": &types.AttributeValueMemberN{Value: "1"},
+		},
+	}))
+	assert.Equal(t, []string{"4", "2", "0"}, query(&dynamodb.QueryInput{
+		TableName:              aws.String("events"),
+		KeyConditionExpression: aws.String("Id = :id"),
+		FilterExpression:       aws.String("NOT Version IN (:one, :three)"),
+		ScanIndexForward:       aws.Bool(false),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":id":    &types.AttributeValueMemberS{Value: "a"},
+			":one":   &types.AttributeValueMemberN{Value: "1"},
+			":three": &types.AttributeValueMemberN{Value: "3"},
+		},
+	}))
+	//The index orders items by Position rather than by the table's key
+	assert.Equal(t, []string{"4", "3", "2", "1", "0", "0"}, query(&dynamodb.QueryInput{
+		TableName:              aws.String("events"),
+		IndexName:              aws.String("PositionIndex"),
+		KeyConditionExpression: aws.String("#log = :log AND #position BETWEEN :low AND :high"),
+		ExpressionAttributeNames: map[string]string{
+			"#log":      "Log",
+			"#position": "Position",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":log":  &types.AttributeValueMemberS{Value: "ALL"},
+			":low":  &types.AttributeValueMemberN{Value: "6"},
+			":high": &types.AttributeValueMemberN{Value: "20"},
+		},
+	}))
+
+	out, err := client.Query(ctx, &dynamodb.QueryInput{
+		TableName:              aws.String("events"),
+		KeyConditionExpression: aws.String("Id = :id"),
+		ScanIndexForward:       aws.Bool(false),
+		Limit:                  aws.Int32(1),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":id": &types.AttributeValueMemberS{Value: "a"},
+		},
+	})
+	require.Nil(t, err)
+	assert.Equal(t, []string{"4"}, versions(t, out.Items))
+	assert.NotNil(t, out.LastEvaluatedKey)
+}
+
+func TestQuery_IndexDelay(t *testing.T) {
+	srv, client := newTable(t)
+	srv.IndexDelay = 200 * time.Millisecond
+	_, err := client.PutItem(ctx, &dynamodb.PutItemInput{TableName: aws.String("events"), Item: event("a", 0, 0)})
+	require.Nil(t, err)
+	query := func(index string) []string {
+		input := &dynamodb.QueryInput{
+			TableName:              aws.String("events"),
+			KeyConditionExpression: aws.String("Id = :id"),
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":id": &types.AttributeValueMemberS{Value: "a"},
+			},
+		}
+		if index != "" {
+			input.IndexName = aws.String(index)
+			input.KeyConditionExpression = aws.String("#log = :log")
+			input.ExpressionAttributeNames = map[string]string{"#log": "Log"}
+			input.ExpressionAttributeValues = map[string]types.AttributeValue{":log": &types.AttributeValueMemberS{Value: "ALL"}}
+		}
+		out, err := client.Query(ctx, input)
+		require.Nil(t, err)
+		return versions(t, out.Items)
+	}
+	//The table shows the write at once while the index only shows it after the delay
+	assert.Equal(t, []string{"0"}, query(""))
+	assert.Empty(t, query("PositionIndex"))
+	time.Sleep(srv.IndexDelay)
+	assert.Equal(t, []string{"0"}, query("PositionIndex"))
+}
+
+func TestTransactWriteItems(t *testing.T) {
+	_, client := newTable(t)
+	counter := map[string]types.AttributeValue{
+		"Id":      &types.AttributeValueMemberS{Value: "POSITION"},
+		"Version": &types.AttributeValueMemberN{Value: "0"},
+	}
+	transact := func(id string) error {
+		_, err := client.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{TransactItems: []types.TransactWriteItem{{
+			Put: &types.Put{
+				TableName:           aws.String("events"),
+				Item:                event(id, 0, 0),
+				ConditionExpression: aws.String("attribute_not_exists(Version)"),
+
+				ReturnValuesOnConditionCheckFailure: types.ReturnValuesOnConditionCheckFailureAllOld,
+			},
+		}, {
+			Update: &types.Update{
+				TableName:                aws.String("events"),
+				Key:                      counter,
+				UpdateExpression:         aws.String("SET #position = if_not_exists(#position, :zero) + :one"),
+				ExpressionAttributeNames: map[string]string{"#position": "Position"},
+				ExpressionAttributeValues: map[string]types.AttributeValue{
+					":zero": &types.AttributeValueMemberN{Value: "0"},
+					":one":  &types.AttributeValueMemberN{Value: "1"},
+				},
+			},
+		}}})
+		return err
+	}
+	require.Nil(t, transact("a"))
+	require.Nil(t, transact("b"))
+
+	err := transact("a")
+	checkErr := &types.TransactionCanceledException{}
+	require.True(t, errors.As(err, &checkErr), "expected TransactionCanceledException, got %v", err)
+	require.Len(t, checkErr.CancellationReasons, 2)
+	assert.Equal(t, "ConditionalCheckFailed", aws.ToString(checkErr.CancellationReasons[0].Code))
+	assert.Equal(t, event("a", 0, 0), checkErr.CancellationReasons[0].Item)
+	assert.Equal(t, "None", aws.ToString(checkErr.CancellationReasons[1].Code))
+	assert.Nil(t, checkErr.CancellationReasons[1].Item)
+
+	//The canceled transaction did not advance the counter
+	out, err := client.GetItem(ctx, &dynamodb.GetItemInput{TableName: aws.String("events"), Key: counter})
+	require.Nil(t, err)
+	assert.Equal(t, &types.AttributeValueMemberN{Value: "2"}, out.Item["Position"])
+}
@@ -0,0 +1,146 @@
+package dynamotest
+
+import (
+	"bytes"
+	"encoding/json"
+	"math/big"
+	"reflect"
+	"sort"
+)
+
+// attribute is an AttributeValue in the JSON form of the DynamoDB API, such as {"S": "abc"} or {"N": "1"}
+// Values are kept as the client sent them, so they are returned exactly as written
+type attribute map[string]json.RawMessage
+
+// item is a DynamoDB item or key
+type item map[string]attribute
+
+// kind returns the type of the attribute, such as S, N or B
+func (a attribute) kind() string {
+	for k := range a {
+		return k
+	}
+	return ""
+}
+
+// scalar decodes the value of an S, N or B attribute; B values are decoded from base64
+func (a attribute) scalar() (string, bool) {
+	switch a.kind() {
+	case "S", "N":
+		var s string
+		if json.Unmarshal(a[a.kind()], &s) != nil {
+			return "", false
+		}
+		return s, true
+	case "B":
+		var b []byte
+		if json.Unmarshal(a["B"], &b) != nil {
+			return "", false
+		}
+		return string(b), true
+	}
+	return "", false
+}
+
+// compare orders two S, N or B attributes of the same type; ok is false for any other pair
+func compare(a, b attribute) (c int, ok bool) {
+	kind := a.kind()
+	if kind != b.kind() {
+		return 0, false
+	}
+	x, okA := a.scalar()
+	y, okB := b.scalar()
+	if !okA || !okB {
+		return 0, false
+	}
+	if kind == "N" {
+		m, okM := new(big.Float).SetString(x)
+		n, okN := new(big.Float).SetString(y)
+		if !okM || !okN {
+			return 0, false
+		}
+		return m.Cmp(n), true
+	}
+	return bytes.Compare([]byte(x), []byte(y)), true
+}
+
+// equal reports whether two attributes hold the same value
+func equal(a, b attribute) bool {
+	if c, ok := compare(a, b); ok {
+		return c == 0
+	}
+	if a.kind() != b.kind() {
+		return false
+	}
+	var x, y any
+	if json.Unmarshal(a[a.kind()], &x) != nil || json.Unmarshal(b[b.kind()], &y) != nil {
+		return false
+	}
+	return reflect.DeepEqual(x, y)
+}
+
+// key returns the attributes of it named by names, skipping empty names
+func (it item) key(names ...string) item {
+	key := make(item, len(names))
+	for _, name := range names {
+		if name == "" {
+			continue
+		}
+		if v, ok := it[name]; ok {
+			key[name] = v
+		}
+	}
+	return key
+}
+
+// has reports whether it has every attribute named by names, skipping empty names
+func (it item) has(names ...string) bool {
+	for _, name := range names {
+		if _, ok := it[name]; name != "" && !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// copy returns a copy of it that shares no maps with it
+func (it item) copy() item {
+	c := make(item, len(it))
+	for k, v := range it {
+		c[k] = v
+	}
+	return c
+}
+
+// keyString returns a string identifying the item with key in a table whose key attributes are names
+func keyString(key item, names ...string) string {
+	var b bytes.Buffer
+	for _, name := range names {
+		if name == "" {
+			continue
+		}
+		v, _ := key[name].scalar()
+		json.NewEncoder(&b).Encode(v)
+	}
+	return b.String()
+}
+
+// sortItems orders items by the attributes named by order, comparing each in turn
+func sortItems(items []item, order ...string) {
+	sort.SliceStable(items, func(i, j int) bool {
+		return compareItems(items[i], items[j], order...) < 0
+	})
+}
+
+// compareItems compares two items by the attributes named by order, comparing each in turn
+func compareItems(a, b item, order ...string) int {
+	for _, name := range order {
+		if name == "" {
+			continue
+		}
+		if c, _ := compare(a[name], b[name]); c != 0 {
+			return c
+		}
+	}
+	return 0
+}
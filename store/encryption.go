@@ -0,0 +1,435 @@
+package store
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/cpustejovsky/event-store/events"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"strings"
+	"sync"
+)
+
+// KeyValue is appended to a subject to form the Id of its key item in DynamoDB
+const KeyValue string = "KEY"
+
+// KeySize is the size of the AES-256 keys generated for subjects
+const KeySize int = 32
+
+// encryptedPrefix starts the value of a field encrypted by WithEncryption; the rest is the base64 of the nonce and ciphertext
+const encryptedPrefix string = "encrypted:"
+
+// KeyStore keeps the encryption key of every subject whose personal data is encrypted in events
+// Deleting a key crypto-shreds the subject: the events stay in the log but its personal data can no longer be read
+type KeyStore interface {
+	// CreateKey returns the key of subject, generating and storing one on first use
+	// It returns a KeyDeletedError once the key of subject was deleted
+	CreateKey(ctx context.Context, subject string) ([]byte, error)
+	// Key returns the key of subject or a KeyNotFoundError if it has none or it was deleted
+	Key(ctx context.Context, subject string) ([]byte, error)
+	DeleteKey(ctx context.Context, subject string) error
+}
+
+// KeyNotFoundError is returned by KeyStore.Key for a subject without a key
+type KeyNotFoundError struct {
+	Subject string
+}
+
+func (e *KeyNotFoundError) Error() string {
+	return fmt.Sprintf("no key for subject %s", e.Subject)
+}
+
+// KeyDeletedError is returned when personal data of a subject whose key was deleted is written
+type KeyDeletedError struct {
+	Subject string
+}
+
+func (e *KeyDeletedError) Error() string {
+	return fmt.Sprintf("key of subject %s was deleted", e.Subject)
+}
+
+// PersonalDataFieldError is returned when a field of PersonalData is not a string field of the payload's message
+type PersonalDataFieldError struct {
+	EventName string
+	Field     string
+}
+
+func (e *PersonalDataFieldError) Error() string {
+	return fmt.Sprintf("%s has no string field %s to encrypt", e.EventName, e.Field)
+}
+
+// PersonalData designates the string fields of the events with EventName that hold personal data
+type PersonalData struct {
+	EventName string
+	// Event is a message of the type of the event payloads
+	Event proto.Message
+	// Snapshot is a message of the type of the snapshot payloads, needed when the aggregate state is another message than Event
+	Snapshot proto.Message
+	// Fields are the names of the string fields that are encrypted, such as CharacterName
+	Fields []string
+	// Subject returns the subject whose key encrypts the events of the stream with id; the stream id is used without it
+	Subject func(id string) string
+}
+
+// WithEncryption encrypts the fields of data with AES-GCM, using a key per subject from keys
+// Appends and snapshots store the fields encrypted and reads return them decrypted
+// The fields of a subject whose key was deleted are read as empty strings
+func WithEncryption(keys KeyStore, data ...PersonalData) Option {
+	return func(o *options) {
+		o.keys = keys
+		o.personalData = make(map[string]PersonalData, len(data))
+		for _, d := range data {
+			o.personalData[d.EventName] = d
+		}
+	}
+}
+
+// keyring caches the keys of subjects during one read or write
+type keyring struct {
+	keys KeyStore
+	// create is set when writing, so subjects without a key get one
+	create bool
+	cache  map[string]cipher.AEAD
+}
+
+func (o *options) keyring(create bool) *keyring {
+	return &keyring{keys: o.keys, create: create, cache: make(map[string]cipher.AEAD)}
+}
+
+// aead returns the cipher of subject, or nil if its key was deleted and shredded is true
+func (k *keyring) aead(ctx context.Context, subject string, shredded bool) (cipher.AEAD, error) {
+	if aead, ok := k.cache[subject]; ok {
+		return aead, nil
+	}
+	var key []byte
+	var err error
+	if k.create {
+		key, err = k.keys.CreateKey(ctx, subject)
+	} else {
+		key, err = k.keys.Key(ctx, subject)
+	}
+	notFound := &KeyNotFoundError{}
+	deleted := &KeyDeletedError{}
+	if shredded && (errors.As(err, &notFound) || errors.As(err, &deleted)) {
+		k.cache[subject] = nil
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	k.cache[subject] = aead
+	return aead, nil
+}
+
+// encrypt returns copies of envelopes whose personal data is encrypted, leaving envelopes unchanged
+func (o *options) encrypt(ctx context.Context, envelopes []events.Envelope) ([]events.Envelope, error) {
+	if o.keys == nil {
+		return envelopes, nil
+	}
+	k := o.keyring(true)
+	encrypted := make([]events.Envelope, len(envelopes))
+	for i, e := range envelopes {
+		payload, err := k.encrypt(ctx, o.personalData, e.Id, e.EventName, e.Event, false)
+		if err != nil {
+			return nil, err
+		}
+		e.Event = payload
+		encrypted[i] = e
+	}
+	return encrypted, nil
+}
+
+// encryptSnapshot returns the payload of snapshot with its personal data encrypted
+// The personal data of a subject whose key was deleted is dropped, since it could only come from events that can no longer be read
+func (o *options) encryptSnapshot(ctx context.Context, snapshot *events.Snapshot) ([]byte, error) {
+	if o.keys == nil {
+		return snapshot.Event, nil
+	}
+	return o.keyring(true).encrypt(ctx, o.personalData, snapshot.Id, snapshot.EventName, snapshot.Event, true)
+}
+
+// decrypt decrypts the personal data of envelopes in place
+func (o *options) decrypt(ctx context.Context, envelopes []events.Envelope) error {
+	if o.keys == nil {
+		return nil
+	}
+	k := o.keyring(false)
+	for i := range envelopes {
+		e := &envelopes[i]
+		payload, err := k.decrypt(ctx, o.personalData, e.Id, e.EventName, e.Event, false)
+		if err != nil {
+			return err
+		}
+		e.Event = payload
+	}
+	return nil
+}
+
+// decryptSnapshot returns a copy of snapshot with its personal data decrypted
+func (o *options) decryptSnapshot(ctx context.Context, snapshot *events.Snapshot) (*events.Snapshot, error) {
+	if o.keys == nil {
+		return snapshot, nil
+	}
+	payload, err := o.keyring(false).decrypt(ctx, o.personalData, snapshot.Id, snapshot.EventName, snapshot.Event, true)
+	if err != nil {
+		return nil, err
+	}
+	s := *snapshot
+	s.Event = payload
+	return &s, nil
+}
+
+func (k *keyring) encrypt(ctx context.Context, data map[string]PersonalData, id, eventName string, payload []byte, snapshot bool) ([]byte, error) {
+	d, ok := data[eventName]
+	if !ok {
+		return payload, nil
+	}
+	subject := d.subject(id)
+	return d.transform(payload, snapshot, func(value string) (string, error) {
+		aead, err := k.aead(ctx, subject, snapshot)
+		if err != nil || aead == nil {
+			return "", err
+		}
+		sealed := make([]byte, aead.NonceSize(), aead.NonceSize()+len(value)+aead.Overhead())
+		if _, err := rand.Read(sealed); err != nil {
+			return "", err
+		}
+		sealed = aead.Seal(sealed, sealed, []byte(value), []byte(subject))
+		return encryptedPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+	})
+}
+
+func (k *keyring) decrypt(ctx context.Context, data map[string]PersonalData, id, eventName string, payload []byte, snapshot bool) ([]byte, error) {
+	d, ok := data[eventName]
+	if !ok {
+		return payload, nil
+	}
+	subject := d.subject(id)
+	return d.transform(payload, snapshot, func(value string) (string, error) {
+		//Values written before encryption was enabled are read as they are
+		if !strings.HasPrefix(value, encryptedPrefix) {
+			return value, nil
+		}
+		aead, err := k.aead(ctx, subject, true)
+		if err != nil || aead == nil {
+			return "", err
+		}
+		sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, encryptedPrefix))
+		if err != nil {
+			return "", err
+		}
+		if len(sealed) < aead.NonceSize() {
+			return "", errors.New("encrypted value is shorter than its nonce")
+		}
+		plain, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(subject))
+		if err != nil {
+			return "", err
+		}
+		return string(plain), nil
+	})
+}
+
+func (d PersonalData) subject(id string) string {
+	if d.Subject == nil {
+		return id
+	}
+	return d.Subject(id)
+}
+
+// transform replaces every non-empty designated field of payload with the result of fn
+// A payload without such fields is returned as it is
+func (d PersonalData) transform(payload []byte, snapshot bool, fn func(string) (string, error)) ([]byte, error) {
+	message := d.Event
+	if snapshot && d.Snapshot != nil {
+		message = d.Snapshot
+	}
+	m := message.ProtoReflect().New()
+	if err := proto.Unmarshal(payload, m.Interface()); err != nil {
+		return nil, err
+	}
+	changed := false
+	for _, name := range d.Fields {
+		field := m.Descriptor().Fields().ByName(protoreflect.Name(name))
+		if field == nil || field.Kind() != protoreflect.StringKind || field.IsList() {
+			return nil, &PersonalDataFieldError{EventName: d.EventName, Field: name}
+		}
+		value := m.Get(field).String()
+		if value == "" {
+			continue
+		}
+		transformed, err := fn(value)
+		if err != nil {
+			return nil, err
+		}
+		m.Set(field, protoreflect.ValueOfString(transformed))
+		changed = true
+	}
+	if !changed {
+		return payload, nil
+	}
+	return proto.Marshal(m.Interface())
+}
+
+// newKey returns a random AES-256 key
+func newKey() ([]byte, error) {
+	key := make([]byte, KeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// InMemoryKeyStore keeps keys in memory; they do not survive a restart of the process
+type InMemoryKeyStore struct {
+	mu      sync.Mutex
+	keys    map[string][]byte
+	deleted map[string]bool
+}
+
+func InMemoryKeys() *InMemoryKeyStore {
+	return &InMemoryKeyStore{keys: make(map[string][]byte), deleted: make(map[string]bool)}
+}
+
+func (m *InMemoryKeyStore) CreateKey(ctx context.Context, subject string) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.deleted[subject] {
+		return nil, &KeyDeletedError{Subject: subject}
+	}
+	if key, ok := m.keys[subject]; ok {
+		return key, nil
+	}
+	key, err := newKey()
+	if err != nil {
+		return nil, err
+	}
+	m.keys[subject] = key
+	return key, nil
+}
+
+func (m *InMemoryKeyStore) Key(ctx context.Context, subject string) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key, ok := m.keys[subject]
+	if !ok {
+		return nil, &KeyNotFoundError{Subject: subject}
+	}
+	return key, nil
+}
+
+func (m *InMemoryKeyStore) DeleteKey(ctx context.Context, subject string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.keys, subject)
+	m.deleted[subject] = true
+	return nil
+}
+
+// DynamoDBKeyStore keeps keys as items of a table with the event store's key schema, under the subject with KeyValue appended
+// A deleted key leaves an item without the key, so the subject cannot get a new one
+// Keep the keys in another table than the events, so backups of the events do not hold the keys that read them
+type DynamoDBKeyStore struct {
+	DB    *dynamodb.Client
+	Table string
+}
+
+func DynamoDBKeys(db *dynamodb.Client, table string) *DynamoDBKeyStore {
+	return &DynamoDBKeyStore{DB: db, Table: table}
+}
+
+func (d *DynamoDBKeyStore) CreateKey(ctx context.Context, subject string) ([]byte, error) {
+	key, err := d.Key(ctx, subject)
+	notFound := &KeyNotFoundError{}
+	if !errors.As(err, &notFound) {
+		return key, err
+	}
+	key, err = newKey()
+	if err != nil {
+		return nil, err
+	}
+	item := d.key(subject)
+	item["Key"] = &types.AttributeValueMemberB{Value: key}
+	_, err = d.DB.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:           aws.String(d.Table),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(Version)"),
+	})
+	checkErr := &types.ConditionalCheckFailedException{}
+	if errors.As(err, &checkErr) {
+		//Another writer created the key first, or the key was deleted
+		return d.storedKey(ctx, subject)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func (d *DynamoDBKeyStore) Key(ctx context.Context, subject string) ([]byte, error) {
+	key, err := d.storedKey(ctx, subject)
+	deleted := &KeyDeletedError{}
+	if errors.As(err, &deleted) {
+		return nil, &KeyNotFoundError{Subject: subject}
+	}
+	return key, err
+}
+
+// storedKey returns the key of subject, a KeyNotFoundError if it has none or a KeyDeletedError if it was deleted
+func (d *DynamoDBKeyStore) storedKey(ctx context.Context, subject string) ([]byte, error) {
+	out, err := d.DB.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(d.Table),
+		Key:            d.key(subject),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if out.Item == nil {
+		return nil, &KeyNotFoundError{Subject: subject}
+	}
+	key, ok := out.Item["Key"].(*types.AttributeValueMemberB)
+	if !ok {
+		return nil, &KeyDeletedError{Subject: subject}
+	}
+	return key.Value, nil
+}
+
+func (d *DynamoDBKeyStore) DeleteKey(ctx context.Context, subject string) error {
+	_, err := d.DB.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(d.Table),
+		Item:      d.key(subject),
+	})
+	return err
+}
+
+func (d *DynamoDBKeyStore) key(subject string) AttributeValueMap {
+	return AttributeValueMap{
+		"Id":      &types.AttributeValueMemberS{Value: subject + KeyValue},
+		"Version": &types.AttributeValueMemberN{Value: "0"},
+	}
+}
@@ -0,0 +1,179 @@
+package store_test
+
+import (
+	"errors"
+	"github.com/cpustejovsky/event-store/events"
+	"github.com/cpustejovsky/event-store/protos/hitpoints"
+	"github.com/cpustejovsky/event-store/store"
+	"github.com/cpustejovsky/event-store/store/storetest"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+	"os"
+	"strings"
+	"testing"
+)
+
+var hitPointsPersonalData = store.PersonalData{
+	EventName: events.HitPointsName,
+	Event:     &hitpoints.PlayerCharacterHitPoints{},
+	Fields:    []string{"CharacterName", "Note"},
+}
+
+func hitPointChange(t *testing.T, id string, change int32, note string) events.Envelope {
+	t.Helper()
+	bin, err := proto.Marshal(&hitpoints.PlayerCharacterHitPoints{Id: id, CharacterName: "Tharivol", CharacterHitPoints: change, Note: note})
+	require.Nil(t, err)
+	return events.Envelope{EventName: events.HitPointsName, Event: bin}
+}
+
+func decodeHitPoints(t *testing.T, e *events.Envelope) *hitpoints.PlayerCharacterHitPoints {
+	t.Helper()
+	var hp hitpoints.PlayerCharacterHitPoints
+	require.Nil(t, proto.Unmarshal(e.Event, &hp))
+	return &hp
+}
+
+// testEncryption appends personal data to es, checks the store returned by raw, which reads the same storage without the keys,
+// only sees it encrypted, and shreds it by deleting the key
+func testEncryption(t *testing.T, keys store.KeyStore, es store.EventStore, raw func() store.EventStore) {
+	id := uuid.NewString()
+	require.Nil(t, es.AppendExpected(ctx, id, store.NoStream, hitPointChange(t, id, 8, "long rest"), hitPointChange(t, id, -3, "fireball")))
+	queried, err := es.QueryAll(ctx, id)
+	require.Nil(t, err)
+	assert.Equal(t, "Tharivol", decodeHitPoints(t, &queried[0]).CharacterName)
+	assert.Equal(t, "fireball", decodeHitPoints(t, &queried[1]).Note)
+	projected, err := es.Project(ctx, id)
+	require.Nil(t, err)
+	require.Nil(t, es.Snapshot(ctx, &events.Snapshot{Id: id, Version: 1, LatestVersion: projected.Version, EventName: events.HitPointsName, Event: projected.Event}))
+	projected, err = es.Project(ctx, id)
+	require.Nil(t, err)
+	assert.Equal(t, "Tharivol", decodeHitPoints(t, projected).CharacterName)
+	assert.Contains(t, decodeHitPoints(t, projected).Note, "fireball")
+
+	stored, err := raw().QueryAll(ctx, id)
+	require.Nil(t, err)
+	for i := range stored {
+		hp := decodeHitPoints(t, &stored[i])
+		assert.True(t, strings.HasPrefix(hp.CharacterName, "encrypted:"), "CharacterName %q is not encrypted", hp.CharacterName)
+		assert.NotContains(t, hp.Note, "fire")
+		assert.Equal(t, decodeHitPoints(t, &queried[i]).CharacterHitPoints, hp.CharacterHitPoints)
+	}
+	projected, err = raw().Project(ctx, id)
+	require.Nil(t, err)
+	assert.NotContains(t, decodeHitPoints(t, projected).CharacterName, "Tharivol")
+
+	require.Nil(t, keys.DeleteKey(ctx, id))
+	shredded, err := es.QueryAll(ctx, id)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(shredded))
+	for i := range shredded {
+		hp := decodeHitPoints(t, &shredded[i])
+		assert.Equal(t, "", hp.CharacterName)
+		assert.Equal(t, "", hp.Note)
+		assert.Equal(t, id, hp.Id)
+	}
+	projected, err = es.Project(ctx, id)
+	require.Nil(t, err)
+	hp := decodeHitPoints(t, projected)
+	assert.Equal(t, "", hp.CharacterName)
+	assert.Equal(t, int32(5), hp.CharacterHitPoints)
+
+	err = es.AppendExpected(ctx, id, 1, hitPointChange(t, id, 2, "potion"))
+	checkErr := &store.KeyDeletedError{}
+	assert.True(t, errors.As(err, &checkErr), "expected KeyDeletedError, got %v", err)
+}
+
+func TestWithEncryption_InMemory(t *testing.T) {
+	keys := store.InMemoryKeys()
+	es := store.InMemory(store.WithEncryption(keys, hitPointsPersonalData))
+	id := uuid.NewString()
+	require.Nil(t, es.AppendExpected(ctx, id, store.NoStream, hitPointChange(t, id, 8, "long rest")))
+	require.Nil(t, keys.DeleteKey(ctx, id))
+	queried, err := es.QueryAll(ctx, id)
+	require.Nil(t, err)
+	assert.Equal(t, "", decodeHitPoints(t, &queried[0]).CharacterName)
+	all, err := es.ReadAll(ctx, queried[0].Position, 1)
+	require.Nil(t, err)
+	assert.Equal(t, "", decodeHitPoints(t, &all[0]).Note)
+}
+
+func TestWithEncryption_File(t *testing.T) {
+	dir := t.TempDir()
+	keys := store.InMemoryKeys()
+	testEncryption(t, keys, openFile(t, dir, store.WithEncryption(keys, hitPointsPersonalData)), func() store.EventStore {
+		return openFile(t, dir)
+	})
+
+	//The segment files only hold the encrypted values
+	for _, path := range segmentFiles(t, dir) {
+		b, err := os.ReadFile(path)
+		require.Nil(t, err)
+		assert.NotContains(t, string(b), "Tharivol")
+	}
+}
+
+func TestWithEncryption_SQL(t *testing.T) {
+	keys := store.InMemoryKeys()
+	es := sqliteStore(t, store.WithEncryption(keys, hitPointsPersonalData))
+	testEncryption(t, keys, es, func() store.EventStore { return store.SQL(es.DB, store.SQLite) })
+}
+
+func TestWithEncryption_DynamoDB(t *testing.T) {
+	client := dynamoClient(t)
+	keys := store.DynamoDBKeys(client, EventStoreTable)
+	testEncryption(t, keys, store.DynamoDB(client, EventStoreTable, store.WithEncryption(keys, hitPointsPersonalData)), func() store.EventStore {
+		return store.DynamoDB(client, EventStoreTable)
+	})
+}
+
+func TestWithEncryption_Conformance(t *testing.T) {
+	storetest.Run(t, func() store.EventStore {
+		return store.InMemory(store.WithEncryption(store.InMemoryKeys(), hitPointsPersonalData))
+	})
+}
+
+func TestWithEncryption_UnknownField(t *testing.T) {
+	es := store.InMemory(store.WithEncryption(store.InMemoryKeys(), store.PersonalData{
+		EventName: events.HitPointsName,
+		Event:     &hitpoints.PlayerCharacterHitPoints{},
+		Fields:    []string{"CharacterHitPoints"},
+	}))
+	id := uuid.NewString()
+	err := es.AppendExpected(ctx, id, store.NoStream, hitPointChange(t, id, 8, "long rest"))
+	checkErr := &store.PersonalDataFieldError{}
+	assert.True(t, errors.As(err, &checkErr), "expected PersonalDataFieldError, got %v", err)
+}
+
+func testKeyStore(t *testing.T, keys store.KeyStore) {
+	subject := uuid.NewString()
+	_, err := keys.Key(ctx, subject)
+	notFound := &store.KeyNotFoundError{}
+	assert.True(t, errors.As(err, &notFound), "expected KeyNotFoundError, got %v", err)
+
+	key, err := keys.CreateKey(ctx, subject)
+	require.Nil(t, err)
+	assert.Equal(t, store.KeySize, len(key))
+	again, err := keys.CreateKey(ctx, subject)
+	require.Nil(t, err)
+	assert.Equal(t, key, again)
+	stored, err := keys.Key(ctx, subject)
+	require.Nil(t, err)
+	assert.Equal(t, key, stored)
+
+	require.Nil(t, keys.DeleteKey(ctx, subject))
+	_, err = keys.Key(ctx, subject)
+	assert.True(t, errors.As(err, &notFound), "expected KeyNotFoundError, got %v", err)
+	_, err = keys.CreateKey(ctx, subject)
+	deleted := &store.KeyDeletedError{}
+	assert.True(t, errors.As(err, &deleted), "expected KeyDeletedError, got %v", err)
+}
+
+func TestInMemoryKeyStore(t *testing.T) {
+	testKeyStore(t, store.InMemoryKeys())
+}
+
+func TestDynamoDBKeyStore(t *testing.T) {
+	testKeyStore(t, store.DynamoDBKeys(dynamoClient(t), EventStoreTable))
+}
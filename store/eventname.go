@@ -0,0 +1,119 @@
+package store
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/cpustejovsky/event-store/events"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// EventNameIndex is the global secondary index read by QueryByEventName
+// Its hash key is the EventName attribute and its range key is the Position attribute
+const EventNameIndex string = "EventNameIndex"
+
+// EventNameOptions selects the events returned by QueryByEventName
+type EventNameOptions struct {
+	// FromPosition is the first global Position to read
+	FromPosition int
+	// Since selects the events recorded at or after it; the zero time selects every event
+	Since time.Time
+	// Until selects the events recorded before it; the zero time selects every event
+	Until time.Time
+	// Limit is the maximum number of events to return; zero returns every selected event
+	Limit int
+}
+
+// match reports whether an event of the queried name is selected by the options
+func (o EventNameOptions) match(e *events.Envelope) bool {
+	if e.Position < o.FromPosition {
+		return false
+	}
+	if !o.Since.IsZero() && e.RecordedAt.Before(o.Since) {
+		return false
+	}
+	if !o.Until.IsZero() && !e.RecordedAt.Before(o.Until) {
+		return false
+	}
+	return true
+}
+
+// QueryByEventName takes a context, EventName and EventNameOptions and returns the selected events of every stream in global order
+// Events are selected by the EventName they were stored with, before upcasting; it reads EventNameIndex, which is eventually consistent
+func (d *DynamoDBEventStore) QueryByEventName(ctx context.Context, name string, opts EventNameOptions) ([]events.Envelope, error) {
+	params := dynamodb.QueryInput{
+		TableName:              aws.String(d.Table),
+		IndexName:              aws.String(EventNameIndex),
+		KeyConditionExpression: aws.String("#name = :name AND #position >= :from"),
+		ExpressionAttributeNames: map[string]string{
+			"#name":     "EventName",
+			"#position": "Position",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":name": &types.AttributeValueMemberS{Value: name},
+			":from": &types.AttributeValueMemberN{Value: strconv.Itoa(opts.FromPosition)},
+		},
+	}
+	//RecordedAt is stored with a fixed width layout in UTC, so comparing the strings compares the times
+	var filters []string
+	if !opts.Since.IsZero() {
+		filters = append(filters, "#recorded >= :since")
+		params.ExpressionAttributeValues[":since"] = &types.AttributeValueMemberS{Value: opts.Since.UTC().Format(RecordedAtLayout)}
+	}
+	if !opts.Until.IsZero() {
+		filters = append(filters, "#recorded < :until")
+		params.ExpressionAttributeValues[":until"] = &types.AttributeValueMemberS{Value: opts.Until.UTC().Format(RecordedAtLayout)}
+	}
+	if len(filters) > 0 {
+		params.ExpressionAttributeNames["#recorded"] = "RecordedAt"
+		params.FilterExpression = aws.String(strings.Join(filters, " AND "))
+	}
+	if opts.Limit > 0 {
+		params.Limit = aws.Int32(int32(opts.Limit))
+	}
+	maplist, err := d.query(ctx, &params)
+	if err != nil {
+		return nil, err
+	}
+	var events []events.Envelope
+	err = attributevalue.UnmarshalListOfMaps(maplist, &events)
+	if err != nil {
+		return nil, err
+	}
+	if err := d.decode(ctx, events); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// QueryByEventName takes a context, EventName and EventNameOptions and returns the selected events of every stream in global order
+// Events are selected by the EventName they were stored with, before upcasting
+func (m *InMemoryEventStore) QueryByEventName(ctx context.Context, name string, opts EventNameOptions) ([]events.Envelope, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var envelopes []events.Envelope
+	for i := range m.log {
+		e := &m.log[i]
+		if erased(e) || e.EventName != name || !opts.match(e) {
+			continue
+		}
+		envelopes = append(envelopes, copyEnvelope(*e))
+		if opts.Limit > 0 && len(envelopes) == opts.Limit {
+			break
+		}
+	}
+	if len(envelopes) == 0 {
+		return nil, &NoEventFoundError{}
+	}
+	if err := m.load(ctx, envelopes); err != nil {
+		return nil, err
+	}
+	return envelopes, nil
+}
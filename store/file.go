@@ -0,0 +1,782 @@
+package store
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/cpustejovsky/event-store/events"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// DefaultSegmentSize is the size at which a FileEventStore starts a new segment file unless WithSegmentSize is set
+const DefaultSegmentSize int64 = 64 << 20
+
+const (
+	// segmentPattern names a segment file after the global Position of its first event, zero padded so the names sort in log order
+	segmentPattern = "segment-%020d.log"
+	snapshotsFile  = "snapshots.log"
+	// recordHeaderSize is the size of the payload length and CRC-32C that precede every record
+	recordHeaderSize = 8
+	// maxRecordSize bounds the length read from a record header, so a corrupt length is not mistaken for a huge record
+	maxRecordSize = 1 << 30
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// CorruptLogError is returned by File when a record that is not at the end of the log fails its checksum
+// A torn record at the end of the log is left by a crash during a write and is truncated instead
+type CorruptLogError struct {
+	Path   string
+	Offset int64
+}
+
+func (e *CorruptLogError) Error() string {
+	return fmt.Sprintf("corrupt record in %s at offset %d", e.Path, e.Offset)
+}
+
+// FileEventStore is an InMemoryEventStore made durable by a write-ahead journal, so it needs no database
+// Every event is journaled to append-only segment files and every snapshot to a separate file in a directory, synced before the write is acknowledged,
+// and File replays the journal into memory. Memory keeps the index and the metadata of the events, such as their Id, Version, Position and EventName,
+// but not their Event payloads and Headers, which reads fetch from the segments through the index; snapshots are kept in memory
+// The store suits edge deployments and offline sessions
+type FileEventStore struct {
+	*InMemoryEventStore
+	dir         string
+	segmentSize int64
+
+	// logMu guards the files and the index; it is taken after the lock of the in-memory store
+	// Reads of the segments hold it for reading, so a compaction does not replace a segment while it is read
+	logMu sync.RWMutex
+	// compactMu serializes compactions, which copy the files without holding logMu
+	compactMu sync.Mutex
+	// segments are ordered by Position; the last one is active and open for appending
+	segments    []segment
+	active      *os.File
+	snapshotLog *os.File
+	// snapshotLogSize is the size of the snapshots file
+	snapshotLogSize int64
+	// index locates the record holding each event, so reads find its payload and Compact finds the segments holding hard deleted events
+	index map[eventKey]recordLocation
+	// err is set once a failed write could not be undone or the store is closed, and fails every later write
+	err error
+}
+
+// segment is a file of event records
+type segment struct {
+	path string
+	// base is the global Position of the segment's first event
+	base int
+	size int64
+}
+
+type eventKey struct {
+	Id      string
+	Version int
+}
+
+// recordLocation is the segment and offset of a record
+type recordLocation struct {
+	segment int
+	offset  int64
+}
+
+// snapshotRecord is a record of the snapshots file: a stored snapshot or the deletion of snapshots of a stream
+type snapshotRecord struct {
+	Put    *events.Snapshot `json:",omitempty"`
+	Id     string           `json:",omitempty"`
+	Delete []int            `json:",omitempty"`
+}
+
+// WithSegmentSize sets the size at which a FileEventStore starts a new segment file
+func WithSegmentSize(bytes int64) Option {
+	return func(o *options) {
+		o.segmentSize = bytes
+	}
+}
+
+// File opens the FileEventStore in dir, creating the directory if it does not exist
+// It replays the segment and snapshot files, truncating a record torn by a crash at the end of either
+func File(dir string, opts ...Option) (*FileEventStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	f := &FileEventStore{
+		InMemoryEventStore: InMemory(opts...),
+		dir:                dir,
+		segmentSize:        DefaultSegmentSize,
+		index:              make(map[eventKey]recordLocation),
+	}
+	if f.options.segmentSize > 0 {
+		f.segmentSize = f.options.segmentSize
+	}
+	//The replayed events are inserted without their payloads, which are read back from the segments
+	f.journal = f
+	if err := f.loadSegments(); err != nil {
+		return nil, err
+	}
+	if err := f.loadSnapshots(); err != nil {
+		f.active.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// Close closes the files of the store; writes fail afterwards while reads keep working
+func (f *FileEventStore) Close() error {
+	f.logMu.Lock()
+	defer f.logMu.Unlock()
+	if f.err == os.ErrClosed {
+		return nil
+	}
+	f.err = os.ErrClosed
+	err := f.active.Close()
+	if serr := f.snapshotLog.Close(); err == nil {
+		err = serr
+	}
+	return err
+}
+
+// loadSegments replays the segment files into the in-memory store and opens the last one for appending
+func (f *FileEventStore) loadSegments() error {
+	paths, err := filepath.Glob(filepath.Join(f.dir, "segment-*.log"))
+	if err != nil {
+		return err
+	}
+	sort.Strings(paths)
+	for i, path := range paths {
+		var base int
+		if _, err := fmt.Sscanf(filepath.Base(path), segmentPattern, &base); err != nil {
+			return fmt.Errorf("unexpected segment file %s: %w", path, err)
+		}
+		last := i == len(paths)-1
+		size, err := replay(path, last, func(offset int64, payload []byte) error {
+			var batch []events.Envelope
+			if err := json.Unmarshal(payload, &batch); err != nil {
+				return err
+			}
+			for _, e := range batch {
+				if e.Position < len(f.log) {
+					//A compaction interrupted before it removed the segments it merged leaves their events in two files,
+					//and the merged file may hold placeholders for events that were hard deleted
+					continue
+				}
+				if e.Position != len(f.log) {
+					return &CorruptLogError{Path: path, Offset: offset}
+				}
+				f.insert(e)
+				if !erased(&e) {
+					f.index[eventKey{Id: e.Id, Version: e.Version}] = recordLocation{segment: base, offset: offset}
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		f.segments = append(f.segments, segment{path: path, base: base, size: size})
+	}
+	if len(f.segments) == 0 {
+		return f.newSegment(0)
+	}
+	active, err := os.OpenFile(f.segments[len(f.segments)-1].path, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	f.active = active
+	return nil
+}
+
+// loadSnapshots replays the snapshots file into the in-memory store and opens it for appending
+func (f *FileEventStore) loadSnapshots() error {
+	path := filepath.Join(f.dir, snapshotsFile)
+	size, err := replay(path, true, func(_ int64, payload []byte) error {
+		var record snapshotRecord
+		if err := json.Unmarshal(payload, &record); err != nil {
+			return err
+		}
+		f.applySnapshotRecord(record)
+		return nil
+	})
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	f.snapshotLog = file
+	f.snapshotLogSize = size
+	return syncDir(f.dir)
+}
+
+// applySnapshotRecord applies a record of the snapshots file to the in-memory store
+func (f *FileEventStore) applySnapshotRecord(record snapshotRecord) {
+	if record.Put != nil {
+		//The snapshots of a hard deleted stream are removed with its events, even if the store crashed before it recorded that
+		if _, ok := purged(f.deleted(record.Put.Id), HardDelete); !ok {
+			f.storeSnapshot(*record.Put)
+		}
+		return
+	}
+	deleted := make(map[int]bool, len(record.Delete))
+	for _, v := range record.Delete {
+		deleted[v] = true
+	}
+	snapshots := f.InMemoryEventStore.snapshots[record.Id]
+	kept := make([]events.Snapshot, 0, len(snapshots))
+	for _, s := range snapshots {
+		if !deleted[s.Version] {
+			kept = append(kept, s)
+		}
+	}
+	f.InMemoryEventStore.snapshots[record.Id] = kept
+}
+
+// appendEvents writes a batch of envelopes as a single record, so a crash keeps all of them or none
+func (f *FileEventStore) appendEvents(envelopes []events.Envelope) error {
+	f.logMu.Lock()
+	defer f.logMu.Unlock()
+	if f.err != nil {
+		return f.err
+	}
+	payload, err := json.Marshal(envelopes)
+	if err != nil {
+		return err
+	}
+	current := &f.segments[len(f.segments)-1]
+	if current.size > 0 && current.size+recordHeaderSize+int64(len(payload)) > f.segmentSize {
+		if err := f.newSegment(envelopes[0].Position); err != nil {
+			return err
+		}
+		current = &f.segments[len(f.segments)-1]
+	}
+	offset := current.size
+	if err := f.appendRecord(f.active, offset, payload); err != nil {
+		return err
+	}
+	current.size += recordHeaderSize + int64(len(payload))
+	for _, e := range envelopes {
+		f.index[eventKey{Id: e.Id, Version: e.Version}] = recordLocation{segment: current.base, offset: offset}
+	}
+	return nil
+}
+
+// readEvents fills in the Event and Headers of envelopes from their records in the segments
+// Each record is read once however many of the envelopes it holds; the placeholders of hard deleted events are skipped
+func (f *FileEventStore) readEvents(envelopes []events.Envelope) error {
+	f.logMu.RLock()
+	defer f.logMu.RUnlock()
+	files := make(map[int]*os.File)
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+	records := make(map[recordLocation][]events.Envelope)
+	for i := range envelopes {
+		e := &envelopes[i]
+		if erased(e) {
+			continue
+		}
+		loc, ok := f.index[eventKey{Id: e.Id, Version: e.Version}]
+		if !ok {
+			return fmt.Errorf("no record of version %d of stream %s", e.Version, e.Id)
+		}
+		batch, ok := records[loc]
+		if !ok {
+			file, ok := files[loc.segment]
+			if !ok {
+				var err error
+				if file, err = os.Open(segmentPath(f.dir, loc.segment)); err != nil {
+					return err
+				}
+				files[loc.segment] = file
+			}
+			var err error
+			if batch, err = readBatch(file, loc.offset); err != nil {
+				return err
+			}
+			records[loc] = batch
+		}
+		found := false
+		for _, stored := range batch {
+			if stored.Id == e.Id && stored.Version == e.Version {
+				e.Event, e.Headers, found = stored.Event, stored.Headers, true
+				break
+			}
+		}
+		if !found {
+			return &CorruptLogError{Path: segmentPath(f.dir, loc.segment), Offset: loc.offset}
+		}
+	}
+	return nil
+}
+
+// readBatch reads the batch of events of the record at offset in a segment file
+func readBatch(file *os.File, offset int64) ([]events.Envelope, error) {
+	payload, err := readRecord(io.NewSectionReader(file, offset, maxRecordSize+recordHeaderSize))
+	if err != nil {
+		return nil, &CorruptLogError{Path: file.Name(), Offset: offset}
+	}
+	var batch []events.Envelope
+	if err := json.Unmarshal(payload, &batch); err != nil {
+		return nil, err
+	}
+	return batch, nil
+}
+
+func (f *FileEventStore) putSnapshot(snapshot events.Snapshot) error {
+	return f.appendSnapshotRecord(snapshotRecord{Put: &snapshot})
+}
+
+func (f *FileEventStore) deleteSnapshots(id string, versions []int) error {
+	return f.appendSnapshotRecord(snapshotRecord{Id: id, Delete: versions})
+}
+
+func (f *FileEventStore) appendSnapshotRecord(record snapshotRecord) error {
+	f.logMu.Lock()
+	defer f.logMu.Unlock()
+	if f.err != nil {
+		return f.err
+	}
+	payload, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if err := f.appendRecord(f.snapshotLog, f.snapshotLogSize, payload); err != nil {
+		return err
+	}
+	f.snapshotLogSize += recordHeaderSize + int64(len(payload))
+	return nil
+}
+
+// appendRecord writes payload as a record at the end of file, which is size bytes long, and syncs it
+// A failed write is truncated away so the file ends with a whole record; if that fails too the store stops accepting writes
+func (f *FileEventStore) appendRecord(file *os.File, size int64, payload []byte) error {
+	_, err := file.Write(encodeRecord(payload))
+	if err == nil {
+		err = file.Sync()
+	}
+	if err != nil {
+		if terr := file.Truncate(size); terr != nil {
+			f.err = fmt.Errorf("%s may end with a partial record: %w", file.Name(), err)
+		}
+		return err
+	}
+	return nil
+}
+
+// newSegment closes the active segment and starts a segment whose first event has the global Position base
+func (f *FileEventStore) newSegment(base int) error {
+	path := segmentPath(f.dir, base)
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+	if err := syncDir(f.dir); err != nil {
+		file.Close()
+		return err
+	}
+	if f.active != nil {
+		f.active.Close()
+	}
+	f.active = file
+	f.segments = append(f.segments, segment{path: path, base: base})
+	return nil
+}
+
+// segmentPath returns the path of the segment in dir whose first event has the global Position base
+func segmentPath(dir string, base int) string {
+	return filepath.Join(dir, fmt.Sprintf(segmentPattern, base))
+}
+
+// Compact merges consecutive segments that together fit in the segment size into one file
+// and rewrites the snapshots file without the snapshots that were replaced, pruned or invalidated
+// Sealed segments holding events of hard deleted streams are rewritten without them; the active segment keeps them until it is sealed
+// The files are copied without holding the store's locks, which are only taken to plan the compaction and to swap the copies in,
+// so appends, snapshots and reads carry on meanwhile. It is safe to call while the store is in use; a crash during compaction loses nothing
+func (f *FileEventStore) Compact(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	f.compactMu.Lock()
+	defer f.compactMu.Unlock()
+	plan, err := f.planCompaction()
+	if err != nil {
+		return err
+	}
+	//Sealed segments are never written to again, so they are merged from the files while appends go to the active segment
+	var merges []*mergedSegments
+	defer func() {
+		for _, m := range merges {
+			os.Remove(m.tmp)
+		}
+	}()
+	for _, group := range plan.groups {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		m, err := mergeSegments(f.dir, group, plan.erased)
+		if err != nil {
+			return err
+		}
+		merges = append(merges, m)
+	}
+	snapshots, size, err := writeSnapshots(f.dir, plan.snapshots)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(snapshots)
+
+	f.logMu.Lock()
+	defer f.logMu.Unlock()
+	if f.err != nil {
+		return f.err
+	}
+	for _, m := range merges {
+		if err := f.installSegments(m); err != nil {
+			return err
+		}
+	}
+	return f.installSnapshots(snapshots, size, plan.snapshotLogSize)
+}
+
+// compaction is the work of a Compact call, planned while holding the store's locks
+type compaction struct {
+	// groups are the runs of sealed segments that are merged into the file of their first segment
+	groups [][]segment
+	// erased holds the events of the sealed segments that were hard deleted when the compaction was planned
+	erased map[eventKey]bool
+	// snapshots are copies of the stored snapshots, which the snapshots file held up to snapshotLogSize
+	snapshots       []events.Snapshot
+	snapshotLogSize int64
+}
+
+// mergedSegments is a run of segments copied into a temporary file
+type mergedSegments struct {
+	segments []segment
+	tmp      string
+	size     int64
+	// locations index the events of the merged file
+	locations map[eventKey]recordLocation
+}
+
+// planCompaction picks the sealed segments to merge and copies the snapshots while holding both locks
+// The in-memory lock is taken first, like journal writes do, so the snapshots match the snapshots file
+func (f *FileEventStore) planCompaction() (*compaction, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	f.logMu.Lock()
+	defer f.logMu.Unlock()
+	if f.err != nil {
+		return nil, f.err
+	}
+	plan := &compaction{erased: make(map[eventKey]bool), snapshotLogSize: f.snapshotLogSize}
+	//Segments whose events were hard deleted are rewritten even if there is nothing to merge them with
+	erasedIn := make(map[int]bool)
+	for key, loc := range f.index {
+		if !f.exists(key) {
+			erasedIn[loc.segment] = true
+			plan.erased[key] = true
+		}
+	}
+	//The active segment is still being appended to and is never merged
+	sealed := f.segments[:len(f.segments)-1]
+	for len(sealed) > 0 {
+		n, size, rewritten := 1, sealed[0].size, erasedIn[sealed[0].base]
+		for n < len(sealed) && size+sealed[n].size <= f.segmentSize {
+			size += sealed[n].size
+			rewritten = rewritten || erasedIn[sealed[n].base]
+			n++
+		}
+		if n > 1 || rewritten {
+			plan.groups = append(plan.groups, append([]segment(nil), sealed[:n]...))
+		}
+		sealed = sealed[n:]
+	}
+	for _, snapshots := range f.InMemoryEventStore.snapshots {
+		plan.snapshots = append(plan.snapshots, snapshots...)
+	}
+	return plan, nil
+}
+
+// mergeSegments copies the records of segments into a temporary file in dir
+// Hard deleted events are written as placeholders that keep only their Position, so the global log stays dense when it is replayed
+func mergeSegments(dir string, segments []segment, erasedEvents map[eventKey]bool) (*mergedSegments, error) {
+	m := &mergedSegments{segments: segments, locations: make(map[eventKey]recordLocation)}
+	var err error
+	m.tmp, err = writeTemp(segments[0].path, func(w io.Writer) error {
+		for _, s := range segments {
+			_, err := replay(s.path, false, func(_ int64, payload []byte) error {
+				var batch []events.Envelope
+				if err := json.Unmarshal(payload, &batch); err != nil {
+					return err
+				}
+				changed := false
+				for i, e := range batch {
+					key := eventKey{Id: e.Id, Version: e.Version}
+					if erased(&e) || erasedEvents[key] {
+						changed = changed || !erased(&e)
+						batch[i] = events.Envelope{Position: e.Position}
+						continue
+					}
+					m.locations[key] = recordLocation{segment: segments[0].base, offset: m.size}
+				}
+				if changed {
+					var err error
+					if payload, err = json.Marshal(batch); err != nil {
+						return err
+					}
+				}
+				record := encodeRecord(payload)
+				if _, err := w.Write(record); err != nil {
+					return err
+				}
+				m.size += int64(len(record))
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// installSegments renames the merged file over the first of its segments, removes the others and updates the index; callers must hold logMu
+func (f *FileEventStore) installSegments(m *mergedSegments) error {
+	if err := os.Rename(m.tmp, m.segments[0].path); err != nil {
+		return err
+	}
+	for _, s := range m.segments[1:] {
+		if err := os.Remove(s.path); err != nil {
+			return err
+		}
+	}
+	if err := syncDir(f.dir); err != nil {
+		return err
+	}
+	merged := make(map[int]bool, len(m.segments))
+	for _, s := range m.segments {
+		merged[s.base] = true
+	}
+	for key, loc := range f.index {
+		if merged[loc.segment] {
+			delete(f.index, key)
+		}
+	}
+	for key, loc := range m.locations {
+		f.index[key] = loc
+	}
+	//Only appends change the segments meanwhile and they only add segments after the merged ones
+	segments := make([]segment, 0, len(f.segments))
+	for _, s := range f.segments {
+		if s.base == m.segments[0].base {
+			s.size = m.size
+		} else if merged[s.base] {
+			continue
+		}
+		segments = append(segments, s)
+	}
+	f.segments = segments
+	return nil
+}
+
+// exists reports whether the event with key is still stored rather than hard deleted; callers must hold the lock of the in-memory store
+func (f *FileEventStore) exists(key eventKey) bool {
+	stream := f.streams[key.Id]
+	return len(stream) > 0 && stream[0].Version <= key.Version
+}
+
+// writeSnapshots writes a record for every snapshot to a temporary file in dir and returns its name and size
+func writeSnapshots(dir string, snapshots []events.Snapshot) (string, int64, error) {
+	var size int64
+	tmp, err := writeTemp(filepath.Join(dir, snapshotsFile), func(w io.Writer) error {
+		for i := range snapshots {
+			payload, err := json.Marshal(snapshotRecord{Put: &snapshots[i]})
+			if err != nil {
+				return err
+			}
+			if _, err := w.Write(encodeRecord(payload)); err != nil {
+				return err
+			}
+			size += recordHeaderSize + int64(len(payload))
+		}
+		return nil
+	})
+	return tmp, size, err
+}
+
+// installSnapshots replaces the snapshots file with the compacted file tmp of size bytes; callers must hold logMu
+// The records written to the snapshots file after its first from bytes were copied are appended to tmp first
+func (f *FileEventStore) installSnapshots(tmp string, size, from int64) error {
+	path := filepath.Join(f.dir, snapshotsFile)
+	if tail := f.snapshotLogSize - from; tail > 0 {
+		if err := copyTail(path, tmp, from, tail); err != nil {
+			return err
+		}
+		size += tail
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	if err := syncDir(f.dir); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		//The old handle refers to the replaced file, so writing through it would lose snapshots
+		f.err = err
+		return err
+	}
+	f.snapshotLog.Close()
+	f.snapshotLog = file
+	f.snapshotLogSize = size
+	return nil
+}
+
+// copyTail appends the n bytes of the file at src from offset to the file at dst and syncs it
+func copyTail(src, dst string, offset, n int64) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, io.NewSectionReader(in, offset, n))
+	if err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// replay calls apply with the offset and payload of every record of the file at path and returns the size of the file's whole records
+// A torn record at the end of the file is truncated when the file is the last of its log and is a CorruptLogError otherwise
+func replay(path string, last bool, apply func(offset int64, payload []byte) error) (int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	r := bufio.NewReader(file)
+	var offset int64
+	for {
+		payload, err := readRecord(r)
+		if err == io.EOF {
+			return offset, nil
+		}
+		if err != nil {
+			if !last {
+				return 0, &CorruptLogError{Path: path, Offset: offset}
+			}
+			return offset, truncate(path, offset)
+		}
+		if err := apply(offset, payload); err != nil {
+			return 0, err
+		}
+		offset += recordHeaderSize + int64(len(payload))
+	}
+}
+
+// encodeRecord returns payload preceded by its length and CRC-32C
+func encodeRecord(payload []byte) []byte {
+	record := make([]byte, recordHeaderSize, recordHeaderSize+len(payload))
+	binary.LittleEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(record[4:8], crc32.Checksum(payload, crcTable))
+	return append(record, payload...)
+}
+
+// errTornRecord is returned by readRecord for a record that is incomplete or fails its checksum
+var errTornRecord = errors.New("torn record")
+
+// readRecord reads the payload of the next record, returning io.EOF at the end of the file
+func readRecord(r io.Reader) ([]byte, error) {
+	var header [recordHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, errTornRecord
+		}
+		return nil, err
+	}
+	length := binary.LittleEndian.Uint32(header[0:4])
+	if length > maxRecordSize {
+		return nil, errTornRecord
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, errTornRecord
+		}
+		return nil, err
+	}
+	if crc32.Checksum(payload, crcTable) != binary.LittleEndian.Uint32(header[4:8]) {
+		return nil, errTornRecord
+	}
+	return payload, nil
+}
+
+// truncate cuts the file at path to size and syncs it
+func truncate(path string, size int64) error {
+	file, err := os.OpenFile(path, os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if err := file.Truncate(size); err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+// writeTemp writes the content written by write to a synced temporary file next to path and returns its name
+// Renaming the temporary file over path replaces the file atomically
+func writeTemp(path string, write func(io.Writer) error) (string, error) {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return "", err
+	}
+	w := bufio.NewWriter(tmp)
+	err = write(w)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	return tmp.Name(), nil
+}
+
+// syncDir syncs a directory so the files created, renamed or removed in it survive a crash
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
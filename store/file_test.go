@@ -0,0 +1,303 @@
+package store_test
+
+import (
+	"errors"
+	"github.com/cpustejovsky/event-store/events"
+	"github.com/cpustejovsky/event-store/store"
+	"github.com/cpustejovsky/event-store/store/storetest"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// openFile opens the FileEventStore in dir aggregating "sum" events and closes it when the test ends
+func openFile(t *testing.T, dir string, opts ...store.Option) *store.FileEventStore {
+	t.Helper()
+	var mu sync.Mutex
+	registry := events.DefaultRegistry()
+	registry.Register("sum", func() events.Aggregator { return sumAggregator{mu: &mu, folded: new(int)} })
+	es, err := store.File(dir, append([]store.Option{store.WithRegistry(registry)}, opts...)...)
+	require.Nil(t, err)
+	t.Cleanup(func() { es.Close() })
+	return es
+}
+
+func segmentFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	paths, err := filepath.Glob(filepath.Join(dir, "segment-*.log"))
+	require.Nil(t, err)
+	return paths
+}
+
+func appendFile(t *testing.T, path string, b []byte) {
+	t.Helper()
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o644)
+	require.Nil(t, err)
+	_, err = f.Write(b)
+	require.Nil(t, err)
+	require.Nil(t, f.Close())
+}
+
+func TestFileEventStore(t *testing.T) {
+	storetest.Run(t, func() store.EventStore {
+		return openFile(t, t.TempDir())
+	})
+}
+
+func TestFileEventStore_Registry(t *testing.T) {
+	storetest.RunRegistry(t, func(registry *events.Registry) store.EventStore {
+		return openFile(t, t.TempDir(), store.WithRegistry(registry))
+	})
+}
+
+func TestFileEventStore_Reopen(t *testing.T) {
+	dir := t.TempDir()
+	es := openFile(t, dir)
+	id := uuid.NewString()
+	snapshotSums(t, es, id, 1, 2, 3)
+	appendSums(t, es, uuid.NewString(), 4)
+	all, err := es.ReadAll(ctx, 0, 0)
+	require.Nil(t, err)
+	require.Nil(t, es.Close())
+	require.NotNil(t, es.Append(ctx, &events.Envelope{Id: id, Version: 3, EventName: "sum"}))
+
+	es = openFile(t, dir, store.WithRetentionPolicy(store.RetentionPolicy{KeepLast: 1}))
+	reopened, err := es.ReadAll(ctx, 0, 0)
+	require.Nil(t, err)
+	assert.Equal(t, all, reopened)
+	projected, err := es.Project(ctx, id)
+	require.Nil(t, err)
+	assert.Equal(t, []byte{6}, projected.Event)
+	pruned, err := es.PruneSnapshots(ctx, id)
+	require.Nil(t, err)
+	assert.Equal(t, 2, pruned)
+	appendSums(t, es, id, 4)
+	require.Nil(t, es.Close())
+
+	es = openFile(t, dir, store.WithRetentionPolicy(store.RetentionPolicy{KeepLast: 1}))
+	pruned, err = es.PruneSnapshots(ctx, id)
+	require.Nil(t, err)
+	assert.Equal(t, 0, pruned)
+	projected, err = es.Project(ctx, id)
+	require.Nil(t, err)
+	assert.Equal(t, []byte{10}, projected.Event)
+	queried, err := es.QueryAll(ctx, id)
+	require.Nil(t, err)
+	assert.Equal(t, len(all), queried[3].Position)
+}
+
+func TestFileEventStore_TornWrite(t *testing.T) {
+	dir := t.TempDir()
+	es := openFile(t, dir)
+	id := uuid.NewString()
+	appendSums(t, es, id, 1, 2)
+	require.Nil(t, es.Close())
+	//A header announcing more bytes than were written before the crash
+	segments := segmentFiles(t, dir)
+	appendFile(t, segments[len(segments)-1], []byte{100, 0, 0, 0, 1, 2, 3, 4, '[', '{'})
+
+	es = openFile(t, dir)
+	queried, err := es.QueryAll(ctx, id)
+	require.Nil(t, err)
+	assert.Equal(t, 2, len(queried))
+	appendSums(t, es, id, 3)
+	require.Nil(t, es.Close())
+
+	es = openFile(t, dir)
+	queried, err = es.QueryAll(ctx, id)
+	require.Nil(t, err)
+	assert.Equal(t, 3, len(queried))
+}
+
+func TestFileEventStore_CorruptSegment(t *testing.T) {
+	dir := t.TempDir()
+	es := openFile(t, dir, store.WithSegmentSize(1))
+	appendSums(t, es, uuid.NewString(), 1, 2)
+	require.Nil(t, es.Close())
+	segments := segmentFiles(t, dir)
+	require.Equal(t, 2, len(segments))
+	b, err := os.ReadFile(segments[0])
+	require.Nil(t, err)
+	b[len(b)-2] ^= 0xff
+	require.Nil(t, os.WriteFile(segments[0], b, 0o644))
+
+	_, err = store.File(dir)
+	checkErr := &store.CorruptLogError{}
+	require.True(t, errors.As(err, &checkErr), "expected CorruptLogError, got %v", err)
+	assert.Equal(t, segments[0], checkErr.Path)
+	assert.Equal(t, int64(0), checkErr.Offset)
+}
+
+func TestFileEventStore_ReadsSegments(t *testing.T) {
+	dir := t.TempDir()
+	es := openFile(t, dir)
+	id := uuid.NewString()
+	appendSums(t, es, id, 1, 2, 3)
+	queried, err := es.QueryAll(ctx, id)
+	require.Nil(t, err)
+	assert.Equal(t, []byte{3}, queried[2].Event)
+
+	//The payloads are not kept in memory, so damage to the segment after it was replayed shows in reads
+	segments := segmentFiles(t, dir)
+	b, err := os.ReadFile(segments[0])
+	require.Nil(t, err)
+	b[len(b)-2] ^= 0xff
+	require.Nil(t, os.WriteFile(segments[0], b, 0o644))
+	_, err = es.QueryAll(ctx, id)
+	checkErr := &store.CorruptLogError{}
+	require.True(t, errors.As(err, &checkErr), "expected CorruptLogError, got %v", err)
+	assert.Equal(t, segments[0], checkErr.Path)
+	//Reads of the metadata kept in memory still work
+	version, err := es.QueryLatestVersion(ctx, id)
+	require.Nil(t, err)
+	assert.Equal(t, 2, version)
+}
+
+func TestFileEventStore_Compact(t *testing.T) {
+	dir := t.TempDir()
+	es := openFile(t, dir, store.WithSegmentSize(1))
+	id := uuid.NewString()
+	snapshotSums(t, es, id, 1, 2, 3)
+	all, err := es.ReadAll(ctx, 0, 0)
+	require.Nil(t, err)
+	require.Nil(t, es.Close())
+	require.Equal(t, 3, len(segmentFiles(t, dir)))
+
+	es = openFile(t, dir, store.WithRetentionPolicy(store.RetentionPolicy{KeepLast: 1}))
+	_, err = es.PruneSnapshots(ctx, id)
+	require.Nil(t, err)
+	info, err := os.Stat(filepath.Join(dir, "snapshots.log"))
+	require.Nil(t, err)
+	require.Nil(t, es.Compact(ctx))
+	assert.Equal(t, 2, len(segmentFiles(t, dir)))
+	compacted, err := os.Stat(filepath.Join(dir, "snapshots.log"))
+	require.Nil(t, err)
+	assert.Less(t, compacted.Size(), info.Size())
+	appendSums(t, es, id, 4)
+	require.Nil(t, es.Close())
+
+	es = openFile(t, dir, store.WithRetentionPolicy(store.RetentionPolicy{KeepLast: 1}))
+	reopened, err := es.ReadAll(ctx, 0, 0)
+	require.Nil(t, err)
+	assert.Equal(t, all, reopened[:len(all)])
+	pruned, err := es.PruneSnapshots(ctx, id)
+	require.Nil(t, err)
+	assert.Equal(t, 0, pruned)
+	projected, err := es.Project(ctx, id)
+	require.Nil(t, err)
+	assert.Equal(t, []byte{10}, projected.Event)
+}
+
+func TestFileEventStore_CompactWhileWriting(t *testing.T) {
+	dir := t.TempDir()
+	es := openFile(t, dir, store.WithSegmentSize(1))
+	id := uuid.NewString()
+	appendSums(t, es, uuid.NewString(), 1, 2, 3)
+	require.Nil(t, es.Close())
+	//The default segment size lets the first compaction merge the small segments
+	es = openFile(t, dir)
+	values := make([]byte, 20)
+	for i := range values {
+		values[i] = byte(i + 1)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		snapshotSums(t, es, id, values...)
+	}()
+	//Appends and snapshots written while a compaction copies the files are kept when the copies are swapped in
+	for compacting := true; compacting; {
+		require.Nil(t, es.Compact(ctx))
+		select {
+		case <-done:
+			compacting = false
+		default:
+		}
+	}
+	require.Nil(t, es.Compact(ctx))
+	all, err := es.ReadAll(ctx, 0, 0)
+	require.Nil(t, err)
+	require.Nil(t, es.Close())
+
+	es = openFile(t, dir, store.WithRetentionPolicy(store.RetentionPolicy{KeepLast: 1}))
+	reopened, err := es.ReadAll(ctx, 0, 0)
+	require.Nil(t, err)
+	assert.Equal(t, all, reopened)
+	pruned, err := es.PruneSnapshots(ctx, id)
+	require.Nil(t, err)
+	assert.Equal(t, len(values)-1, pruned)
+	projected, err := es.Project(ctx, id)
+	require.Nil(t, err)
+	assert.Equal(t, []byte{210}, projected.Event)
+}
+
+func TestFileEventStore_InterruptedCompaction(t *testing.T) {
+	dir := t.TempDir()
+	es := openFile(t, dir, store.WithSegmentSize(1))
+	id := uuid.NewString()
+	appendSums(t, es, id, 1, 2, 3)
+	require.Nil(t, es.Close())
+	//The first segment was replaced by the merged segments but the second was not removed yet
+	segments := segmentFiles(t, dir)
+	second, err := os.ReadFile(segments[1])
+	require.Nil(t, err)
+	appendFile(t, segments[0], second)
+
+	es = openFile(t, dir)
+	queried, err := es.QueryAll(ctx, id)
+	require.Nil(t, err)
+	assert.Equal(t, 3, len(queried))
+	all, err := es.ReadAll(ctx, 0, 0)
+	require.Nil(t, err)
+	assert.Equal(t, 3, len(all))
+}
+
+func TestFileEventStore_HardDelete(t *testing.T) {
+	dir := t.TempDir()
+	es := openFile(t, dir, store.WithSegmentSize(1))
+	id := uuid.NewString()
+	other := uuid.NewString()
+	snapshotSums(t, es, id, 1, 2, 3)
+	appendSums(t, es, other, 4)
+	require.Nil(t, es.DeleteStream(ctx, id, store.HardDelete))
+	//The three removed events leave erased markers before the other stream's event and the tombstone
+	all, err := es.ReadAll(ctx, 0, 0)
+	require.Nil(t, err)
+	require.Equal(t, 5, len(all))
+	for _, e := range all[:3] {
+		assert.Equal(t, store.ErasedEventName, e.EventName)
+	}
+	require.Nil(t, es.Close())
+
+	es = openFile(t, dir, store.WithSegmentSize(1))
+	reopened, err := es.ReadAll(ctx, 0, 0)
+	require.Nil(t, err)
+	assert.Equal(t, all, reopened)
+	pruned, err := es.PruneSnapshots(ctx, id)
+	require.Nil(t, err)
+	assert.Equal(t, 0, pruned)
+
+	//Compaction rewrites the sealed segments without the deleted events
+	require.Nil(t, es.Compact(ctx))
+	for _, path := range segmentFiles(t, dir)[:3] {
+		b, err := os.ReadFile(path)
+		require.Nil(t, err)
+		assert.NotContains(t, string(b), id)
+	}
+	appendSums(t, es, other, 5)
+	require.Nil(t, es.Close())
+
+	es = openFile(t, dir)
+	reopened, err = es.ReadAll(ctx, 0, 0)
+	require.Nil(t, err)
+	require.Equal(t, 6, len(reopened))
+	assert.Equal(t, all, reopened[:5])
+	assert.Equal(t, 5, reopened[5].Position)
+	_, err = es.QueryAll(ctx, id)
+	checkErr := &store.StreamDeletedError{}
+	assert.True(t, errors.As(err, &checkErr), "expected StreamDeletedError, got %v", err)
+}
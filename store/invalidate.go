@@ -0,0 +1,98 @@
+package store
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/cpustejovsky/event-store/events"
+)
+
+// SnapshotInvalidator is implemented by event stores that delete snapshots in bulk
+// After the aggregator of an EventName changes, invalidating its snapshots makes Project replay every event
+type SnapshotInvalidator interface {
+	InvalidateSnapshots(ctx context.Context, eventName string) (int, error)
+}
+
+// WithSnapshotRebuild makes Project replace a snapshot built by another version of the aggregator with its projection
+// Without it such snapshots are ignored until a SnapshotPolicy asks for a new one or they are invalidated
+func WithSnapshotRebuild() Option {
+	return func(o *options) {
+		o.rebuild = true
+	}
+}
+
+// aggregatorVersion returns the version of the aggregator registered for eventName
+// An unknown eventName has version 0; projecting it fails with an AggregatorNotFoundError anyway
+func (o *options) aggregatorVersion(eventName string) int {
+	version, _ := o.aggregators().AggregatorVersion(eventName)
+	return version
+}
+
+// current reports whether the snapshot was built by the registered version of its aggregator
+func (o *options) current(snapshot *events.Snapshot) bool {
+	return snapshot.AggregatorVersion == o.aggregatorVersion(snapshot.EventName)
+}
+
+// currentSnapshots returns the snapshots built by the registered versions of their aggregators
+func (o *options) currentSnapshots(snapshots []events.Snapshot) []events.Snapshot {
+	var current []events.Snapshot
+	for i := range snapshots {
+		if o.current(&snapshots[i]) {
+			current = append(current, snapshots[i])
+		}
+	}
+	return current
+}
+
+// InvalidateSnapshots deletes every snapshot of streams with eventName and returns how many were deleted
+func (m *InMemoryEventStore) InvalidateSnapshots(ctx context.Context, eventName string) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	invalidated := 0
+	for id, snapshots := range m.snapshots {
+		var deleted []events.Snapshot
+		kept := make([]events.Snapshot, 0, len(snapshots))
+		for _, s := range snapshots {
+			if s.EventName == eventName {
+				deleted = append(deleted, s)
+				continue
+			}
+			kept = append(kept, s)
+		}
+		if err := m.deleteSnapshots(id, deleted); err != nil {
+			return invalidated, err
+		}
+		invalidated += len(deleted)
+		m.snapshots[id] = kept
+	}
+	return invalidated, nil
+}
+
+// InvalidateSnapshots deletes every snapshot item of streams with eventName and returns how many were deleted
+// It scans the whole table; on an error it returns how many were deleted before it
+func (d *DynamoDBEventStore) InvalidateSnapshots(ctx context.Context, eventName string) (int, error) {
+	var keys []AttributeValueMap
+	p := dynamodb.NewScanPaginator(d.DB, &dynamodb.ScanInput{
+		TableName:                aws.String(d.Table),
+		FilterExpression:         aws.String("attribute_exists(LatestVersion) AND EventName = :name"),
+		ProjectionExpression:     aws.String("#id, #version"),
+		ExpressionAttributeNames: map[string]string{"#id": "Id", "#version": "Version"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":name": &types.AttributeValueMemberS{Value: eventName},
+		},
+	})
+	for p.HasMorePages() {
+		out, err := p.NextPage(ctx)
+		if err != nil {
+			return 0, err
+		}
+		for _, item := range out.Items {
+			keys = append(keys, AttributeValueMap{"Id": item["Id"], "Version": item["Version"]})
+		}
+	}
+	return d.deleteItems(ctx, keys)
+}
@@ -0,0 +1,100 @@
+package store_test
+
+import (
+	"github.com/cpustejovsky/event-store/events"
+	"github.com/cpustejovsky/event-store/store"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"sync"
+	"testing"
+)
+
+// versionedSum is a sumAggregator with an AggregatorVersion
+type versionedSum struct {
+	sumAggregator
+	version int
+}
+
+func (v versionedSum) AggregatorVersion() int {
+	return v.version
+}
+
+// versionedStore returns an in-memory store aggregating "sum" events, a function registering the given aggregator version
+// and a function returning how many events the last projection folded
+func versionedStore(opts ...store.Option) (*store.InMemoryEventStore, func(int), func() int) {
+	var mu sync.Mutex
+	folded := 0
+	registry := events.NewRegistry()
+	register := func(version int) {
+		registry.Register("sum", func() events.Aggregator {
+			return versionedSum{sumAggregator: sumAggregator{mu: &mu, folded: &folded}, version: version}
+		})
+	}
+	register(1)
+	es := store.InMemory(append([]store.Option{store.WithRegistry(registry)}, opts...)...)
+	return es, register, func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return folded
+	}
+}
+
+func TestSnapshot_AggregatorVersion(t *testing.T) {
+	es, register, folded := versionedStore()
+	id := uuid.NewString()
+	snapshotSums(t, es, id, 1, 2)
+	projected, err := es.Project(ctx, id)
+	require.Nil(t, err)
+	assert.Equal(t, 1, folded())
+
+	//Snapshots of version 1 are ignored once version 2 is registered
+	register(2)
+	for i := 0; i < 2; i++ {
+		projected, err = es.Project(ctx, id)
+		require.Nil(t, err)
+		assert.Equal(t, 2, folded())
+		assert.Equal(t, []byte{3}, projected.Event)
+	}
+	projected, err = es.ProjectAt(ctx, id, 0)
+	require.Nil(t, err)
+	assert.Equal(t, 1, folded())
+	assert.Equal(t, []byte{1}, projected.Event)
+
+	//New snapshots record the registered version
+	snapshotSums(t, es, id, 3)
+	_, err = es.Project(ctx, id)
+	require.Nil(t, err)
+	assert.Equal(t, 1, folded())
+}
+
+func TestSnapshot_Rebuild(t *testing.T) {
+	es, register, folded := versionedStore(store.WithSnapshotRebuild())
+	id := uuid.NewString()
+	snapshotSums(t, es, id, 1, 2)
+	register(2)
+	_, err := es.Project(ctx, id)
+	require.Nil(t, err)
+	assert.Equal(t, 2, folded())
+	//The stale snapshot at the same version was replaced
+	projected, err := es.Project(ctx, id)
+	require.Nil(t, err)
+	assert.Equal(t, 1, folded())
+	assert.Equal(t, []byte{3}, projected.Event)
+}
+
+func TestInvalidateSnapshots(t *testing.T) {
+	es, _, folded := versionedStore()
+	id := uuid.NewString()
+	snapshotSums(t, es, id, 1, 2, 3)
+	invalidated, err := es.InvalidateSnapshots(ctx, events.HitPointsName)
+	require.Nil(t, err)
+	assert.Equal(t, 0, invalidated)
+	invalidated, err = es.InvalidateSnapshots(ctx, "sum")
+	require.Nil(t, err)
+	assert.Equal(t, 3, invalidated)
+	projected, err := es.Project(ctx, id)
+	require.Nil(t, err)
+	assert.Equal(t, 3, folded())
+	assert.Equal(t, []byte{6}, projected.Event)
+}
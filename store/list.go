@@ -0,0 +1,382 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/cpustejovsky/event-store/events"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// StreamValue is appended to a stream's id to form the Id of its header item in DynamoDB
+const StreamValue string = "STREAM"
+
+// StreamIndex is the global secondary index read by ListStreams
+// Its hash key is the StreamLog attribute, which spreads the stream headers over StreamShards partitions, and its range key is the StreamId attribute
+const StreamIndex string = "StreamIndex"
+
+// StreamShards is how many StreamIndex partitions the stream headers are spread over by a hash of the stream id
+// Every append rewrites the header of its stream, so a single StreamLog value would cap the appends of the whole table at the
+// 1,000 writes a second of an index partition; ListStreams queries every shard and merges them
+const StreamShards int = 16
+
+// streamShard returns the StreamIndex shard of the header of the stream id
+func streamShard(id string) int {
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	return int(h.Sum32() % uint32(StreamShards))
+}
+
+// streamLog returns the StreamLog attribute of the headers in shard
+func streamLog(shard int) string {
+	return LogValue + "#" + strconv.Itoa(shard)
+}
+
+// ListOptions selects the streams returned by ListStreams
+type ListOptions struct {
+	// Prefix selects the streams whose id starts with it
+	Prefix string
+	// EventName selects the streams whose latest event has it
+	EventName string
+	// PageToken continues a previous listing; it is the token ListStreams returned with the previous page
+	PageToken string
+	// Limit is the maximum number of streams to return; zero returns every stream
+	Limit int
+}
+
+// StreamInfo describes a stream
+type StreamInfo struct {
+	Id string
+	// EventName is the EventName of the stream's latest event
+	EventName     string
+	LatestVersion int
+	// UpdatedAt is when an event was last appended to the stream
+	UpdatedAt time.Time
+}
+
+// streamHeaders returns the header of every stream in the batch, in the order the streams first appear
+func streamHeaders(envelopes []events.Envelope) []StreamInfo {
+	var headers []StreamInfo
+	index := make(map[string]int)
+	for _, e := range envelopes {
+		i, ok := index[e.Id]
+		if !ok {
+			index[e.Id] = len(headers)
+			headers = append(headers, StreamInfo{Id: e.Id, EventName: e.EventName, LatestVersion: e.Version, UpdatedAt: e.RecordedAt})
+			continue
+		}
+		if e.Version > headers[i].LatestVersion {
+			headers[i].EventName = e.EventName
+			headers[i].LatestVersion = e.Version
+		}
+	}
+	return headers
+}
+
+// headerUpdate records the header of a stream unless it already records a later version or the stream was deleted
+// A tombstone records its DeleteMode in the Deleted attribute of the header
+// The header is returned with the cancellation reason of a failed condition, so appendBatch can tell a deleted stream from a gap
+func (d *DynamoDBEventStore) headerUpdate(header StreamInfo, mode DeleteMode) *types.Update {
+	update := &types.Update{
+		TableName: aws.String(d.Table),
+		Key: AttributeValueMap{
+			"Id":      &types.AttributeValueMemberS{Value: header.Id + StreamValue},
+			"Version": &types.AttributeValueMemberN{Value: "0"},
+		},
+		UpdateExpression:                    aws.String("SET #log = :log, #stream = :stream, #name = :name, #version = :version, #updated = :updated"),
+		ConditionExpression:                 aws.String("(attribute_not_exists(#version) OR #version < :version) AND attribute_not_exists(#deleted)"),
+		ReturnValuesOnConditionCheckFailure: types.ReturnValuesOnConditionCheckFailureAllOld,
+		ExpressionAttributeNames: map[string]string{
+			"#log":     "StreamLog",
+			"#stream":  "StreamId",
+			"#name":    "EventName",
+			"#version": "StreamVersion",
+			"#updated": "UpdatedAt",
+			"#deleted": "Deleted",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":log":     &types.AttributeValueMemberS{Value: streamLog(streamShard(header.Id))},
+			":stream":  &types.AttributeValueMemberS{Value: header.Id},
+			":name":    &types.AttributeValueMemberS{Value: header.EventName},
+			":version": &types.AttributeValueMemberN{Value: strconv.Itoa(header.LatestVersion)},
+			":updated": &types.AttributeValueMemberS{Value: header.UpdatedAt.Format(RecordedAtLayout)},
+		},
+	}
+	if mode != "" {
+		update.UpdateExpression = aws.String(*update.UpdateExpression + ", #deleted = :mode")
+		update.ExpressionAttributeValues[":mode"] = &types.AttributeValueMemberS{Value: string(mode)}
+	}
+	return update
+}
+
+// deletedHeader returns a StreamDeletedError if the header item records that its stream was deleted, and nil otherwise
+func deletedHeader(item AttributeValueMap) error {
+	mode, ok := item["Deleted"].(*types.AttributeValueMemberS)
+	if !ok {
+		return nil
+	}
+	info, err := streamInfo(item)
+	if err != nil {
+		return err
+	}
+	return &StreamDeletedError{ID: info.Id, Version: info.LatestVersion, Mode: DeleteMode(mode.Value)}
+}
+
+// ListStreams returns the streams selected by opts ordered by id, and the token of the next page
+// The token is empty once every selected stream has been returned
+// Streams last appended to before stream headers were introduced are listed once BackfillStreamHeaders has run
+// It reads the StreamShards partitions of StreamIndex, which is eventually consistent
+func (d *DynamoDBEventStore) ListStreams(ctx context.Context, opts ListOptions) ([]StreamInfo, string, error) {
+	var streams []StreamInfo
+	token := opts.PageToken
+	for {
+		want := 0
+		if opts.Limit > 0 {
+			want = opts.Limit - len(streams)
+		}
+		page, more, err := mergeShards(StreamShards, want, func(shard int, share int) ([]StreamInfo, error) {
+			return d.listShard(ctx, streamLog(shard), opts, token, share)
+		}, func(a, b StreamInfo) bool { return a.Id < b.Id })
+		if err != nil {
+			return nil, "", err
+		}
+		streams = append(streams, page...)
+		if !more || (opts.Limit > 0 && len(streams) >= opts.Limit) {
+			break
+		}
+		token = page[len(page)-1].Id
+	}
+	return streams, nextPageToken(streams, opts.Limit), nil
+}
+
+// listShard returns up to limit streams selected by opts after token in the StreamIndex partition with the StreamLog value, or every one for a limit of zero
+func (d *DynamoDBEventStore) listShard(ctx context.Context, log string, opts ListOptions, token string, limit int) ([]StreamInfo, error) {
+	params := dynamodb.QueryInput{
+		TableName:              aws.String(d.Table),
+		IndexName:              aws.String(StreamIndex),
+		KeyConditionExpression: aws.String("#log = :log"),
+		FilterExpression:       aws.String("attribute_not_exists(#deleted)"),
+		ExpressionAttributeNames: map[string]string{
+			"#log":     "StreamLog",
+			"#deleted": "Deleted",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":log": &types.AttributeValueMemberS{Value: log},
+		},
+	}
+	if opts.Prefix != "" {
+		params.KeyConditionExpression = aws.String("#log = :log AND begins_with(#stream, :prefix)")
+		params.ExpressionAttributeNames["#stream"] = "StreamId"
+		params.ExpressionAttributeValues[":prefix"] = &types.AttributeValueMemberS{Value: opts.Prefix}
+	}
+	if opts.EventName != "" {
+		params.FilterExpression = aws.String("attribute_not_exists(#deleted) AND #name = :name")
+		params.ExpressionAttributeNames["#name"] = "EventName"
+		params.ExpressionAttributeValues[":name"] = &types.AttributeValueMemberS{Value: opts.EventName}
+	}
+	if token != "" {
+		params.ExclusiveStartKey = AttributeValueMap{
+			"Id":        &types.AttributeValueMemberS{Value: token + StreamValue},
+			"Version":   &types.AttributeValueMemberN{Value: "0"},
+			"StreamLog": &types.AttributeValueMemberS{Value: log},
+			"StreamId":  &types.AttributeValueMemberS{Value: token},
+		}
+	}
+	if limit > 0 {
+		params.Limit = aws.Int32(int32(limit))
+	}
+	items, err := d.query(ctx, &params)
+	checkErr := &NoEventFoundError{}
+	if errors.As(err, &checkErr) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	streams := make([]StreamInfo, 0, len(items))
+	for _, item := range items {
+		info, err := streamInfo(item)
+		if err != nil {
+			return nil, err
+		}
+		streams = append(streams, info)
+	}
+	return streams, nil
+}
+
+// BackfillStreamHeaders writes the header of every stream that has events but no up to date header and returns how many it wrote
+// It scans the whole table, so it is meant to be run once after upgrading a table whose streams predate the headers
+// A header written by a concurrent append for a later version is kept, and a stream closed by a tombstone gets a deleted header
+// Headers written before StreamIndex was sharded are moved to the shard of their stream
+func (d *DynamoDBEventStore) BackfillStreamHeaders(ctx context.Context) (int, error) {
+	var headers []StreamInfo
+	var unsharded []string
+	modes := make(map[string]DeleteMode)
+	index := make(map[string]int)
+	p := dynamodb.NewScanPaginator(d.DB, &dynamodb.ScanInput{
+		TableName:        aws.String(d.Table),
+		FilterExpression: aws.String("(attribute_exists(#event) AND attribute_not_exists(LatestVersion)) OR #log = :log"),
+		ExpressionAttributeNames: map[string]string{
+			"#event": "Event",
+			"#log":   "StreamLog",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":log": &types.AttributeValueMemberS{Value: LogValue},
+		},
+	})
+	for p.HasMorePages() {
+		out, err := p.NextPage(ctx)
+		if err != nil {
+			return 0, err
+		}
+		for _, item := range out.Items {
+			if _, ok := item["StreamLog"]; ok {
+				info, err := streamInfo(item)
+				if err != nil {
+					return 0, err
+				}
+				unsharded = append(unsharded, info.Id)
+				continue
+			}
+			var e events.Envelope
+			if err := attributevalue.UnmarshalMap(item, &e); err != nil {
+				return 0, err
+			}
+			i, ok := index[e.Id]
+			if !ok {
+				i = len(headers)
+				index[e.Id] = i
+				headers = append(headers, StreamInfo{Id: e.Id, LatestVersion: -1})
+			}
+			if e.RecordedAt.After(headers[i].UpdatedAt) {
+				headers[i].UpdatedAt = e.RecordedAt
+			}
+			if e.Version > headers[i].LatestVersion {
+				headers[i].EventName = e.EventName
+				headers[i].LatestVersion = e.Version
+				modes[e.Id] = ""
+				if e.EventName == TombstoneEventName {
+					modes[e.Id] = DeleteMode(e.Event)
+				}
+			}
+		}
+	}
+	written := 0
+	for _, header := range headers {
+		_, err := d.DB.UpdateItem(ctx, updateItemInput(d.headerUpdate(header, modes[header.Id])))
+		checkErr := &types.ConditionalCheckFailedException{}
+		if errors.As(err, &checkErr) {
+			//The header is up to date or records that the stream was deleted
+			continue
+		}
+		if err != nil {
+			return written, err
+		}
+		written++
+	}
+	for _, id := range unsharded {
+		_, err := d.DB.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+			TableName: aws.String(d.Table),
+			Key: AttributeValueMap{
+				"Id":      &types.AttributeValueMemberS{Value: id + StreamValue},
+				"Version": &types.AttributeValueMemberN{Value: "0"},
+			},
+			UpdateExpression:    aws.String("SET #log = :shard"),
+			ConditionExpression: aws.String("#log = :log"),
+			ExpressionAttributeNames: map[string]string{
+				"#log": "StreamLog",
+			},
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":log":   &types.AttributeValueMemberS{Value: LogValue},
+				":shard": &types.AttributeValueMemberS{Value: streamLog(streamShard(id))},
+			},
+		})
+		checkErr := &types.ConditionalCheckFailedException{}
+		if errors.As(err, &checkErr) {
+			//The header was rewritten above or by a concurrent append
+			continue
+		}
+		if err != nil {
+			return written, err
+		}
+		written++
+	}
+	return written, nil
+}
+
+// streamInfo reads a stream header item
+func streamInfo(item AttributeValueMap) (StreamInfo, error) {
+	var info StreamInfo
+	if v, ok := item["StreamId"].(*types.AttributeValueMemberS); ok {
+		info.Id = v.Value
+	}
+	if v, ok := item["EventName"].(*types.AttributeValueMemberS); ok {
+		info.EventName = v.Value
+	}
+	if v, ok := item["StreamVersion"].(*types.AttributeValueMemberN); ok {
+		version, err := strconv.Atoi(v.Value)
+		if err != nil {
+			return info, err
+		}
+		info.LatestVersion = version
+	}
+	if v, ok := item["UpdatedAt"].(*types.AttributeValueMemberS); ok {
+		updated, err := time.Parse(RecordedAtLayout, v.Value)
+		if err != nil {
+			return info, err
+		}
+		info.UpdatedAt = updated
+	}
+	return info, nil
+}
+
+// nextPageToken returns the token continuing after a page that holds limit streams, or an empty token for the last page
+func nextPageToken(streams []StreamInfo, limit int) string {
+	if limit <= 0 || len(streams) < limit {
+		return ""
+	}
+	return streams[len(streams)-1].Id
+}
+
+// ListStreams returns the streams selected by opts ordered by id, and the token of the next page
+// The token is empty once every selected stream has been returned
+func (m *InMemoryEventStore) ListStreams(ctx context.Context, opts ListOptions) ([]StreamInfo, string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, "", err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	ids := make([]string, 0, len(m.streams))
+	for id, stream := range m.streams {
+		if len(stream) > 0 && m.deleted(id) == nil && strings.HasPrefix(id, opts.Prefix) && id > opts.PageToken {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	var streams []StreamInfo
+	for _, id := range ids {
+		stream := m.streams[id]
+		latest := stream[len(stream)-1]
+		if opts.EventName != "" && latest.EventName != opts.EventName {
+			continue
+		}
+		info := StreamInfo{Id: id, EventName: latest.EventName, LatestVersion: latest.Version}
+		for _, e := range stream {
+			if e.RecordedAt.After(info.UpdatedAt) {
+				info.UpdatedAt = e.RecordedAt
+			}
+		}
+		streams = append(streams, info)
+		if opts.Limit > 0 && len(streams) == opts.Limit {
+			break
+		}
+	}
+	return streams, nextPageToken(streams, opts.Limit), nil
+}
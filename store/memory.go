@@ -0,0 +1,494 @@
+package store
+
+import (
+	"context"
+	"github.com/cpustejovsky/event-store/events"
+	"sort"
+	"sync"
+	"time"
+)
+
+// InMemoryEventStore is a concurrency-safe EventStore that keeps every stream in memory
+// It mirrors the semantics of DynamoDBEventStore and is intended for tests and local development
+type InMemoryEventStore struct {
+	mu        sync.RWMutex
+	streams   map[string][]events.Envelope
+	snapshots map[string][]events.Snapshot
+	log       []events.Envelope
+	broker    broker
+	// journal, when set, persists every change before it is applied
+	journal journal
+	options
+}
+
+// journal persists the changes of an InMemoryEventStore; a change is applied only once its journal write succeeds
+// The store keeps journaled events without their Event and Headers, except for tombstones, and readEvents reads them back
+// Its methods are called with the store's lock held
+type journal interface {
+	appendEvents(envelopes []events.Envelope) error
+	putSnapshot(snapshot events.Snapshot) error
+	deleteSnapshots(id string, versions []int) error
+	readEvents(envelopes []events.Envelope) error
+}
+
+func InMemory(opts ...Option) *InMemoryEventStore {
+	m := &InMemoryEventStore{
+		streams:   make(map[string][]events.Envelope),
+		snapshots: make(map[string][]events.Snapshot),
+		options:   newOptions(opts),
+	}
+	m.broker.limit = DefaultSubscriptionBuffer
+	if m.options.subscriptionBuffer > 0 {
+		m.broker.limit = m.options.subscriptionBuffer
+	}
+	return m
+}
+
+// Append takes a context and Envelope and returns an error
+// It ensures the Version does not already exist for the Envelope's Id before storing a copy of it
+func (m *InMemoryEventStore) Append(ctx context.Context, e *events.Envelope) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := checkId(e.Id); err != nil {
+		return err
+	}
+	return m.appendLocked(ctx, func() ([]events.Envelope, error) {
+		if err := m.deleted(e.Id); err != nil {
+			return nil, err
+		}
+		if m.exists(e.Id, e.Version) {
+			return nil, &EventAlreadyExistsError{ID: e.Id, Version: e.Version}
+		}
+		batch := stamped([]events.Envelope{*e})
+		if err := m.commit(ctx, batch); err != nil {
+			return nil, err
+		}
+		e.RecordedAt = batch[0].RecordedAt
+		e.Position = batch[0].Position
+		return batch, nil
+	})
+}
+
+// AppendBatch takes a context and a slice of Envelopes and stores all of them or none of them
+func (m *InMemoryEventStore) AppendBatch(ctx context.Context, envelopes []events.Envelope) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := validateBatch(envelopes); err != nil {
+		return err
+	}
+	return m.appendLocked(ctx, func() ([]events.Envelope, error) {
+		for _, e := range envelopes {
+			if err := m.deleted(e.Id); err != nil {
+				return nil, err
+			}
+			if m.exists(e.Id, e.Version) {
+				return nil, &EventAlreadyExistsError{ID: e.Id, Version: e.Version}
+			}
+		}
+		batch := stamped(envelopes)
+		if err := m.commit(ctx, batch); err != nil {
+			return nil, err
+		}
+		recorded(envelopes, batch)
+		return batch, nil
+	})
+}
+
+// AppendExpected appends envelopes to the stream with id only if its latest version is expectedVersion
+// The store assigns the Id and consecutive Versions of the envelopes; all of them are appended or none are
+func (m *InMemoryEventStore) AppendExpected(ctx context.Context, id string, expectedVersion int, envelopes ...events.Envelope) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := checkId(id); err != nil {
+		return err
+	}
+	return m.appendLocked(ctx, func() ([]events.Envelope, error) {
+		if err := m.deleted(id); err != nil {
+			return nil, err
+		}
+		stream := m.streams[id]
+		actual := NoStream
+		if len(stream) > 0 {
+			actual = stream[len(stream)-1].Version
+		}
+		if err := checkExpectedVersion(id, expectedVersion, actual); err != nil {
+			return nil, err
+		}
+		batch := versionEnvelopes(id, actual, envelopes)
+		if err := validateBatch(batch); err != nil {
+			return nil, err
+		}
+		stamp(batch)
+		return batch, m.commit(ctx, batch)
+	})
+}
+
+// appendLocked runs commit, which appends and returns a batch, with the lock held
+// and then evaluates the snapshot policies of the batch, which takes the lock again
+func (m *InMemoryEventStore) appendLocked(ctx context.Context, commit func() ([]events.Envelope, error)) error {
+	batch, err := func() ([]events.Envelope, error) {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		return commit()
+	}()
+	if err != nil {
+		return err
+	}
+	m.snapshotAppended(ctx, m, batch)
+	return nil
+}
+
+// Subscribe returns a channel that receives the events matching filter appended after the call
+// Events are published while the store's lock is held, so they arrive in the order they were appended
+// The channel is closed when ctx is done, an appended event filter matches cannot be upcast
+// or the consumer falls more than the subscription buffer of events behind, after the events queued before
+func (m *InMemoryEventStore) Subscribe(ctx context.Context, filter SubscriptionFilter) (<-chan events.Envelope, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return m.broker.subscribe(ctx, filter), nil
+}
+
+// publish delivers appended envelopes to subscriptions in the current schema of their events
+// An envelope that cannot be upcast closes the subscriptions whose filter matches it as stored after the envelopes preceding it,
+// like a DynamoDBEventStore subscription; the other subscriptions keep receiving the envelopes after it
+func (m *InMemoryEventStore) publish(envelopes ...events.Envelope) {
+	upcast := make([]events.Envelope, 0, len(envelopes))
+	for i, e := range envelopes {
+		u, err := m.aggregators().Upcast(e)
+		if err != nil {
+			m.broker.publish(upcast...)
+			m.broker.close(&envelopes[i])
+			upcast = upcast[:0]
+			continue
+		}
+		upcast = append(upcast, u)
+	}
+	m.broker.publish(upcast...)
+}
+
+// Snapshot stores a copy of the snapshot separately from the events of its stream
+// Like DynamoDBEventStore, snapshots are keyed by their Version and cannot be overwritten
+func (m *InMemoryEventStore) Snapshot(ctx context.Context, snapshot *events.Snapshot) error {
+	return m.putSnapshot(ctx, snapshot, false)
+}
+
+// replaceSnapshot stores a copy of the snapshot, overwriting a snapshot with the same Version
+func (m *InMemoryEventStore) replaceSnapshot(ctx context.Context, snapshot *events.Snapshot) error {
+	return m.putSnapshot(ctx, snapshot, true)
+}
+
+func (m *InMemoryEventStore) putSnapshot(ctx context.Context, snapshot *events.Snapshot, replace bool) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	snapshots := m.snapshots[snapshot.Id]
+	i := sort.Search(len(snapshots), func(i int) bool { return snapshots[i].Version >= snapshot.Version })
+	exists := i < len(snapshots) && snapshots[i].Version == snapshot.Version
+	if exists && !replace {
+		return &EventAlreadyExistsError{ID: snapshot.Id + SnapshotValue, Version: snapshot.Version}
+	}
+	snapshot.RecordedAt = recordedAt()
+	snapshot.AggregatorVersion = m.aggregatorVersion(snapshot.EventName)
+	s := *snapshot
+	payload, err := m.encryptSnapshot(ctx, snapshot)
+	if err != nil {
+		return err
+	}
+	s.Event = append([]byte(nil), payload...)
+	s.Headers = copyHeaders(snapshot.Headers)
+	if m.journal != nil {
+		if err := m.journal.putSnapshot(s); err != nil {
+			return err
+		}
+	}
+	m.storeSnapshot(s)
+	return nil
+}
+
+// storeSnapshot stores s in Version order, replacing a snapshot with the same Version; callers must hold the lock
+func (m *InMemoryEventStore) storeSnapshot(s events.Snapshot) {
+	snapshots := m.snapshots[s.Id]
+	i := sort.Search(len(snapshots), func(i int) bool { return snapshots[i].Version >= s.Version })
+	if i == len(snapshots) || snapshots[i].Version != s.Version {
+		snapshots = append(snapshots, events.Snapshot{})
+		copy(snapshots[i+1:], snapshots[i:])
+	}
+	snapshots[i] = s
+	m.snapshots[s.Id] = snapshots
+}
+
+// Project takes an id, reads events since the last snapshot, and returns a reconstituted Envelope
+// If the SnapshotPolicy for the stream's EventName asks for it, the result is stored as a new snapshot
+func (m *InMemoryEventStore) Project(ctx context.Context, id string) (*events.Envelope, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	projected, since, stale, err := m.project(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	m.autoSnapshot(ctx, m, projected, since, stale)
+	return projected, nil
+}
+
+// project reconstitutes the stream with id and returns the events folded on top of its latest snapshot
+// stale reports that the latest snapshot was built by another version of the aggregator and was not used
+func (m *InMemoryEventStore) project(ctx context.Context, id string) (projected *events.Envelope, since []events.Envelope, stale bool, err error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if err := m.deleted(id); err != nil {
+		return nil, nil, false, err
+	}
+	snapshots := m.snapshots[id]
+	if len(snapshots) > 0 {
+		stale = !m.current(&snapshots[len(snapshots)-1])
+	}
+	if len(snapshots) == 0 || stale {
+		envelopes, err := m.queryAll(ctx, id)
+		if err != nil {
+			return nil, nil, stale, err
+		}
+		projected, err := m.aggregate(envelopes)
+		return projected, envelopes, stale, err
+	}
+	snapshot := snapshots[len(snapshots)-1]
+	//No events recorded since the snapshot is not an error; the snapshot alone is the projection
+	envelopes, _ := m.read(ctx, id, ReadOptions{FromVersion: snapshot.LatestVersion})
+	projected, err = m.aggregateSnapshot(ctx, &snapshot, envelopes)
+	return projected, envelopes, false, err
+}
+
+// ProjectAt takes an id and version and returns the Envelope reconstituted from the events up to and including version
+func (m *InMemoryEventStore) ProjectAt(ctx context.Context, id string, version int) (*events.Envelope, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.projectAt(ctx, id, version)
+}
+
+// ProjectAsOf takes an id and time and returns the Envelope reconstituted from the events recorded at or before t
+func (m *InMemoryEventStore) ProjectAsOf(ctx context.Context, id string, t time.Time) (*events.Envelope, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if err := m.deleted(id); err != nil {
+		return nil, err
+	}
+	version, err := versionAsOf(m.streams[id], t)
+	if err != nil {
+		return nil, err
+	}
+	return m.projectAt(ctx, id, version)
+}
+
+// projectAt reconstitutes the stream with id up to version; callers must hold the lock
+func (m *InMemoryEventStore) projectAt(ctx context.Context, id string, version int) (*events.Envelope, error) {
+	if err := m.deleted(id); err != nil {
+		return nil, err
+	}
+	var snapshot *events.Snapshot
+	if s := snapshotAt(m.currentSnapshots(m.snapshots[id]), version); s != nil {
+		c := *s
+		snapshot = &c
+	}
+	return m.options.projectAt(ctx, lockedReader{m}, id, version, snapshot)
+}
+
+func (m *InMemoryEventStore) QueryLatestVersion(ctx context.Context, id string) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return -1, err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if err := m.deleted(id); err != nil {
+		return -1, err
+	}
+	stream := m.streams[id]
+	if len(stream) == 0 {
+		return -1, &NoEventFoundError{}
+	}
+	return stream[len(stream)-1].Version, nil
+}
+
+// QueryAll takes a context and id and returns a slice of Events ordered by Version and an error
+func (m *InMemoryEventStore) QueryAll(ctx context.Context, id string) ([]events.Envelope, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.queryAll(ctx, id)
+}
+
+// Read takes a context, id and ReadOptions and returns the selected range of the stream
+func (m *InMemoryEventStore) Read(ctx context.Context, id string, opts ReadOptions) ([]events.Envelope, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.read(ctx, id, opts)
+}
+
+// ReadAll takes a context, position and limit and returns up to limit events of every stream from fromPosition on in global order
+// The position of an event removed by a HardDelete holds an erased marker
+func (m *InMemoryEventStore) ReadAll(ctx context.Context, fromPosition int, limit int) ([]events.Envelope, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if fromPosition < 0 {
+		fromPosition = 0
+	}
+	var envelopes []events.Envelope
+	for i := fromPosition; i < len(m.log); i++ {
+		if erased(&m.log[i]) {
+			envelopes = append(envelopes, erasedMarker(i))
+		} else {
+			envelopes = append(envelopes, copyEnvelope(m.log[i]))
+		}
+		if limit > 0 && len(envelopes) == limit {
+			break
+		}
+	}
+	if len(envelopes) == 0 {
+		return nil, &NoEventFoundError{}
+	}
+	if err := m.load(ctx, envelopes); err != nil {
+		return nil, err
+	}
+	return envelopes, nil
+}
+
+func (m *InMemoryEventStore) queryAll(ctx context.Context, id string) ([]events.Envelope, error) {
+	return m.read(ctx, id, ReadOptions{})
+}
+
+// read returns copies of the events of the stream with id selected by opts; callers must hold the lock
+func (m *InMemoryEventStore) read(ctx context.Context, id string, opts ReadOptions) ([]events.Envelope, error) {
+	if err := m.deleted(id); err != nil {
+		return nil, err
+	}
+	stream := m.streams[id]
+	var envelopes []events.Envelope
+	for i := range stream {
+		e := stream[i]
+		if opts.Reverse {
+			e = stream[len(stream)-1-i]
+		}
+		if e.Version < opts.FromVersion || (opts.ToVersion != nil && e.Version > *opts.ToVersion) {
+			continue
+		}
+		envelopes = append(envelopes, copyEnvelope(e))
+		if opts.Limit > 0 && len(envelopes) == opts.Limit {
+			break
+		}
+	}
+	if len(envelopes) == 0 {
+		return nil, &NoEventFoundError{}
+	}
+	if err := m.load(ctx, envelopes); err != nil {
+		return nil, err
+	}
+	return envelopes, nil
+}
+
+// load reads the Event and Headers of journaled envelopes back from the journal and decodes the envelopes; callers must hold the lock
+func (m *InMemoryEventStore) load(ctx context.Context, envelopes []events.Envelope) error {
+	if m.journal != nil {
+		if err := m.journal.readEvents(envelopes); err != nil {
+			return err
+		}
+	}
+	return m.decode(ctx, envelopes)
+}
+
+// lockedReader reads from an InMemoryEventStore whose lock is already held
+type lockedReader struct {
+	m *InMemoryEventStore
+}
+
+func (r lockedReader) Read(ctx context.Context, id string, opts ReadOptions) ([]events.Envelope, error) {
+	return r.m.read(ctx, id, opts)
+}
+
+// exists reports whether the stream with id has an event at version; callers must hold the lock
+func (m *InMemoryEventStore) exists(id string, version int) bool {
+	stream := m.streams[id]
+	i := sort.Search(len(stream), func(i int) bool { return stream[i].Version >= version })
+	return i < len(stream) && stream[i].Version == version
+}
+
+// commit assigns the envelopes the next global Positions, writes them to the journal, stores them and publishes them
+// The journal and the store receive the envelopes with their personal data encrypted; subscriptions receive them as they were appended
+// Callers must hold the lock and check exists first
+func (m *InMemoryEventStore) commit(ctx context.Context, envelopes []events.Envelope) error {
+	for i := range envelopes {
+		envelopes[i].Position = len(m.log) + i
+	}
+	stored, err := m.encrypt(ctx, envelopes)
+	if err != nil {
+		return err
+	}
+	if m.journal != nil {
+		if err := m.journal.appendEvents(stored); err != nil {
+			return err
+		}
+	}
+	for _, e := range stored {
+		m.insert(e)
+	}
+	m.publish(envelopes...)
+	return nil
+}
+
+// insert stores a copy of e, whose Position must be the next global position, in Version order; callers must hold the lock
+// A HardDelete tombstone erases the events before it
+// With a journal only the metadata of e is kept, as load reads its Event and Headers back; a tombstone keeps its DeleteMode
+func (m *InMemoryEventStore) insert(e events.Envelope) {
+	if m.journal != nil && tombstoneError(&e) == nil {
+		e.Event, e.Headers = nil, nil
+	}
+	m.log = append(m.log, copyEnvelope(e))
+	if erased(&e) {
+		return
+	}
+	stream := m.streams[e.Id]
+	i := sort.Search(len(stream), func(i int) bool { return stream[i].Version >= e.Version })
+	stream = append(stream, events.Envelope{})
+	copy(stream[i+1:], stream[i:])
+	stream[i] = copyEnvelope(e)
+	m.streams[e.Id] = stream
+	if deleted, ok := purged(tombstoneError(&e), HardDelete); ok {
+		m.erase(e.Id, deleted.Version)
+	}
+}
+
+// copyEnvelope returns a copy of e that does not share its Event bytes or Headers
+func copyEnvelope(e events.Envelope) events.Envelope {
+	e.Event = append([]byte(nil), e.Event...)
+	e.Headers = copyHeaders(e.Headers)
+	return e
+}
+
+func copyHeaders(headers map[string]string) map[string]string {
+	if headers == nil {
+		return nil
+	}
+	c := make(map[string]string, len(headers))
+	for k, v := range headers {
+		c[k] = v
+	}
+	return c
+}
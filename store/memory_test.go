@@ -0,0 +1,101 @@
+package store_test
+
+import (
+	"context"
+	"errors"
+	"github.com/cpustejovsky/event-store/events"
+	"github.com/cpustejovsky/event-store/store"
+	"github.com/cpustejovsky/event-store/store/storetest"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"sync"
+	"testing"
+)
+
+func TestInMemoryEventStore(t *testing.T) {
+	storetest.Run(t, func() store.EventStore {
+		return store.InMemory()
+	})
+}
+
+func TestInMemoryEventStore_Registry(t *testing.T) {
+	storetest.RunRegistry(t, func(registry *events.Registry) store.EventStore {
+		return store.InMemory(store.WithRegistry(registry))
+	})
+}
+
+func TestInMemoryEventStore_ConcurrentAppend(t *testing.T) {
+	es := store.InMemory()
+	id := uuid.NewString()
+	const n = 50
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(v int) {
+			defer wg.Done()
+			//Every version is appended twice; exactly one of each pair may succeed
+			e := events.Envelope{Id: id, Version: v % (n / 2), EventName: events.HitPointsName}
+			_ = es.Append(ctx, &e)
+		}(i)
+	}
+	wg.Wait()
+	queried, err := es.QueryAll(ctx, id)
+	require.Nil(t, err)
+	require.Equal(t, n/2, len(queried))
+	for i, e := range queried {
+		assert.Equal(t, i, e.Version)
+	}
+}
+
+func TestInMemoryEventStore_WithRegistry(t *testing.T) {
+	registry := events.NewRegistry()
+	registry.Register("count", func() events.Aggregator { return countAggregator{} })
+	es := store.InMemory(store.WithRegistry(registry))
+	id := uuid.NewString()
+	for v := 0; v < 3; v++ {
+		require.Nil(t, es.Append(ctx, &events.Envelope{Id: id, Version: v, EventName: "count"}))
+	}
+	projected, err := es.Project(ctx, id)
+	require.Nil(t, err)
+	assert.Equal(t, []byte{3}, projected.Event)
+
+	//The default registry does not know the event
+	other := store.InMemory()
+	require.Nil(t, other.Append(ctx, &events.Envelope{Id: id, EventName: "count"}))
+	_, err = other.Project(ctx, id)
+	checkErr := &events.AggregatorNotFoundError{}
+	assert.True(t, errors.As(err, &checkErr))
+}
+
+// countAggregator aggregates events into the number of events
+type countAggregator struct{}
+
+func (countAggregator) Aggregate(events [][]byte) ([]byte, error) {
+	return []byte{byte(len(events))}, nil
+}
+
+func TestInMemoryEventStore_SubscriptionBuffer(t *testing.T) {
+	es := store.InMemory(store.WithSubscriptionBuffer(2))
+	id := uuid.NewString()
+	subCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	lagging, err := es.Subscribe(subCtx, store.SubscriptionFilter{Id: id})
+	require.Nil(t, err)
+	other, err := es.Subscribe(subCtx, store.SubscriptionFilter{Id: "other"})
+	require.Nil(t, err)
+	appendVersions(t, es, id, 0, 4)
+
+	//A consumer that receives nothing while more events than the buffer are appended gets the events queued before and is closed
+	var received []int
+	for e := range lagging {
+		received = append(received, e.Version)
+	}
+	require.NotEmpty(t, received)
+	assert.Less(t, len(received), 5)
+	assert.Equal(t, versions(0, len(received)-1), received)
+	//Subscriptions that keep up are not affected
+	require.Nil(t, es.Append(ctx, &events.Envelope{Id: "other", Version: 0, EventName: events.HitPointsName}))
+	e := <-other
+	assert.Equal(t, "other", e.Id)
+}
@@ -0,0 +1,42 @@
+CREATE TABLE event_store_events (
+	id TEXT NOT NULL,
+	version INTEGER NOT NULL,
+	position INTEGER NOT NULL,
+	event_name TEXT NOT NULL,
+	schema_version INTEGER NOT NULL DEFAULT 0,
+	event BLOB,
+	recorded_at TEXT NOT NULL,
+	user_name TEXT NOT NULL DEFAULT '',
+	correlation_id TEXT NOT NULL DEFAULT '',
+	causation_id TEXT NOT NULL DEFAULT '',
+	headers TEXT,
+	PRIMARY KEY (id, version)
+);
+
+CREATE UNIQUE INDEX event_store_events_position ON event_store_events (position);
+
+CREATE INDEX event_store_events_event_name ON event_store_events (event_name, position);
+
+CREATE TABLE event_store_snapshots (
+	id TEXT NOT NULL,
+	version INTEGER NOT NULL,
+	latest_version INTEGER NOT NULL,
+	aggregator_version INTEGER NOT NULL DEFAULT 0,
+	event_name TEXT NOT NULL,
+	event BLOB,
+	recorded_at TEXT NOT NULL,
+	user_name TEXT NOT NULL DEFAULT '',
+	correlation_id TEXT NOT NULL DEFAULT '',
+	causation_id TEXT NOT NULL DEFAULT '',
+	headers TEXT,
+	PRIMARY KEY (id, version)
+);
+
+CREATE INDEX event_store_snapshots_event_name ON event_store_snapshots (event_name);
+
+CREATE TABLE event_store_positions (
+	id INTEGER PRIMARY KEY,
+	position INTEGER NOT NULL
+);
+
+INSERT INTO event_store_positions (id, position) VALUES (1, -1);
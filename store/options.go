@@ -0,0 +1,72 @@
+package store
+
+import (
+	"context"
+	"github.com/cpustejovsky/event-store/events"
+)
+
+// Option configures an EventStore created by DynamoDB or InMemory
+type Option func(*options)
+
+// options holds the configuration shared by the EventStore implementations
+type options struct {
+	registry           *events.Registry
+	policies           map[string]SnapshotPolicy
+	async              bool
+	onSnapshotError    func(error)
+	retention          RetentionPolicy
+	rebuild            bool
+	segmentSize        int64
+	subscriptionBuffer int
+	keys               KeyStore
+	personalData       map[string]PersonalData
+}
+
+// defaultRegistry aggregates streams when no Registry is configured
+var defaultRegistry = events.DefaultRegistry()
+
+func newOptions(opts []Option) options {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// WithRegistry sets the Registry whose aggregators reconstitute streams in Project, ProjectAt and ProjectAsOf
+// Without it events.DefaultRegistry is used
+func WithRegistry(r *events.Registry) Option {
+	return func(o *options) {
+		o.registry = r
+	}
+}
+
+// aggregators returns the configured Registry or the default one
+func (o *options) aggregators() *events.Registry {
+	if o.registry == nil {
+		return defaultRegistry
+	}
+	return o.registry
+}
+
+// decode decrypts the envelopes read from a store and brings them to the current schema of their events in place
+func (o *options) decode(ctx context.Context, envelopes []events.Envelope) error {
+	if err := o.decrypt(ctx, envelopes); err != nil {
+		return err
+	}
+	return o.aggregators().UpcastEnvelopes(envelopes)
+}
+
+// aggregate reconstitutes the ordered envelopes of a stream
+func (o *options) aggregate(envelopes []events.Envelope) (*events.Envelope, error) {
+	return o.aggregators().AggregateEnvelopes(envelopes)
+}
+
+// aggregateSnapshot folds the decoded envelopes recorded since a snapshot onto the snapshot's aggregate
+func (o *options) aggregateSnapshot(ctx context.Context, snapshot *events.Snapshot, envelopes []events.Envelope) (*events.Envelope, error) {
+	snapshot, err := o.decryptSnapshot(ctx, snapshot)
+	if err != nil {
+		return nil, err
+	}
+	return o.aggregators().AggregateSnapshot(snapshot, envelopes)
+}
@@ -0,0 +1,194 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"github.com/cpustejovsky/event-store/events"
+)
+
+// SnapshotStats describes the events Project folded on top of a stream's latest snapshot, or every event when there is none
+type SnapshotStats struct {
+	EventName string
+	// Events is the number of events recorded since the latest snapshot
+	Events int
+	// Bytes is the total size of the events recorded since the latest snapshot
+	Bytes int
+}
+
+// SnapshotPolicy decides whether a stream's projection is stored as a new snapshot
+// It is evaluated by Project and after every append of an event with its EventName
+type SnapshotPolicy interface {
+	ShouldSnapshot(SnapshotStats) bool
+}
+
+// SnapshotPolicyFunc adapts a function to a SnapshotPolicy
+type SnapshotPolicyFunc func(SnapshotStats) bool
+
+func (f SnapshotPolicyFunc) ShouldSnapshot(stats SnapshotStats) bool {
+	return f(stats)
+}
+
+// EveryNEvents snapshots a stream once n events have been recorded since its latest snapshot
+func EveryNEvents(n int) SnapshotPolicy {
+	return SnapshotPolicyFunc(func(stats SnapshotStats) bool {
+		return stats.Events >= n
+	})
+}
+
+// ByteThreshold snapshots a stream once the events recorded since its latest snapshot add up to at least bytes
+func ByteThreshold(bytes int) SnapshotPolicy {
+	return SnapshotPolicyFunc(func(stats SnapshotStats) bool {
+		return stats.Bytes >= bytes
+	})
+}
+
+// WithSnapshotPolicy makes Project and the appends snapshot the streams of eventName according to policy
+// A policy for the empty eventName applies to every event name without a policy of its own
+func WithSnapshotPolicy(eventName string, policy SnapshotPolicy) Option {
+	return func(o *options) {
+		if o.policies == nil {
+			o.policies = make(map[string]SnapshotPolicy)
+		}
+		o.policies[eventName] = policy
+	}
+}
+
+// WithAsyncSnapshots makes Project and the appends write the snapshots asked for by a SnapshotPolicy in the background instead of before returning
+// onError, which may be nil, receives the errors of those writes
+func WithAsyncSnapshots(onError func(error)) Option {
+	return func(o *options) {
+		o.async = true
+		o.onSnapshotError = onError
+	}
+}
+
+// WithSnapshotErrors sets the function receiving the errors of the snapshots written before Project or an append returns,
+// which do not fail the call as its events were read or stored
+func WithSnapshotErrors(onError func(error)) Option {
+	return func(o *options) {
+		o.onSnapshotError = onError
+	}
+}
+
+// snapshotter is the part of an EventStore that stores snapshots
+type snapshotter interface {
+	Snapshot(context.Context, *events.Snapshot) error
+	replaceSnapshot(context.Context, *events.Snapshot) error
+}
+
+// projector is the part of an EventStore that projects the streams appended to for their snapshot policies
+type projector interface {
+	snapshotter
+	project(ctx context.Context, id string) (projected *events.Envelope, since []events.Envelope, stale bool, err error)
+}
+
+// policy returns the SnapshotPolicy for eventName, or nil when snapshots are not automatic
+func (o *options) policy(eventName string) SnapshotPolicy {
+	if policy, ok := o.policies[eventName]; ok {
+		return policy
+	}
+	return o.policies[""]
+}
+
+// autoSnapshot stores projected as a snapshot when the policy for its EventName asks for one
+// or when the latest snapshot is stale and WithSnapshotRebuild is set, in the background with WithAsyncSnapshots
+// since holds the events folded on top of the latest snapshot; a stale snapshot is overwritten rather than kept
+// The projection succeeded whether or not the snapshot is written, so a failed write goes to the snapshot error handler
+func (o *options) autoSnapshot(ctx context.Context, s snapshotter, projected *events.Envelope, since []events.Envelope, stale bool) {
+	write := o.snapshotWrite(s, projected, since, stale)
+	if write == nil {
+		return
+	}
+	if !o.async {
+		o.snapshotError(write(ctx))
+		return
+	}
+	go func() {
+		//The snapshot outlives the Project call, so it is not bound to its context
+		o.snapshotError(write(context.Background()))
+	}()
+}
+
+// snapshotAppended evaluates the snapshot policies of the streams appended to like Project does, so streams that are rarely projected get snapshots too
+// Streams are projected only for events whose EventName has a policy, and never for tombstones
+// The events are already stored, so the errors of the projections and writes go to the snapshot error handler
+func (o *options) snapshotAppended(ctx context.Context, p projector, envelopes []events.Envelope) {
+	var ids []string
+	seen := make(map[string]bool)
+	for i := range envelopes {
+		e := &envelopes[i]
+		if seen[e.Id] || tombstoneError(e) != nil || o.policy(e.EventName) == nil {
+			continue
+		}
+		seen[e.Id] = true
+		ids = append(ids, e.Id)
+	}
+	if len(ids) == 0 {
+		return
+	}
+	snapshot := func(ctx context.Context) {
+		for _, id := range ids {
+			projected, since, stale, err := p.project(ctx, id)
+			if err != nil {
+				o.snapshotError(err)
+				continue
+			}
+			if write := o.snapshotWrite(p, projected, since, stale); write != nil {
+				o.snapshotError(write(ctx))
+			}
+		}
+	}
+	if !o.async {
+		snapshot(ctx)
+		return
+	}
+	//The snapshots outlive the append, so they are not bound to its context
+	go snapshot(context.Background())
+}
+
+// snapshotWrite returns the write storing projected as a snapshot, or nil when none is asked for
+// A snapshot already stored for the same version by a concurrent Project is not an error
+func (o *options) snapshotWrite(s snapshotter, projected *events.Envelope, since []events.Envelope, stale bool) func(context.Context) error {
+	if !(stale && o.rebuild) && !o.shouldSnapshot(projected.EventName, since) {
+		return nil
+	}
+	snapshot := &events.Snapshot{
+		Id:            projected.Id,
+		Version:       projected.Version,
+		LatestVersion: projected.Version,
+		Event:         append([]byte(nil), projected.Event...),
+		EventName:     projected.EventName,
+		Metadata:      projected.Metadata,
+	}
+	return func(ctx context.Context) error {
+		if stale {
+			return s.replaceSnapshot(ctx, snapshot)
+		}
+		err := s.Snapshot(ctx, snapshot)
+		checkErr := &EventAlreadyExistsError{}
+		if errors.As(err, &checkErr) {
+			return nil
+		}
+		return err
+	}
+}
+
+// snapshotError passes a failed snapshot write to the handler set by WithSnapshotErrors or WithAsyncSnapshots
+func (o *options) snapshotError(err error) {
+	if err != nil && o.onSnapshotError != nil {
+		o.onSnapshotError(err)
+	}
+}
+
+// shouldSnapshot reports whether the policy for eventName asks for a snapshot after the events since the latest one
+func (o *options) shouldSnapshot(eventName string, since []events.Envelope) bool {
+	policy := o.policy(eventName)
+	if policy == nil || len(since) == 0 {
+		return false
+	}
+	stats := SnapshotStats{EventName: eventName, Events: len(since)}
+	for _, e := range since {
+		stats.Bytes += len(e.Event)
+	}
+	return policy.ShouldSnapshot(stats)
+}
@@ -0,0 +1,159 @@
+package store_test
+
+import (
+	"errors"
+	"github.com/cpustejovsky/event-store/events"
+	"github.com/cpustejovsky/event-store/store"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// sumAggregator adds up single byte events and records how many events it was given
+type sumAggregator struct {
+	mu     *sync.Mutex
+	folded *int
+}
+
+func (s sumAggregator) Aggregate(events [][]byte) ([]byte, error) {
+	s.mu.Lock()
+	*s.folded = len(events)
+	s.mu.Unlock()
+	var sum byte
+	for _, e := range events {
+		if len(e) > 0 {
+			sum += e[0]
+		}
+	}
+	return []byte{sum}, nil
+}
+
+// policyStore returns an in-memory store aggregating "sum" events and a function returning how many events the last projection folded
+func policyStore(opts ...store.Option) (*store.InMemoryEventStore, func() int) {
+	var mu sync.Mutex
+	folded := 0
+	registry := events.NewRegistry()
+	registry.Register("sum", func() events.Aggregator { return sumAggregator{mu: &mu, folded: &folded} })
+	es := store.InMemory(append([]store.Option{store.WithRegistry(registry)}, opts...)...)
+	return es, func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return folded
+	}
+}
+
+func appendSums(t *testing.T, es store.EventStore, id string, values ...byte) {
+	t.Helper()
+	for _, v := range values {
+		require.Nil(t, es.AppendExpected(ctx, id, store.AnyVersion, events.Envelope{EventName: "sum", Event: []byte{v}}))
+	}
+}
+
+func TestSnapshotPolicy_EveryNEvents(t *testing.T) {
+	es, folded := policyStore(store.WithSnapshotPolicy("sum", store.EveryNEvents(3)))
+	id := uuid.NewString()
+	appendSums(t, es, id, 1, 2)
+	_, err := es.Project(ctx, id)
+	require.Nil(t, err)
+	assert.Equal(t, 2, folded())
+
+	//Appending the third event snapshots the stream, so Project only folds the snapshot
+	appendSums(t, es, id, 3)
+	projected, err := es.Project(ctx, id)
+	require.Nil(t, err)
+	assert.Equal(t, 1, folded())
+	assert.Equal(t, []byte{6}, projected.Event)
+
+	//The snapshot of the first three events is folded with the event after it
+	appendSums(t, es, id, 4)
+	projected, err = es.Project(ctx, id)
+	require.Nil(t, err)
+	assert.Equal(t, 2, folded())
+	assert.Equal(t, []byte{10}, projected.Event)
+	assert.Equal(t, 4, projected.Version)
+}
+
+func TestSnapshotPolicy_PerEventName(t *testing.T) {
+	es, folded := policyStore(
+		store.WithSnapshotPolicy("", store.EveryNEvents(1)),
+		store.WithSnapshotPolicy("sum", store.ByteThreshold(3)),
+	)
+	id := uuid.NewString()
+	appendSums(t, es, id, 1, 1)
+	_, err := es.Project(ctx, id)
+	require.Nil(t, err)
+	_, err = es.Project(ctx, id)
+	require.Nil(t, err)
+	assert.Equal(t, 2, folded())
+
+	appendSums(t, es, id, 1)
+	_, err = es.Project(ctx, id)
+	require.Nil(t, err)
+	projected, err := es.Project(ctx, id)
+	require.Nil(t, err)
+	assert.Equal(t, 1, folded())
+	assert.Equal(t, []byte{3}, projected.Event)
+}
+
+func TestSnapshotPolicy_Async(t *testing.T) {
+	errs := make(chan error, 1)
+	es, folded := policyStore(
+		store.WithSnapshotPolicy("sum", store.EveryNEvents(2)),
+		store.WithAsyncSnapshots(func(err error) { errs <- err }),
+	)
+	id := uuid.NewString()
+	appendSums(t, es, id, 1, 2)
+	_, err := es.Project(ctx, id)
+	require.Nil(t, err)
+	assert.Eventually(t, func() bool {
+		projected, err := es.Project(ctx, id)
+		return err == nil && folded() == 1 && projected.Version == 2
+	}, 5*time.Second, time.Millisecond)
+	select {
+	case err := <-errs:
+		t.Fatal(err)
+	default:
+	}
+}
+
+func TestSnapshotPolicy_Append(t *testing.T) {
+	es, folded := policyStore(store.WithSnapshotPolicy("sum", store.EveryNEvents(2)))
+	id := uuid.NewString()
+	//The streams appended to are snapshotted without being projected
+	appendSums(t, es, id, 1, 2, 3)
+	require.Nil(t, es.AppendBatch(ctx, []events.Envelope{{Id: id, Version: 3, EventName: "sum", Event: []byte{4}}}))
+	projected, err := es.Project(ctx, id)
+	require.Nil(t, err)
+	assert.Equal(t, 1, folded())
+	assert.Equal(t, []byte{10}, projected.Event)
+	assert.Equal(t, 4, projected.Version)
+}
+
+func TestSnapshotPolicy_SnapshotErrors(t *testing.T) {
+	errs := make(chan error, 1)
+	var enabled atomic.Bool
+	es := openFile(t, t.TempDir(),
+		store.WithSnapshotPolicy("sum", store.SnapshotPolicyFunc(func(store.SnapshotStats) bool { return enabled.Load() })),
+		store.WithSnapshotErrors(func(err error) { errs <- err }),
+	)
+	id := uuid.NewString()
+	appendSums(t, es, id, 1, 2)
+	require.Nil(t, es.Close())
+
+	//A closed store reads events but cannot write the snapshot, which is reported rather than failing Project
+	enabled.Store(true)
+	projected, err := es.Project(ctx, id)
+	require.Nil(t, err)
+	assert.Equal(t, []byte{3}, projected.Event)
+	select {
+	case err := <-errs:
+		assert.True(t, errors.Is(err, os.ErrClosed), "expected os.ErrClosed, got %v", err)
+	default:
+		t.Fatal("the failed snapshot was not reported")
+	}
+}
@@ -0,0 +1,234 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/cpustejovsky/event-store/events"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxBatchWriteSize is the largest number of requests a DynamoDB BatchWriteItem call accepts
+const maxBatchWriteSize int = 25
+
+// MaxBatchWriteAttempts is how many times a batch of write requests is sent while DynamoDB leaves some of them unprocessed
+const MaxBatchWriteAttempts int = 10
+
+// batchWriteBackoff is the delay before unprocessed write requests are first resent; it doubles with every attempt up to maxBackoff
+const batchWriteBackoff = 50 * time.Millisecond
+
+// UnprocessedItemsError is returned when DynamoDB still leaves write requests unprocessed after MaxBatchWriteAttempts attempts
+// Unprocessed counts them along with the requests of the batches that were not sent yet
+type UnprocessedItemsError struct {
+	Unprocessed int
+	Attempts    int
+}
+
+func (e *UnprocessedItemsError) Error() string {
+	return fmt.Sprintf("%d write requests left unprocessed after %d attempts", e.Unprocessed, e.Attempts)
+}
+
+// RetentionPolicy selects the snapshots of a stream that are kept when snapshots are pruned
+// A snapshot is pruned when either limit excludes it, but the newest snapshot of a stream is always kept
+type RetentionPolicy struct {
+	// KeepLast is how many of the newest snapshots are kept; zero keeps any number
+	KeepLast int
+	// MaxAge is how long after it was recorded a snapshot is kept; zero keeps snapshots of any age
+	MaxAge time.Duration
+}
+
+// SnapshotPruner is implemented by event stores that delete the snapshots their RetentionPolicy no longer keeps
+// Both methods return the number of snapshots deleted
+type SnapshotPruner interface {
+	PruneSnapshots(ctx context.Context, id string) (int, error)
+	PruneAllSnapshots(ctx context.Context) (int, error)
+}
+
+// WithRetentionPolicy sets the RetentionPolicy applied by PruneSnapshots and PruneAllSnapshots
+// Without it pruning keeps every snapshot
+func WithRetentionPolicy(policy RetentionPolicy) Option {
+	return func(o *options) {
+		o.retention = policy
+	}
+}
+
+// expired returns the snapshots, ordered by Version, that the policy does not keep at now
+func (p RetentionPolicy) expired(snapshots []events.Snapshot, now time.Time) []events.Snapshot {
+	var expired []events.Snapshot
+	for i := 0; i < len(snapshots)-1; i++ {
+		newer := len(snapshots) - 1 - i
+		tooMany := p.KeepLast > 0 && newer >= p.KeepLast
+		tooOld := p.MaxAge > 0 && now.Sub(snapshots[i].RecordedAt) > p.MaxAge
+		if tooMany || tooOld {
+			expired = append(expired, snapshots[i])
+		}
+	}
+	return expired
+}
+
+// PruneSnapshots deletes the snapshots of the stream with id that the RetentionPolicy does not keep
+func (m *InMemoryEventStore) PruneSnapshots(ctx context.Context, id string) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.pruneSnapshots(id)
+}
+
+// PruneAllSnapshots deletes the snapshots of every stream that the RetentionPolicy does not keep
+func (m *InMemoryEventStore) PruneAllSnapshots(ctx context.Context) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	pruned := 0
+	for id := range m.snapshots {
+		n, err := m.pruneSnapshots(id)
+		pruned += n
+		if err != nil {
+			return pruned, err
+		}
+	}
+	return pruned, nil
+}
+
+// pruneSnapshots deletes the expired snapshots of the stream with id; callers must hold the lock
+func (m *InMemoryEventStore) pruneSnapshots(id string) (int, error) {
+	snapshots := m.snapshots[id]
+	expired := m.retention.expired(snapshots, recordedAt())
+	if len(expired) == 0 {
+		return 0, nil
+	}
+	if err := m.deleteSnapshots(id, expired); err != nil {
+		return 0, err
+	}
+	kept := make([]events.Snapshot, 0, len(snapshots)-len(expired))
+	for _, s := range snapshots {
+		if len(expired) > 0 && expired[0].Version == s.Version {
+			expired = expired[1:]
+			continue
+		}
+		kept = append(kept, s)
+	}
+	pruned := len(snapshots) - len(kept)
+	m.snapshots[id] = kept
+	return pruned, nil
+}
+
+// deleteSnapshots writes the deletion of snapshots of the stream with id to the journal; callers must hold the lock
+func (m *InMemoryEventStore) deleteSnapshots(id string, snapshots []events.Snapshot) error {
+	if m.journal == nil || len(snapshots) == 0 {
+		return nil
+	}
+	versions := make([]int, 0, len(snapshots))
+	for _, s := range snapshots {
+		versions = append(versions, s.Version)
+	}
+	return m.journal.deleteSnapshots(id, versions)
+}
+
+// PruneSnapshots deletes the snapshot items of the stream with id that the RetentionPolicy does not keep
+// On an error it returns how many were deleted before it
+func (d *DynamoDBEventStore) PruneSnapshots(ctx context.Context, id string) (int, error) {
+	snapshots, err := d.getSnapshots(ctx, id)
+	if err != nil {
+		checkErr := &NoEventFoundError{}
+		if errors.As(err, &checkErr) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	expired := d.retention.expired(snapshots, recordedAt())
+	keys := make([]AttributeValueMap, 0, len(expired))
+	for _, s := range expired {
+		keys = append(keys, AttributeValueMap{
+			"Id":      &types.AttributeValueMemberS{Value: id + SnapshotValue},
+			"Version": &types.AttributeValueMemberN{Value: strconv.Itoa(s.Version)},
+		})
+	}
+	return d.deleteItems(ctx, keys)
+}
+
+// PruneAllSnapshots scans the table for streams with snapshots and prunes each of them
+// It reads the whole table and is meant to run as a periodic batch job; on an error it returns how many snapshots were deleted before it
+func (d *DynamoDBEventStore) PruneAllSnapshots(ctx context.Context) (int, error) {
+	ids := make(map[string]struct{})
+	p := dynamodb.NewScanPaginator(d.DB, &dynamodb.ScanInput{
+		TableName:                aws.String(d.Table),
+		FilterExpression:         aws.String("attribute_exists(LatestVersion)"),
+		ProjectionExpression:     aws.String("#id"),
+		ExpressionAttributeNames: map[string]string{"#id": "Id"},
+	})
+	for p.HasMorePages() {
+		out, err := p.NextPage(ctx)
+		if err != nil {
+			return 0, err
+		}
+		for _, item := range out.Items {
+			if id, ok := item["Id"].(*types.AttributeValueMemberS); ok {
+				ids[strings.TrimSuffix(id.Value, SnapshotValue)] = struct{}{}
+			}
+		}
+	}
+	pruned := 0
+	for id := range ids {
+		n, err := d.PruneSnapshots(ctx, id)
+		pruned += n
+		if err != nil {
+			return pruned, err
+		}
+	}
+	return pruned, nil
+}
+
+// deleteItems deletes the items with keys in batches and returns how many were deleted, also when it fails
+func (d *DynamoDBEventStore) deleteItems(ctx context.Context, keys []AttributeValueMap) (int, error) {
+	requests := make([]types.WriteRequest, 0, len(keys))
+	for _, key := range keys {
+		requests = append(requests, types.WriteRequest{DeleteRequest: &types.DeleteRequest{Key: key}})
+	}
+	return d.writeItems(ctx, requests)
+}
+
+// writeItems sends the write requests in batches and returns how many were processed, also when it fails
+// The requests DynamoDB leaves unprocessed are resent after a jittered exponential backoff, up to MaxBatchWriteAttempts times
+func (d *DynamoDBEventStore) writeItems(ctx context.Context, pending []types.WriteRequest) (int, error) {
+	written := 0
+	for len(pending) > 0 {
+		n := len(pending)
+		if n > maxBatchWriteSize {
+			n = maxBatchWriteSize
+		}
+		requests := pending[:n]
+		pending = pending[n:]
+		for attempt := 1; ; attempt++ {
+			out, err := d.DB.BatchWriteItem(ctx, &dynamodb.BatchWriteItemInput{
+				RequestItems: map[string][]types.WriteRequest{d.Table: requests},
+			})
+			if err != nil {
+				return written, err
+			}
+			unprocessed := out.UnprocessedItems[d.Table]
+			written += len(requests) - len(unprocessed)
+			requests = unprocessed
+			if len(requests) == 0 {
+				break
+			}
+			if attempt == MaxBatchWriteAttempts {
+				return written, &UnprocessedItemsError{Unprocessed: len(requests) + len(pending), Attempts: attempt}
+			}
+			//Unprocessed requests are usually throttled, so back off before resending them
+			if err := backoff(ctx, attempt, batchWriteBackoff); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
@@ -0,0 +1,83 @@
+package store_test
+
+import (
+	"github.com/cpustejovsky/event-store/events"
+	"github.com/cpustejovsky/event-store/store"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+// snapshotSums appends a sum event and snapshots the stream after it, once per value
+func snapshotSums(t *testing.T, es store.EventStore, id string, values ...byte) {
+	t.Helper()
+	for _, v := range values {
+		appendSums(t, es, id, v)
+		projected, err := es.Project(ctx, id)
+		require.Nil(t, err)
+		require.Nil(t, es.Snapshot(ctx, &events.Snapshot{
+			Id:            id,
+			Version:       projected.Version,
+			LatestVersion: projected.Version,
+			Event:         projected.Event,
+			EventName:     projected.EventName,
+		}))
+	}
+}
+
+func TestPruneSnapshots_KeepLast(t *testing.T) {
+	es, folded := policyStore(store.WithRetentionPolicy(store.RetentionPolicy{KeepLast: 2}))
+	id := uuid.NewString()
+	other := uuid.NewString()
+	snapshotSums(t, es, id, 1, 2, 3, 4)
+	snapshotSums(t, es, other, 1, 2, 3)
+
+	pruned, err := es.PruneSnapshots(ctx, id)
+	require.Nil(t, err)
+	assert.Equal(t, 2, pruned)
+	pruned, err = es.PruneSnapshots(ctx, id)
+	require.Nil(t, err)
+	assert.Equal(t, 0, pruned)
+
+	//Projections still start from the newest snapshot and older versions from the kept ones
+	projected, err := es.Project(ctx, id)
+	require.Nil(t, err)
+	assert.Equal(t, 1, folded())
+	assert.Equal(t, []byte{10}, projected.Event)
+	projected, err = es.ProjectAt(ctx, id, 2)
+	require.Nil(t, err)
+	assert.Equal(t, []byte{6}, projected.Event)
+	projected, err = es.ProjectAt(ctx, id, 1)
+	require.Nil(t, err)
+	assert.Equal(t, 2, folded())
+	assert.Equal(t, []byte{3}, projected.Event)
+
+	pruned, err = es.PruneAllSnapshots(ctx)
+	require.Nil(t, err)
+	assert.Equal(t, 1, pruned)
+}
+
+func TestPruneSnapshots_MaxAge(t *testing.T) {
+	es, _ := policyStore(store.WithRetentionPolicy(store.RetentionPolicy{MaxAge: time.Nanosecond}))
+	id := uuid.NewString()
+	snapshotSums(t, es, id, 1, 2, 3)
+	time.Sleep(time.Millisecond)
+	//The newest snapshot is kept however old it is
+	pruned, err := es.PruneAllSnapshots(ctx)
+	require.Nil(t, err)
+	assert.Equal(t, 2, pruned)
+	projected, err := es.Project(ctx, id)
+	require.Nil(t, err)
+	assert.Equal(t, []byte{6}, projected.Event)
+}
+
+func TestPruneSnapshots_NoPolicy(t *testing.T) {
+	es, _ := policyStore()
+	id := uuid.NewString()
+	snapshotSums(t, es, id, 1, 2, 3)
+	pruned, err := es.PruneSnapshots(ctx, id)
+	require.Nil(t, err)
+	assert.Equal(t, 0, pruned)
+}
@@ -0,0 +1,723 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/cpustejovsky/event-store/events"
+	"io/fs"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Dialect selects the SQL understood by the database of a SQLEventStore
+type Dialect string
+
+const (
+	Postgres Dialect = "postgres"
+	SQLite   Dialect = "sqlite"
+)
+
+// migrations holds the schema of each Dialect as numbered SQL files applied in order by Migrate
+//
+//go:embed migrations
+var migrations embed.FS
+
+// eventColumns and snapshotColumns are selected in the order scanEnvelopes and scanSnapshots read them
+const (
+	eventColumns    = "id, version, position, event_name, schema_version, event, recorded_at, user_name, correlation_id, causation_id, headers"
+	snapshotColumns = "id, version, latest_version, aggregator_version, event_name, event, recorded_at, user_name, correlation_id, causation_id, headers"
+)
+
+// SQLEventStore is an EventStore backed by a relational database through database/sql
+// Events and snapshots are rows of the event_store_events and event_store_snapshots tables created by Migrate
+// Appends take a row lock on the global position counter, so they are serialized like DynamoDBEventStore transactions
+type SQLEventStore struct {
+	DB      *sql.DB
+	Dialect Dialect
+	options
+}
+
+// SQL takes a database opened with a driver for dialect and returns a SQLEventStore; call Migrate before using it
+// SQLite databases should be opened with a busy timeout and immediate transactions,
+// for example _pragma=busy_timeout(5000)&_txlock=immediate with modernc.org/sqlite
+func SQL(db *sql.DB, dialect Dialect, opts ...Option) *SQLEventStore {
+	return &SQLEventStore{DB: db, Dialect: dialect, options: newOptions(opts)}
+}
+
+// queryer is implemented by *sql.DB and *sql.Tx
+type queryer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// rebind rewrites the ? placeholders of query into the placeholders of the dialect
+func (d Dialect) rebind(query string) string {
+	if d != Postgres {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// uniqueViolation reports whether err is the violation of a primary key or unique index
+// It recognizes the errors of any driver by their SQLSTATE or message, so the store does not depend on a driver
+func (d Dialect) uniqueViolation(err error) bool {
+	if err == nil {
+		return false
+	}
+	if d == Postgres {
+		var state interface{ SQLState() string }
+		if errors.As(err, &state) {
+			return state.SQLState() == "23505"
+		}
+		return strings.Contains(err.Error(), "duplicate key value violates unique constraint")
+	}
+	return strings.Contains(err.Error(), "UNIQUE constraint failed")
+}
+
+// Migrate applies the embedded schema migrations of the store's Dialect that the database has not applied yet
+// Applied migrations are recorded in the event_store_migrations table, so Migrate can run every time a service starts
+func (s *SQLEventStore) Migrate(ctx context.Context) error {
+	dir := "migrations/" + string(s.Dialect)
+	entries, err := fs.ReadDir(migrations, dir)
+	if err != nil {
+		return fmt.Errorf("no migrations for dialect %q: %w", s.Dialect, err)
+	}
+	if _, err := s.DB.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS event_store_migrations (version INTEGER PRIMARY KEY)"); err != nil {
+		return err
+	}
+	applied := make(map[int]bool)
+	rows, err := s.DB.QueryContext(ctx, "SELECT version FROM event_store_migrations")
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var v int
+		if err := rows.Scan(&v); err != nil {
+			rows.Close()
+			return err
+		}
+		applied[v] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	for _, entry := range entries {
+		version, err := strconv.Atoi(strings.SplitN(entry.Name(), "_", 2)[0])
+		if err != nil {
+			return fmt.Errorf("migration %s is not numbered: %w", entry.Name(), err)
+		}
+		if applied[version] {
+			continue
+		}
+		script, err := migrations.ReadFile(dir + "/" + entry.Name())
+		if err != nil {
+			return err
+		}
+		err = s.transact(ctx, func(tx *sql.Tx) error {
+			//Statements are run one at a time because not every driver runs several in one call
+			for _, statement := range strings.Split(string(script), ";") {
+				if strings.TrimSpace(statement) == "" {
+					continue
+				}
+				if _, err := tx.ExecContext(ctx, statement); err != nil {
+					return fmt.Errorf("migration %s: %w", entry.Name(), err)
+				}
+			}
+			_, err := tx.ExecContext(ctx, s.Dialect.rebind("INSERT INTO event_store_migrations (version) VALUES (?)"), version)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// transact runs fn in a transaction that is committed if fn returns nil and rolled back otherwise
+func (s *SQLEventStore) transact(ctx context.Context, fn func(*sql.Tx) error) error {
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Append takes a context and Envelope and returns an error
+// The (id, version) primary key rejects a Version that already exists with an EventAlreadyExistsError
+func (s *SQLEventStore) Append(ctx context.Context, e *events.Envelope) error {
+	batch := []events.Envelope{*e}
+	if err := s.AppendBatch(ctx, batch); err != nil {
+		return err
+	}
+	e.RecordedAt = batch[0].RecordedAt
+	e.Position = batch[0].Position
+	return nil
+}
+
+// AppendBatch takes a context and a slice of Envelopes and writes all of them or none of them in a transaction
+// It accepts the same batches as DynamoDBEventStore, so code can move between the stores
+func (s *SQLEventStore) AppendBatch(ctx context.Context, envelopes []events.Envelope) error {
+	if err := validateBatch(envelopes); err != nil {
+		return err
+	}
+	batch := stamped(envelopes)
+	err := s.transact(ctx, func(tx *sql.Tx) error {
+		//Locking the position counter first serializes appends with DeleteStream, so a stream cannot be deleted before the commit
+		if _, err := s.reservePositions(ctx, tx, 0); err != nil {
+			return err
+		}
+		checked := make(map[string]bool)
+		for _, e := range envelopes {
+			if checked[e.Id] {
+				continue
+			}
+			checked[e.Id] = true
+			if _, err := s.latestVersion(ctx, tx, e.Id); err != nil {
+				return err
+			}
+		}
+		return s.insertEvents(ctx, tx, batch)
+	})
+	if err != nil {
+		return err
+	}
+	recorded(envelopes, batch)
+	s.snapshotAppended(ctx, s, batch)
+	return nil
+}
+
+// AppendExpected appends envelopes to the stream with id only if its latest version is expectedVersion
+// The store assigns the Id and consecutive Versions of the envelopes starting after the latest version and writes them in a transaction
+// expectedVersion may be NoStream for a new stream or AnyVersion to skip the check
+func (s *SQLEventStore) AppendExpected(ctx context.Context, id string, expectedVersion int, envelopes ...events.Envelope) error {
+	if err := checkId(id); err != nil {
+		return err
+	}
+	var batch []events.Envelope
+	err := s.transact(ctx, func(tx *sql.Tx) error {
+		//Locking the position counter first serializes appends, so the latest version read below cannot change before the commit
+		if _, err := s.reservePositions(ctx, tx, 0); err != nil {
+			return err
+		}
+		actual, err := s.latestVersion(ctx, tx, id)
+		if err != nil {
+			return err
+		}
+		if err := checkExpectedVersion(id, expectedVersion, actual); err != nil {
+			return err
+		}
+		batch = versionEnvelopes(id, actual, envelopes)
+		if err := validateBatch(batch); err != nil {
+			return err
+		}
+		stamp(batch)
+		return s.insertEvents(ctx, tx, batch)
+	})
+	checkErr := &EventAlreadyExistsError{}
+	if errors.As(err, &checkErr) {
+		actual, err := s.latestVersion(ctx, s.DB, id)
+		if err != nil {
+			return err
+		}
+		return &WrongExpectedVersionError{ID: id, Expected: expectedVersion, Actual: actual}
+	}
+	if err != nil {
+		return err
+	}
+	s.snapshotAppended(ctx, s, batch)
+	return nil
+}
+
+// reservePositions advances the global position counter by n and returns the first of the n positions
+// The update locks the counter row until the transaction ends
+func (s *SQLEventStore) reservePositions(ctx context.Context, tx *sql.Tx, n int) (int, error) {
+	var last int
+	err := tx.QueryRowContext(ctx, s.Dialect.rebind("UPDATE event_store_positions SET position = position + ? WHERE id = 1 RETURNING position"), n).Scan(&last)
+	if err != nil {
+		return 0, err
+	}
+	return last - n + 1, nil
+}
+
+// insertEvents assigns the envelopes consecutive global Positions and inserts them with their personal data encrypted
+func (s *SQLEventStore) insertEvents(ctx context.Context, tx *sql.Tx, envelopes []events.Envelope) error {
+	first, err := s.reservePositions(ctx, tx, len(envelopes))
+	if err != nil {
+		return err
+	}
+	for i := range envelopes {
+		envelopes[i].Position = first + i
+	}
+	stored, err := s.encrypt(ctx, envelopes)
+	if err != nil {
+		return err
+	}
+	query := s.Dialect.rebind("INSERT INTO event_store_events (" + eventColumns + ") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)")
+	for i := range stored {
+		e := &stored[i]
+		headers, err := encodeHeaders(e.Headers)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, query, e.Id, e.Version, e.Position, e.EventName, e.SchemaVersion, e.Event,
+			e.RecordedAt.UTC().Format(RecordedAtLayout), e.User, e.CorrelationId, e.CausationId, headers)
+		if s.Dialect.uniqueViolation(err) {
+			return &EventAlreadyExistsError{ID: e.Id, Version: e.Version}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Snapshot stores the snapshot in the snapshots table; a snapshot with the same Version cannot be overwritten
+func (s *SQLEventStore) Snapshot(ctx context.Context, snapshot *events.Snapshot) error {
+	return s.putSnapshot(ctx, snapshot, "")
+}
+
+// replaceSnapshot stores the snapshot, overwriting a snapshot with the same Version
+func (s *SQLEventStore) replaceSnapshot(ctx context.Context, snapshot *events.Snapshot) error {
+	return s.putSnapshot(ctx, snapshot, ` ON CONFLICT (id, version) DO UPDATE SET latest_version = excluded.latest_version,
+		aggregator_version = excluded.aggregator_version, event_name = excluded.event_name, event = excluded.event, recorded_at = excluded.recorded_at,
+		user_name = excluded.user_name, correlation_id = excluded.correlation_id, causation_id = excluded.causation_id, headers = excluded.headers`)
+}
+
+// putSnapshot stamps and inserts the snapshot, ending the statement with conflict
+func (s *SQLEventStore) putSnapshot(ctx context.Context, snapshot *events.Snapshot, conflict string) error {
+	snapshot.RecordedAt = recordedAt()
+	snapshot.AggregatorVersion = s.aggregatorVersion(snapshot.EventName)
+	payload, err := s.encryptSnapshot(ctx, snapshot)
+	if err != nil {
+		return err
+	}
+	headers, err := encodeHeaders(snapshot.Headers)
+	if err != nil {
+		return err
+	}
+	_, err = s.DB.ExecContext(ctx, s.Dialect.rebind("INSERT INTO event_store_snapshots ("+snapshotColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"+conflict),
+		snapshot.Id, snapshot.Version, snapshot.LatestVersion, snapshot.AggregatorVersion, snapshot.EventName, payload,
+		snapshot.RecordedAt.Format(RecordedAtLayout), snapshot.User, snapshot.CorrelationId, snapshot.CausationId, headers)
+	if s.Dialect.uniqueViolation(err) {
+		return &EventAlreadyExistsError{ID: snapshot.Id + SnapshotValue, Version: snapshot.Version}
+	}
+	return err
+}
+
+// Project takes an id, reads events since the last snapshot, and returns a reconstituted Envelope
+// If the SnapshotPolicy for the stream's EventName asks for it, the result is stored as a new snapshot
+func (s *SQLEventStore) Project(ctx context.Context, id string) (*events.Envelope, error) {
+	projected, since, stale, err := s.project(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	s.autoSnapshot(ctx, s, projected, since, stale)
+	return projected, nil
+}
+
+// project reconstitutes the stream with id and returns the events folded on top of its latest snapshot
+// stale reports that the latest snapshot was built by another version of the aggregator and was not used
+func (s *SQLEventStore) project(ctx context.Context, id string) (projected *events.Envelope, since []events.Envelope, stale bool, err error) {
+	snapshots, err := s.querySnapshots(ctx, "WHERE id = ? ORDER BY version DESC LIMIT 1", id)
+	checkErr := &NoEventFoundError{}
+	if err != nil && !errors.As(err, &checkErr) {
+		return nil, nil, false, err
+	}
+	if err == nil {
+		stale = !s.current(&snapshots[0])
+	}
+	if err != nil || stale {
+		envelopes, err := s.QueryAll(ctx, id)
+		if err != nil {
+			return nil, nil, stale, err
+		}
+		projected, err := s.aggregate(envelopes)
+		return projected, envelopes, stale, err
+	}
+	envelopes, err := s.Read(ctx, id, ReadOptions{FromVersion: snapshots[0].LatestVersion})
+	//No events recorded since the snapshot is not an error; the snapshot alone is the projection
+	if err != nil && !errors.As(err, &checkErr) {
+		return nil, nil, false, err
+	}
+	projected, err = s.aggregateSnapshot(ctx, &snapshots[0], envelopes)
+	return projected, envelopes, false, err
+}
+
+// ProjectAt takes an id and version and returns the Envelope reconstituted from the events up to and including version
+// It starts from the newest snapshot taken at or before version and only reads the events recorded after it
+func (s *SQLEventStore) ProjectAt(ctx context.Context, id string, version int) (*events.Envelope, error) {
+	if _, err := s.latestVersion(ctx, s.DB, id); err != nil {
+		return nil, err
+	}
+	snapshots, err := s.querySnapshots(ctx, "WHERE id = ? ORDER BY version", id)
+	checkErr := &NoEventFoundError{}
+	if err != nil && !errors.As(err, &checkErr) {
+		return nil, err
+	}
+	return s.projectAt(ctx, s, id, version, snapshotAt(s.currentSnapshots(snapshots), version))
+}
+
+// ProjectAsOf takes an id and time and returns the Envelope reconstituted from the events recorded at or before t
+// It looks up the version recorded at t without reading the events, then projects it like ProjectAt
+func (s *SQLEventStore) ProjectAsOf(ctx context.Context, id string, t time.Time) (*events.Envelope, error) {
+	if _, err := s.latestVersion(ctx, s.DB, id); err != nil {
+		return nil, err
+	}
+	var version int
+	err := s.DB.QueryRowContext(ctx, s.Dialect.rebind("SELECT version FROM event_store_events WHERE id = ? AND recorded_at <= ? ORDER BY version DESC LIMIT 1"),
+		id, t.UTC().Format(RecordedAtLayout)).Scan(&version)
+	if err == sql.ErrNoRows {
+		return nil, &NoEventFoundError{}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s.ProjectAt(ctx, id, version)
+}
+
+// QueryLatestVersion returns the latest Version of the stream with id, a NoEventFoundError for an empty stream or a StreamDeletedError for a deleted one
+func (s *SQLEventStore) QueryLatestVersion(ctx context.Context, id string) (int, error) {
+	v, err := s.latestVersion(ctx, s.DB, id)
+	if err != nil {
+		return -1, err
+	}
+	if v == NoStream {
+		return -1, &NoEventFoundError{}
+	}
+	return v, nil
+}
+
+// latestVersion returns the latest version of the stream with id, NoStream for an empty stream or a StreamDeletedError for a deleted one
+func (s *SQLEventStore) latestVersion(ctx context.Context, q queryer, id string) (int, error) {
+	latest := events.Envelope{Id: id}
+	err := q.QueryRowContext(ctx, s.Dialect.rebind("SELECT version, event_name, event FROM event_store_events WHERE id = ? ORDER BY version DESC LIMIT 1"), id).
+		Scan(&latest.Version, &latest.EventName, &latest.Event)
+	if err == sql.ErrNoRows {
+		return NoStream, nil
+	}
+	if err != nil {
+		return NoStream, err
+	}
+	if err := tombstoneError(&latest); err != nil {
+		return NoStream, err
+	}
+	return latest.Version, nil
+}
+
+// QueryAll takes a context and id and returns a slice of Events ordered by Version and an error
+func (s *SQLEventStore) QueryAll(ctx context.Context, id string) ([]events.Envelope, error) {
+	return s.Read(ctx, id, ReadOptions{})
+}
+
+// Read takes a context, id and ReadOptions and returns the selected range of the stream
+func (s *SQLEventStore) Read(ctx context.Context, id string, opts ReadOptions) ([]events.Envelope, error) {
+	if _, err := s.latestVersion(ctx, s.DB, id); err != nil {
+		return nil, err
+	}
+	where := "WHERE id = ? AND version >= ?"
+	args := []any{id, opts.FromVersion}
+	if opts.ToVersion != nil {
+		where += " AND version <= ?"
+		args = append(args, *opts.ToVersion)
+	}
+	where += " ORDER BY version"
+	if opts.Reverse {
+		where += " DESC"
+	}
+	where, args = limit(where, args, opts.Limit)
+	return s.queryEvents(ctx, where, args...)
+}
+
+// ReadAll takes a context, position and limit and returns up to limit events of every stream from fromPosition on in global order
+// A limit of zero returns every event; the position of an event removed by a HardDelete holds an erased marker
+func (s *SQLEventStore) ReadAll(ctx context.Context, fromPosition int, limitEvents int) ([]events.Envelope, error) {
+	where, args := limit("WHERE position >= ? ORDER BY position", []any{fromPosition}, limitEvents)
+	envelopes, err := s.queryEvents(ctx, where, args...)
+	for i := range envelopes {
+		if envelopes[i].EventName == ErasedEventName {
+			envelopes[i] = erasedMarker(envelopes[i].Position)
+		}
+	}
+	return envelopes, err
+}
+
+// QueryByEventName takes a context, EventName and EventNameOptions and returns the selected events of every stream in global order
+// Events are selected by the EventName they were stored with, before upcasting
+func (s *SQLEventStore) QueryByEventName(ctx context.Context, name string, opts EventNameOptions) ([]events.Envelope, error) {
+	where := "WHERE event_name = ? AND position >= ?"
+	args := []any{name, opts.FromPosition}
+	//recorded_at is stored with a fixed width layout in UTC, so comparing the strings compares the times
+	if !opts.Since.IsZero() {
+		where += " AND recorded_at >= ?"
+		args = append(args, opts.Since.UTC().Format(RecordedAtLayout))
+	}
+	if !opts.Until.IsZero() {
+		where += " AND recorded_at < ?"
+		args = append(args, opts.Until.UTC().Format(RecordedAtLayout))
+	}
+	where, args = limit(where+" ORDER BY position", args, opts.Limit)
+	return s.queryEvents(ctx, where, args...)
+}
+
+// ListStreams returns the streams selected by opts ordered by id, and the token of the next page
+// The token is empty once every selected stream has been returned
+func (s *SQLEventStore) ListStreams(ctx context.Context, opts ListOptions) ([]StreamInfo, string, error) {
+	query := `SELECT e.id, e.event_name, e.version, l.updated_at FROM event_store_events e
+		JOIN (SELECT id, MAX(version) AS version, MAX(recorded_at) AS updated_at FROM event_store_events
+			WHERE substr(id, 1, ?) = ? AND id > ? GROUP BY id) l
+		ON e.id = l.id AND e.version = l.version
+		WHERE e.event_name <> ?`
+	args := []any{len(opts.Prefix), opts.Prefix, opts.PageToken, TombstoneEventName}
+	if opts.EventName != "" {
+		query += " AND e.event_name = ?"
+		args = append(args, opts.EventName)
+	}
+	query, args = limit(query+" ORDER BY e.id", args, opts.Limit)
+	rows, err := s.DB.QueryContext(ctx, s.Dialect.rebind(query), args...)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+	var streams []StreamInfo
+	for rows.Next() {
+		var info StreamInfo
+		var updated string
+		if err := rows.Scan(&info.Id, &info.EventName, &info.LatestVersion, &updated); err != nil {
+			return nil, "", err
+		}
+		if info.UpdatedAt, err = time.Parse(RecordedAtLayout, updated); err != nil {
+			return nil, "", err
+		}
+		streams = append(streams, info)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", err
+	}
+	return streams, nextPageToken(streams, opts.Limit), nil
+}
+
+// DeleteStream closes the stream with id by appending a tombstone after its latest version
+// Appends to the stream and reads of it fail with a StreamDeletedError afterwards; ReadAll and QueryByEventName return the tombstone
+// HardDelete also deletes the stream's events and snapshots in the same transaction; ReadAll returns an erased marker at the position of every deleted event
+// Deleting a stream that was hard deleted again with HardDelete does nothing; deleting it otherwise returns its StreamDeletedError,
+// and deleting an empty stream a NoEventFoundError
+func (s *SQLEventStore) DeleteStream(ctx context.Context, id string, mode DeleteMode) error {
+	if err := mode.validate(); err != nil {
+		return err
+	}
+	if err := checkId(id); err != nil {
+		return err
+	}
+	return s.transact(ctx, func(tx *sql.Tx) error {
+		if _, err := s.reservePositions(ctx, tx, 0); err != nil {
+			return err
+		}
+		latest, err := s.latestVersion(ctx, tx, id)
+		if _, ok := purged(err, mode); ok {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if latest == NoStream {
+			return &NoEventFoundError{}
+		}
+		if err := s.insertEvents(ctx, tx, tombstone(id, latest, mode)); err != nil {
+			return err
+		}
+		if mode == SoftDelete {
+			return nil
+		}
+		//The rows stay as erased markers, so ReadAll reports their positions as erased rather than leaving a gap
+		if _, err := tx.ExecContext(ctx, s.Dialect.rebind(`UPDATE event_store_events SET event_name = ?, schema_version = 0, event = NULL,
+			user_name = '', correlation_id = '', causation_id = '', headers = NULL WHERE id = ? AND version <= ?`), ErasedEventName, id, latest); err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, s.Dialect.rebind("DELETE FROM event_store_snapshots WHERE id = ?"), id)
+		return err
+	})
+}
+
+// InvalidateSnapshots deletes every snapshot of streams with eventName and returns how many were deleted
+func (s *SQLEventStore) InvalidateSnapshots(ctx context.Context, eventName string) (int, error) {
+	result, err := s.DB.ExecContext(ctx, s.Dialect.rebind("DELETE FROM event_store_snapshots WHERE event_name = ?"), eventName)
+	if err != nil {
+		return 0, err
+	}
+	n, err := result.RowsAffected()
+	return int(n), err
+}
+
+// PruneSnapshots deletes the snapshots of the stream with id that the RetentionPolicy does not keep
+func (s *SQLEventStore) PruneSnapshots(ctx context.Context, id string) (int, error) {
+	snapshots, err := s.querySnapshots(ctx, "WHERE id = ? ORDER BY version", id)
+	checkErr := &NoEventFoundError{}
+	if errors.As(err, &checkErr) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	expired := s.retention.expired(snapshots, recordedAt())
+	err = s.transact(ctx, func(tx *sql.Tx) error {
+		for _, snapshot := range expired {
+			if _, err := tx.ExecContext(ctx, s.Dialect.rebind("DELETE FROM event_store_snapshots WHERE id = ? AND version = ?"), id, snapshot.Version); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(expired), nil
+}
+
+// PruneAllSnapshots prunes the snapshots of every stream that has any
+func (s *SQLEventStore) PruneAllSnapshots(ctx context.Context) (int, error) {
+	rows, err := s.DB.QueryContext(ctx, "SELECT DISTINCT id FROM event_store_snapshots")
+	if err != nil {
+		return 0, err
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	pruned := 0
+	for _, id := range ids {
+		n, err := s.PruneSnapshots(ctx, id)
+		pruned += n
+		if err != nil {
+			return pruned, err
+		}
+	}
+	return pruned, nil
+}
+
+// limit appends a LIMIT clause to query when n is positive
+func limit(query string, args []any, n int) (string, []any) {
+	if n <= 0 {
+		return query, args
+	}
+	return query + " LIMIT ?", append(args, n)
+}
+
+// queryEvents selects the events matching the where clause, decrypted and upcast to the current schema
+// It returns NoEventFoundError when there are none
+func (s *SQLEventStore) queryEvents(ctx context.Context, where string, args ...any) ([]events.Envelope, error) {
+	rows, err := s.DB.QueryContext(ctx, s.Dialect.rebind("SELECT "+eventColumns+" FROM event_store_events "+where), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var envelopes []events.Envelope
+	for rows.Next() {
+		var e events.Envelope
+		var recorded string
+		var headers sql.NullString
+		err := rows.Scan(&e.Id, &e.Version, &e.Position, &e.EventName, &e.SchemaVersion, &e.Event,
+			&recorded, &e.User, &e.CorrelationId, &e.CausationId, &headers)
+		if err != nil {
+			return nil, err
+		}
+		if e.Metadata, err = decodeMetadata(e.Metadata, recorded, headers); err != nil {
+			return nil, err
+		}
+		envelopes = append(envelopes, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(envelopes) == 0 {
+		return nil, &NoEventFoundError{}
+	}
+	if err := s.decode(ctx, envelopes); err != nil {
+		return nil, err
+	}
+	return envelopes, nil
+}
+
+// querySnapshots selects the snapshots matching the where clause and returns NoEventFoundError when there are none
+func (s *SQLEventStore) querySnapshots(ctx context.Context, where string, args ...any) ([]events.Snapshot, error) {
+	rows, err := s.DB.QueryContext(ctx, s.Dialect.rebind("SELECT "+snapshotColumns+" FROM event_store_snapshots "+where), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var snapshots []events.Snapshot
+	for rows.Next() {
+		var snapshot events.Snapshot
+		var recorded string
+		var headers sql.NullString
+		err := rows.Scan(&snapshot.Id, &snapshot.Version, &snapshot.LatestVersion, &snapshot.AggregatorVersion, &snapshot.EventName, &snapshot.Event,
+			&recorded, &snapshot.User, &snapshot.CorrelationId, &snapshot.CausationId, &headers)
+		if err != nil {
+			return nil, err
+		}
+		if snapshot.Metadata, err = decodeMetadata(snapshot.Metadata, recorded, headers); err != nil {
+			return nil, err
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(snapshots) == 0 {
+		return nil, &NoEventFoundError{}
+	}
+	return snapshots, nil
+}
+
+// encodeHeaders returns the headers as a JSON object, or NULL when there are none
+func encodeHeaders(headers map[string]string) (sql.NullString, error) {
+	if len(headers) == 0 {
+		return sql.NullString{}, nil
+	}
+	b, err := json.Marshal(headers)
+	return sql.NullString{String: string(b), Valid: true}, err
+}
+
+// decodeMetadata sets the RecordedAt and Headers of m from their columns
+func decodeMetadata(m events.Metadata, recorded string, headers sql.NullString) (events.Metadata, error) {
+	t, err := time.Parse(RecordedAtLayout, recorded)
+	if err != nil {
+		return m, err
+	}
+	m.RecordedAt = t
+	if headers.Valid {
+		err = json.Unmarshal([]byte(headers.String), &m.Headers)
+	}
+	return m, err
+}
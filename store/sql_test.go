@@ -0,0 +1,125 @@
+package store_test
+
+import (
+	"database/sql"
+	"github.com/cpustejovsky/event-store/events"
+	"github.com/cpustejovsky/event-store/store"
+	"github.com/cpustejovsky/event-store/store/storetest"
+	"github.com/google/uuid"
+	_ "github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	_ "modernc.org/sqlite"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// PostgresDSNEnv names the environment variable holding the connection string of a PostgreSQL database for the Postgres conformance run
+// The run is skipped when it is not set; every store gets its own schema, which is dropped after the test
+const PostgresDSNEnv = "EVENT_STORE_POSTGRES_DSN"
+
+// sqliteStore returns a migrated SQLEventStore on a new SQLite database in a temporary directory
+func sqliteStore(t *testing.T, opts ...store.Option) *store.SQLEventStore {
+	t.Helper()
+	db, err := sql.Open("sqlite", "file:"+filepath.Join(t.TempDir(), "events.db")+"?_pragma=busy_timeout(10000)&_pragma=journal_mode(WAL)&_txlock=immediate")
+	require.Nil(t, err)
+	t.Cleanup(func() { db.Close() })
+	es := store.SQL(db, store.SQLite, opts...)
+	require.Nil(t, es.Migrate(ctx))
+	return es
+}
+
+// postgresStore returns a migrated SQLEventStore on a new schema of the database named by PostgresDSNEnv, skipping the test without one
+func postgresStore(t *testing.T, opts ...store.Option) *store.SQLEventStore {
+	t.Helper()
+	dsn := os.Getenv(PostgresDSNEnv)
+	if dsn == "" {
+		t.Skipf("%s is not set", PostgresDSNEnv)
+	}
+	admin, err := sql.Open("postgres", dsn)
+	require.Nil(t, err)
+	t.Cleanup(func() { admin.Close() })
+	schema := "event_store_" + strings.ReplaceAll(uuid.NewString(), "-", "")
+	_, err = admin.ExecContext(ctx, "CREATE SCHEMA "+schema)
+	require.Nil(t, err)
+	t.Cleanup(func() { admin.ExecContext(ctx, "DROP SCHEMA "+schema+" CASCADE") })
+
+	//lib/pq passes unknown connection parameters to the server as run-time parameters
+	separator := " "
+	if strings.Contains(dsn, "://") {
+		separator = "?"
+		if strings.Contains(dsn, "?") {
+			separator = "&"
+		}
+	}
+	db, err := sql.Open("postgres", dsn+separator+"search_path="+schema)
+	require.Nil(t, err)
+	t.Cleanup(func() { db.Close() })
+	es := store.SQL(db, store.Postgres, opts...)
+	require.Nil(t, es.Migrate(ctx))
+	return es
+}
+
+func TestSQLEventStore(t *testing.T) {
+	storetest.Run(t, func() store.EventStore {
+		return sqliteStore(t)
+	})
+}
+
+func TestSQLEventStore_Registry(t *testing.T) {
+	storetest.RunRegistry(t, func(registry *events.Registry) store.EventStore {
+		return sqliteStore(t, store.WithRegistry(registry))
+	})
+}
+
+func TestSQLEventStore_Postgres(t *testing.T) {
+	if os.Getenv(PostgresDSNEnv) == "" {
+		t.Skipf("%s is not set", PostgresDSNEnv)
+	}
+	storetest.Run(t, func() store.EventStore {
+		return postgresStore(t)
+	})
+	storetest.RunRegistry(t, func(registry *events.Registry) store.EventStore {
+		return postgresStore(t, store.WithRegistry(registry))
+	})
+}
+
+func TestSQLEventStore_Migrate(t *testing.T) {
+	es := sqliteStore(t)
+	require.Nil(t, es.Migrate(ctx))
+	var applied int
+	require.Nil(t, es.DB.QueryRow("SELECT COUNT(*) FROM event_store_migrations").Scan(&applied))
+	assert.Equal(t, 1, applied)
+
+	err := store.SQL(es.DB, store.Dialect("oracle")).Migrate(ctx)
+	assert.NotNil(t, err)
+}
+
+func TestSQLEventStore_PruneAndInvalidate(t *testing.T) {
+	var mu sync.Mutex
+	folded := 0
+	registry := events.NewRegistry()
+	registry.Register("sum", func() events.Aggregator { return sumAggregator{mu: &mu, folded: &folded} })
+	es := sqliteStore(t, store.WithRegistry(registry), store.WithRetentionPolicy(store.RetentionPolicy{KeepLast: 1}))
+	id := uuid.NewString()
+	snapshotSums(t, es, id, 1, 2, 3)
+	pruned, err := es.PruneAllSnapshots(ctx)
+	require.Nil(t, err)
+	assert.Equal(t, 2, pruned)
+	projected, err := es.Project(ctx, id)
+	require.Nil(t, err)
+	assert.Equal(t, []byte{6}, projected.Event)
+	//Only the latest snapshot is folded
+	assert.Equal(t, 1, folded)
+
+	invalidated, err := es.InvalidateSnapshots(ctx, "sum")
+	require.Nil(t, err)
+	assert.Equal(t, 1, invalidated)
+	projected, err = es.Project(ctx, id)
+	require.Nil(t, err)
+	assert.Equal(t, []byte{6}, projected.Event)
+	assert.Equal(t, 3, folded)
+}
@@ -9,11 +9,39 @@ import (
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
 	"github.com/cpustejovsky/event-store/events"
+	"math/rand"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
 const SnapshotValue string = "SNAPSHOT"
 
+// PositionValue is the Id of the item holding the last global position assigned to an event
+const PositionValue string = "POSITION"
+
+// PositionIndex is the global secondary index read by ReadAll
+// Its hash key is the Log attribute, which spreads the events over LogShards partitions, and its range key is the Position attribute
+const PositionIndex string = "PositionIndex"
+
+// LogValue prefixes the Log attribute of every event item; the event at a Position is in the shard LogValue#<Position modulo LogShards>
+const LogValue string = "ALL"
+
+// LogShards is how many PositionIndex partitions the events are spread over, round robin by Position
+// An index partition takes about 1,000 writes a second, so a single Log value would cap the appends of the whole table at that rate;
+// ReadAll queries every shard and merges them, and changing it requires rewriting the Log attribute of every event
+const LogShards int = 16
+
+// logShard returns the Log attribute of the event at position
+func logShard(position int) string {
+	return LogValue + "#" + strconv.Itoa(position%LogShards)
+}
+
+// RecordedAtLayout is the time layout of the RecordedAt attribute; unlike time.RFC3339Nano it keeps trailing zeros
+const RecordedAtLayout string = "2006-01-02T15:04:05.000000000Z07:00"
+
 type AttributeValueMap map[string]types.AttributeValue
 type AttributeValueMapList []map[string]types.AttributeValue
 
@@ -32,90 +60,361 @@ func (e *NoEventFoundError) Error() string {
 	return "no event found"
 }
 
+// ReservedIdError is returned when events are appended to, or a stream is deleted with, an Id the DynamoDB table uses for its own items:
+// an empty Id, PositionValue or an Id ending in SnapshotValue, StreamValue, KeyValue or CheckpointValue
+// Every store rejects them, so code can move between the stores
+type ReservedIdError struct {
+	ID string
+}
+
+func (e *ReservedIdError) Error() string {
+	return fmt.Sprintf("stream ID %q is reserved", e.ID)
+}
+
+// checkId returns a ReservedIdError if id cannot be the Id of a stream
+func checkId(id string) error {
+	if id == "" || id == PositionValue {
+		return &ReservedIdError{ID: id}
+	}
+	for _, suffix := range []string{SnapshotValue, StreamValue, KeyValue, CheckpointValue} {
+		if strings.HasSuffix(id, suffix) {
+			return &ReservedIdError{ID: id}
+		}
+	}
+	return nil
+}
+
+// NoStream is the expected version of a stream that has no events yet
+const NoStream int = -1
+
+// AnyVersion disables the expected version check of AppendExpected
+const AnyVersion int = -2
+
+// WrongExpectedVersionError is returned by AppendExpected when the stream is not at the expected version
+// Actual carries the latest version of the stream so callers can reload and retry
+type WrongExpectedVersionError struct {
+	ID       string
+	Expected int
+	Actual   int
+}
+
+func (e *WrongExpectedVersionError) Error() string {
+	return fmt.Sprintf("wrong expected version for ID %s: expected %d, actual %d", e.ID, e.Expected, e.Actual)
+}
+
+// maxTransactionItems is the largest number of items a DynamoDB transaction holds
+const maxTransactionItems int = 100
+
+// MaxBatchSize is the largest number of envelopes AppendBatch accepts for a single stream
+// Besides the events, a DynamoDB transaction advances the global position counter and updates the header of every stream in the batch,
+// so a batch spanning several streams holds one envelope less for every additional stream
+const MaxBatchSize int = maxTransactionItems - 2
+
+// BatchTooLargeError is returned by AppendBatch when a batch cannot be written in a single transaction
+type BatchTooLargeError struct {
+	Size    int
+	Streams int
+}
+
+func (e *BatchTooLargeError) Error() string {
+	return fmt.Sprintf("batch of %d envelopes across %d streams exceeds the maximum of %d", e.Size, e.Streams, maxTransactionItems-e.Streams-1)
+}
+
+// MaxAppendAttempts is how many times an append submits its transaction while other writers keep moving the global position counter
+const MaxAppendAttempts int = 10
+
+// appendBackoff is the delay before the first resubmission of an append; it doubles with every attempt up to maxBackoff
+const appendBackoff = 10 * time.Millisecond
+
+// maxBackoff is the longest delay before a DynamoDB request is resent
+const maxBackoff = 2 * time.Second
+
+// PositionContentionError is returned by an append whose transaction lost the race for the global position counter MaxAppendAttempts times
+type PositionContentionError struct {
+	Attempts int
+}
+
+func (e *PositionContentionError) Error() string {
+	return fmt.Sprintf("append gave up after %d attempts contending for the global position counter", e.Attempts)
+}
+
+// ReadOptions selects the range of a stream returned by Read
+type ReadOptions struct {
+	// FromVersion is the first Version to read
+	FromVersion int
+	// ToVersion is the last Version to read; nil reads to the end of the stream
+	// UpTo builds it, so a range can end at Version zero
+	ToVersion *int
+	// Reverse reads from the newest Version to the oldest
+	Reverse bool
+	// Limit is the maximum number of events to return; zero returns every event in range
+	Limit int
+}
+
 type EventStore interface {
 	Append(context.Context, *events.Envelope) error
+	AppendBatch(context.Context, []events.Envelope) error
+	AppendExpected(ctx context.Context, id string, expectedVersion int, envelopes ...events.Envelope) error
 	Snapshot(context.Context, *events.Snapshot) error
 	Project(context.Context, string) (*events.Envelope, error)
+	ProjectAt(ctx context.Context, id string, version int) (*events.Envelope, error)
+	ProjectAsOf(ctx context.Context, id string, t time.Time) (*events.Envelope, error)
 	QueryLatestVersion(context.Context, string) (int, error)
 	QueryAll(context.Context, string) ([]events.Envelope, error)
+	Read(context.Context, string, ReadOptions) ([]events.Envelope, error)
+	ReadAll(ctx context.Context, fromPosition int, limit int) ([]events.Envelope, error)
+	ListStreams(context.Context, ListOptions) ([]StreamInfo, string, error)
+	QueryByEventName(ctx context.Context, name string, opts EventNameOptions) ([]events.Envelope, error)
+	DeleteStream(ctx context.Context, id string, mode DeleteMode) error
+}
+
+// UpTo returns the ToVersion of a range ending at version
+func UpTo(version int) *int {
+	return &version
+}
+
+// reader is the part of an EventStore that reads a range of a stream
+type reader interface {
+	Read(context.Context, string, ReadOptions) ([]events.Envelope, error)
 }
 
 type DynamoDBEventStore struct {
 	DB    *dynamodb.Client
 	Table string
+	// Streams, StreamArn and PollInterval configure Subscribe; see streams.go
+	Streams      StreamSource
+	StreamArn    string
+	PollInterval time.Duration
+	options
 }
 
-func DynamoDB(db *dynamodb.Client, table string) *DynamoDBEventStore {
-	return &DynamoDBEventStore{DB: db, Table: table}
+func DynamoDB(db *dynamodb.Client, table string, opts ...Option) *DynamoDBEventStore {
+	return &DynamoDBEventStore{DB: db, Table: table, options: newOptions(opts)}
 }
 
 // Append takes a context and Envelope and returns an error
-// It ensures the Version does not already exist then attempts a PUT operation on the DynamoDB EventStoreTable
+// It ensures the Version does not already exist then writes the event and its global Position in a transaction on the DynamoDB EventStoreTable
 func (d *DynamoDBEventStore) Append(ctx context.Context, e *events.Envelope) error {
-	valueMap := AttributeValueMap{
-		"Id": &types.AttributeValueMemberS{Value: e.Id},
-		//AttributeValueMemberN takes a string value, see https://docs.aws.amazon.com/amazondynamodb/latest/APIReference/API_AttributeValue.html
-		"Version":   &types.AttributeValueMemberN{Value: strconv.Itoa(e.Version)},
-		"EventName": &types.AttributeValueMemberS{Value: e.EventName},
-		"Event":     &types.AttributeValueMemberB{Value: e.Event},
+	if err := checkId(e.Id); err != nil {
+		return err
+	}
+	batch := stamped([]events.Envelope{*e})
+	if err := d.appendBatch(ctx, batch); err != nil {
+		return err
+	}
+	e.RecordedAt = batch[0].RecordedAt
+	e.Position = batch[0].Position
+	d.snapshotAppended(ctx, d, batch)
+	return nil
+}
+
+// AppendBatch takes a context and a slice of Envelopes and writes all of them or none of them
+// It uses a single TransactWriteItems call, so a batch for one stream may contain at most MaxBatchSize envelopes
+// The envelopes are given consecutive global Positions in the order of the slice, which are set on them only once the transaction succeeds
+// If any Version already exists the transaction is canceled and an EventAlreadyExistsError for that envelope is returned
+func (d *DynamoDBEventStore) AppendBatch(ctx context.Context, envelopes []events.Envelope) error {
+	if err := validateBatch(envelopes); err != nil {
+		return err
+	}
+	batch := stamped(envelopes)
+	if err := d.appendBatch(ctx, batch); err != nil {
+		return err
+	}
+	recorded(envelopes, batch)
+	d.snapshotAppended(ctx, d, batch)
+	return nil
+}
+
+// AppendExpected appends envelopes to the stream with id only if its latest version is expectedVersion
+// The store assigns the Id and consecutive Versions of the envelopes starting after the latest version
+// and writes them atomically like AppendBatch
+// expectedVersion may be NoStream for a new stream or AnyVersion to skip the check
+// If another writer appends first, a WrongExpectedVersionError with the actual version is returned
+func (d *DynamoDBEventStore) AppendExpected(ctx context.Context, id string, expectedVersion int, envelopes ...events.Envelope) error {
+	if err := checkId(id); err != nil {
+		return err
+	}
+	actual, err := d.latestVersion(ctx, id)
+	if err != nil {
+		return err
+	}
+	if err := checkExpectedVersion(id, expectedVersion, actual); err != nil {
+		return err
+	}
+	batch := versionEnvelopes(id, actual, envelopes)
+	if err := validateBatch(batch); err != nil {
+		return err
+	}
+	stamp(batch)
+	err = d.appendBatch(ctx, batch)
+	checkErr := &EventAlreadyExistsError{}
+	if errors.As(err, &checkErr) {
+		//The conditional write of the next version lost a race with another writer
+		actual, err := d.latestVersion(ctx, id)
+		if err != nil {
+			return err
+		}
+		return &WrongExpectedVersionError{ID: id, Expected: expectedVersion, Actual: actual}
+	}
+	if err != nil {
+		return err
 	}
-	return d.append(ctx, valueMap)
+	d.snapshotAppended(ctx, d, batch)
+	return nil
 }
 
+// Snapshot stores the snapshot under its Id with SnapshotValue appended; a snapshot with the same Version cannot be overwritten
 func (d *DynamoDBEventStore) Snapshot(ctx context.Context, snapshot *events.Snapshot) error {
-	valueMap := AttributeValueMap{
-		"Id":            &types.AttributeValueMemberS{Value: snapshot.Id + SnapshotValue},
-		"Version":       &types.AttributeValueMemberN{Value: strconv.Itoa(snapshot.Version)},
-		"LatestVersion": &types.AttributeValueMemberN{Value: strconv.Itoa(snapshot.LatestVersion)},
-		"EventName":     &types.AttributeValueMemberS{Value: snapshot.EventName},
-		"Event":         &types.AttributeValueMemberB{Value: snapshot.Event},
+	item, err := d.snapshotItem(ctx, snapshot)
+	if err != nil {
+		return err
 	}
+	return d.append(ctx, item)
+}
 
-	return d.append(ctx, valueMap)
+// replaceSnapshot stores the snapshot, overwriting a snapshot with the same Version
+func (d *DynamoDBEventStore) replaceSnapshot(ctx context.Context, snapshot *events.Snapshot) error {
+	item, err := d.snapshotItem(ctx, snapshot)
+	if err != nil {
+		return err
+	}
+	_, err = d.DB.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(d.Table),
+		Item:      item,
+	})
+	return err
+}
+
+// snapshotItem stamps the snapshot and maps it to the attributes of its DynamoDB item, with its personal data encrypted
+func (d *DynamoDBEventStore) snapshotItem(ctx context.Context, snapshot *events.Snapshot) (AttributeValueMap, error) {
+	snapshot.RecordedAt = recordedAt()
+	snapshot.AggregatorVersion = d.aggregatorVersion(snapshot.EventName)
+	payload, err := d.encryptSnapshot(ctx, snapshot)
+	if err != nil {
+		return nil, err
+	}
+	valueMap := AttributeValueMap{
+		"Id":                &types.AttributeValueMemberS{Value: snapshot.Id + SnapshotValue},
+		"Version":           &types.AttributeValueMemberN{Value: strconv.Itoa(snapshot.Version)},
+		"LatestVersion":     &types.AttributeValueMemberN{Value: strconv.Itoa(snapshot.LatestVersion)},
+		"AggregatorVersion": &types.AttributeValueMemberN{Value: strconv.Itoa(snapshot.AggregatorVersion)},
+		"EventName":         &types.AttributeValueMemberS{Value: snapshot.EventName},
+		"Event":             &types.AttributeValueMemberB{Value: payload},
+	}
+	metadataItem(valueMap, snapshot.Metadata)
+	return valueMap, nil
 }
 
 // Project takes an id, queries events since the last snapshot, and returns a reconstituted Envelope
+// If the SnapshotPolicy for the stream's EventName asks for it, the result is stored as a new snapshot
 func (d *DynamoDBEventStore) Project(ctx context.Context, id string) (*events.Envelope, error) {
-	snapshot, err := d.getLatestSnapshot(ctx, id)
+	projected, since, stale, err := d.project(ctx, id)
 	if err != nil {
-		checkErr := &NoEventFoundError{}
-		if errors.As(err, &checkErr) {
-			envelopes, err := d.QueryAll(ctx, id)
-			if err != nil {
-				return nil, err
-			}
-			return events.AggregateEnvelopes(envelopes)
-		}
 		return nil, err
 	}
-	params := dynamodb.QueryInput{
-		TableName:              aws.String(d.Table),
-		KeyConditionExpression: aws.String("Id = :uuid AND Version >= :version"),
-		ExpressionAttributeValues: map[string]types.AttributeValue{
-			":uuid":    &types.AttributeValueMemberS{Value: id},
-			":version": &types.AttributeValueMemberN{Value: strconv.Itoa(snapshot.LatestVersion)},
-		},
+	d.autoSnapshot(ctx, d, projected, since, stale)
+	return projected, nil
+}
+
+// project reconstitutes the stream with id and returns the events folded on top of its latest snapshot
+// stale reports that the latest snapshot was built by another version of the aggregator and was not used
+func (d *DynamoDBEventStore) project(ctx context.Context, id string) (projected *events.Envelope, since []events.Envelope, stale bool, err error) {
+	snapshot, err := d.getLatestSnapshot(ctx, id)
+	checkErr := &NoEventFoundError{}
+	if err != nil && !errors.As(err, &checkErr) {
+		return nil, nil, false, err
 	}
-	ml, err := d.query(ctx, &params)
-	if err != nil {
+	if err == nil {
+		stale = !d.current(snapshot)
+	}
+	if err != nil || stale {
+		envelopes, err := d.QueryAll(ctx, id)
+		if err != nil {
+			return nil, nil, stale, err
+		}
+		projected, err := d.aggregate(envelopes)
+		return projected, envelopes, stale, err
+	}
+	envelopes, err := d.Read(ctx, id, ReadOptions{FromVersion: snapshot.LatestVersion})
+	//No events recorded since the snapshot is not an error; the snapshot alone is the projection
+	if err != nil && !errors.As(err, &checkErr) {
+		return nil, nil, false, err
+	}
+	projected, err = d.aggregateSnapshot(ctx, snapshot, envelopes)
+	return projected, envelopes, false, err
+}
+
+// ProjectAt takes an id and version and returns the Envelope reconstituted from the events up to and including version
+// It starts from the newest snapshot taken at or before version and only reads the events recorded after it
+func (d *DynamoDBEventStore) ProjectAt(ctx context.Context, id string, version int) (*events.Envelope, error) {
+	//The snapshot may cover every event up to version, in which case no event is read that would reveal the tombstone
+	if err := d.checkDeleted(ctx, id); err != nil {
 		return nil, err
 	}
-	var envelopes []events.Envelope
-	err = attributevalue.UnmarshalListOfMaps(ml, &envelopes)
+	snapshots, err := d.getSnapshots(ctx, id)
+	checkErr := &NoEventFoundError{}
+	if err != nil && !errors.As(err, &checkErr) {
+		return nil, err
+	}
+	return d.projectAt(ctx, d, id, version, snapshotAt(d.currentSnapshots(snapshots), version))
+}
+
+// ProjectAsOf takes an id and time and returns the Envelope reconstituted from the events recorded at or before t
+// It looks up the version recorded at t without reading the events, then projects it like ProjectAt
+func (d *DynamoDBEventStore) ProjectAsOf(ctx context.Context, id string, t time.Time) (*events.Envelope, error) {
+	version, err := d.versionAsOf(ctx, id, t)
+	checkErr := &NoEventFoundError{}
+	if errors.As(err, &checkErr) {
+		//A stream deleted after t is still reported as deleted
+		if err := d.checkDeleted(ctx, id); err != nil {
+			return nil, err
+		}
+	}
 	if err != nil {
 		return nil, err
 	}
-	snapshotEnvelope := events.Envelope{
-		Id:        snapshot.Id,
-		Version:   snapshot.LatestVersion + 1,
-		Event:     snapshot.Event,
-		EventName: snapshot.EventName,
+	return d.ProjectAt(ctx, id, version)
+}
+
+// versionAsOf returns the Version of the last event of the stream with id recorded at or before t
+// It reads the stream newest first and stops at the first page holding such an event, so only the keys of later events are read
+// Events written before RecordedAt was recorded count as recorded before any time
+func (d *DynamoDBEventStore) versionAsOf(ctx context.Context, id string, t time.Time) (int, error) {
+	params := dynamodb.QueryInput{
+		TableName:              aws.String(d.Table),
+		KeyConditionExpression: aws.String("Id = :uuid"),
+		FilterExpression:       aws.String("attribute_not_exists(RecordedAt) OR RecordedAt <= :t"),
+		ProjectionExpression:   aws.String("Version"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":uuid": &types.AttributeValueMemberS{Value: id},
+			":t":    &types.AttributeValueMemberS{Value: t.UTC().Format(RecordedAtLayout)},
+		},
+		ScanIndexForward: aws.Bool(false),
 	}
-	envelopes = append(envelopes, snapshotEnvelope)
-	return events.AggregateEnvelopes(envelopes)
+	p := dynamodb.NewQueryPaginator(d.DB, &params)
+	for p.HasMorePages() {
+		out, err := p.NextPage(ctx)
+		if err != nil {
+			return NoStream, err
+		}
+		if len(out.Items) == 0 {
+			continue
+		}
+		var e events.Envelope
+		if err := attributevalue.UnmarshalMap(out.Items[0], &e); err != nil {
+			return NoStream, err
+		}
+		return e.Version, nil
+	}
+	return NoStream, &NoEventFoundError{}
 }
 
+// QueryLatestVersion returns the latest Version of the stream with id, a NoEventFoundError for an empty stream or a StreamDeletedError for a deleted one
 func (d *DynamoDBEventStore) QueryLatestVersion(ctx context.Context, id string) (int, error) {
+	//A reserved Id holds the table's own items rather than events
+	if err := checkId(id); err != nil {
+		return -1, &NoEventFoundError{}
+	}
 	params := dynamodb.QueryInput{
 		TableName:              aws.String(d.Table),
 		KeyConditionExpression: aws.String("Id = :uuid"),
@@ -125,7 +424,7 @@ func (d *DynamoDBEventStore) QueryLatestVersion(ctx context.Context, id string)
 		Limit:            aws.Int32(1),
 		ScanIndexForward: aws.Bool(false),
 	}
-	var e []events.Snapshot
+	var e []events.Envelope
 	mapList, err := d.query(ctx, &params)
 	if err != nil {
 		return -1, err
@@ -135,17 +434,183 @@ func (d *DynamoDBEventStore) QueryLatestVersion(ctx context.Context, id string)
 	if err != nil {
 		return -1, err
 	}
+	if err := tombstoneError(&e[0]); err != nil {
+		return -1, err
+	}
 	return e[0].Version, nil
 }
 
+// ReadAll takes a context, position and limit and returns up to limit events of every stream from fromPosition on in global order
+// A limit of zero returns every event; the positions of events removed by a HardDelete are left out
+// It reads the LogShards partitions of PositionIndex, which is eventually consistent, so a recent event may be missing while later ones are returned
+func (d *DynamoDBEventStore) ReadAll(ctx context.Context, fromPosition int, limit int) ([]events.Envelope, error) {
+	var all []events.Envelope
+	for {
+		want := 0
+		if limit > 0 {
+			want = limit - len(all)
+		}
+		page, more, err := d.readShards(ctx, fromPosition, want)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, page...)
+		if !more || (limit > 0 && len(all) >= limit) {
+			break
+		}
+		fromPosition = page[len(page)-1].Position + 1
+	}
+	if len(all) == 0 {
+		return nil, &NoEventFoundError{}
+	}
+	if err := d.decode(ctx, all); err != nil {
+		return nil, err
+	}
+	return all, nil
+}
+
+// readShards queries every shard of PositionIndex in parallel for its share of want events from fromPosition on and merges them by Position
+func (d *DynamoDBEventStore) readShards(ctx context.Context, fromPosition int, want int) ([]events.Envelope, bool, error) {
+	return mergeShards(LogShards, want, func(shard int, share int) ([]events.Envelope, error) {
+		return d.readShard(ctx, logShard(shard), fromPosition, share)
+	}, func(a, b events.Envelope) bool { return a.Position < b.Position })
+}
+
+// mergeShards reads every one of shards in parallel for its share of want items and merges them in the order of less
+// A want of zero reads every item; more reports that a shard filled its share, in which case the page ends at the last item
+// every shard has been read up to, as a shard that filled its share may hold further items before the last ones of the others
+func mergeShards[T any](shards int, want int, read func(shard int, share int) ([]T, error), less func(a, b T) bool) (page []T, more bool, err error) {
+	share := 0
+	if want > 0 {
+		share = (want + shards - 1) / shards
+	}
+	results := make([][]T, shards)
+	errs := make([]error, shards)
+	var wg sync.WaitGroup
+	for shard := range results {
+		wg.Add(1)
+		go func(shard int) {
+			defer wg.Done()
+			results[shard], errs[shard] = read(shard, share)
+		}(shard)
+	}
+	wg.Wait()
+	//through is the last item every shard has been read up to when a shard filled its share
+	var through T
+	for shard, items := range results {
+		if errs[shard] != nil {
+			return nil, false, errs[shard]
+		}
+		if share > 0 && len(items) == share {
+			if last := items[share-1]; !more || less(last, through) {
+				through = last
+			}
+			more = true
+		}
+		page = append(page, items...)
+	}
+	sort.Slice(page, func(i, j int) bool { return less(page[i], page[j]) })
+	if more {
+		page = page[:sort.Search(len(page), func(i int) bool { return less(through, page[i]) })]
+	}
+	if want > 0 && len(page) > want {
+		page = page[:want]
+	}
+	return page, more, nil
+}
+
+// readShard returns up to limit events of the PositionIndex partition with the Log value from fromPosition on, or every one for a limit of zero
+func (d *DynamoDBEventStore) readShard(ctx context.Context, log string, fromPosition int, limit int) ([]events.Envelope, error) {
+	params := dynamodb.QueryInput{
+		TableName:              aws.String(d.Table),
+		IndexName:              aws.String(PositionIndex),
+		KeyConditionExpression: aws.String("#log = :log AND #position >= :from"),
+		ExpressionAttributeNames: map[string]string{
+			"#log":      "Log",
+			"#position": "Position",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":log":  &types.AttributeValueMemberS{Value: log},
+			":from": &types.AttributeValueMemberN{Value: strconv.Itoa(fromPosition)},
+		},
+	}
+	if limit > 0 {
+		params.Limit = aws.Int32(int32(limit))
+	}
+	maplist, err := d.query(ctx, &params)
+	checkErr := &NoEventFoundError{}
+	if errors.As(err, &checkErr) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var events []events.Envelope
+	err = attributevalue.UnmarshalListOfMaps(maplist, &events)
+	if err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// latestVersion behaves like QueryLatestVersion but returns NoStream rather than an error for an empty stream
+func (d *DynamoDBEventStore) latestVersion(ctx context.Context, id string) (int, error) {
+	v, err := d.QueryLatestVersion(ctx, id)
+	checkErr := &NoEventFoundError{}
+	if errors.As(err, &checkErr) {
+		return NoStream, nil
+	}
+	return v, err
+}
+
 // QueryAll takes a context and id and returns a slice of Events and an error
 func (d *DynamoDBEventStore) QueryAll(ctx context.Context, id string) ([]events.Envelope, error) {
+	return d.Read(ctx, id, ReadOptions{})
+}
+
+// Read takes a context, id and ReadOptions and returns the selected range of the stream
+// The range is expressed as a key condition on Version, so DynamoDB only reads the requested items
+// A range that does not reach the latest item, which is the tombstone of a deleted stream, costs another query to check the stream was not deleted
+func (d *DynamoDBEventStore) Read(ctx context.Context, id string, opts ReadOptions) ([]events.Envelope, error) {
+	events, err := d.read(ctx, id, opts)
+	for i := range events {
+		if err := tombstoneError(&events[i]); err != nil {
+			return nil, err
+		}
+	}
+	reachedEnd := err == nil && opts.ToVersion == nil && (opts.Reverse || opts.Limit == 0 || len(events) < opts.Limit)
+	if !reachedEnd {
+		if err := d.checkDeleted(ctx, id); err != nil {
+			return nil, err
+		}
+	}
+	return events, err
+}
+
+// read returns the selected range of the stream with id without checking whether the stream was deleted
+func (d *DynamoDBEventStore) read(ctx context.Context, id string, opts ReadOptions) ([]events.Envelope, error) {
+	if checkId(id) != nil || (opts.ToVersion != nil && *opts.ToVersion < opts.FromVersion) {
+		return nil, &NoEventFoundError{}
+	}
 	params := dynamodb.QueryInput{
 		TableName:              aws.String(d.Table),
 		KeyConditionExpression: aws.String("Id = :uuid"),
 		ExpressionAttributeValues: map[string]types.AttributeValue{
 			":uuid": &types.AttributeValueMemberS{Value: id},
 		},
+		ScanIndexForward: aws.Bool(!opts.Reverse),
+	}
+	switch {
+	case opts.ToVersion != nil:
+		params.KeyConditionExpression = aws.String("Id = :uuid AND Version BETWEEN :from AND :to")
+		params.ExpressionAttributeValues[":from"] = &types.AttributeValueMemberN{Value: strconv.Itoa(opts.FromVersion)}
+		params.ExpressionAttributeValues[":to"] = &types.AttributeValueMemberN{Value: strconv.Itoa(*opts.ToVersion)}
+	case opts.FromVersion > 0:
+		params.KeyConditionExpression = aws.String("Id = :uuid AND Version >= :from")
+		params.ExpressionAttributeValues[":from"] = &types.AttributeValueMemberN{Value: strconv.Itoa(opts.FromVersion)}
+	}
+	if opts.Limit > 0 {
+		params.Limit = aws.Int32(int32(opts.Limit))
 	}
 	maplist, err := d.query(ctx, &params)
 	if err != nil {
@@ -156,6 +621,9 @@ func (d *DynamoDBEventStore) QueryAll(ctx context.Context, id string) ([]events.
 	if err != nil {
 		return nil, err
 	}
+	if err := d.decode(ctx, events); err != nil {
+		return nil, err
+	}
 	return events, nil
 }
 
@@ -179,12 +647,172 @@ func (d *DynamoDBEventStore) getLatestSnapshot(ctx context.Context, id string) (
 	if err != nil {
 		return nil, err
 	}
+	//Snapshot items are stored under the id with SnapshotValue appended
+	snapshots[0].Id = id
 	return &snapshots[0], nil
 }
 
+// getSnapshots returns every snapshot of the stream with id
+func (d *DynamoDBEventStore) getSnapshots(ctx context.Context, id string) ([]events.Snapshot, error) {
+	params := dynamodb.QueryInput{
+		TableName:              aws.String(d.Table),
+		KeyConditionExpression: aws.String("Id = :uuid"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":uuid": &types.AttributeValueMemberS{Value: id + SnapshotValue},
+		},
+	}
+	var snapshots []events.Snapshot
+	mapList, err := d.query(ctx, &params)
+	if err != nil {
+		return nil, err
+	}
+	err = attributevalue.UnmarshalListOfMaps(mapList, &snapshots)
+	if err != nil {
+		return nil, err
+	}
+	for i := range snapshots {
+		snapshots[i].Id = id
+	}
+	return snapshots, nil
+}
+
+// snapshotAt returns the snapshot covering the most events without covering any event after version, or nil if there is none
+// A snapshot covers the events before its LatestVersion
+func snapshotAt(snapshots []events.Snapshot, version int) *events.Snapshot {
+	var at *events.Snapshot
+	for i := range snapshots {
+		s := &snapshots[i]
+		if s.LatestVersion > version+1 {
+			continue
+		}
+		if at == nil || s.LatestVersion > at.LatestVersion || (s.LatestVersion == at.LatestVersion && s.Version > at.Version) {
+			at = s
+		}
+	}
+	return at
+}
+
+// projectAt reconstitutes the stream with id up to and including version from snapshot, which may be nil, and the events after it
+func (o *options) projectAt(ctx context.Context, r reader, id string, version int, snapshot *events.Snapshot) (*events.Envelope, error) {
+	if version < 0 {
+		return nil, &NoEventFoundError{}
+	}
+	from := 0
+	if snapshot != nil {
+		from = snapshot.LatestVersion
+	}
+	var envelopes []events.Envelope
+	var err error
+	//The snapshot may cover every event up to version
+	if from <= version {
+		envelopes, err = r.Read(ctx, id, ReadOptions{FromVersion: from, ToVersion: UpTo(version)})
+	}
+	checkErr := &NoEventFoundError{}
+	if err != nil && !errors.As(err, &checkErr) {
+		return nil, err
+	}
+	if snapshot != nil {
+		return o.aggregateSnapshot(ctx, snapshot, envelopes)
+	}
+	if len(envelopes) == 0 {
+		return nil, &NoEventFoundError{}
+	}
+	return o.aggregate(envelopes)
+}
+
+// versionAsOf returns the Version of the last of the ordered envelopes recorded at or before t
+func versionAsOf(envelopes []events.Envelope, t time.Time) (int, error) {
+	version := NoStream
+	for _, e := range envelopes {
+		if e.RecordedAt.After(t) {
+			break
+		}
+		version = e.Version
+	}
+	if version == NoStream {
+		return NoStream, &NoEventFoundError{}
+	}
+	return version, nil
+}
+
+// recordedAt returns the time the store records for events appended now
+func recordedAt() time.Time {
+	return time.Now().UTC()
+}
+
+// stamp sets the RecordedAt time of every envelope written together
+func stamp(envelopes []events.Envelope) {
+	t := recordedAt()
+	for i := range envelopes {
+		envelopes[i].RecordedAt = t
+	}
+}
+
+// stamped returns copies of envelopes written together, stamped with the time they are recorded at
+// The caller's envelopes are left as they are until the write succeeds, when recorded copies the stamps back
+func stamped(envelopes []events.Envelope) []events.Envelope {
+	batch := append([]events.Envelope(nil), envelopes...)
+	stamp(batch)
+	return batch
+}
+
+// recorded copies the RecordedAt time and Position of the written batch back to the envelopes it was stamped from
+func recorded(envelopes, batch []events.Envelope) {
+	for i := range envelopes {
+		envelopes[i].RecordedAt = batch[i].RecordedAt
+		envelopes[i].Position = batch[i].Position
+	}
+}
+
+// versionEnvelopes returns copies of envelopes assigned to the stream with id and numbered consecutively after latest
+func versionEnvelopes(id string, latest int, envelopes []events.Envelope) []events.Envelope {
+	versioned := make([]events.Envelope, len(envelopes))
+	for i, e := range envelopes {
+		e.Id = id
+		e.Version = latest + 1 + i
+		versioned[i] = e
+	}
+	return versioned
+}
+
+// validateBatch ensures a batch fits in one transaction, does not repeat an Id and Version and only holds stream Ids
+func validateBatch(envelopes []events.Envelope) error {
+	type key struct {
+		id      string
+		version int
+	}
+	seen := make(map[key]struct{}, len(envelopes))
+	streams := make(map[string]struct{})
+	for _, e := range envelopes {
+		if err := checkId(e.Id); err != nil {
+			return err
+		}
+		k := key{id: e.Id, version: e.Version}
+		if _, ok := seen[k]; ok {
+			return &EventAlreadyExistsError{ID: e.Id, Version: e.Version}
+		}
+		seen[k] = struct{}{}
+		streams[e.Id] = struct{}{}
+	}
+	if len(envelopes)+len(streams)+1 > maxTransactionItems {
+		return &BatchTooLargeError{Size: len(envelopes), Streams: len(streams)}
+	}
+	return nil
+}
+
+// checkExpectedVersion returns a WrongExpectedVersionError if the actual version of the stream with id is not the expected one
+func checkExpectedVersion(id string, expected, actual int) error {
+	if expected == AnyVersion || expected == actual {
+		return nil
+	}
+	return &WrongExpectedVersionError{ID: id, Expected: expected, Actual: actual}
+}
+
 // query takes a context and DynamoDB query parameters and returns a slice of Events and an error
+// If params.Limit is set, it is the total number of items returned rather than the size of each page
 func (d *DynamoDBEventStore) query(ctx context.Context, params *dynamodb.QueryInput) (AttributeValueMapList, error) {
 	var maps AttributeValueMapList
+	limit := int(aws.ToInt32(params.Limit))
 	// Query paginator provides pagination for queries until there are no more pages for DynamoDB to go through
 	// See: https://docs.aws.amazon.com/amazondynamodb/latest/developerguide/Query.Pagination.htm
 	p := dynamodb.NewQueryPaginator(d.DB, params)
@@ -195,6 +823,10 @@ func (d *DynamoDBEventStore) query(ctx context.Context, params *dynamodb.QueryIn
 		}
 		items := out.Items
 		maps = append(maps, items...)
+		if limit > 0 && len(maps) >= limit {
+			maps = maps[:limit]
+			break
+		}
 	}
 	// If the slice is empty, then error is returned
 	if len(maps) < 1 {
@@ -203,6 +835,346 @@ func (d *DynamoDBEventStore) query(ctx context.Context, params *dynamodb.QueryIn
 	return maps, nil
 }
 
+// envelopeItem maps an Envelope to the attributes of its DynamoDB item
+func envelopeItem(e *events.Envelope) AttributeValueMap {
+	valueMap := AttributeValueMap{
+		"Id": &types.AttributeValueMemberS{Value: e.Id},
+		//AttributeValueMemberN takes a string value, see https://docs.aws.amazon.com/amazondynamodb/latest/APIReference/API_AttributeValue.html
+		"Version":   &types.AttributeValueMemberN{Value: strconv.Itoa(e.Version)},
+		"Position":  &types.AttributeValueMemberN{Value: strconv.Itoa(e.Position)},
+		"Log":       &types.AttributeValueMemberS{Value: logShard(e.Position)},
+		"EventName": &types.AttributeValueMemberS{Value: e.EventName},
+		"Event":     &types.AttributeValueMemberB{Value: e.Event},
+	}
+	if e.SchemaVersion != 0 {
+		valueMap["SchemaVersion"] = &types.AttributeValueMemberN{Value: strconv.Itoa(e.SchemaVersion)}
+	}
+	metadataItem(valueMap, e.Metadata)
+	return valueMap
+}
+
+// metadataItem adds the non-empty Metadata fields to valueMap as top level attributes
+// RecordedAt is written with a fixed width layout so its string values sort chronologically
+func metadataItem(valueMap AttributeValueMap, m events.Metadata) {
+	if !m.RecordedAt.IsZero() {
+		valueMap["RecordedAt"] = &types.AttributeValueMemberS{Value: m.RecordedAt.UTC().Format(RecordedAtLayout)}
+	}
+	if m.User != "" {
+		valueMap["User"] = &types.AttributeValueMemberS{Value: m.User}
+	}
+	if m.CorrelationId != "" {
+		valueMap["CorrelationId"] = &types.AttributeValueMemberS{Value: m.CorrelationId}
+	}
+	if m.CausationId != "" {
+		valueMap["CausationId"] = &types.AttributeValueMemberS{Value: m.CausationId}
+	}
+	if len(m.Headers) > 0 {
+		headers := make(AttributeValueMap, len(m.Headers))
+		for k, v := range m.Headers {
+			headers[k] = &types.AttributeValueMemberS{Value: v}
+		}
+		valueMap["Headers"] = &types.AttributeValueMemberM{Value: headers}
+	}
+}
+
+// appendBatch writes envelopes and advances the global position counter in a single transaction
+// The counter update is conditioned on the position read beforehand, so concurrent writers are serialized and the transaction is retried
+// after a jittered exponential backoff, up to MaxAppendAttempts times before a PositionContentionError is returned
+// The Position of every envelope is set to the one it was written with
+func (d *DynamoDBEventStore) appendBatch(ctx context.Context, envelopes []events.Envelope) error {
+	if len(envelopes) == 0 {
+		return nil
+	}
+	//skip holds the streams whose header already records a later version than the batch
+	skip := make(map[string]bool)
+	//deletes holds the DeleteMode of the streams the batch closes with a tombstone
+	deletes := make(map[string]DeleteMode)
+	for _, e := range envelopes {
+		if e.EventName == TombstoneEventName {
+			deletes[e.Id] = DeleteMode(e.Event)
+		}
+	}
+	stored, err := d.encrypt(ctx, envelopes)
+	if err != nil {
+		return err
+	}
+	for attempt := 1; ; attempt++ {
+		last, err := d.lastPosition(ctx)
+		if err != nil {
+			return err
+		}
+		items := make([]types.TransactWriteItem, 0, len(envelopes)+2)
+		for i := range envelopes {
+			envelopes[i].Position = last + 1 + i
+			stored[i].Position = envelopes[i].Position
+			items = append(items, types.TransactWriteItem{
+				Put: &types.Put{
+					TableName:           aws.String(d.Table),
+					Item:                envelopeItem(&stored[i]),
+					ConditionExpression: aws.String("attribute_not_exists(Version)"),
+				},
+			})
+		}
+		headers := streamHeaders(envelopes)
+		var headerIds []string
+		for _, header := range headers {
+			if skip[header.Id] {
+				continue
+			}
+			headerIds = append(headerIds, header.Id)
+			items = append(items, types.TransactWriteItem{Update: d.headerUpdate(header, deletes[header.Id])})
+		}
+		items = append(items, types.TransactWriteItem{Update: d.positionUpdate(last, last+len(envelopes))})
+		_, err = d.DB.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{TransactItems: items})
+		if err == nil {
+			return nil
+		}
+		//Cancellation reasons are listed in the same order as the transaction items, so the failed condition points at the offending envelope
+		var txErr *types.TransactionCanceledException
+		if !errors.As(err, &txErr) {
+			return err
+		}
+		//A deleted stream fails its header condition whether or not the Version exists, so it is reported first
+		for i, reason := range txErr.CancellationReasons {
+			if i >= len(envelopes) && i < len(envelopes)+len(headerIds) && aws.ToString(reason.Code) == "ConditionalCheckFailed" {
+				if err := deletedHeader(reason.Item); err != nil {
+					return err
+				}
+			}
+		}
+		retry, contended := false, false
+		for i, reason := range txErr.CancellationReasons {
+			switch aws.ToString(reason.Code) {
+			case "ConditionalCheckFailed":
+				if i < len(envelopes) {
+					return &EventAlreadyExistsError{ID: envelopes[i].Id, Version: envelopes[i].Version}
+				}
+				if i < len(envelopes)+len(headerIds) {
+					//The batch fills a gap below the stream's latest version, so the header stays as it is
+					skip[headerIds[i-len(envelopes)]] = true
+				} else {
+					//Another writer moved the position counter
+					contended = true
+				}
+				retry = true
+			case "TransactionConflict":
+				retry, contended = true, true
+			}
+		}
+		if !retry {
+			return err
+		}
+		if attempt == MaxAppendAttempts {
+			return &PositionContentionError{Attempts: attempt}
+		}
+		if !contended {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			continue
+		}
+		//Writers racing for the counter resubmit at once and would keep colliding, so they back off at random
+		if err := backoff(ctx, attempt, appendBackoff); err != nil {
+			return err
+		}
+	}
+}
+
+// backoff waits a random time up to base doubled for every attempt before the one about to be retried, capped at maxBackoff, or until ctx is done
+func backoff(ctx context.Context, attempt int, base time.Duration) error {
+	limit := maxBackoff
+	if attempt < 30 && base<<(attempt-1) < maxBackoff {
+		limit = base << (attempt - 1)
+	}
+	timer := time.NewTimer(time.Duration(rand.Int63n(int64(limit)) + 1))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// lastPosition returns the last global position assigned to an event, or -1 before the first event
+func (d *DynamoDBEventStore) lastPosition(ctx context.Context) (int, error) {
+	out, err := d.DB.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(d.Table),
+		Key:            positionKey(),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return -1, err
+	}
+	position, ok := out.Item["Position"].(*types.AttributeValueMemberN)
+	if !ok {
+		return -1, nil
+	}
+	return strconv.Atoi(position.Value)
+}
+
+// positionUpdate moves the global position counter from last to next, failing if another writer moved it first
+func (d *DynamoDBEventStore) positionUpdate(last, next int) *types.Update {
+	update := &types.Update{
+		TableName:           aws.String(d.Table),
+		Key:                 positionKey(),
+		UpdateExpression:    aws.String("SET #position = :next"),
+		ConditionExpression: aws.String("#position = :last"),
+		ExpressionAttributeNames: map[string]string{
+			"#position": "Position",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":next": &types.AttributeValueMemberN{Value: strconv.Itoa(next)},
+			":last": &types.AttributeValueMemberN{Value: strconv.Itoa(last)},
+		},
+	}
+	if last < 0 {
+		update.ConditionExpression = aws.String("attribute_not_exists(#position)")
+		delete(update.ExpressionAttributeValues, ":last")
+	}
+	return update
+}
+
+// reservePositions advances the global position counter by n and returns the first of the positions it skipped over
+func (d *DynamoDBEventStore) reservePositions(ctx context.Context, n int) (int, error) {
+	for attempt := 1; ; attempt++ {
+		last, err := d.lastPosition(ctx)
+		if err != nil {
+			return 0, err
+		}
+		_, err = d.DB.UpdateItem(ctx, updateItemInput(d.positionUpdate(last, last+n)))
+		if err == nil {
+			return last + 1, nil
+		}
+		checkErr := &types.ConditionalCheckFailedException{}
+		if !errors.As(err, &checkErr) {
+			return 0, err
+		}
+		if attempt == MaxAppendAttempts {
+			return 0, &PositionContentionError{Attempts: attempt}
+		}
+		if err := backoff(ctx, attempt, appendBackoff); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// BackfillPositions gives every event written before global positions existed a Position and a Log shard,
+// moves the events written with the single Log value used before PositionIndex was sharded to their shard, and returns how many events it updated
+// The events without a Position are given the positions after the last one assigned, in RecordedAt order, which also seeds the counter of a table
+// whose events all predate it; until then ReadAll, CatchUpSubscription and QueryByEventName leave them out
+// It scans the whole table, so it is meant to be run once after upgrading a table; running it again skips the events already updated
+func (d *DynamoDBEventStore) BackfillPositions(ctx context.Context) (int, error) {
+	var unpositioned, unsharded []events.Envelope
+	p := dynamodb.NewScanPaginator(d.DB, &dynamodb.ScanInput{
+		TableName:            aws.String(d.Table),
+		FilterExpression:     aws.String("attribute_exists(#event) AND attribute_not_exists(#latest) AND (attribute_not_exists(#position) OR #log = :log)"),
+		ProjectionExpression: aws.String("#id, #version, #position, #recorded"),
+		ExpressionAttributeNames: map[string]string{
+			"#id":       "Id",
+			"#version":  "Version",
+			"#event":    "Event",
+			"#latest":   "LatestVersion",
+			"#position": "Position",
+			"#log":      "Log",
+			"#recorded": "RecordedAt",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":log": &types.AttributeValueMemberS{Value: LogValue},
+		},
+	})
+	for p.HasMorePages() {
+		out, err := p.NextPage(ctx)
+		if err != nil {
+			return 0, err
+		}
+		for _, item := range out.Items {
+			var e events.Envelope
+			if err := attributevalue.UnmarshalMap(item, &e); err != nil {
+				return 0, err
+			}
+			if _, ok := item["Position"]; ok {
+				unsharded = append(unsharded, e)
+			} else {
+				unpositioned = append(unpositioned, e)
+			}
+		}
+	}
+	//Events written before RecordedAt was recorded sort first, and the events of a stream stay in Version order
+	sort.Slice(unpositioned, func(i, j int) bool {
+		a, b := &unpositioned[i], &unpositioned[j]
+		if !a.RecordedAt.Equal(b.RecordedAt) {
+			return a.RecordedAt.Before(b.RecordedAt)
+		}
+		if a.Id != b.Id {
+			return a.Id < b.Id
+		}
+		return a.Version < b.Version
+	})
+	if len(unpositioned) > 0 {
+		first, err := d.reservePositions(ctx, len(unpositioned))
+		if err != nil {
+			return 0, err
+		}
+		for i := range unpositioned {
+			unpositioned[i].Position = first + i
+		}
+	}
+	updated := 0
+	for i, e := range append(unsharded, unpositioned...) {
+		condition := "#position = :position"
+		if i >= len(unsharded) {
+			condition = "attribute_not_exists(#position)"
+		}
+		_, err := d.DB.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+			TableName: aws.String(d.Table),
+			Key: AttributeValueMap{
+				"Id":      &types.AttributeValueMemberS{Value: e.Id},
+				"Version": &types.AttributeValueMemberN{Value: strconv.Itoa(e.Version)},
+			},
+			UpdateExpression:    aws.String("SET #position = :position, #log = :log"),
+			ConditionExpression: aws.String(condition),
+			ExpressionAttributeNames: map[string]string{
+				"#position": "Position",
+				"#log":      "Log",
+			},
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":position": &types.AttributeValueMemberN{Value: strconv.Itoa(e.Position)},
+				":log":      &types.AttributeValueMemberS{Value: logShard(e.Position)},
+			},
+		})
+		checkErr := &types.ConditionalCheckFailedException{}
+		if errors.As(err, &checkErr) {
+			//A concurrent run updated the event first; the position reserved for it is left as a gap
+			continue
+		}
+		if err != nil {
+			return updated, err
+		}
+		updated++
+	}
+	return updated, nil
+}
+
+// updateItemInput returns the input of an UpdateItem call making the update of a transaction item
+func updateItemInput(update *types.Update) *dynamodb.UpdateItemInput {
+	return &dynamodb.UpdateItemInput{
+		TableName:                 update.TableName,
+		Key:                       update.Key,
+		UpdateExpression:          update.UpdateExpression,
+		ConditionExpression:       update.ConditionExpression,
+		ExpressionAttributeNames:  update.ExpressionAttributeNames,
+		ExpressionAttributeValues: update.ExpressionAttributeValues,
+	}
+}
+
+func positionKey() AttributeValueMap {
+	return AttributeValueMap{
+		"Id":      &types.AttributeValueMemberS{Value: PositionValue},
+		"Version": &types.AttributeValueMemberN{Value: "0"},
+	}
+}
+
 func (d *DynamoDBEventStore) append(ctx context.Context, valueMap AttributeValueMap) error {
 	input := &dynamodb.PutItemInput{
 		TableName: &d.Table,
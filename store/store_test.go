@@ -2,67 +2,78 @@ package store_test
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/credentials"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
 	"github.com/cpustejovsky/event-store/events"
 	"github.com/cpustejovsky/event-store/protos/hitpoints"
 	"github.com/cpustejovsky/event-store/store"
+	"github.com/cpustejovsky/event-store/store/dynamotest"
+	"github.com/cpustejovsky/event-store/store/storetest"
 	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"google.golang.org/protobuf/proto"
-	"log"
-	"os"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 var EventStoreTable = "event-store"
 var hp int32
-var client *dynamodb.Client
 var ctx = context.Background()
 var id = "1aa75e80-51e4-48d9-a5b7-2f5e49e78e86"
 var name = "cpustejovsky"
 
-func init() {
-	//Create Dynamodb Client
-	cfg, err := config.LoadDefaultConfig(ctx,
-		config.WithRegion(os.Getenv("AWS_REGION")),
-		config.WithEndpointResolverWithOptions(
-			aws.EndpointResolverWithOptionsFunc(
-				func(service, region string, options ...interface{}) (aws.Endpoint, error) {
-					return aws.Endpoint{}, &aws.EndpointNotFoundError{}
-				},
-			),
-		),
-		config.WithCredentialsProvider(
-			credentials.StaticCredentialsProvider{
-				Value: aws.Credentials{
-					AccessKeyID:     os.Getenv("AWS_ACCESS_ID"),
-					SecretAccessKey: os.Getenv("AWS_SECRET_KEY"),
-				},
-			},
-		),
-	)
-	if err != nil {
-		log.Fatal(err)
-	}
-	client = dynamodb.NewFromConfig(cfg)
+// dynamoClient starts a fake DynamoDB server holding an empty event store table and returns a client of it
+func dynamoClient(t *testing.T) *dynamodb.Client {
+	return pagedDynamoClient(t, 0)
 }
 
-func TestEventStore(t *testing.T) {
-	if testing.Short() {
-		t.Skip("skipping acceptance test")
-	}
+// pagedDynamoClient is dynamoClient with a fake server returning at most pageSize items per Query or Scan page
+func pagedDynamoClient(t *testing.T, pageSize int) *dynamodb.Client {
+	srv := dynamotest.NewServer()
+	srv.PageSize = pageSize
+	t.Cleanup(srv.Close)
+	client := srv.Client()
+	require.Nil(t, store.CreateTable(ctx, client, EventStoreTable))
+	return client
+}
+
+func TestDynamoDBEventStoreConformance(t *testing.T) {
+	storetest.Run(t, func() store.EventStore {
+		return store.DynamoDB(dynamoClient(t), EventStoreTable)
+	})
+}
+
+func TestDynamoDBEventStoreConformance_Paged(t *testing.T) {
+	//One item per page makes every read follow LastEvaluatedKey
+	storetest.Run(t, func() store.EventStore {
+		return store.DynamoDB(pagedDynamoClient(t, 1), EventStoreTable)
+	})
+}
+
+func TestDynamoDBEventStore_Registry(t *testing.T) {
+	storetest.RunRegistry(t, func(registry *events.Registry) store.EventStore {
+		return store.DynamoDB(dynamoClient(t), EventStoreTable, store.WithRegistry(registry))
+	})
+}
 
+func TestEventStore(t *testing.T) {
 	//Create Event Store
-	es := store.DynamoDB(client, EventStoreTable)
+	es := store.DynamoDB(dynamoClient(t), EventStoreTable)
 	require.NotNil(t, es)
 
-	hitPointEvents := []hitpoints.PlayerCharacterHitPoints{{
+	hitPointEvents := []*hitpoints.PlayerCharacterHitPoints{{
 		Id:                 id,
 		CharacterName:      name,
 		CharacterHitPoints: 8,
@@ -81,7 +92,7 @@ func TestEventStore(t *testing.T) {
 	var envelopes []events.Envelope
 	for i, e := range hitPointEvents {
 		hp += e.GetCharacterHitPoints()
-		bin, err := proto.Marshal(&e)
+		bin, err := proto.Marshal(e)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -94,8 +105,9 @@ func TestEventStore(t *testing.T) {
 	}
 
 	t.Run("Append Items to Envelope Store", func(t *testing.T) {
-		for _, event := range envelopes {
-			err := es.Append(ctx, &event)
+		//Append through the slice so the RecordedAt time set by the store is kept for comparison
+		for i := range envelopes {
+			err := es.Append(ctx, &envelopes[i])
 			if err != nil {
 				t.Fatal(err)
 			}
@@ -159,29 +171,420 @@ func TestEventStore(t *testing.T) {
 		assert.Nil(t, err)
 		assert.Equal(t, len(envelopes), len(queriedEvents))
 	})
+}
+
+func TestDynamoDBEventStore_PruneAndInvalidate(t *testing.T) {
+	var mu sync.Mutex
+	folded := 0
+	registry := events.NewRegistry()
+	registry.Register("sum", func() events.Aggregator { return sumAggregator{mu: &mu, folded: &folded} })
+	es := store.DynamoDB(pagedDynamoClient(t, 2), EventStoreTable, store.WithRegistry(registry), store.WithRetentionPolicy(store.RetentionPolicy{KeepLast: 1}))
+	id := uuid.NewString()
+	snapshotSums(t, es, id, 1, 2, 3)
+	pruned, err := es.PruneAllSnapshots(ctx)
+	require.Nil(t, err)
+	assert.Equal(t, 2, pruned)
+	projected, err := es.Project(ctx, id)
+	require.Nil(t, err)
+	assert.Equal(t, []byte{6}, projected.Event)
+	assert.Equal(t, 1, folded)
+
+	invalidated, err := es.InvalidateSnapshots(ctx, "sum")
+	require.Nil(t, err)
+	assert.Equal(t, 1, invalidated)
+	projected, err = es.Project(ctx, id)
+	require.Nil(t, err)
+	assert.Equal(t, []byte{6}, projected.Event)
+	assert.Equal(t, 3, folded)
+}
 
-	t.Cleanup(func() {
-		p := dynamodb.NewScanPaginator(client, &dynamodb.ScanInput{
+func TestDynamoDBEventStore_BackfillStreamHeaders(t *testing.T) {
+	client := dynamoClient(t)
+	es := store.DynamoDB(client, EventStoreTable)
+	live, deleted, current := uuid.NewString(), uuid.NewString(), uuid.NewString()
+	for _, stream := range []string{live, deleted, current} {
+		require.Nil(t, es.AppendBatch(ctx, []events.Envelope{
+			{Id: stream, Version: 0, EventName: events.LevelsName},
+			{Id: stream, Version: 1, EventName: events.HitPointsName},
+		}))
+	}
+	require.Nil(t, es.DeleteStream(ctx, deleted, store.SoftDelete))
+	//Removing the headers of live and deleted leaves them like streams appended to before headers existed
+	for _, stream := range []string{live, deleted} {
+		_, err := client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
 			TableName: aws.String(EventStoreTable),
+			Key: store.AttributeValueMap{
+				"Id":      &types.AttributeValueMemberS{Value: stream + store.StreamValue},
+				"Version": &types.AttributeValueMemberN{Value: "0"},
+			},
 		})
-		for p.HasMorePages() {
-			out, err := p.NextPage(ctx)
-			if err != nil {
-				t.Fatal(err)
+		require.Nil(t, err)
+	}
+	streams, _, err := es.ListStreams(ctx, store.ListOptions{})
+	require.Nil(t, err)
+	require.Equal(t, 1, len(streams))
+
+	written, err := es.BackfillStreamHeaders(ctx)
+	require.Nil(t, err)
+	assert.Equal(t, 2, written)
+	streams, _, err = es.ListStreams(ctx, store.ListOptions{})
+	require.Nil(t, err)
+	require.Equal(t, 2, len(streams))
+	ids := []string{streams[0].Id, streams[1].Id}
+	assert.ElementsMatch(t, []string{live, current}, ids)
+	for _, info := range streams {
+		assert.Equal(t, 1, info.LatestVersion)
+		assert.Equal(t, events.HitPointsName, info.EventName)
+		assert.False(t, info.UpdatedAt.IsZero())
+	}
+	//The backfilled header of the deleted stream still rejects appends
+	err = es.Append(ctx, &events.Envelope{Id: deleted, Version: 3, EventName: events.HitPointsName})
+	checkErr := &store.StreamDeletedError{}
+	assert.True(t, errors.As(err, &checkErr), "expected StreamDeletedError, got %v", err)
+
+	written, err = es.BackfillStreamHeaders(ctx)
+	require.Nil(t, err)
+	assert.Equal(t, 0, written)
+}
+
+func TestDynamoDBEventStore_BackfillPositions(t *testing.T) {
+	client := dynamoClient(t)
+	es := store.DynamoDB(client, EventStoreTable)
+	current, legacy := uuid.NewString(), uuid.NewString()
+	appendVersions(t, es, current, 0, 1)
+	//The second event was written with the Log value used before PositionIndex was sharded
+	_, err := client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(EventStoreTable),
+		Key: store.AttributeValueMap{
+			"Id":      &types.AttributeValueMemberS{Value: current},
+			"Version": &types.AttributeValueMemberN{Value: "1"},
+		},
+		UpdateExpression:          aws.String("SET #log = :log"),
+		ExpressionAttributeNames:  map[string]string{"#log": "Log"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{":log": &types.AttributeValueMemberS{Value: store.LogValue}},
+	})
+	require.Nil(t, err)
+	//The legacy stream was written before events had a Position
+	for version := 0; version < 3; version++ {
+		_, err := client.PutItem(ctx, &dynamodb.PutItemInput{
+			TableName: aws.String(EventStoreTable),
+			Item: store.AttributeValueMap{
+				"Id":         &types.AttributeValueMemberS{Value: legacy},
+				"Version":    &types.AttributeValueMemberN{Value: strconv.Itoa(version)},
+				"EventName":  &types.AttributeValueMemberS{Value: events.HitPointsName},
+				"Event":      &types.AttributeValueMemberB{Value: []byte{byte(version)}},
+				"RecordedAt": &types.AttributeValueMemberS{Value: time.Now().UTC().Format(store.RecordedAtLayout)},
+			},
+		})
+		require.Nil(t, err)
+	}
+	all, err := es.ReadAll(ctx, 0, 0)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(all))
+
+	updated, err := es.BackfillPositions(ctx)
+	require.Nil(t, err)
+	assert.Equal(t, 4, updated)
+	all, err = es.ReadAll(ctx, 0, 0)
+	require.Nil(t, err)
+	require.Equal(t, 5, len(all))
+	for i, want := range []struct {
+		id      string
+		version int
+	}{{current, 0}, {current, 1}, {legacy, 0}, {legacy, 1}, {legacy, 2}} {
+		assert.Equal(t, i, all[i].Position)
+		assert.Equal(t, want.id, all[i].Id)
+		assert.Equal(t, want.version, all[i].Version)
+	}
+	named, err := es.QueryByEventName(ctx, events.HitPointsName, store.EventNameOptions{})
+	require.Nil(t, err)
+	assert.Equal(t, 5, len(named))
+
+	//The counter was seeded past the backfilled events, and a second run has nothing left to do
+	appendVersions(t, es, current, 2, 2)
+	all, err = es.ReadAll(ctx, 5, 0)
+	require.Nil(t, err)
+	assert.Equal(t, 5, all[0].Position)
+	updated, err = es.BackfillPositions(ctx)
+	require.Nil(t, err)
+	assert.Equal(t, 0, updated)
+}
+
+func TestDynamoDBEventStore_HardDeleteRemovesItems(t *testing.T) {
+	client := dynamoClient(t)
+	es := store.DynamoDB(client, EventStoreTable)
+	id := uuid.NewString()
+	appendVersions(t, es, id, 0, 2)
+	require.Nil(t, es.Snapshot(ctx, &events.Snapshot{Id: id, Version: 0, LatestVersion: 2, EventName: events.HitPointsName}))
+	require.Nil(t, es.DeleteStream(ctx, id, store.HardDelete))
+
+	//Only the tombstone and the stream header are left
+	out, err := client.Scan(ctx, &dynamodb.ScanInput{TableName: aws.String(EventStoreTable)})
+	require.Nil(t, err)
+	var ids []string
+	for _, item := range out.Items {
+		if v := item["Id"].(*types.AttributeValueMemberS).Value; v != store.PositionValue {
+			ids = append(ids, v)
+		}
+	}
+	assert.ElementsMatch(t, []string{id, id + store.StreamValue}, ids)
+	all, err := es.ReadAll(ctx, 0, 0)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(all))
+	assert.Equal(t, store.TombstoneEventName, all[0].EventName)
+	assert.Equal(t, 3, all[0].Position)
+}
+
+func TestDynamoDBEventStore_ReadAllShards(t *testing.T) {
+	client := pagedDynamoClient(t, 3)
+	es := store.DynamoDB(client, EventStoreTable)
+	for i := 0; i < 4; i++ {
+		appendVersions(t, es, uuid.NewString(), 0, 9)
+	}
+
+	//The events are spread over every shard of PositionIndex
+	logs := make(map[string]bool)
+	p := dynamodb.NewScanPaginator(client, &dynamodb.ScanInput{TableName: aws.String(EventStoreTable)})
+	for p.HasMorePages() {
+		out, err := p.NextPage(ctx)
+		require.Nil(t, err)
+		for _, item := range out.Items {
+			if log, ok := item["Log"].(*types.AttributeValueMemberS); ok {
+				logs[log.Value] = true
 			}
+		}
+	}
+	assert.Equal(t, store.LogShards, len(logs))
+
+	//Reading the shards for their share of a limit still returns the events in global order without skipping any
+	for _, page := range []struct{ from, limit int }{{0, 0}, {0, 1}, {5, 7}, {3, 16}, {0, 17}, {10, 100}, {39, 5}} {
+		all, err := es.ReadAll(ctx, page.from, page.limit)
+		require.Nil(t, err)
+		want := 40 - page.from
+		if page.limit > 0 && page.limit < want {
+			want = page.limit
+		}
+		var positions []int
+		for _, e := range all {
+			positions = append(positions, e.Position)
+		}
+		assert.Equal(t, versions(page.from, page.from+want-1), positions, "ReadAll(%d, %d)", page.from, page.limit)
+	}
+}
 
-			for _, item := range out.Items {
-				_, err = client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
-					TableName: aws.String(EventStoreTable),
-					Key: map[string]types.AttributeValue{
-						"Id":      item["Id"],
-						"Version": item["Version"],
-					},
-				})
-				if err != nil {
-					t.Fatal(err)
-				}
+func TestDynamoDBEventStore_ListStreamsShards(t *testing.T) {
+	client := pagedDynamoClient(t, 3)
+	es := store.DynamoDB(client, EventStoreTable)
+	var ids []string
+	for i := 0; i < 40; i++ {
+		id := fmt.Sprintf("stream-%02d", i)
+		ids = append(ids, id)
+		appendVersions(t, es, id, 0, 0)
+	}
+
+	//The headers are spread over the shards of StreamIndex
+	logs := make(map[string]bool)
+	p := dynamodb.NewScanPaginator(client, &dynamodb.ScanInput{TableName: aws.String(EventStoreTable)})
+	for p.HasMorePages() {
+		out, err := p.NextPage(ctx)
+		require.Nil(t, err)
+		for _, item := range out.Items {
+			if log, ok := item["StreamLog"].(*types.AttributeValueMemberS); ok {
+				logs[log.Value] = true
 			}
 		}
+	}
+	assert.Greater(t, len(logs), 1)
+
+	//Paging through the shards returns every stream once in order of id
+	for _, limit := range []int{0, 1, 7, 16, 17, 100} {
+		var listed []string
+		token := ""
+		for {
+			streams, next, err := es.ListStreams(ctx, store.ListOptions{Prefix: "stream-", PageToken: token, Limit: limit})
+			require.Nil(t, err)
+			for _, info := range streams {
+				listed = append(listed, info.Id)
+			}
+			if next == "" {
+				break
+			}
+			token = next
+		}
+		assert.Equal(t, ids, listed, "Limit %d", limit)
+	}
+
+	//A header written before StreamIndex was sharded is listed once BackfillStreamHeaders moves it to its shard
+	_, err := client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(EventStoreTable),
+		Key: store.AttributeValueMap{
+			"Id":      &types.AttributeValueMemberS{Value: ids[3] + store.StreamValue},
+			"Version": &types.AttributeValueMemberN{Value: "0"},
+		},
+		UpdateExpression:          aws.String("SET #log = :log"),
+		ExpressionAttributeNames:  map[string]string{"#log": "StreamLog"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{":log": &types.AttributeValueMemberS{Value: store.LogValue}},
 	})
+	require.Nil(t, err)
+	streams, _, err := es.ListStreams(ctx, store.ListOptions{})
+	require.Nil(t, err)
+	assert.Equal(t, 39, len(streams))
+	written, err := es.BackfillStreamHeaders(ctx)
+	require.Nil(t, err)
+	assert.Equal(t, 1, written)
+	streams, _, err = es.ListStreams(ctx, store.ListOptions{})
+	require.Nil(t, err)
+	assert.Equal(t, 40, len(streams))
+}
+
+// transportClient is a client of srv that sends its requests through transport
+func transportClient(srv *dynamotest.Server, transport http.RoundTripper) *dynamodb.Client {
+	return dynamodb.New(dynamodb.Options{
+		Region:           dynamotest.Region,
+		Credentials:      credentials.NewStaticCredentialsProvider("fake", "fake", ""),
+		EndpointResolver: dynamodb.EndpointResolverFromURL(srv.URL, func(e *aws.Endpoint) { e.SigningRegion = dynamotest.Region }),
+		HTTPClient:       &http.Client{Transport: transport},
+		RetryMaxAttempts: 1,
+	})
+}
+
+// batchWriteTransport sends the first BatchWriteItem call to the server and answers the second one itself,
+// with an error when fail is set and otherwise leaving every request of the call unprocessed
+type batchWriteTransport struct {
+	http.RoundTripper
+	fail  bool
+	calls int32
+}
+
+func (b *batchWriteTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if r.Header.Get("X-Amz-Target") != "DynamoDB_20120810.BatchWriteItem" || atomic.AddInt32(&b.calls, 1) != 2 {
+		return b.RoundTripper.RoundTrip(r)
+	}
+	status, body := http.StatusInternalServerError, `{"__type":"com.amazonaws.dynamodb.v20120810#InternalServerError","message":"Internal server error"}`
+	if !b.fail {
+		var input struct{ RequestItems json.RawMessage }
+		if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+			return nil, err
+		}
+		status, body = http.StatusOK, `{"UnprocessedItems":`+string(input.RequestItems)+`}`
+	}
+	return &http.Response{
+		StatusCode: status,
+		Header:     http.Header{"Content-Type": []string{"application/x-amz-json-1.0"}},
+		Body:       io.NopCloser(strings.NewReader(body)),
+		Request:    r,
+	}, nil
+}
+
+// snapshotVersions stores a snapshot of the stream with id for every version from 0 to to
+func snapshotVersions(t *testing.T, es store.EventStore, id string, to int) {
+	t.Helper()
+	appendVersions(t, es, id, 0, to)
+	for v := 0; v <= to; v++ {
+		require.Nil(t, es.Snapshot(ctx, &events.Snapshot{Id: id, Version: v, LatestVersion: v, EventName: events.HitPointsName}))
+	}
+}
+
+func TestDynamoDBEventStore_PruneAllSnapshotsPartialFailure(t *testing.T) {
+	srv := dynamotest.NewServer()
+	t.Cleanup(srv.Close)
+	require.Nil(t, store.CreateTable(ctx, srv.Client(), EventStoreTable))
+	id := uuid.NewString()
+	snapshotVersions(t, store.DynamoDB(srv.Client(), EventStoreTable), id, 29)
+
+	//The second batch fails, so only the 25 snapshots of the first one are deleted and counted
+	transport := &batchWriteTransport{RoundTripper: http.DefaultTransport, fail: true}
+	es := store.DynamoDB(transportClient(srv, transport), EventStoreTable, store.WithRetentionPolicy(store.RetentionPolicy{KeepLast: 1}))
+	pruned, err := es.PruneAllSnapshots(ctx)
+	require.NotNil(t, err)
+	assert.Equal(t, 25, pruned)
+	pruned, err = es.PruneAllSnapshots(ctx)
+	require.Nil(t, err)
+	assert.Equal(t, 4, pruned)
+}
+
+func TestDynamoDBEventStore_PruneSnapshotsUnprocessed(t *testing.T) {
+	srv := dynamotest.NewServer()
+	t.Cleanup(srv.Close)
+	require.Nil(t, store.CreateTable(ctx, srv.Client(), EventStoreTable))
+	id := uuid.NewString()
+	snapshotVersions(t, store.DynamoDB(srv.Client(), EventStoreTable), id, 29)
+
+	//The requests left unprocessed by the second call are resent
+	transport := &batchWriteTransport{RoundTripper: http.DefaultTransport}
+	es := store.DynamoDB(transportClient(srv, transport), EventStoreTable, store.WithRetentionPolicy(store.RetentionPolicy{KeepLast: 1}))
+	pruned, err := es.PruneSnapshots(ctx, id)
+	require.Nil(t, err)
+	assert.Equal(t, 29, pruned)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&transport.calls))
+	pruned, err = es.PruneSnapshots(ctx, id)
+	require.Nil(t, err)
+	assert.Equal(t, 0, pruned)
+}
+
+func TestDynamoDBEventStore_InvalidateSnapshotsPartialFailure(t *testing.T) {
+	srv := dynamotest.NewServer()
+	t.Cleanup(srv.Close)
+	require.Nil(t, store.CreateTable(ctx, srv.Client(), EventStoreTable))
+	snapshotVersions(t, store.DynamoDB(srv.Client(), EventStoreTable), uuid.NewString(), 29)
+
+	//The second batch fails, so only the 25 snapshots of the first one are deleted and counted
+	transport := &batchWriteTransport{RoundTripper: http.DefaultTransport, fail: true}
+	es := store.DynamoDB(transportClient(srv, transport), EventStoreTable)
+	invalidated, err := es.InvalidateSnapshots(ctx, events.HitPointsName)
+	require.NotNil(t, err)
+	assert.Equal(t, 25, invalidated)
+	invalidated, err = es.InvalidateSnapshots(ctx, events.HitPointsName)
+	require.Nil(t, err)
+	assert.Equal(t, 5, invalidated)
+}
+
+// conflictingTransport answers every TransactWriteItems call with a TransactionConflict, as DynamoDB does while another transaction holds the items
+type conflictingTransport struct {
+	http.RoundTripper
+	attempts int32
+}
+
+func (c *conflictingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if r.Header.Get("X-Amz-Target") != "DynamoDB_20120810.TransactWriteItems" {
+		return c.RoundTripper.RoundTrip(r)
+	}
+	atomic.AddInt32(&c.attempts, 1)
+	body := `{"__type":"com.amazonaws.dynamodb.v20120810#TransactionCanceledException","Message":"Transaction cancelled","CancellationReasons":[{"Code":"TransactionConflict"}]}`
+	return &http.Response{
+		StatusCode: http.StatusBadRequest,
+		Header:     http.Header{"Content-Type": []string{"application/x-amz-json-1.0"}},
+		Body:       io.NopCloser(strings.NewReader(body)),
+		Request:    r,
+	}, nil
+}
+
+func TestDynamoDBEventStore_PositionContention(t *testing.T) {
+	srv := dynamotest.NewServer()
+	t.Cleanup(srv.Close)
+	require.Nil(t, store.CreateTable(ctx, srv.Client(), EventStoreTable))
+	es := store.DynamoDB(srv.Client(), EventStoreTable)
+
+	//Concurrent writers back off and all get a Position
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			appendVersions(t, es, uuid.NewString(), 0, 4)
+		}()
+	}
+	wg.Wait()
+	all, err := es.ReadAll(ctx, 0, 0)
+	require.Nil(t, err)
+	assert.Equal(t, 40, len(all))
+
+	//A transaction that keeps conflicting gives up after MaxAppendAttempts
+	transport := &conflictingTransport{RoundTripper: http.DefaultTransport}
+	conflicting := store.DynamoDB(transportClient(srv, transport), EventStoreTable)
+	err = conflicting.Append(ctx, &events.Envelope{Id: uuid.NewString(), Version: 0, EventName: events.HitPointsName})
+	checkErr := &store.PositionContentionError{}
+	require.True(t, errors.As(err, &checkErr), "expected PositionContentionError, got %v", err)
+	assert.Equal(t, store.MaxAppendAttempts, checkErr.Attempts)
+	assert.Equal(t, int32(store.MaxAppendAttempts), atomic.LoadInt32(&transport.attempts))
 }
@@ -0,0 +1,936 @@
+// Package storetest provides a conformance suite for store.EventStore implementations
+//
+// Every backend should be able to prove it honors the EventStore contract with a single call:
+//
+//	func TestMyEventStore(t *testing.T) {
+//		storetest.Run(t, func() store.EventStore { return mystore.New() })
+//	}
+package storetest
+
+import (
+	"context"
+	"errors"
+	"github.com/cpustejovsky/event-store/events"
+	"github.com/cpustejovsky/event-store/protos/hitpoints"
+	"github.com/cpustejovsky/event-store/store"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+const characterName = "storetest"
+
+var hitPointChanges = []int32{8, -2, -3}
+
+// Run exercises the EventStore returned by newStore against the behavior expected of every implementation
+// newStore is called once per subtest; streams use random ids so a shared backing table is safe to reuse
+func Run(t *testing.T, newStore func() store.EventStore) {
+	t.Helper()
+	ctx := context.Background()
+
+	t.Run("QueryAll returns appended events ordered by Version", func(t *testing.T) {
+		es := newStore()
+		id := uuid.NewString()
+		envelopes := hitPointEnvelopes(t, id, hitPointChanges...)
+		//Append out of order to ensure ordering comes from Version rather than insertion
+		for i := len(envelopes) - 1; i >= 0; i-- {
+			require.Nil(t, es.Append(ctx, &envelopes[i]))
+		}
+		queried, err := es.QueryAll(ctx, id)
+		require.Nil(t, err)
+		assertEnvelopes(t, envelopes, queried)
+	})
+
+	t.Run("Append rejects an existing Version", func(t *testing.T) {
+		es := newStore()
+		id := uuid.NewString()
+		appendAll(t, es, hitPointEnvelopes(t, id, hitPointChanges...))
+		duplicate := hitPointEnvelopes(t, id, 1)[0]
+		err := es.Append(ctx, &duplicate)
+		checkErr := &store.EventAlreadyExistsError{}
+		require.True(t, errors.As(err, &checkErr), "expected EventAlreadyExistsError, got %v", err)
+		assert.Equal(t, id, checkErr.ID)
+		assert.Equal(t, 0, checkErr.Version)
+		queried, err := es.QueryAll(ctx, id)
+		require.Nil(t, err)
+		assert.Equal(t, len(hitPointChanges), len(queried))
+	})
+
+	t.Run("QueryAll returns NoEventFoundError for an empty stream", func(t *testing.T) {
+		es := newStore()
+		_, err := es.QueryAll(ctx, uuid.NewString())
+		checkErr := &store.NoEventFoundError{}
+		assert.True(t, errors.As(err, &checkErr), "expected NoEventFoundError, got %v", err)
+	})
+
+	t.Run("QueryLatestVersion returns the latest Version or NoEventFoundError for an empty stream", func(t *testing.T) {
+		es := newStore()
+		id := uuid.NewString()
+		_, err := es.QueryLatestVersion(ctx, id)
+		checkErr := &store.NoEventFoundError{}
+		require.True(t, errors.As(err, &checkErr), "expected NoEventFoundError, got %v", err)
+		appendAll(t, es, hitPointEnvelopes(t, id, hitPointChanges...))
+		v, err := es.QueryLatestVersion(ctx, id)
+		require.Nil(t, err)
+		assert.Equal(t, len(hitPointChanges)-1, v)
+	})
+
+	t.Run("Project aggregates every event of a stream", func(t *testing.T) {
+		es := newStore()
+		id := uuid.NewString()
+		appendAll(t, es, hitPointEnvelopes(t, id, hitPointChanges...))
+		agg, err := es.Project(ctx, id)
+		require.Nil(t, err)
+		assert.Equal(t, id, agg.Id)
+		assert.Equal(t, len(hitPointChanges), agg.Version)
+		assert.Equal(t, sum(hitPointChanges...), hitPoints(t, agg))
+	})
+
+	t.Run("QueryAll excludes snapshots", func(t *testing.T) {
+		es := newStore()
+		id := uuid.NewString()
+		envelopes := hitPointEnvelopes(t, id, hitPointChanges...)
+		appendAll(t, es, envelopes)
+		snapshot(t, es, id)
+		queried, err := es.QueryAll(ctx, id)
+		require.Nil(t, err)
+		assertEnvelopes(t, envelopes, queried)
+	})
+
+	t.Run("Project uses the latest snapshot and the events recorded after it", func(t *testing.T) {
+		es := newStore()
+		id := uuid.NewString()
+		appendAll(t, es, hitPointEnvelopes(t, id, hitPointChanges...))
+		snapshot(t, es, id)
+
+		agg, err := es.Project(ctx, id)
+		require.Nil(t, err)
+		assert.Equal(t, len(hitPointChanges), agg.Version)
+		assert.Equal(t, sum(hitPointChanges...), hitPoints(t, agg))
+
+		changes := append(append([]int32(nil), hitPointChanges...), 4, -1)
+		appendAll(t, es, hitPointEnvelopes(t, id, changes...)[len(hitPointChanges):])
+		agg, err = es.Project(ctx, id)
+		require.Nil(t, err)
+		assert.Equal(t, len(changes), agg.Version)
+		assert.Equal(t, sum(changes...), hitPoints(t, agg))
+	})
+
+	t.Run("AppendBatch appends every envelope", func(t *testing.T) {
+		es := newStore()
+		id := uuid.NewString()
+		envelopes := hitPointEnvelopes(t, id, hitPointChanges...)
+		require.Nil(t, es.AppendBatch(ctx, envelopes))
+		queried, err := es.QueryAll(ctx, id)
+		require.Nil(t, err)
+		assertEnvelopes(t, envelopes, queried)
+	})
+
+	t.Run("AppendBatch appends nothing if any Version already exists", func(t *testing.T) {
+		es := newStore()
+		id := uuid.NewString()
+		envelopes := hitPointEnvelopes(t, id, hitPointChanges...)
+		appendAll(t, es, envelopes[1:2])
+		err := es.AppendBatch(ctx, envelopes)
+		checkErr := &store.EventAlreadyExistsError{}
+		require.True(t, errors.As(err, &checkErr), "expected EventAlreadyExistsError, got %v", err)
+		assert.Equal(t, id, checkErr.ID)
+		assert.Equal(t, 1, checkErr.Version)
+		//The envelopes of a failed batch are left as the caller built them
+		for _, e := range []events.Envelope{envelopes[0], envelopes[2]} {
+			assert.True(t, e.RecordedAt.IsZero(), "RecordedAt of Version %d was set", e.Version)
+			assert.Equal(t, 0, e.Position)
+		}
+		queried, err := es.QueryAll(ctx, id)
+		require.Nil(t, err)
+		assertEnvelopes(t, envelopes[1:2], queried)
+	})
+
+	t.Run("AppendBatch rejects invalid batches", func(t *testing.T) {
+		es := newStore()
+		id := uuid.NewString()
+		envelopes := hitPointEnvelopes(t, id, hitPointChanges...)
+		err := es.AppendBatch(ctx, append(envelopes, envelopes[0]))
+		checkErr := &store.EventAlreadyExistsError{}
+		assert.True(t, errors.As(err, &checkErr), "expected EventAlreadyExistsError, got %v", err)
+
+		err = es.AppendBatch(ctx, hitPointEnvelopes(t, id, make([]int32, store.MaxBatchSize+1)...))
+		sizeErr := &store.BatchTooLargeError{}
+		require.True(t, errors.As(err, &sizeErr), "expected BatchTooLargeError, got %v", err)
+		assert.Equal(t, store.MaxBatchSize+1, sizeErr.Size)
+
+		_, err = es.QueryAll(ctx, id)
+		notFoundErr := &store.NoEventFoundError{}
+		assert.True(t, errors.As(err, &notFoundErr), "expected NoEventFoundError, got %v", err)
+	})
+
+	t.Run("AppendExpected assigns consecutive versions when the stream is at the expected version", func(t *testing.T) {
+		es := newStore()
+		id := uuid.NewString()
+		envelopes := hitPointEnvelopes(t, id, hitPointChanges...)
+		require.Nil(t, es.AppendExpected(ctx, id, store.NoStream, envelopes[:2]...))
+		require.Nil(t, es.AppendExpected(ctx, id, 1, envelopes[2]))
+		queried, err := es.QueryAll(ctx, id)
+		require.Nil(t, err)
+		assertEnvelopes(t, envelopes, queried)
+	})
+
+	t.Run("AppendExpected returns WrongExpectedVersionError with the actual version", func(t *testing.T) {
+		es := newStore()
+		id := uuid.NewString()
+		envelopes := hitPointEnvelopes(t, id, hitPointChanges...)
+		require.Nil(t, es.AppendExpected(ctx, id, store.NoStream, envelopes[:2]...))
+
+		for _, expected := range []int{store.NoStream, 0, 2} {
+			err := es.AppendExpected(ctx, id, expected, envelopes[2])
+			checkErr := &store.WrongExpectedVersionError{}
+			require.True(t, errors.As(err, &checkErr), "expected WrongExpectedVersionError, got %v", err)
+			assert.Equal(t, id, checkErr.ID)
+			assert.Equal(t, expected, checkErr.Expected)
+			assert.Equal(t, 1, checkErr.Actual)
+		}
+		v, err := es.QueryLatestVersion(ctx, id)
+		require.Nil(t, err)
+		assert.Equal(t, 1, v)
+
+		require.Nil(t, es.AppendExpected(ctx, id, store.AnyVersion, envelopes[2]))
+		queried, err := es.QueryAll(ctx, id)
+		require.Nil(t, err)
+		assertEnvelopes(t, envelopes, queried)
+	})
+
+	t.Run("AppendExpected lets contending writers retry deterministically", func(t *testing.T) {
+		es := newStore()
+		id := uuid.NewString()
+		const writers = 5
+		changes := make([]int32, writers)
+		var wg sync.WaitGroup
+		for i := 0; i < writers; i++ {
+			changes[i] = 1
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				e := hitPointEnvelopes(t, id, 1)[0]
+				expected := store.NoStream
+				for {
+					err := es.AppendExpected(ctx, id, expected, e)
+					checkErr := &store.WrongExpectedVersionError{}
+					if !errors.As(err, &checkErr) {
+						assert.Nil(t, err)
+						return
+					}
+					expected = checkErr.Actual
+				}
+			}()
+		}
+		wg.Wait()
+		queried, err := es.QueryAll(ctx, id)
+		require.Nil(t, err)
+		assertEnvelopes(t, hitPointEnvelopes(t, id, changes...), queried)
+	})
+
+	t.Run("Read returns the selected range of a stream", func(t *testing.T) {
+		es := newStore()
+		id := uuid.NewString()
+		envelopes := hitPointEnvelopes(t, id, 8, -2, -3, 4, -1, 6)
+		appendAll(t, es, envelopes)
+		snapshot(t, es, id)
+		reversed := make([]events.Envelope, len(envelopes))
+		for i := range envelopes {
+			reversed[len(envelopes)-1-i] = envelopes[i]
+		}
+		tests := []struct {
+			name string
+			opts store.ReadOptions
+			want []events.Envelope
+		}{
+			{"whole stream", store.ReadOptions{}, envelopes},
+			{"from version", store.ReadOptions{FromVersion: 2}, envelopes[2:]},
+			{"to version", store.ReadOptions{ToVersion: store.UpTo(3)}, envelopes[:4]},
+			{"to version zero", store.ReadOptions{ToVersion: store.UpTo(0)}, envelopes[:1]},
+			{"from and to version", store.ReadOptions{FromVersion: 1, ToVersion: store.UpTo(4)}, envelopes[1:5]},
+			{"limit", store.ReadOptions{FromVersion: 1, Limit: 2}, envelopes[1:3]},
+			{"reverse", store.ReadOptions{Reverse: true}, reversed},
+			{"last events", store.ReadOptions{Reverse: true, Limit: 2}, reversed[:2]},
+			{"reverse range", store.ReadOptions{FromVersion: 1, ToVersion: store.UpTo(4), Reverse: true, Limit: 3}, reversed[1:4]},
+			{"limit beyond range", store.ReadOptions{FromVersion: 4, Limit: 10}, envelopes[4:]},
+		}
+		for _, tt := range tests {
+			queried, err := es.Read(ctx, id, tt.opts)
+			require.Nil(t, err, tt.name)
+			assertEnvelopes(t, tt.want, queried)
+		}
+	})
+
+	t.Run("Read returns NoEventFoundError for an empty range", func(t *testing.T) {
+		es := newStore()
+		id := uuid.NewString()
+		appendAll(t, es, hitPointEnvelopes(t, id, hitPointChanges...))
+		for _, opts := range []store.ReadOptions{
+			{FromVersion: len(hitPointChanges)},
+			{FromVersion: 2, ToVersion: store.UpTo(1)},
+		} {
+			_, err := es.Read(ctx, id, opts)
+			checkErr := &store.NoEventFoundError{}
+			assert.True(t, errors.As(err, &checkErr), "expected NoEventFoundError, got %v", err)
+		}
+		_, err := es.Read(ctx, uuid.NewString(), store.ReadOptions{})
+		checkErr := &store.NoEventFoundError{}
+		assert.True(t, errors.As(err, &checkErr), "expected NoEventFoundError, got %v", err)
+	})
+
+	t.Run("ProjectAt uses the newest snapshot at or before the version", func(t *testing.T) {
+		es := newStore()
+		id := uuid.NewString()
+		changes := []int32{8, -2, -3, 4, -1, 6}
+		appendAll(t, es, hitPointEnvelopes(t, id, changes...))
+		//Snapshots with distinctive totals show which one a projection started from
+		for _, s := range []struct {
+			version int
+			total   int32
+		}{{1, 1000}, {2, 2000}} {
+			bin, err := proto.Marshal(&hitpoints.PlayerCharacterHitPoints{Id: id, CharacterName: characterName, CharacterHitPoints: s.total})
+			require.Nil(t, err)
+			err = es.Snapshot(ctx, &events.Snapshot{
+				Id:            id,
+				Version:       s.version,
+				LatestVersion: 2 * s.version,
+				Event:         bin,
+				EventName:     events.HitPointsName,
+			})
+			require.Nil(t, err)
+		}
+		tests := []struct {
+			version int
+			want    int32
+		}{
+			{0, 8},
+			{1, 1000},
+			{2, 1000 - 3},
+			{3, 2000},
+			{5, 2000 - 1 + 6},
+			{100, 2000 - 1 + 6},
+		}
+		for _, tt := range tests {
+			agg, err := es.ProjectAt(ctx, id, tt.version)
+			require.Nil(t, err, "version %d", tt.version)
+			assert.Equal(t, id, agg.Id)
+			assert.Equal(t, tt.want, hitPoints(t, agg), "version %d", tt.version)
+			assert.Equal(t, minInt(tt.version, len(changes)-1)+1, agg.Version, "version %d", tt.version)
+		}
+		_, err := es.ProjectAt(ctx, id, -1)
+		checkErr := &store.NoEventFoundError{}
+		assert.True(t, errors.As(err, &checkErr), "expected NoEventFoundError, got %v", err)
+	})
+
+	t.Run("ProjectAsOf aggregates the events recorded at or before a time", func(t *testing.T) {
+		es := newStore()
+		id := uuid.NewString()
+		changes := []int32{8, -2, -3, 4}
+		envelopes := hitPointEnvelopes(t, id, changes...)
+		before := time.Now().Add(-time.Second)
+		for i := range envelopes {
+			require.Nil(t, es.Append(ctx, &envelopes[i]))
+			time.Sleep(time.Millisecond)
+		}
+		snapshot(t, es, id)
+		queried, err := es.QueryAll(ctx, id)
+		require.Nil(t, err)
+		for i, e := range queried {
+			agg, err := es.ProjectAsOf(ctx, id, e.RecordedAt)
+			require.Nil(t, err)
+			assert.Equal(t, sum(changes[:i+1]...), hitPoints(t, agg))
+			assert.Equal(t, i+1, agg.Version)
+		}
+		_, err = es.ProjectAsOf(ctx, id, before)
+		checkErr := &store.NoEventFoundError{}
+		assert.True(t, errors.As(err, &checkErr), "expected NoEventFoundError, got %v", err)
+	})
+
+	t.Run("Appended events get increasing global positions across streams", func(t *testing.T) {
+		es := newStore()
+		id := uuid.NewString()
+		other := uuid.NewString()
+		envelopes := hitPointEnvelopes(t, id, hitPointChanges...)
+		otherEnvelopes := hitPointEnvelopes(t, other, hitPointChanges...)
+		require.Nil(t, es.Append(ctx, &envelopes[0]))
+		require.Nil(t, es.AppendBatch(ctx, []events.Envelope{otherEnvelopes[0], envelopes[1]}))
+		require.Nil(t, es.AppendExpected(ctx, other, 0, otherEnvelopes[1:]...))
+		require.Nil(t, es.AppendExpected(ctx, id, 1, envelopes[2]))
+		snapshot(t, es, id)
+
+		queried, err := es.QueryAll(ctx, id)
+		require.Nil(t, err)
+		otherQueried, err := es.QueryAll(ctx, other)
+		require.Nil(t, err)
+		assert.Equal(t, envelopes[0].Position, queried[0].Position)
+		//Expected global order of the appends above
+		ordered := []events.Envelope{queried[0], otherQueried[0], queried[1], otherQueried[1], otherQueried[2], queried[2]}
+		for i := 1; i < len(ordered); i++ {
+			assert.Greater(t, ordered[i].Position, ordered[i-1].Position)
+		}
+
+		all, err := es.ReadAll(ctx, ordered[0].Position, len(ordered))
+		require.Nil(t, err)
+		assertEnvelopes(t, ordered, all)
+		for i := range all {
+			assert.Equal(t, ordered[i].Position, all[i].Position)
+		}
+		all, err = es.ReadAll(ctx, ordered[2].Position, 2)
+		require.Nil(t, err)
+		assertEnvelopes(t, ordered[2:4], all)
+	})
+
+	t.Run("ReadAll returns NoEventFoundError past the last position", func(t *testing.T) {
+		es := newStore()
+		id := uuid.NewString()
+		appendAll(t, es, hitPointEnvelopes(t, id, hitPointChanges...))
+		v, err := es.QueryAll(ctx, id)
+		require.Nil(t, err)
+		_, err = es.ReadAll(ctx, v[len(v)-1].Position+1, 0)
+		checkErr := &store.NoEventFoundError{}
+		assert.True(t, errors.As(err, &checkErr), "expected NoEventFoundError, got %v", err)
+	})
+
+	t.Run("Appended events carry their Metadata and the time the store recorded them", func(t *testing.T) {
+		es := newStore()
+		id := uuid.NewString()
+		envelopes := hitPointEnvelopes(t, id, hitPointChanges...)
+		for i := range envelopes {
+			envelopes[i].Metadata = events.Metadata{
+				User:          "storetest",
+				CorrelationId: uuid.NewString(),
+				CausationId:   uuid.NewString(),
+				Headers:       map[string]string{"index": strconv.Itoa(i)},
+			}
+		}
+		before := time.Now()
+		require.Nil(t, es.Append(ctx, &envelopes[0]))
+		require.Nil(t, es.AppendBatch(ctx, envelopes[1:2]))
+		require.Nil(t, es.AppendExpected(ctx, id, 1, envelopes[2]))
+		after := time.Now()
+
+		queried, err := es.QueryAll(ctx, id)
+		require.Nil(t, err)
+		require.Equal(t, len(envelopes), len(queried))
+		for i, e := range queried {
+			assert.Equal(t, envelopes[i].User, e.User)
+			assert.Equal(t, envelopes[i].CorrelationId, e.CorrelationId)
+			assert.Equal(t, envelopes[i].CausationId, e.CausationId)
+			assert.Equal(t, envelopes[i].Headers, e.Headers)
+			assert.False(t, e.RecordedAt.Before(before), "RecordedAt %v is before %v", e.RecordedAt, before)
+			assert.False(t, e.RecordedAt.After(after), "RecordedAt %v is after %v", e.RecordedAt, after)
+		}
+		assert.Equal(t, queried[0].RecordedAt, envelopes[0].RecordedAt)
+		assert.Equal(t, queried[1].RecordedAt, envelopes[1].RecordedAt)
+	})
+
+	t.Run("Appended events keep their SchemaVersion", func(t *testing.T) {
+		es := newStore()
+		id := uuid.NewString()
+		envelopes := hitPointEnvelopes(t, id, hitPointChanges...)
+		for i := range envelopes {
+			envelopes[i].SchemaVersion = i
+		}
+		appendAll(t, es, envelopes)
+		queried, err := es.QueryAll(ctx, id)
+		require.Nil(t, err)
+		require.Equal(t, len(envelopes), len(queried))
+		for i, e := range queried {
+			assert.Equal(t, i, e.SchemaVersion)
+		}
+	})
+
+	t.Run("ListStreams pages through the streams with a prefix and event name", func(t *testing.T) {
+		es := newStore()
+		prefix := uuid.NewString() + "-"
+		appendAll(t, es, hitPointEnvelopes(t, prefix+"b", hitPointChanges[:2]...))
+		appendAll(t, es, hitPointEnvelopes(t, prefix+"a", hitPointChanges[:1]...))
+		levels := hitPointEnvelopes(t, prefix+"c", hitPointChanges[:3]...)
+		for i := range levels {
+			levels[i].EventName = events.LevelsName
+		}
+		require.Nil(t, es.AppendBatch(ctx, levels))
+
+		streams, token, err := es.ListStreams(ctx, store.ListOptions{Prefix: prefix})
+		require.Nil(t, err)
+		assert.Equal(t, "", token)
+		require.Equal(t, 3, len(streams))
+		for i, want := range []store.StreamInfo{
+			{Id: prefix + "a", EventName: events.HitPointsName, LatestVersion: 0},
+			{Id: prefix + "b", EventName: events.HitPointsName, LatestVersion: 1},
+			{Id: prefix + "c", EventName: events.LevelsName, LatestVersion: 2},
+		} {
+			assert.Equal(t, want.Id, streams[i].Id)
+			assert.Equal(t, want.EventName, streams[i].EventName)
+			assert.Equal(t, want.LatestVersion, streams[i].LatestVersion)
+			assert.False(t, streams[i].UpdatedAt.IsZero())
+		}
+		assert.Equal(t, levels[2].RecordedAt, streams[2].UpdatedAt)
+
+		var ids []string
+		token = ""
+		for page := 0; page == 0 || token != ""; page++ {
+			require.Less(t, page, 3)
+			streams, token, err = es.ListStreams(ctx, store.ListOptions{Prefix: prefix, PageToken: token, Limit: 2})
+			require.Nil(t, err)
+			for _, s := range streams {
+				ids = append(ids, s.Id)
+			}
+		}
+		assert.Equal(t, []string{prefix + "a", prefix + "b", prefix + "c"}, ids)
+
+		streams, _, err = es.ListStreams(ctx, store.ListOptions{Prefix: prefix, EventName: events.LevelsName})
+		require.Nil(t, err)
+		require.Equal(t, 1, len(streams))
+		assert.Equal(t, prefix+"c", streams[0].Id)
+
+		streams, token, err = es.ListStreams(ctx, store.ListOptions{Prefix: uuid.NewString()})
+		require.Nil(t, err)
+		assert.Empty(t, streams)
+		assert.Equal(t, "", token)
+	})
+
+	t.Run("QueryByEventName returns the events with an EventName across streams in global order", func(t *testing.T) {
+		es := newStore()
+		name := "query-" + uuid.NewString()
+		id := uuid.NewString()
+		other := uuid.NewString()
+		envelopes := hitPointEnvelopes(t, id, hitPointChanges[:2]...)
+		otherEnvelopes := hitPointEnvelopes(t, other, hitPointChanges[:2]...)
+		for i := range envelopes {
+			envelopes[i].EventName = name
+		}
+		otherEnvelopes[1].EventName = name
+		require.Nil(t, es.Append(ctx, &envelopes[0]))
+		require.Nil(t, es.AppendBatch(ctx, otherEnvelopes))
+		require.Nil(t, es.Append(ctx, &envelopes[1]))
+
+		queried, err := es.QueryByEventName(ctx, name, store.EventNameOptions{})
+		require.Nil(t, err)
+		assertEnvelopes(t, []events.Envelope{envelopes[0], otherEnvelopes[1], envelopes[1]}, queried)
+		for i := 1; i < len(queried); i++ {
+			assert.Greater(t, queried[i].Position, queried[i-1].Position)
+		}
+
+		from, err := es.QueryByEventName(ctx, name, store.EventNameOptions{FromPosition: queried[1].Position})
+		require.Nil(t, err)
+		assertEnvelopes(t, queried[1:], from)
+		limited, err := es.QueryByEventName(ctx, name, store.EventNameOptions{Limit: 2})
+		require.Nil(t, err)
+		assertEnvelopes(t, queried[:2], limited)
+		since, err := es.QueryByEventName(ctx, name, store.EventNameOptions{Since: queried[2].RecordedAt})
+		require.Nil(t, err)
+		require.NotEmpty(t, since)
+		assertEnvelopes(t, queried[2:], since[len(since)-1:])
+
+		checkErr := &store.NoEventFoundError{}
+		_, err = es.QueryByEventName(ctx, name, store.EventNameOptions{Until: queried[0].RecordedAt})
+		assert.True(t, errors.As(err, &checkErr), "expected NoEventFoundError, got %v", err)
+		_, err = es.QueryByEventName(ctx, uuid.NewString(), store.EventNameOptions{})
+		assert.True(t, errors.As(err, &checkErr), "expected NoEventFoundError, got %v", err)
+	})
+
+	t.Run("Subscribe delivers matching events appended after the call", func(t *testing.T) {
+		es := newStore()
+		subscriber, ok := es.(store.Subscriber)
+		if !ok {
+			t.Skip("EventStore does not implement store.Subscriber")
+		}
+		prefix := uuid.NewString()
+		id := prefix + "-a"
+		other := prefix + "-b"
+		appendAll(t, es, hitPointEnvelopes(t, id, 1))
+
+		subCtx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		byId, err := subscriber.Subscribe(subCtx, store.SubscriptionFilter{Id: id})
+		notConfigured := &store.StreamsNotConfiguredError{}
+		if errors.As(err, &notConfigured) {
+			t.Skip("EventStore subscriptions are not configured")
+		}
+		require.Nil(t, err)
+		byPrefix, err := subscriber.Subscribe(subCtx, store.SubscriptionFilter{IdPrefix: prefix, EventName: events.HitPointsName})
+		require.Nil(t, err)
+		byName, err := subscriber.Subscribe(subCtx, store.SubscriptionFilter{IdPrefix: prefix, EventName: events.LevelsName})
+		require.Nil(t, err)
+
+		envelopes := hitPointEnvelopes(t, id, hitPointChanges...)[1:]
+		otherEnvelopes := hitPointEnvelopes(t, other, hitPointChanges...)
+		require.Nil(t, es.AppendBatch(ctx, envelopes[:1]))
+		appendAll(t, es, otherEnvelopes)
+		require.Nil(t, es.AppendExpected(ctx, id, 1, envelopes[1]))
+		snapshot(t, es, id)
+
+		assertEnvelopes(t, envelopes, receive(t, byId, len(envelopes)))
+		received := receive(t, byPrefix, len(envelopes)+len(otherEnvelopes))
+		var gotId, gotOther []events.Envelope
+		for _, e := range received {
+			if e.Id == id {
+				gotId = append(gotId, e)
+			} else {
+				gotOther = append(gotOther, e)
+			}
+		}
+		assertEnvelopes(t, envelopes, gotId)
+		assertEnvelopes(t, otherEnvelopes, gotOther)
+
+		cancel()
+		for _, ch := range []<-chan events.Envelope{byId, byPrefix, byName} {
+			select {
+			case e, open := <-ch:
+				assert.False(t, open, "unexpected event %v", e)
+			case <-time.After(subscriptionTimeout):
+				t.Fatal("subscription was not closed after its context was canceled")
+			}
+		}
+	})
+
+	t.Run("DeleteStream with SoftDelete closes the stream with a tombstone", func(t *testing.T) {
+		es := newStore()
+		id := uuid.NewString()
+		other := uuid.NewString()
+		envelopes := hitPointEnvelopes(t, id, hitPointChanges...)
+		appendAll(t, es, envelopes[:2])
+		appendAll(t, es, hitPointEnvelopes(t, other, hitPointChanges...))
+		snapshot(t, es, id)
+		require.Nil(t, es.DeleteStream(ctx, id, store.SoftDelete))
+
+		assertDeleted(t, es.Append(ctx, &envelopes[2]), store.SoftDelete, 2)
+		assertDeleted(t, es.AppendBatch(ctx, envelopes[2:]), store.SoftDelete, 2)
+		assertDeleted(t, es.AppendExpected(ctx, id, 1, envelopes[2]), store.SoftDelete, 2)
+		_, err := es.QueryAll(ctx, id)
+		assertDeleted(t, err, store.SoftDelete, 2)
+		_, err = es.Read(ctx, id, store.ReadOptions{FromVersion: 0, Limit: 1})
+		assertDeleted(t, err, store.SoftDelete, 2)
+		_, err = es.Read(ctx, id, store.ReadOptions{Reverse: true})
+		assertDeleted(t, err, store.SoftDelete, 2)
+		_, err = es.Project(ctx, id)
+		assertDeleted(t, err, store.SoftDelete, 2)
+		_, err = es.ProjectAt(ctx, id, 1)
+		assertDeleted(t, err, store.SoftDelete, 2)
+		_, err = es.ProjectAsOf(ctx, id, time.Now())
+		assertDeleted(t, err, store.SoftDelete, 2)
+		_, err = es.QueryLatestVersion(ctx, id)
+		assertDeleted(t, err, store.SoftDelete, 2)
+		assertDeleted(t, es.DeleteStream(ctx, id, store.SoftDelete), store.SoftDelete, 2)
+		assertDeleted(t, es.DeleteStream(ctx, id, store.HardDelete), store.SoftDelete, 2)
+
+		//The events and the tombstone stay in the global log for audit
+		queried, err := es.QueryByEventName(ctx, store.TombstoneEventName, store.EventNameOptions{})
+		require.Nil(t, err)
+		tombstone := queried[len(queried)-1]
+		assert.Equal(t, id, tombstone.Id)
+		assert.Equal(t, 2, tombstone.Version)
+		assert.Equal(t, []byte(store.SoftDelete), tombstone.Event)
+		all, err := es.ReadAll(ctx, tombstone.Position-len(hitPointChanges)-2, 0)
+		require.Nil(t, err)
+		assertEnvelopes(t, append(envelopes[:2:2], hitPointEnvelopes(t, other, hitPointChanges...)...), all[:len(all)-1])
+
+		latest, err := es.QueryLatestVersion(ctx, other)
+		require.Nil(t, err)
+		assert.Equal(t, len(hitPointChanges)-1, latest)
+		streams, _, err := es.ListStreams(ctx, store.ListOptions{Prefix: id})
+		require.Nil(t, err)
+		assert.Empty(t, streams)
+	})
+
+	t.Run("DeleteStream with HardDelete removes the events and snapshots of the stream", func(t *testing.T) {
+		es := newStore()
+		id := uuid.NewString()
+		envelopes := hitPointEnvelopes(t, id, hitPointChanges...)
+		appendAll(t, es, envelopes)
+		snapshot(t, es, id)
+		queried, err := es.QueryAll(ctx, id)
+		require.Nil(t, err)
+		require.Nil(t, es.DeleteStream(ctx, id, store.HardDelete))
+
+		all, err := es.ReadAll(ctx, queried[0].Position, 0)
+		require.Nil(t, err)
+		var remaining []events.Envelope
+		for _, e := range all {
+			if e.Id == id {
+				remaining = append(remaining, e)
+			}
+		}
+		require.Equal(t, 1, len(remaining))
+		assert.Equal(t, store.TombstoneEventName, remaining[0].EventName)
+		assert.Equal(t, []byte(store.HardDelete), remaining[0].Event)
+		//The positions of the removed events hold erased markers, or are left out by a store that deletes the events' items
+		removed := make(map[int]bool)
+		for _, e := range queried {
+			removed[e.Position] = true
+		}
+		for _, e := range all {
+			if removed[e.Position] {
+				assert.Equal(t, store.ErasedEventName, e.EventName)
+				assert.Equal(t, "", e.Id)
+				assert.Empty(t, e.Event)
+			}
+		}
+
+		for _, opts := range []store.ReadOptions{{}, {FromVersion: 0, ToVersion: store.UpTo(1)}, {Limit: 1}} {
+			_, err = es.Read(ctx, id, opts)
+			assertDeleted(t, err, store.HardDelete, len(envelopes))
+		}
+		_, err = es.ProjectAt(ctx, id, 0)
+		assertDeleted(t, err, store.HardDelete, len(envelopes))
+		assertDeleted(t, es.Append(ctx, &events.Envelope{Id: id, Version: 0, Event: envelopes[0].Event, EventName: events.HitPointsName}), store.HardDelete, len(envelopes))
+		//Repeating a HardDelete finishes one that was interrupted
+		assert.Nil(t, es.DeleteStream(ctx, id, store.HardDelete))
+		assertDeleted(t, es.DeleteStream(ctx, id, store.SoftDelete), store.HardDelete, len(envelopes))
+	})
+
+	t.Run("DeleteStream rejects an empty stream and an unknown mode", func(t *testing.T) {
+		es := newStore()
+		id := uuid.NewString()
+		err := es.DeleteStream(ctx, id, store.SoftDelete)
+		checkErr := &store.NoEventFoundError{}
+		assert.True(t, errors.As(err, &checkErr), "expected NoEventFoundError, got %v", err)
+
+		appendAll(t, es, hitPointEnvelopes(t, id, hitPointChanges...))
+		err = es.DeleteStream(ctx, id, "archive")
+		modeErr := &store.UnknownDeleteModeError{}
+		assert.True(t, errors.As(err, &modeErr), "expected UnknownDeleteModeError, got %v", err)
+		_, err = es.QueryAll(ctx, id)
+		assert.Nil(t, err)
+	})
+
+	t.Run("Appends and deletes reject reserved Ids", func(t *testing.T) {
+		es := newStore()
+		base := uuid.NewString()
+		for _, id := range []string{"", store.PositionValue, base + store.SnapshotValue, base + store.StreamValue, base + store.KeyValue, base + store.CheckpointValue} {
+			envelopes := hitPointEnvelopes(t, id, hitPointChanges...)
+			checkErr := &store.ReservedIdError{}
+			err := es.Append(ctx, &envelopes[0])
+			assert.True(t, errors.As(err, &checkErr), "Append %q: expected ReservedIdError, got %v", id, err)
+			err = es.AppendBatch(ctx, envelopes)
+			assert.True(t, errors.As(err, &checkErr), "AppendBatch %q: expected ReservedIdError, got %v", id, err)
+			err = es.AppendExpected(ctx, id, store.AnyVersion, envelopes...)
+			assert.True(t, errors.As(err, &checkErr), "AppendExpected %q: expected ReservedIdError, got %v", id, err)
+			err = es.DeleteStream(ctx, id, store.HardDelete)
+			assert.True(t, errors.As(err, &checkErr), "DeleteStream %q: expected ReservedIdError, got %v", id, err)
+		}
+		//The stream whose items the suffixes name is left alone
+		appendAll(t, es, hitPointEnvelopes(t, base, hitPointChanges...))
+		snapshot(t, es, base)
+		_, err := es.QueryAll(ctx, base+store.SnapshotValue)
+		checkErr := &store.NoEventFoundError{}
+		assert.True(t, errors.As(err, &checkErr), "expected NoEventFoundError, got %v", err)
+	})
+
+	t.Run("Operations fail with a canceled context", func(t *testing.T) {
+		es := newStore()
+		id := uuid.NewString()
+		envelopes := hitPointEnvelopes(t, id, hitPointChanges...)
+		appendAll(t, es, envelopes[:1])
+		canceled, cancel := context.WithCancel(ctx)
+		cancel()
+
+		err := es.Append(canceled, &envelopes[1])
+		assert.True(t, errors.Is(err, context.Canceled), "Append: expected context.Canceled, got %v", err)
+		err = es.AppendBatch(canceled, envelopes[1:])
+		assert.True(t, errors.Is(err, context.Canceled), "AppendBatch: expected context.Canceled, got %v", err)
+		err = es.AppendExpected(canceled, id, 0, envelopes[1])
+		assert.True(t, errors.Is(err, context.Canceled), "AppendExpected: expected context.Canceled, got %v", err)
+		err = es.Snapshot(canceled, &events.Snapshot{Id: id, LatestVersion: 1, EventName: events.HitPointsName})
+		assert.True(t, errors.Is(err, context.Canceled), "Snapshot: expected context.Canceled, got %v", err)
+		_, err = es.QueryAll(canceled, id)
+		assert.True(t, errors.Is(err, context.Canceled), "QueryAll: expected context.Canceled, got %v", err)
+		_, err = es.Read(canceled, id, store.ReadOptions{})
+		assert.True(t, errors.Is(err, context.Canceled), "Read: expected context.Canceled, got %v", err)
+		_, err = es.ProjectAt(canceled, id, 0)
+		assert.True(t, errors.Is(err, context.Canceled), "ProjectAt: expected context.Canceled, got %v", err)
+		_, err = es.ProjectAsOf(canceled, id, time.Now())
+		assert.True(t, errors.Is(err, context.Canceled), "ProjectAsOf: expected context.Canceled, got %v", err)
+		_, err = es.ReadAll(canceled, 0, 1)
+		assert.True(t, errors.Is(err, context.Canceled), "ReadAll: expected context.Canceled, got %v", err)
+		_, err = es.QueryLatestVersion(canceled, id)
+		assert.True(t, errors.Is(err, context.Canceled), "QueryLatestVersion: expected context.Canceled, got %v", err)
+		_, err = es.Project(canceled, id)
+		assert.True(t, errors.Is(err, context.Canceled), "Project: expected context.Canceled, got %v", err)
+		_, _, err = es.ListStreams(canceled, store.ListOptions{})
+		assert.True(t, errors.Is(err, context.Canceled), "ListStreams: expected context.Canceled, got %v", err)
+		_, err = es.QueryByEventName(canceled, events.HitPointsName, store.EventNameOptions{})
+		assert.True(t, errors.Is(err, context.Canceled), "QueryByEventName: expected context.Canceled, got %v", err)
+
+		queried, err := es.QueryAll(ctx, id)
+		require.Nil(t, err)
+		assert.Equal(t, 1, len(queried))
+	})
+}
+
+// RunRegistry exercises the behavior of the EventStore that depends on the events.Registry it is built with
+// newStore is called once per subtest and must return a store using the registry, for example through store.WithRegistry
+func RunRegistry(t *testing.T, newStore func(*events.Registry) store.EventStore) {
+	t.Helper()
+	ctx := context.Background()
+
+	t.Run("An event that cannot be upcast fails reads and closes subscriptions", func(t *testing.T) {
+		//The upcasters of the broken event rename it back and forth, which is an UpcastCycleError
+		const broken = "storetest-broken"
+		registry := events.DefaultRegistry()
+		registry.RegisterUpcaster(broken, 0, events.UpcasterFunc(func(e events.Envelope) (events.Envelope, error) {
+			e.EventName = broken + "-renamed"
+			return e, nil
+		}))
+		registry.RegisterUpcaster(broken+"-renamed", 0, events.UpcasterFunc(func(e events.Envelope) (events.Envelope, error) {
+			e.EventName = broken
+			return e, nil
+		}))
+		es := newStore(registry)
+		id := uuid.NewString()
+
+		var ch <-chan events.Envelope
+		subCtx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		if subscriber, ok := es.(store.Subscriber); ok {
+			var err error
+			ch, err = subscriber.Subscribe(subCtx, store.SubscriptionFilter{Id: id})
+			notConfigured := &store.StreamsNotConfiguredError{}
+			if errors.As(err, &notConfigured) {
+				ch = nil
+			} else {
+				require.Nil(t, err)
+			}
+		}
+
+		envelopes := hitPointEnvelopes(t, id, hitPointChanges...)
+		appendAll(t, es, envelopes[:2])
+		envelopes[2].EventName = broken
+		appendAll(t, es, envelopes[2:])
+		appendAll(t, es, hitPointEnvelopes(t, id, 0, 0, 0, 1)[3:])
+
+		checkErr := &events.UpcastCycleError{}
+		_, err := es.QueryAll(ctx, id)
+		assert.True(t, errors.As(err, &checkErr), "expected UpcastCycleError, got %v", err)
+		_, err = es.Project(ctx, id)
+		assert.True(t, errors.As(err, &checkErr), "expected UpcastCycleError, got %v", err)
+		read, err := es.Read(ctx, id, store.ReadOptions{ToVersion: store.UpTo(1)})
+		require.Nil(t, err)
+		assertEnvelopes(t, envelopes[:2], read)
+		_, err = es.ReadAll(ctx, read[0].Position, 0)
+		assert.True(t, errors.As(err, &checkErr), "expected UpcastCycleError, got %v", err)
+
+		if ch == nil {
+			return
+		}
+		//The events before the broken one are delivered, then the subscription closes without the event after it
+		assertEnvelopes(t, envelopes[:2], receive(t, ch, 2))
+		select {
+		case e, open := <-ch:
+			assert.False(t, open, "unexpected event %v", e)
+		case <-time.After(subscriptionTimeout):
+			t.Fatal("subscription was not closed after an event that cannot be upcast")
+		}
+	})
+}
+
+const subscriptionTimeout = 30 * time.Second
+
+// receive reads n events from ch
+func receive(t *testing.T, ch <-chan events.Envelope, n int) []events.Envelope {
+	t.Helper()
+	var received []events.Envelope
+	for len(received) < n {
+		select {
+		case e, ok := <-ch:
+			require.True(t, ok, "subscription closed after %d of %d events", len(received), n)
+			received = append(received, e)
+		case <-time.After(subscriptionTimeout):
+			t.Fatalf("received %d of %d events", len(received), n)
+		}
+	}
+	return received
+}
+
+// hitPointEnvelopes builds one Envelope per hit point change, versioned from 0
+func hitPointEnvelopes(t *testing.T, id string, changes ...int32) []events.Envelope {
+	t.Helper()
+	var envelopes []events.Envelope
+	for i, change := range changes {
+		bin, err := proto.Marshal(&hitpoints.PlayerCharacterHitPoints{
+			Id:                 id,
+			CharacterName:      characterName,
+			CharacterHitPoints: change,
+			Note:               "storetest",
+		})
+		require.Nil(t, err)
+		envelopes = append(envelopes, events.Envelope{
+			Id:        id,
+			Version:   i,
+			Event:     bin,
+			EventName: events.HitPointsName,
+		})
+	}
+	return envelopes
+}
+
+func appendAll(t *testing.T, es store.EventStore, envelopes []events.Envelope) {
+	t.Helper()
+	for i := range envelopes {
+		require.Nil(t, es.Append(context.Background(), &envelopes[i]))
+	}
+}
+
+// snapshot projects the stream with id and stores the aggregate as a snapshot
+func snapshot(t *testing.T, es store.EventStore, id string) {
+	t.Helper()
+	agg, err := es.Project(context.Background(), id)
+	require.Nil(t, err)
+	err = es.Snapshot(context.Background(), &events.Snapshot{
+		Id:            agg.Id,
+		LatestVersion: agg.Version,
+		Event:         agg.Event,
+		EventName:     agg.EventName,
+	})
+	require.Nil(t, err)
+}
+
+// assertDeleted asserts err is the StreamDeletedError of a stream deleted with mode at version
+func assertDeleted(t *testing.T, err error, mode store.DeleteMode, version int) {
+	t.Helper()
+	checkErr := &store.StreamDeletedError{}
+	require.True(t, errors.As(err, &checkErr), "expected StreamDeletedError, got %v", err)
+	assert.Equal(t, mode, checkErr.Mode)
+	assert.Equal(t, version, checkErr.Version)
+}
+
+// assertEnvelopes compares the stored fields of envelopes in order
+func assertEnvelopes(t *testing.T, want, got []events.Envelope) {
+	t.Helper()
+	require.Equal(t, len(want), len(got))
+	for i := range want {
+		assert.Equal(t, want[i].Id, got[i].Id)
+		assert.Equal(t, want[i].Version, got[i].Version)
+		assert.Equal(t, want[i].EventName, got[i].EventName)
+		assert.Equal(t, want[i].Event, got[i].Event)
+	}
+}
+
+func hitPoints(t *testing.T, e *events.Envelope) int32 {
+	t.Helper()
+	var hp hitpoints.PlayerCharacterHitPoints
+	require.Nil(t, proto.Unmarshal(e.Event, &hp))
+	return hp.GetCharacterHitPoints()
+}
+
+func sum(changes ...int32) int32 {
+	var total int32
+	for _, change := range changes {
+		total += change
+	}
+	return total
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
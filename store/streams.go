@@ -0,0 +1,231 @@
+package store
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodbstreams"
+	streamtypes "github.com/aws/aws-sdk-go-v2/service/dynamodbstreams/types"
+	"github.com/cpustejovsky/event-store/events"
+	"sort"
+	"time"
+)
+
+// DefaultPollInterval is how often a DynamoDBEventStore subscription polls its stream shards when PollInterval is not set
+const DefaultPollInterval = time.Second
+
+// StreamSource is the part of the DynamoDB Streams API used to subscribe to a DynamoDBEventStore
+// It is satisfied by *dynamodbstreams.Client
+type StreamSource interface {
+	DescribeStream(context.Context, *dynamodbstreams.DescribeStreamInput, ...func(*dynamodbstreams.Options)) (*dynamodbstreams.DescribeStreamOutput, error)
+	GetShardIterator(context.Context, *dynamodbstreams.GetShardIteratorInput, ...func(*dynamodbstreams.Options)) (*dynamodbstreams.GetShardIteratorOutput, error)
+	GetRecords(context.Context, *dynamodbstreams.GetRecordsInput, ...func(*dynamodbstreams.Options)) (*dynamodbstreams.GetRecordsOutput, error)
+}
+
+// StreamsNotConfiguredError is returned by Subscribe when the DynamoDBEventStore has no StreamSource
+type StreamsNotConfiguredError struct{}
+
+func (e *StreamsNotConfiguredError) Error() string {
+	return "no DynamoDB stream source configured"
+}
+
+// Subscribe reads the table's DynamoDB stream and delivers the events matching filter that are appended after the call
+// The table must have a stream with NEW_IMAGE or NEW_AND_OLD_IMAGES; if StreamArn is empty the table's latest stream is used
+// The events read by one poll of the shards are delivered in Position order; the stream only orders the records of an item,
+// so an event read by a later poll may still precede one already delivered, while the events of one stream always arrive in Version order
+// The channel is closed when ctx is done, the stream can no longer be read or an event matching filter as stored cannot be decoded,
+// in which case the events of every shard of its poll preceding it are delivered first
+func (d *DynamoDBEventStore) Subscribe(ctx context.Context, filter SubscriptionFilter) (<-chan events.Envelope, error) {
+	if d.Streams == nil {
+		return nil, &StreamsNotConfiguredError{}
+	}
+	arn := d.StreamArn
+	if arn == "" {
+		out, err := d.DB.DescribeTable(ctx, &dynamodb.DescribeTableInput{TableName: aws.String(d.Table)})
+		if err != nil {
+			return nil, err
+		}
+		arn = aws.ToString(out.Table.LatestStreamArn)
+		if arn == "" {
+			return nil, &StreamsNotConfiguredError{}
+		}
+	}
+	p := &streamPoller{
+		source:   d.Streams,
+		arn:      arn,
+		filter:   filter,
+		interval: d.PollInterval,
+		options:  &d.options,
+		shards:   make(map[string]*shardState),
+		ch:       make(chan events.Envelope),
+	}
+	if p.interval <= 0 {
+		p.interval = DefaultPollInterval
+	}
+	//Shards open now are read from their latest record so only events appended after Subscribe are delivered
+	if err := p.discover(ctx, streamtypes.ShardIteratorTypeLatest); err != nil {
+		return nil, err
+	}
+	go p.run(ctx)
+	return p.ch, nil
+}
+
+// streamPoller reads every shard of a DynamoDB stream, following shard splits as they happen
+type streamPoller struct {
+	source   StreamSource
+	arn      string
+	filter   SubscriptionFilter
+	interval time.Duration
+	// options decode the events read from the stream
+	options *options
+	shards  map[string]*shardState
+	ch      chan events.Envelope
+}
+
+type shardState struct {
+	parent   string
+	iterator *string
+	done     bool
+}
+
+func (p *streamPoller) run(ctx context.Context) {
+	defer close(p.ch)
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		if err := p.poll(ctx); err != nil {
+			return
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		//Shards created after Subscribe hold only new records, so they are read from the start
+		if err := p.discover(ctx, streamtypes.ShardIteratorTypeTrimHorizon); err != nil {
+			return
+		}
+	}
+}
+
+// discover adds the stream's unknown shards; closed shards present at the first call are skipped
+func (p *streamPoller) discover(ctx context.Context, iteratorType streamtypes.ShardIteratorType) error {
+	first := len(p.shards) == 0
+	input := &dynamodbstreams.DescribeStreamInput{StreamArn: aws.String(p.arn)}
+	for {
+		out, err := p.source.DescribeStream(ctx, input)
+		if err != nil {
+			return err
+		}
+		for _, shard := range out.StreamDescription.Shards {
+			id := aws.ToString(shard.ShardId)
+			if _, ok := p.shards[id]; ok {
+				continue
+			}
+			closed := shard.SequenceNumberRange != nil && shard.SequenceNumberRange.EndingSequenceNumber != nil
+			if first && closed {
+				p.shards[id] = &shardState{done: true}
+				continue
+			}
+			p.shards[id] = &shardState{parent: aws.ToString(shard.ParentShardId)}
+			it, err := p.source.GetShardIterator(ctx, &dynamodbstreams.GetShardIteratorInput{
+				StreamArn:         aws.String(p.arn),
+				ShardId:           shard.ShardId,
+				ShardIteratorType: iteratorType,
+			})
+			if err != nil {
+				return err
+			}
+			p.shards[id].iterator = it.ShardIterator
+		}
+		if out.StreamDescription.LastEvaluatedShardId == nil {
+			return nil
+		}
+		input.ExclusiveStartShardId = out.StreamDescription.LastEvaluatedShardId
+	}
+}
+
+// poll reads the new records of every open shard whose parent has been read completely and delivers them in Position order
+// Waiting for the parent keeps the events of a stream in order across a shard split
+// An event matching the filter that cannot be decoded ends the poll with its error once every shard has been read
+// and the events preceding it are delivered; one that does not match is skipped like any other event the subscription does not select
+func (p *streamPoller) poll(ctx context.Context) error {
+	var polled []events.Envelope
+	var failed error
+	failedAt := 0
+	for _, shard := range p.shards {
+		if shard.done || shard.iterator == nil {
+			continue
+		}
+		if parent, ok := p.shards[shard.parent]; ok && !parent.done {
+			continue
+		}
+		out, err := p.source.GetRecords(ctx, &dynamodbstreams.GetRecordsInput{ShardIterator: shard.iterator})
+		if err != nil {
+			return err
+		}
+		for _, record := range out.Records {
+			e, ok, err := streamEnvelope(record)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				continue
+			}
+			decoded := []events.Envelope{*e}
+			if err := p.options.decode(ctx, decoded); err != nil {
+				if p.filter.Match(e) && (failed == nil || e.Position < failedAt) {
+					failed, failedAt = err, e.Position
+				}
+				continue
+			}
+			if p.filter.Match(&decoded[0]) {
+				polled = append(polled, decoded[0])
+			}
+		}
+		shard.iterator = out.NextShardIterator
+		shard.done = out.NextShardIterator == nil
+	}
+	//Each shard is drained in turn, so the events of the shards are interleaved by Position before they are sent
+	sort.SliceStable(polled, func(i, j int) bool { return polled[i].Position < polled[j].Position })
+	for _, e := range polled {
+		//Events after the first one that cannot be decoded are not delivered, so the subscription stops at it
+		if failed != nil && e.Position > failedAt {
+			break
+		}
+		select {
+		case p.ch <- e:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return failed
+}
+
+// streamEnvelope converts an inserted event item to an Envelope
+// ok is false for records that are not new events, such as snapshots
+func streamEnvelope(record streamtypes.Record) (e *events.Envelope, ok bool, err error) {
+	if record.EventName != streamtypes.OperationTypeInsert || record.Dynamodb == nil || record.Dynamodb.NewImage == nil {
+		return nil, false, nil
+	}
+	item, err := attributevalue.FromDynamoDBStreamsMap(record.Dynamodb.NewImage)
+	if err != nil {
+		return nil, false, err
+	}
+	if !isEventItem(item) {
+		return nil, false, nil
+	}
+	e = &events.Envelope{}
+	if err := attributevalue.UnmarshalMap(item, e); err != nil {
+		return nil, false, err
+	}
+	return e, true, nil
+}
+
+// isEventItem reports whether a table item holds an event rather than a snapshot
+func isEventItem(item AttributeValueMap) bool {
+	_, event := item["Event"]
+	_, snapshot := item["LatestVersion"]
+	return event && !snapshot
+}
@@ -0,0 +1,251 @@
+package store_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodbstreams"
+	streamtypes "github.com/aws/aws-sdk-go-v2/service/dynamodbstreams/types"
+	"github.com/cpustejovsky/event-store/events"
+	"github.com/cpustejovsky/event-store/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeStreamSource is an in-process StreamSource whose shard iterators are "<shard id>:<record index>"
+type fakeStreamSource struct {
+	mu     sync.Mutex
+	shards []*fakeShard
+}
+
+type fakeShard struct {
+	id      string
+	parent  string
+	closed  bool
+	records []streamtypes.Record
+}
+
+func (f *fakeStreamSource) DescribeStream(_ context.Context, _ *dynamodbstreams.DescribeStreamInput, _ ...func(*dynamodbstreams.Options)) (*dynamodbstreams.DescribeStreamOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var shards []streamtypes.Shard
+	for _, s := range f.shards {
+		shard := streamtypes.Shard{
+			ShardId:             aws.String(s.id),
+			SequenceNumberRange: &streamtypes.SequenceNumberRange{StartingSequenceNumber: aws.String("0")},
+		}
+		if s.parent != "" {
+			shard.ParentShardId = aws.String(s.parent)
+		}
+		if s.closed {
+			shard.SequenceNumberRange.EndingSequenceNumber = aws.String(strconv.Itoa(len(s.records)))
+		}
+		shards = append(shards, shard)
+	}
+	return &dynamodbstreams.DescribeStreamOutput{StreamDescription: &streamtypes.StreamDescription{Shards: shards}}, nil
+}
+
+func (f *fakeStreamSource) GetShardIterator(_ context.Context, input *dynamodbstreams.GetShardIteratorInput, _ ...func(*dynamodbstreams.Options)) (*dynamodbstreams.GetShardIteratorOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s := f.shard(aws.ToString(input.ShardId))
+	position := 0
+	if input.ShardIteratorType == streamtypes.ShardIteratorTypeLatest {
+		position = len(s.records)
+	}
+	return &dynamodbstreams.GetShardIteratorOutput{ShardIterator: aws.String(fmt.Sprintf("%s:%d", s.id, position))}, nil
+}
+
+func (f *fakeStreamSource) GetRecords(_ context.Context, input *dynamodbstreams.GetRecordsInput, _ ...func(*dynamodbstreams.Options)) (*dynamodbstreams.GetRecordsOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	parts := strings.Split(aws.ToString(input.ShardIterator), ":")
+	s := f.shard(parts[0])
+	position, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return nil, err
+	}
+	out := &dynamodbstreams.GetRecordsOutput{Records: append([]streamtypes.Record(nil), s.records[position:]...)}
+	if !s.closed {
+		out.NextShardIterator = aws.String(fmt.Sprintf("%s:%d", s.id, len(s.records)))
+	}
+	return out, nil
+}
+
+func (f *fakeStreamSource) shard(id string) *fakeShard {
+	for _, s := range f.shards {
+		if s.id == id {
+			return s
+		}
+	}
+	return nil
+}
+
+// put records an operation on the item in the newest shard
+func (f *fakeStreamSource) put(operation streamtypes.OperationType, item map[string]streamtypes.AttributeValue) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s := f.shards[len(f.shards)-1]
+	s.records = append(s.records, streamtypes.Record{
+		EventName: operation,
+		Dynamodb:  &streamtypes.StreamRecord{NewImage: item},
+	})
+}
+
+// split closes the newest shard and opens a child shard
+func (f *fakeStreamSource) split() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	parent := f.shards[len(f.shards)-1]
+	parent.closed = true
+	f.shards = append(f.shards, &fakeShard{id: fmt.Sprintf("shard-%d", len(f.shards)), parent: parent.id})
+}
+
+func eventImage(id string, version int) map[string]streamtypes.AttributeValue {
+	return map[string]streamtypes.AttributeValue{
+		"Id":        &streamtypes.AttributeValueMemberS{Value: id},
+		"Version":   &streamtypes.AttributeValueMemberN{Value: strconv.Itoa(version)},
+		"EventName": &streamtypes.AttributeValueMemberS{Value: events.HitPointsName},
+		"Event":     &streamtypes.AttributeValueMemberB{Value: []byte{byte(version)}},
+		"User":      &streamtypes.AttributeValueMemberS{Value: "stream"},
+	}
+}
+
+func TestDynamoDBEventStore_Subscribe(t *testing.T) {
+	source := &fakeStreamSource{shards: []*fakeShard{{id: "shard-0"}}}
+	//Records written before Subscribe must not be delivered
+	source.put(streamtypes.OperationTypeInsert, eventImage(id, 0))
+
+	es := store.DynamoDB(nil, EventStoreTable)
+	es.Streams = source
+	es.StreamArn = "arn:aws:dynamodb:local:000000000000:table/event-store/stream/fake"
+	es.PollInterval = time.Millisecond
+	subCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	ch, err := es.Subscribe(subCtx, store.SubscriptionFilter{Id: id})
+	require.Nil(t, err)
+
+	source.put(streamtypes.OperationTypeInsert, eventImage(id, 1))
+	source.put(streamtypes.OperationTypeInsert, eventImage("other", 0))
+	snapshot := eventImage(id+store.SnapshotValue, 0)
+	snapshot["LatestVersion"] = &streamtypes.AttributeValueMemberN{Value: "2"}
+	source.put(streamtypes.OperationTypeInsert, snapshot)
+	source.put(streamtypes.OperationTypeModify, eventImage(id, 1))
+	source.split()
+	source.put(streamtypes.OperationTypeInsert, eventImage(id, 2))
+
+	for _, version := range []int{1, 2} {
+		select {
+		case e := <-ch:
+			assert.Equal(t, id, e.Id)
+			assert.Equal(t, version, e.Version)
+			assert.Equal(t, events.HitPointsName, e.EventName)
+			assert.Equal(t, []byte{byte(version)}, e.Event)
+			assert.Equal(t, "stream", e.User)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("version %d was not delivered", version)
+		}
+	}
+	cancel()
+	for range ch {
+		t.Fatal("unexpected event delivered")
+	}
+}
+
+func TestDynamoDBEventStore_SubscribeUpcastFailure(t *testing.T) {
+	registry := events.DefaultRegistry()
+	registry.RegisterUpcaster("broken", 0, events.UpcasterFunc(func(e events.Envelope) (events.Envelope, error) {
+		return e, errors.New("broken upcaster")
+	}))
+	source := &fakeStreamSource{shards: []*fakeShard{{id: "shard-0"}}}
+	es := store.DynamoDB(nil, EventStoreTable, store.WithRegistry(registry))
+	es.Streams = source
+	es.StreamArn = "arn:aws:dynamodb:local:000000000000:table/event-store/stream/fake"
+	es.PollInterval = time.Millisecond
+	subCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	ch, err := es.Subscribe(subCtx, store.SubscriptionFilter{})
+	require.Nil(t, err)
+
+	//One poll reads all three records; the event after the broken one is not delivered
+	source.mu.Lock()
+	for version, eventName := range []string{events.HitPointsName, "broken", events.HitPointsName} {
+		image := eventImage(id, version)
+		image["Position"] = &streamtypes.AttributeValueMemberN{Value: strconv.Itoa(version)}
+		image["EventName"] = &streamtypes.AttributeValueMemberS{Value: eventName}
+		source.shards[0].records = append(source.shards[0].records, streamtypes.Record{
+			EventName: streamtypes.OperationTypeInsert,
+			Dynamodb:  &streamtypes.StreamRecord{NewImage: image},
+		})
+	}
+	source.mu.Unlock()
+
+	var versions []int
+	for e := range ch {
+		versions = append(versions, e.Version)
+	}
+	assert.Equal(t, []int{0}, versions)
+}
+
+func TestDynamoDBEventStore_SubscribeUpcastFailureShards(t *testing.T) {
+	registry := events.DefaultRegistry()
+	registry.RegisterUpcaster("broken", 0, events.UpcasterFunc(func(e events.Envelope) (events.Envelope, error) {
+		return e, errors.New("broken upcaster")
+	}))
+	source := &fakeStreamSource{shards: []*fakeShard{{id: "shard-0"}, {id: "shard-1"}}}
+	es := store.DynamoDB(nil, EventStoreTable, store.WithRegistry(registry))
+	es.Streams = source
+	es.StreamArn = "arn:aws:dynamodb:local:000000000000:table/event-store/stream/fake"
+	es.PollInterval = time.Millisecond
+	subCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	all, err := es.Subscribe(subCtx, store.SubscriptionFilter{})
+	require.Nil(t, err)
+	unaffected, err := es.Subscribe(subCtx, store.SubscriptionFilter{Id: "other"})
+	require.Nil(t, err)
+
+	//The broken event at Position 1 is in one shard, the events before and after it in the other
+	source.mu.Lock()
+	for _, record := range []struct {
+		shard, position int
+		id, eventName   string
+	}{{0, 1, id, "broken"}, {1, 0, "other", events.HitPointsName}, {1, 2, "other", events.HitPointsName}} {
+		image := eventImage(record.id, record.position)
+		image["Position"] = &streamtypes.AttributeValueMemberN{Value: strconv.Itoa(record.position)}
+		image["EventName"] = &streamtypes.AttributeValueMemberS{Value: record.eventName}
+		source.shards[record.shard].records = append(source.shards[record.shard].records, streamtypes.Record{
+			EventName: streamtypes.OperationTypeInsert,
+			Dynamodb:  &streamtypes.StreamRecord{NewImage: image},
+		})
+	}
+	source.mu.Unlock()
+
+	//Whichever shard is read first, the event preceding the broken one is delivered before the subscription ends
+	var positions []int
+	for e := range all {
+		positions = append(positions, e.Position)
+	}
+	assert.Equal(t, []int{0}, positions)
+	//A subscription that does not select the broken event keeps receiving events
+	for _, position := range []int{0, 2} {
+		select {
+		case e := <-unaffected:
+			assert.Equal(t, position, e.Position)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("position %d was not delivered", position)
+		}
+	}
+}
+
+func TestDynamoDBEventStore_SubscribeWithoutStreams(t *testing.T) {
+	es := store.DynamoDB(nil, EventStoreTable)
+	_, err := es.Subscribe(ctx, store.SubscriptionFilter{})
+	checkErr := &store.StreamsNotConfiguredError{}
+	assert.True(t, errors.As(err, &checkErr))
+}
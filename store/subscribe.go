@@ -0,0 +1,166 @@
+package store
+
+import (
+	"context"
+	"github.com/cpustejovsky/event-store/events"
+	"strings"
+	"sync"
+)
+
+// SubscriptionFilter selects the events delivered to a subscription
+// Empty fields match every event
+type SubscriptionFilter struct {
+	Id        string
+	IdPrefix  string
+	EventName string
+}
+
+// Match reports whether the envelope is selected by the filter
+func (f SubscriptionFilter) Match(e *events.Envelope) bool {
+	if f.Id != "" && e.Id != f.Id {
+		return false
+	}
+	if f.IdPrefix != "" && !strings.HasPrefix(e.Id, f.IdPrefix) {
+		return false
+	}
+	if f.EventName != "" && e.EventName != f.EventName {
+		return false
+	}
+	return true
+}
+
+// Subscriber is implemented by event stores that deliver newly appended events as they are written
+// The returned channel receives matching events in the order they were appended to their stream
+// and is closed once ctx is done or an appended event the filter matches as stored cannot be decoded, such as when its Upcaster fails;
+// the events appended before that event are still delivered
+type Subscriber interface {
+	Subscribe(context.Context, SubscriptionFilter) (<-chan events.Envelope, error)
+}
+
+// DefaultSubscriptionBuffer is how many events an in-process subscription queues for its consumer unless WithSubscriptionBuffer is set
+const DefaultSubscriptionBuffer int = 4096
+
+// WithSubscriptionBuffer sets how many events an in-process subscription queues for a consumer that has not received them yet
+// A subscription whose consumer falls further behind is closed once the queued events are delivered, so a slow consumer
+// cannot make the store hold every event appended since; resubscribe from a checkpoint, as a CatchUpSubscription does, to continue
+func WithSubscriptionBuffer(events int) Option {
+	return func(o *options) {
+		o.subscriptionBuffer = events
+	}
+}
+
+// broker fans appended events out to in-process subscriptions
+// Publishing never blocks; each subscription queues up to limit events until its consumer receives them and is closed when they would overflow
+type broker struct {
+	mu    sync.Mutex
+	subs  map[*subscription]struct{}
+	limit int
+}
+
+type subscription struct {
+	filter SubscriptionFilter
+	ch     chan events.Envelope
+	notify chan struct{}
+	mu     sync.Mutex
+	queue  []events.Envelope
+	// closed is set once no more events are queued; the channel is closed after the queue is delivered
+	closed bool
+}
+
+// subscribe registers a subscription that lives until ctx is done
+func (b *broker) subscribe(ctx context.Context, filter SubscriptionFilter) <-chan events.Envelope {
+	s := &subscription{
+		filter: filter,
+		ch:     make(chan events.Envelope),
+		notify: make(chan struct{}, 1),
+	}
+	b.mu.Lock()
+	if b.subs == nil {
+		b.subs = make(map[*subscription]struct{})
+	}
+	b.subs[s] = struct{}{}
+	b.mu.Unlock()
+	go func() {
+		s.run(ctx)
+		b.mu.Lock()
+		delete(b.subs, s)
+		b.mu.Unlock()
+	}()
+	return s.ch
+}
+
+// publish queues copies of the envelopes for every subscription whose filter matches them
+// A subscription whose queue would exceed the limit is closed instead, after the events already queued
+func (b *broker) publish(envelopes ...events.Envelope) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for s := range b.subs {
+		var matched []events.Envelope
+		for i := range envelopes {
+			if s.filter.Match(&envelopes[i]) {
+				matched = append(matched, copyEnvelope(envelopes[i]))
+			}
+		}
+		if len(matched) == 0 {
+			continue
+		}
+		s.mu.Lock()
+		if b.limit > 0 && len(s.queue)+len(matched) > b.limit {
+			s.closed = true
+			delete(b.subs, s)
+		} else {
+			s.queue = append(s.queue, matched...)
+		}
+		s.mu.Unlock()
+		select {
+		case s.notify <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// close ends every subscription whose filter matches the envelope once the events already queued for it are delivered
+func (b *broker) close(e *events.Envelope) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for s := range b.subs {
+		if !s.filter.Match(e) {
+			continue
+		}
+		s.mu.Lock()
+		s.closed = true
+		s.mu.Unlock()
+		select {
+		case s.notify <- struct{}{}:
+		default:
+		}
+		delete(b.subs, s)
+	}
+}
+
+// run delivers queued events to the subscription's channel until ctx is done or the subscription is closed
+func (s *subscription) run(ctx context.Context) {
+	defer close(s.ch)
+	for {
+		s.mu.Lock()
+		queue := s.queue
+		s.queue = nil
+		closed := s.closed
+		s.mu.Unlock()
+		for _, e := range queue {
+			select {
+			case s.ch <- e:
+			case <-ctx.Done():
+				return
+			}
+		}
+		if closed {
+			return
+		}
+		select {
+		case <-s.notify:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
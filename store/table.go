@@ -0,0 +1,298 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"strings"
+	"time"
+)
+
+// TableDefinition returns the input creating a table with the keys and global secondary indexes DynamoDBEventStore reads
+// The table is billed per request; set StreamSpecification on the result to use Subscribe
+func TableDefinition(table string) *dynamodb.CreateTableInput {
+	return &dynamodb.CreateTableInput{
+		TableName:   aws.String(table),
+		BillingMode: types.BillingModePayPerRequest,
+		AttributeDefinitions: []types.AttributeDefinition{
+			{AttributeName: aws.String("Id"), AttributeType: types.ScalarAttributeTypeS},
+			{AttributeName: aws.String("Version"), AttributeType: types.ScalarAttributeTypeN},
+			{AttributeName: aws.String("Log"), AttributeType: types.ScalarAttributeTypeS},
+			{AttributeName: aws.String("Position"), AttributeType: types.ScalarAttributeTypeN},
+			{AttributeName: aws.String("StreamLog"), AttributeType: types.ScalarAttributeTypeS},
+			{AttributeName: aws.String("StreamId"), AttributeType: types.ScalarAttributeTypeS},
+			{AttributeName: aws.String("EventName"), AttributeType: types.ScalarAttributeTypeS},
+		},
+		KeySchema: keySchema("Id", "Version"),
+		GlobalSecondaryIndexes: []types.GlobalSecondaryIndex{
+			globalIndex(PositionIndex, "Log", "Position"),
+			globalIndex(StreamIndex, "StreamLog", "StreamId"),
+			globalIndex(EventNameIndex, "EventName", "Position"),
+		},
+	}
+}
+
+// CreateTable creates table as described by TableDefinition and waits until it is active
+func CreateTable(ctx context.Context, db *dynamodb.Client, table string) error {
+	return createTable(ctx, db, TableOptions{Table: table})
+}
+
+// keySchema returns a key schema with hash and range attributes
+func keySchema(hash, rng string) []types.KeySchemaElement {
+	return []types.KeySchemaElement{
+		{AttributeName: aws.String(hash), KeyType: types.KeyTypeHash},
+		{AttributeName: aws.String(rng), KeyType: types.KeyTypeRange},
+	}
+}
+
+// globalIndex returns a global secondary index projecting every attribute
+// The indexes are sparse: items without both key attributes, such as snapshots, are left out
+func globalIndex(name, hash, rng string) types.GlobalSecondaryIndex {
+	return types.GlobalSecondaryIndex{
+		IndexName:  aws.String(name),
+		KeySchema:  keySchema(hash, rng),
+		Projection: &types.Projection{ProjectionType: types.ProjectionTypeAll},
+	}
+}
+
+// TableOptions configures EnsureTable
+type TableOptions struct {
+	Table string
+	// TTLAttribute is the attribute DynamoDB expires items by; empty requires no time to live
+	TTLAttribute string
+	// StreamViewType is the view type of the table's DynamoDB stream, which Subscribe needs; empty requires no stream
+	StreamViewType types.StreamViewType
+	// Migrate adds missing indexes and enables a missing stream or time to live on an existing table instead of reporting them
+	Migrate bool
+}
+
+// TableMismatchError is returned when an existing table does not have the schema DynamoDBEventStore needs
+type TableMismatchError struct {
+	Table    string
+	Problems []string
+}
+
+func (e *TableMismatchError) Error() string {
+	return fmt.Sprintf("table %s does not match the event store schema: %s", e.Table, strings.Join(e.Problems, "; "))
+}
+
+// tableDiff holds the differences between a table and TableDefinition
+type tableDiff struct {
+	// problems cannot be migrated
+	problems []string
+	indexes  []types.GlobalSecondaryIndex
+	stream   bool
+	ttl      bool
+}
+
+// mismatches describes every difference, including the ones that can be migrated
+func (d tableDiff) mismatches() []string {
+	mismatches := append([]string(nil), d.problems...)
+	for _, index := range d.indexes {
+		mismatches = append(mismatches, fmt.Sprintf("index %s is missing", aws.ToString(index.IndexName)))
+	}
+	if d.stream {
+		mismatches = append(mismatches, "stream is not enabled")
+	}
+	if d.ttl {
+		mismatches = append(mismatches, "time to live is not enabled")
+	}
+	return mismatches
+}
+
+// ValidateTable compares a table description and its time to live description, which may be nil, with the table EnsureTable creates for opts
+// It returns a TableMismatchError listing every difference
+func ValidateTable(table *types.TableDescription, ttl *types.TimeToLiveDescription, opts TableOptions) error {
+	mismatches := diffTable(table, ttl, opts).mismatches()
+	if len(mismatches) > 0 {
+		return &TableMismatchError{Table: opts.Table, Problems: mismatches}
+	}
+	return nil
+}
+
+func diffTable(table *types.TableDescription, ttl *types.TimeToLiveDescription, opts TableOptions) tableDiff {
+	var diff tableDiff
+	want := TableDefinition(opts.Table)
+	attributes := make(map[string]types.ScalarAttributeType)
+	for _, a := range table.AttributeDefinitions {
+		attributes[aws.ToString(a.AttributeName)] = a.AttributeType
+	}
+	for _, a := range want.AttributeDefinitions {
+		name := aws.ToString(a.AttributeName)
+		if t, ok := attributes[name]; ok && t != a.AttributeType {
+			diff.problems = append(diff.problems, fmt.Sprintf("attribute %s has type %s, want %s", name, t, a.AttributeType))
+		}
+	}
+	if problem := keyProblem("key schema", table.KeySchema, want.KeySchema); problem != "" {
+		diff.problems = append(diff.problems, problem)
+	}
+	indexes := make(map[string]types.GlobalSecondaryIndexDescription)
+	for _, index := range table.GlobalSecondaryIndexes {
+		indexes[aws.ToString(index.IndexName)] = index
+	}
+	for _, index := range want.GlobalSecondaryIndexes {
+		name := aws.ToString(index.IndexName)
+		got, ok := indexes[name]
+		if !ok {
+			diff.indexes = append(diff.indexes, index)
+			continue
+		}
+		if problem := keyProblem("index "+name, got.KeySchema, index.KeySchema); problem != "" {
+			diff.problems = append(diff.problems, problem)
+		}
+		//The store reads whole events from its indexes
+		if got.Projection == nil || got.Projection.ProjectionType != types.ProjectionTypeAll {
+			diff.problems = append(diff.problems, fmt.Sprintf("index %s does not project every attribute", name))
+		}
+	}
+	if opts.StreamViewType != "" {
+		stream := table.StreamSpecification
+		switch {
+		case stream == nil || !aws.ToBool(stream.StreamEnabled):
+			diff.stream = true
+		case stream.StreamViewType != opts.StreamViewType:
+			diff.problems = append(diff.problems, fmt.Sprintf("stream has view type %s, want %s", stream.StreamViewType, opts.StreamViewType))
+		}
+	}
+	if opts.TTLAttribute != "" {
+		switch {
+		case ttl == nil || ttl.TimeToLiveStatus == types.TimeToLiveStatusDisabled || ttl.TimeToLiveStatus == types.TimeToLiveStatusDisabling:
+			diff.ttl = true
+		case aws.ToString(ttl.AttributeName) != opts.TTLAttribute:
+			diff.problems = append(diff.problems, fmt.Sprintf("time to live attribute is %s, want %s", aws.ToString(ttl.AttributeName), opts.TTLAttribute))
+		}
+	}
+	return diff
+}
+
+// keyProblem describes how the key schema got differs from want, or returns an empty string when they match
+func keyProblem(what string, got, want []types.KeySchemaElement) string {
+	describe := func(schema []types.KeySchemaElement) string {
+		keys := make([]string, 0, len(schema))
+		for _, k := range schema {
+			keys = append(keys, fmt.Sprintf("%s %s", k.KeyType, aws.ToString(k.AttributeName)))
+		}
+		return strings.Join(keys, ", ")
+	}
+	if describe(got) == describe(want) {
+		return ""
+	}
+	return fmt.Sprintf("%s is %s, want %s", what, describe(got), describe(want))
+}
+
+// EnsureTable creates the table described by opts, or checks that the existing table matches it
+// An existing table that does not match returns a TableMismatchError, unless every difference can be migrated and opts.Migrate is set
+// Creating the table or an index waits until it is active, which can take minutes
+func EnsureTable(ctx context.Context, db *dynamodb.Client, opts TableOptions) error {
+	describe := &dynamodb.DescribeTableInput{TableName: aws.String(opts.Table)}
+	out, err := db.DescribeTable(ctx, describe)
+	notFound := &types.ResourceNotFoundException{}
+	if errors.As(err, &notFound) {
+		return createTable(ctx, db, opts)
+	}
+	if err != nil {
+		return err
+	}
+	ttl, err := db.DescribeTimeToLive(ctx, &dynamodb.DescribeTimeToLiveInput{TableName: aws.String(opts.Table)})
+	if err != nil {
+		return err
+	}
+	diff := diffTable(out.Table, ttl.TimeToLiveDescription, opts)
+	if !opts.Migrate || len(diff.problems) > 0 {
+		return ValidateTable(out.Table, ttl.TimeToLiveDescription, opts)
+	}
+	if diff.stream {
+		_, err := db.UpdateTable(ctx, &dynamodb.UpdateTableInput{
+			TableName:           aws.String(opts.Table),
+			StreamSpecification: &types.StreamSpecification{StreamEnabled: aws.Bool(true), StreamViewType: opts.StreamViewType},
+		})
+		if err != nil {
+			return err
+		}
+		if err := waitForTable(ctx, db, opts.Table); err != nil {
+			return err
+		}
+	}
+	//DynamoDB creates one index per UpdateTable call and rejects updates while an index is being created
+	for _, index := range diff.indexes {
+		_, err := db.UpdateTable(ctx, &dynamodb.UpdateTableInput{
+			TableName:            aws.String(opts.Table),
+			AttributeDefinitions: TableDefinition(opts.Table).AttributeDefinitions,
+			GlobalSecondaryIndexUpdates: []types.GlobalSecondaryIndexUpdate{{
+				Create: &types.CreateGlobalSecondaryIndexAction{
+					IndexName:  index.IndexName,
+					KeySchema:  index.KeySchema,
+					Projection: index.Projection,
+				},
+			}},
+		})
+		if err != nil {
+			return err
+		}
+		if err := waitForTable(ctx, db, opts.Table); err != nil {
+			return err
+		}
+	}
+	if diff.ttl {
+		return enableTTL(ctx, db, opts)
+	}
+	return nil
+}
+
+// createTable creates the table described by opts and waits until it is active
+func createTable(ctx context.Context, db *dynamodb.Client, opts TableOptions) error {
+	def := TableDefinition(opts.Table)
+	if opts.StreamViewType != "" {
+		def.StreamSpecification = &types.StreamSpecification{StreamEnabled: aws.Bool(true), StreamViewType: opts.StreamViewType}
+	}
+	if _, err := db.CreateTable(ctx, def); err != nil {
+		return err
+	}
+	//Creating the table and its indexes takes a while, and the table cannot be written until it is active
+	if err := waitForTable(ctx, db, opts.Table); err != nil {
+		return err
+	}
+	if opts.TTLAttribute != "" {
+		return enableTTL(ctx, db, opts)
+	}
+	return nil
+}
+
+func enableTTL(ctx context.Context, db *dynamodb.Client, opts TableOptions) error {
+	_, err := db.UpdateTimeToLive(ctx, &dynamodb.UpdateTimeToLiveInput{
+		TableName: aws.String(opts.Table),
+		TimeToLiveSpecification: &types.TimeToLiveSpecification{
+			AttributeName: aws.String(opts.TTLAttribute),
+			Enabled:       aws.Bool(true),
+		},
+	})
+	return err
+}
+
+// tablePollInterval is how often waitForTable describes the table
+const tablePollInterval = 5 * time.Second
+
+// waitForTable waits until the table and every one of its indexes are active
+func waitForTable(ctx context.Context, db *dynamodb.Client, table string) error {
+	for {
+		out, err := db.DescribeTable(ctx, &dynamodb.DescribeTableInput{TableName: aws.String(table)})
+		if err != nil {
+			return err
+		}
+		active := out.Table.TableStatus == types.TableStatusActive
+		for _, index := range out.Table.GlobalSecondaryIndexes {
+			active = active && index.IndexStatus == types.IndexStatusActive
+		}
+		if active {
+			return nil
+		}
+		select {
+		case <-time.After(tablePollInterval):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package store_test
+
+import (
+	"errors"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/cpustejovsky/event-store/store"
+	"github.com/cpustejovsky/event-store/store/dynamotest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+// describeTable returns the description DynamoDB gives of a table created from TableDefinition with a NEW_IMAGE stream
+func describeTable(table string) *types.TableDescription {
+	def := store.TableDefinition(table)
+	desc := &types.TableDescription{
+		TableName:            def.TableName,
+		AttributeDefinitions: def.AttributeDefinitions,
+		KeySchema:            def.KeySchema,
+		TableStatus:          types.TableStatusActive,
+		StreamSpecification:  &types.StreamSpecification{StreamEnabled: aws.Bool(true), StreamViewType: types.StreamViewTypeNewImage},
+	}
+	for _, index := range def.GlobalSecondaryIndexes {
+		desc.GlobalSecondaryIndexes = append(desc.GlobalSecondaryIndexes, types.GlobalSecondaryIndexDescription{
+			IndexName:   index.IndexName,
+			KeySchema:   index.KeySchema,
+			Projection:  index.Projection,
+			IndexStatus: types.IndexStatusActive,
+		})
+	}
+	return desc
+}
+
+var tableOptions = store.TableOptions{Table: "events", TTLAttribute: "ExpiresAt", StreamViewType: types.StreamViewTypeNewImage}
+
+func enabledTTL(attribute string) *types.TimeToLiveDescription {
+	return &types.TimeToLiveDescription{AttributeName: aws.String(attribute), TimeToLiveStatus: types.TimeToLiveStatusEnabled}
+}
+
+func mismatches(t *testing.T, err error) []string {
+	t.Helper()
+	checkErr := &store.TableMismatchError{}
+	require.True(t, errors.As(err, &checkErr), "expected TableMismatchError, got %v", err)
+	assert.Equal(t, "events", checkErr.Table)
+	return checkErr.Problems
+}
+
+func TestValidateTable_Matches(t *testing.T) {
+	assert.Nil(t, store.ValidateTable(describeTable("events"), enabledTTL("ExpiresAt"), tableOptions))
+	//Without a stream or time to live in the options, neither is checked
+	desc := describeTable("events")
+	desc.StreamSpecification = nil
+	assert.Nil(t, store.ValidateTable(desc, nil, store.TableOptions{Table: "events"}))
+}
+
+func TestValidateTable_Missing(t *testing.T) {
+	desc := describeTable("events")
+	desc.GlobalSecondaryIndexes = desc.GlobalSecondaryIndexes[:2]
+	desc.StreamSpecification = nil
+	problems := mismatches(t, store.ValidateTable(desc, nil, tableOptions))
+	assert.Equal(t, []string{
+		"index EventNameIndex is missing",
+		"stream is not enabled",
+		"time to live is not enabled",
+	}, problems)
+}
+
+func TestValidateTable_Mismatched(t *testing.T) {
+	desc := describeTable("events")
+	desc.AttributeDefinitions[1].AttributeType = types.ScalarAttributeTypeS
+	desc.KeySchema = desc.KeySchema[:1]
+	desc.GlobalSecondaryIndexes[0].Projection = &types.Projection{ProjectionType: types.ProjectionTypeKeysOnly}
+	desc.StreamSpecification.StreamViewType = types.StreamViewTypeKeysOnly
+	problems := mismatches(t, store.ValidateTable(desc, enabledTTL("Expiry"), tableOptions))
+	assert.Equal(t, []string{
+		"attribute Version has type S, want N",
+		"key schema is HASH Id, want HASH Id, RANGE Version",
+		"index PositionIndex does not project every attribute",
+		"stream has view type KEYS_ONLY, want NEW_IMAGE",
+		"time to live attribute is Expiry, want ExpiresAt",
+	}, problems)
+	assert.Contains(t, store.ValidateTable(desc, nil, tableOptions).Error(), "table events does not match the event store schema: attribute Version")
+}
+
+func TestEnsureTable_Migrate(t *testing.T) {
+	srv := dynamotest.NewServer()
+	defer srv.Close()
+	client := srv.Client()
+	//An older table without the EventNameIndex, stream or time to live
+	def := store.TableDefinition("events")
+	def.GlobalSecondaryIndexes = def.GlobalSecondaryIndexes[:2]
+	_, err := client.CreateTable(ctx, def)
+	require.Nil(t, err)
+
+	problems := mismatches(t, store.EnsureTable(ctx, client, tableOptions))
+	assert.Len(t, problems, 3)
+
+	migrate := tableOptions
+	migrate.Migrate = true
+	require.Nil(t, store.EnsureTable(ctx, client, migrate))
+	assert.Nil(t, store.EnsureTable(ctx, client, tableOptions))
+}
+
+func TestEnsureTable_Create(t *testing.T) {
+	srv := dynamotest.NewServer()
+	defer srv.Close()
+	client := srv.Client()
+	require.Nil(t, store.EnsureTable(ctx, client, tableOptions))
+	out, err := client.DescribeTable(ctx, &dynamodb.DescribeTableInput{TableName: aws.String("events")})
+	require.Nil(t, err)
+	ttl, err := client.DescribeTimeToLive(ctx, &dynamodb.DescribeTimeToLiveInput{TableName: aws.String("events")})
+	require.Nil(t, err)
+	assert.Nil(t, store.ValidateTable(out.Table, ttl.TimeToLiveDescription, tableOptions))
+}
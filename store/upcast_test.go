@@ -0,0 +1,100 @@
+package store_test
+
+import (
+	"context"
+	"errors"
+	"github.com/cpustejovsky/event-store/events"
+	"github.com/cpustejovsky/event-store/store"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"sync"
+	"testing"
+)
+
+// upcastStore returns an in-memory store aggregating "sum" events
+// that upcasts the old "double" events, whose payload was twice the value, to version 1 of "sum"
+func upcastStore() *store.InMemoryEventStore {
+	var mu sync.Mutex
+	folded := 0
+	registry := events.NewRegistry()
+	registry.Register("sum", func() events.Aggregator { return sumAggregator{mu: &mu, folded: &folded} })
+	registry.RegisterUpcaster("double", 0, events.UpcasterFunc(func(e events.Envelope) (events.Envelope, error) {
+		e.EventName = "sum"
+		e.SchemaVersion = 1
+		e.Event = []byte{e.Event[0] / 2}
+		return e, nil
+	}))
+	return store.InMemory(store.WithRegistry(registry))
+}
+
+func TestInMemoryEventStore_Upcast(t *testing.T) {
+	es := upcastStore()
+	id := uuid.NewString()
+	subCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	ch, err := es.Subscribe(subCtx, store.SubscriptionFilter{EventName: "sum"})
+	require.Nil(t, err)
+	require.Nil(t, es.AppendBatch(ctx, []events.Envelope{
+		{Id: id, Version: 0, EventName: "double", Event: []byte{8}},
+		{Id: id, Version: 1, EventName: "sum", SchemaVersion: 1, Event: []byte{3}},
+	}))
+
+	queried, err := es.QueryAll(ctx, id)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(queried))
+	assert.Equal(t, "sum", queried[0].EventName)
+	assert.Equal(t, 1, queried[0].SchemaVersion)
+	assert.Equal(t, []byte{4}, queried[0].Event)
+
+	all, err := es.ReadAll(ctx, 0, 0)
+	require.Nil(t, err)
+	assert.Equal(t, []byte{4}, all[0].Event)
+
+	projected, err := es.Project(ctx, id)
+	require.Nil(t, err)
+	assert.Equal(t, []byte{7}, projected.Event)
+	projected, err = es.ProjectAt(ctx, id, 0)
+	require.Nil(t, err)
+	assert.Equal(t, []byte{4}, projected.Event)
+
+	//Subscriptions filter and deliver the upcast events
+	for _, want := range []byte{4, 3} {
+		e := <-ch
+		assert.Equal(t, "sum", e.EventName)
+		assert.Equal(t, []byte{want}, e.Event)
+	}
+}
+
+func TestInMemoryEventStore_SubscribeUpcastFailure(t *testing.T) {
+	registry := events.NewRegistry()
+	registry.RegisterUpcaster("broken", 0, events.UpcasterFunc(func(e events.Envelope) (events.Envelope, error) {
+		return e, errors.New("broken upcaster")
+	}))
+	es := store.InMemory(store.WithRegistry(registry))
+	broken, other := uuid.NewString(), uuid.NewString()
+	subCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	all, err := es.Subscribe(subCtx, store.SubscriptionFilter{})
+	require.Nil(t, err)
+	matching, err := es.Subscribe(subCtx, store.SubscriptionFilter{Id: broken})
+	require.Nil(t, err)
+	unaffected, err := es.Subscribe(subCtx, store.SubscriptionFilter{Id: other})
+	require.Nil(t, err)
+
+	require.Nil(t, es.Append(ctx, &events.Envelope{Id: broken, Version: 0, EventName: "sum"}))
+	require.Nil(t, es.Append(ctx, &events.Envelope{Id: broken, Version: 1, EventName: "broken"}))
+	require.Nil(t, es.Append(ctx, &events.Envelope{Id: other, Version: 0, EventName: "sum"}))
+
+	//The subscriptions matching the broken event end after the events preceding it
+	for _, ch := range []<-chan events.Envelope{all, matching} {
+		var versions []int
+		for e := range ch {
+			versions = append(versions, e.Version)
+		}
+		assert.Equal(t, []int{0}, versions)
+	}
+	//A subscription that does not select the broken event keeps receiving events
+	e := <-unaffected
+	assert.Equal(t, other, e.Id)
+}